@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCheckCommand reports media records that share a file, which happened
+// when two downloads mapped to the same file name and the second replaced the
+// first. It hashes each shared file to tell which record still owns it, and
+// exits with status 1 if any are found.
+//
+//	check
+func runCheckCommand(db *database.DB, cfg *config.Config, args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: lemmy-scraper [flags] check")
+		os.Exit(2)
+	}
+
+	shared, err := db.GetSharedFiles()
+	if err != nil {
+		log.Fatalf("Failed to check media files: %v", err)
+	}
+	if len(shared) == 0 {
+		fmt.Println("No media records share a file")
+		return
+	}
+
+	files := newStorage(cfg)
+	for _, file := range shared {
+		fmt.Printf("%s is recorded for %d media:\n", file.FilePath, len(file.Media))
+		hash, err := hashFile(files, cfg.Storage.BaseDirectory, file.FilePath)
+		if err != nil {
+			fmt.Printf("  cannot read the file: %v\n", err)
+		}
+		for _, m := range file.Media {
+			switch {
+			case hash == "":
+				fmt.Printf("  media %d from %s\n", m.ID, m.MediaURL)
+			case m.MediaHash == hash || m.SanitizedHash == hash:
+				fmt.Printf("  media %d from %s: holds its content\n", m.ID, m.MediaURL)
+			default:
+				fmt.Printf("  media %d from %s: content was replaced\n", m.ID, m.MediaURL)
+			}
+		}
+	}
+	fmt.Printf("%d files are shared by several media records\n", len(shared))
+	os.Exit(1)
+}
+
+// hashFile returns the SHA-256 hash of the content of a media file
+func hashFile(files storage.Storage, baseDir, path string) (string, error) {
+	key, err := storage.Key(baseDir, path)
+	if err != nil {
+		return "", err
+	}
+	f, err := files.Get(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return database.HashContent(f)
+}
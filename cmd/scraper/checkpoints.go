@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCheckpointsCommand lists, resets or rewinds source checkpoints
+//
+//	checkpoints [list]
+//	checkpoints reset <source>
+//	checkpoints rewind <source> <time>
+func runCheckpointsCommand(db *database.DB, args []string) {
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "list":
+		checkpoints, err := db.ListCheckpoints()
+		if err != nil {
+			log.Fatalf("Failed to list checkpoints: %v", err)
+		}
+		if len(checkpoints) == 0 {
+			fmt.Println("No checkpoints recorded")
+			return
+		}
+		for _, cp := range checkpoints {
+			fmt.Printf("%-30s %s  post %d  (updated %s)\n", cp.Source,
+				cp.LastPublished.Format(time.RFC3339), cp.LastPostID, cp.UpdatedAt.Format(time.RFC3339))
+		}
+
+	case "reset":
+		if len(args) != 2 {
+			checkpointsUsage()
+		}
+		deleted, err := db.DeleteCheckpoint(args[1])
+		if err != nil {
+			log.Fatalf("Failed to reset checkpoint: %v", err)
+		}
+		if !deleted {
+			log.Fatalf("No checkpoint for source %s", args[1])
+		}
+		fmt.Printf("Checkpoint for %s reset\n", args[1])
+
+	case "rewind":
+		if len(args) != 3 {
+			checkpointsUsage()
+		}
+		to, err := parseTimeArg(args[2])
+		if err != nil {
+			log.Fatalf("Invalid time %q: %v", args[2], err)
+		}
+		if err := db.SaveCheckpoint(args[1], to, 0); err != nil {
+			log.Fatalf("Failed to rewind checkpoint: %v", err)
+		}
+		fmt.Printf("Checkpoint for %s rewound to %s\n", args[1], to.Format(time.RFC3339))
+
+	default:
+		checkpointsUsage()
+	}
+}
+
+// checkpointsUsage prints usage for the checkpoints command and exits
+func checkpointsUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lemmy-scraper [flags] checkpoints [list | reset <source> | rewind <source> <time>]")
+	fmt.Fprintln(os.Stderr, "  <time> is RFC3339 (2024-01-01T00:00:00Z) or a date (2024-01-01)")
+	os.Exit(2)
+}
+
+// parseTimeArg parses an RFC3339 timestamp or a YYYY-MM-DD date (UTC)
+func parseTimeArg(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
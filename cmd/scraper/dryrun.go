@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	log "github.com/sirupsen/logrus"
+)
+
+// runDryRun runs the named communities, or all configured communities when
+// names is nil, without downloading or recording anything, and prints what
+// would have been downloaded
+func runDryRun(ctx context.Context, s *scraper.Scraper, names []string) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := s.DryRun(ctx, names)
+	if report != nil {
+		printDryRunReport(report)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("Dry run failed: %v", err)
+	}
+}
+
+// printDryRunReport prints one line per post followed by its media URLs
+func printDryRunReport(report *scraper.DryRunReport) {
+	counts := make(map[string]int)
+	for _, post := range report.Posts {
+		counts[post.Decision]++
+		line := fmt.Sprintf("%-20s post %-10d %-10s %s", post.Source, post.PostID, post.Decision, post.Title)
+		if post.Reason != "" {
+			line += fmt.Sprintf(" (%s)", post.Reason)
+		}
+		fmt.Println(line)
+
+		for _, media := range post.Media {
+			detail := media.Decision
+			if media.Probe != nil {
+				detail += fmt.Sprintf(" %s %s", media.Probe.MediaType, formatProbeSize(media.Probe.Size))
+			}
+			if media.Reason != "" {
+				detail += fmt.Sprintf(" (%s)", media.Reason)
+			}
+			fmt.Printf("    %-12s %s  %s\n", media.Resolver, media.URL, detail)
+		}
+	}
+
+	fmt.Printf("\n%d posts: %d to download, %d without media, %d filtered, %d deferred, %d seen, %d skipped\n",
+		len(report.Posts), counts[scraper.DecisionDownload], counts[scraper.DecisionNoMedia],
+		counts[scraper.DecisionFiltered], counts[scraper.DecisionDeferred],
+		counts[scraper.DecisionSeen], counts[scraper.DecisionSkipped])
+}
+
+// formatProbeSize formats a probed size, which is negative when unknown
+func formatProbeSize(size int64) string {
+	if size < 0 {
+		return "size unknown"
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	log "github.com/sirupsen/logrus"
+)
+
+// runFetchCommand archives a single post and prints the IDs of its media
+//
+//	fetch <post-id | post-url | ap_id>
+func runFetchCommand(ctx context.Context, s *scraper.Scraper, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: lemmy-scraper [flags] fetch <post-id | post-url | ap_id>")
+		os.Exit(2)
+	}
+	if *dryRun {
+		log.Fatal("--dry-run is not supported for fetch")
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := s.FetchPost(ctx, args[0])
+	if err != nil {
+		log.Fatalf("Failed to fetch %s: %v", args[0], err)
+	}
+
+	fmt.Printf("Post %d in %s: %s\n", result.PostID, result.Community, result.Title)
+	if len(result.MediaIDs) == 0 {
+		fmt.Println("No media stored")
+	}
+	for _, id := range result.MediaIDs {
+		fmt.Printf("Media %d\n", id)
+	}
+	if result.Errors > 0 {
+		log.Fatalf("%d media downloads failed", result.Errors)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,9 +15,13 @@ import (
 	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/phash"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scheduler"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/thumbnails"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/transcode"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/web"
 	log "github.com/sirupsen/logrus"
 )
@@ -24,6 +31,7 @@ var (
 	verbose    = flag.Bool("verbose", false, "Enable verbose logging")
 	stats      = flag.Bool("stats", false, "Display statistics and exit")
 	noWeb      = flag.Bool("no-web", false, "Disable web server (overrides config)")
+	dryRun     = flag.Bool("dry-run", false, "Report what a single run would download without downloading or recording anything")
 )
 
 func main() {
@@ -48,8 +56,9 @@ func main() {
 	}
 	cfg.SetDefaults()
 
-	// CLI flag overrides config for web server
-	if *noWeb {
+	// CLI flag overrides config for web server. A dry run exits when done,
+	// so it never serves the web UI.
+	if *noWeb || *dryRun {
 		cfg.WebServer.Enabled = false
 	}
 
@@ -67,56 +76,164 @@ func main() {
 
 	log.Infof("Database initialized at %s", cfg.Database.Path)
 
+	// Posts archived before their instance was recorded came from this one
+	if adopted, err := db.AdoptLegacyPosts(cfg.Lemmy.Instance); err != nil {
+		log.Fatalf("Failed to update archived posts: %v", err)
+	} else if adopted > 0 {
+		log.Infof("Recorded %s as the instance of %d previously archived posts", cfg.Lemmy.Instance, adopted)
+	}
+
 	// Display stats if requested
 	if *stats {
 		displayStats(db)
 		return
 	}
 
+	// Subcommands that only need the database
+	command := flag.Arg(0)
+	switch command {
+	case "", "scrape", "fetch":
+	case "checkpoints":
+		runCheckpointsCommand(db, flag.Args()[1:])
+		return
+	case "relayout":
+		runRelayoutCommand(db, cfg, flag.Args()[1:])
+		return
+	case "check":
+		runCheckCommand(db, cfg, flag.Args()[1:])
+		return
+	case "sidecars":
+		runSidecarsCommand(db, cfg, flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+
 	// Create storage directory
 	if err := os.MkdirAll(cfg.Storage.BaseDirectory, 0755); err != nil {
 		log.Fatalf("Failed to create storage directory: %v", err)
 	}
+	mediaStorage := newStorage(cfg)
+
+	// Root context for background work, cancelled when main returns
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Initialize API client
 	apiClient := api.NewClient(cfg.Lemmy.Instance)
 
 	// Login
 	log.Info("Authenticating with Lemmy instance...")
-	if err := apiClient.Login(cfg.Lemmy.Username, cfg.Lemmy.Password); err != nil {
+	if err := apiClient.Login(ctx, cfg.Lemmy.Username, cfg.Lemmy.Password); err != nil {
 		log.Fatalf("Failed to authenticate: %v", err)
 	}
 
 	// Initialize downloader
 	dl := downloader.New(db, cfg.Storage.BaseDirectory)
+	dl.PathTemplate = cfg.Storage.PathTemplate
+	dl.Instance = cfg.Lemmy.Instance
+	dl.Mode = cfg.Storage.Mode
+	dl.LinkType = cfg.Storage.LinkType
+	dl.StripMetadata = cfg.Storage.StripMetadata
+	dl.SidecarJSON = cfg.Storage.SidecarJSON
+	dl.SidecarNFO = cfg.Storage.SidecarNFO
+	dl.Storage = mediaStorage
+
+	// Initialize near-duplicate detection if enabled
+	var nearDuplicates *phash.Detector
+	if cfg.NearDuplicates.Enabled {
+		nearDuplicates, err = phash.NewDetector(db)
+		if err != nil {
+			log.Fatalf("Failed to load perceptual hashes: %v", err)
+		}
+		dl.NearDuplicates = nearDuplicates
+		dl.NearDuplicateDistance = cfg.NearDuplicates.MaxDistance
+		dl.SkipNearDuplicates = cfg.NearDuplicates.Action == config.NearDuplicateSkip
+		log.Infof("Near-duplicate detection enabled (max distance: %d, action: %s)", cfg.NearDuplicates.MaxDistance, cfg.NearDuplicates.Action)
+	}
 
 	// Initialize progress tracker for real-time updates
 	progressTracker := progress.NewTracker()
 
 	// Initialize thumbnail generator if enabled
-	var thumbnailGen *thumbnails.Generator
-	if cfg.Thumbnails.Enabled {
-		thumbnailGen = thumbnails.NewGenerator(
-			cfg.Thumbnails.MaxWidth,
-			cfg.Thumbnails.MaxHeight,
-			cfg.Thumbnails.Quality,
-			cfg.Thumbnails.Directory,
-			cfg.Thumbnails.VideoMethod,
-		)
+	thumbnailGen := thumbnails.NewFromConfig(cfg.Thumbnails)
+	if thumbnailGen != nil {
+		thumbnailGen.Storage = mediaStorage
+		thumbnailGen.MediaDir = cfg.Storage.BaseDirectory
 		log.Infof("Thumbnail generation enabled (max: %dx%d)", cfg.Thumbnails.MaxWidth, cfg.Thumbnails.MaxHeight)
 	}
 
+	// Initialize transcoding if enabled
+	transcoder := transcode.NewFromConfig(cfg.Transcode)
+	if transcoder != nil {
+		transcoder.Storage = mediaStorage
+		transcoder.MediaDir = cfg.Storage.BaseDirectory
+		log.Infof("Transcoding enabled (animated GIFs: %s, remux: %t)", cfg.Transcode.GIFFormat, cfg.Transcode.Remux)
+	}
+
 	// Generate thumbnails for existing media that don't have them
-	if thumbnailGen != nil {
-		go thumbnails.BackfillThumbnails(thumbnailGen, db)
+	var background sync.WaitGroup
+	if thumbnailGen != nil && !*dryRun {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			thumbnails.BackfillThumbnails(ctx, thumbnailGen, db)
+		}()
+	}
+
+	// Hash existing media that were downloaded before detection was enabled
+	if nearDuplicates != nil && !*dryRun {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			phash.Backfill(ctx, nearDuplicates, mediaStorage, cfg.Storage.BaseDirectory, cfg.NearDuplicates.MaxDistance)
+		}()
+	}
+
+	// Convert existing media that were downloaded before transcoding was enabled
+	if transcoder != nil && !*dryRun {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			transcode.Backfill(ctx, transcoder, db)
+		}()
 	}
 
 	// Initialize scraper
-	s := scraper.New(cfg, apiClient, db, dl, thumbnailGen)
+	s := scraper.New(cfg, apiClient, db, dl, thumbnailGen, progressTracker)
+	s.Transcoder = transcoder
+
+	// Build the schedule for continuous mode
+	var sched *scheduler.Scheduler
+	if command == "" && cfg.RunMode.Mode != "once" && !*dryRun {
+		sched, err = newScheduler(cfg, s)
+		if err != nil {
+			log.Fatalf("Failed to set up schedule: %v", err)
+		}
+	}
+
+	// Apply configuration changes from the web UI or SIGHUP at the next run
+	configs := config.NewStore(*configPath, cfg)
+	configs.Subscribe(func(old, new *config.Config) {
+		s.UpdateConfig(new)
+	})
+	if sched != nil {
+		configs.Subscribe(func(old, new *config.Config) {
+			if err := configureScheduler(sched, new, s); err != nil {
+				log.Errorf("Failed to update schedule, keeping the previous one: %v", err)
+			}
+		})
+	}
+	go reloadOnHangup(ctx, configs)
 
 	// Start web server if enabled
+	var webServer *web.Server
 	if cfg.WebServer.Enabled {
-		webServer := web.New(cfg, *configPath, db, progressTracker, thumbnailGen)
+		webServer = web.New(configs, db, progressTracker, thumbnailGen)
+		webServer.Scheduler = sched
+		webServer.Scraper = s
+		webServer.Storage = mediaStorage
+		webServer.NearDuplicates = nearDuplicates
 		go func() {
 			log.Infof("Web UI enabled at http://%s:%d", cfg.WebServer.Host, cfg.WebServer.Port)
 			if err := webServer.Start(); err != nil {
@@ -125,18 +242,39 @@ func main() {
 		}()
 	}
 
-	// Run based on mode
-	if cfg.RunMode.Mode == "once" {
-		runOnce(s, cfg.WebServer.Enabled)
+	// Run based on command or mode
+	if command == "scrape" {
+		runScrapeCommand(ctx, s, flag.Args()[1:])
+	} else if command == "fetch" {
+		runFetchCommand(ctx, s, flag.Args()[1:])
+	} else if *dryRun {
+		runDryRun(ctx, s, nil)
+	} else if cfg.RunMode.Mode == "once" {
+		runOnce(ctx, s, cfg.WebServer.Enabled)
 	} else {
-		runContinuous(s, cfg.RunMode.Interval)
+		runContinuous(ctx, s, sched)
 	}
+
+	// Runs have stopped. Stop background work, then the web server and
+	// progress clients; the deferred db.Close runs last.
+	cancel()
+	background.Wait()
+	shutdownServices(webServer, progressTracker)
 }
 
-// runOnce runs the scraper once and exits (unless web server is enabled)
-func runOnce(s *scraper.Scraper, webServerEnabled bool) {
+// runOnce runs the scraper once and exits (unless web server is enabled).
+// An interrupt cancels the run.
+func runOnce(ctx context.Context, s *scraper.Scraper, webServerEnabled bool) {
 	log.Info("Running in one-time mode")
-	if err := s.Run(); err != nil {
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	err := s.Run(runCtx)
+	interrupted := runCtx.Err() != nil
+	stop()
+	if interrupted {
+		log.Info("Scrape interrupted, shutting down")
+		return
+	}
+	if err != nil {
 		log.Errorf("Scraper error: %v", err)
 		if !webServerEnabled {
 			os.Exit(1)
@@ -151,40 +289,78 @@ func runOnce(s *scraper.Scraper, webServerEnabled bool) {
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		sig := <-sigChan
 		log.Infof("Received signal %v, shutting down gracefully", sig)
+		// Runs started from the API may still be active
+		drainRuns(s, sigChan)
 	}
 }
 
-// runContinuous runs the scraper on an interval
-func runContinuous(s *scraper.Scraper, interval time.Duration) {
-	log.Infof("Running in continuous mode with interval: %s", interval)
-
-	// Create a channel to listen for interrupt signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	// Create ticker for interval
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	// Run immediately first time
-	if err := s.Run(); err != nil {
-		log.Errorf("Scraper error: %v", err)
+// newStorage returns the storage backend for media files
+func newStorage(cfg *config.Config) storage.Storage {
+	if cfg.Storage.Backend != storage.BackendS3 {
+		return storage.NewLocal(cfg.Storage.BaseDirectory)
 	}
+	s3 := storage.NewS3(cfg.Storage.S3.Endpoint, cfg.Storage.S3.Region, cfg.Storage.S3.Bucket,
+		cfg.Storage.S3.AccessKeyID, cfg.Storage.S3.SecretAccessKey)
+	s3.Prefix = cfg.Storage.S3.Prefix
+	s3.PathStyle = cfg.Storage.S3.PathStyle
+	log.Infof("Storing media in bucket %s at %s", cfg.Storage.S3.Bucket, cfg.Storage.S3.Endpoint)
+	return s3
+}
+
+// reloadOnHangup reloads the configuration file whenever the process receives
+// SIGHUP, until ctx is cancelled
+func reloadOnHangup(ctx context.Context, configs *config.Store) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
 	for {
 		select {
-		case <-ticker.C:
-			log.Info("Starting scheduled scrape run")
-			if err := s.Run(); err != nil {
-				log.Errorf("Scraper error: %v", err)
-			}
-		case sig := <-sigChan:
-			log.Infof("Received signal %v, shutting down gracefully", sig)
+		case <-ctx.Done():
 			return
+		case <-hup:
+			restartRequired, err := configs.Reload()
+			if err != nil {
+				log.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			log.Infof("Reloaded configuration from %s", configs.Path())
+			if len(restartRequired) > 0 {
+				log.Warnf("Restart required to apply: %s", strings.Join(restartRequired, ", "))
+			}
 		}
 	}
 }
 
+// runContinuous runs the scheduled jobs until interrupted, then waits for the
+// active run to drain
+func runContinuous(ctx context.Context, s *scraper.Scraper, sched *scheduler.Scheduler) {
+	log.Info("Running in continuous mode")
+	if quiet := sched.QuietHours(); quiet != nil {
+		log.Infof("Quiet hours: %s", quiet)
+	}
+	for _, job := range sched.Jobs() {
+		log.Infof("Scheduled %s (%s), next run at %s", job.Name, job.Schedule, job.NextRun.Format(time.RFC3339))
+	}
+
+	// Create a channel to listen for interrupt signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		sched.Run(ctx, stop)
+		close(done)
+	}()
+
+	sig := <-sigChan
+	log.Infof("Received signal %v, shutting down gracefully", sig)
+	close(stop)
+	drainRuns(s, sigChan)
+	<-done
+}
+
 // displayStats shows statistics about scraped media
 func displayStats(db *database.DB) {
 	stats, err := db.GetStats()
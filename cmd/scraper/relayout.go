@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/sidecar"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// runRelayoutCommand moves stored media to the paths given by a path template,
+// storage.path_template unless --template is set, and the storage mode. In
+// content mode files move under objects/ and the template holds links to them.
+// With the global --dry-run flag it only prints the moves. The scraper should
+// not be running meanwhile.
+//
+//	relayout [--template <template>]
+func runRelayoutCommand(db *database.DB, cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("relayout", flag.ExitOnError)
+	tmpl := fs.String("template", cfg.Storage.PathTemplate, "Path template to move media to")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lemmy-scraper [--dry-run] relayout [--template <template>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if cfg.Storage.Backend == storage.BackendS3 {
+		log.Fatalf("relayout only supports the local storage backend")
+	}
+
+	media, err := db.GetAllMedia()
+	if err != nil {
+		log.Fatalf("Failed to list media: %v", err)
+	}
+	plan, err := storage.PlanRelayout(media, storage.Layout{
+		BaseDir:  cfg.Storage.BaseDirectory,
+		Template: *tmpl,
+		Mode:     cfg.Storage.Mode,
+		LinkType: cfg.Storage.LinkType,
+		Instance: cfg.Lemmy.Instance,
+	})
+	if err != nil {
+		log.Fatalf("Failed to plan relayout: %v", err)
+	}
+
+	for _, id := range plan.Missing {
+		log.Warnf("File of media %d is missing, leaving it as it is", id)
+	}
+	if *dryRun {
+		for _, mv := range plan.Moves {
+			if mv.To != mv.From {
+				fmt.Printf("%d: %s -> %s\n", mv.MediaID, mv.From, mv.To)
+			}
+			if mv.Link != mv.OldLink && mv.Link != "" {
+				fmt.Printf("%d: link %s -> %s\n", mv.MediaID, mv.Link, mv.To)
+			}
+		}
+		fmt.Printf("Would move or relink %d files, %d already in place\n", len(plan.Moves), plan.Unchanged)
+		return
+	}
+
+	if err := storage.ApplyRelayout(db, plan); err != nil {
+		log.Fatalf("Relayout failed, no files were moved: %v", err)
+	}
+	fmt.Printf("Moved or relinked %d files, %d already in place\n", len(plan.Moves), plan.Unchanged)
+	moveSidecars(db, cfg, plan)
+	if *tmpl != cfg.Storage.PathTemplate {
+		fmt.Printf("Set storage.path_template to %q so new downloads use the same layout\n", *tmpl)
+	}
+}
+
+// moveSidecars removes the sidecars left at the old paths of moved files and,
+// when sidecars are enabled, writes them next to the new paths
+func moveSidecars(db *database.DB, cfg *config.Config, plan *storage.RelayoutPlan) {
+	ctx := context.Background()
+	w := &sidecar.Writer{
+		Storage: storage.NewLocal(cfg.Storage.BaseDirectory),
+		BaseDir: cfg.Storage.BaseDirectory,
+		JSON:    cfg.Storage.SidecarJSON,
+		NFO:     cfg.Storage.SidecarNFO,
+	}
+	for _, mv := range plan.Moves {
+		from, to := mv.From, mv.To
+		if mv.OldLink != "" {
+			from = mv.OldLink
+		}
+		if mv.Link != "" {
+			to = mv.Link
+		}
+		if from == to {
+			continue
+		}
+		if err := w.Remove(ctx, from); err != nil {
+			log.Warnf("Failed to remove old sidecars of media %d: %v", mv.MediaID, err)
+		}
+		if !w.Enabled() {
+			continue
+		}
+		media, err := db.GetMediaByID(mv.MediaID)
+		if err == nil {
+			var metadata *sidecar.Metadata
+			if metadata, err = sidecar.ForRecord(db, media); err == nil {
+				err = w.Write(ctx, media, metadata)
+			}
+		}
+		if err != nil {
+			log.Warnf("Failed to write sidecars of media %d: %v", mv.MediaID, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scheduler"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+)
+
+// globalJob is the name of the job that scrapes everything without its own schedule
+const globalJob = "global"
+
+// newScheduler builds the continuous-mode schedule. Interval schedules start
+// with an immediate run.
+func newScheduler(cfg *config.Config, s *scraper.Scraper) (*scheduler.Scheduler, error) {
+	sched := scheduler.New(nil, 0)
+	if err := configureScheduler(sched, cfg, s); err != nil {
+		return nil, err
+	}
+
+	if cfg.RunMode.Schedule == "" && !sched.QuietHours().Contains(time.Now()) {
+		sched.RunNow(globalJob)
+	}
+	return sched, nil
+}
+
+// configureScheduler replaces the jobs of sched with one job per community
+// with its own cron schedule, and a global job for everything else that runs
+// on run_mode.schedule or, failing that, every run_mode.interval
+func configureScheduler(sched *scheduler.Scheduler, cfg *config.Config, s *scraper.Scraper) error {
+	quiet, err := scheduler.ParseQuietHours(cfg.RunMode.QuietHours.Start, cfg.RunMode.QuietHours.End)
+	if err != nil {
+		return err
+	}
+
+	type cronJob struct {
+		name string
+		spec string
+		cron *scheduler.CronSchedule
+	}
+	var jobs []cronJob
+	var unscheduled []string
+	for _, community := range cfg.Lemmy.Communities {
+		if community.Schedule == "" {
+			unscheduled = append(unscheduled, community.Name)
+			continue
+		}
+		cron, err := scheduler.ParseCron(community.Schedule)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, cronJob{name: community.Name, spec: community.Schedule, cron: cron})
+	}
+
+	var globalCron *scheduler.CronSchedule
+	if cfg.RunMode.Schedule != "" {
+		if globalCron, err = scheduler.ParseCron(cfg.RunMode.Schedule); err != nil {
+			return err
+		}
+	}
+
+	// Everything is parsed, so the old schedule is only replaced by a valid one
+	sched.Reset(quiet, cfg.RunMode.Jitter)
+	for _, job := range jobs {
+		name := job.name
+		sched.Add(name, job.spec, job.cron, func(ctx context.Context) error {
+			return s.RunCommunities(ctx, []string{name})
+		})
+	}
+
+	// Every community has its own schedule, nothing is left for the global job
+	if len(cfg.Lemmy.Communities) > 0 && len(unscheduled) == 0 {
+		return nil
+	}
+
+	run := s.Run
+	if len(unscheduled) < len(cfg.Lemmy.Communities) {
+		run = func(ctx context.Context) error { return s.RunCommunities(ctx, unscheduled) }
+	}
+
+	if globalCron != nil {
+		sched.Add(globalJob, cfg.RunMode.Schedule, globalCron, run)
+	} else {
+		sched.Add(globalJob, "every "+cfg.RunMode.Interval.String(), scheduler.Every(cfg.RunMode.Interval), run)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	log "github.com/sirupsen/logrus"
+)
+
+// runScrapeCommand runs a single scrape, or a historical backfill with --backfill.
+// An interrupt cancels the run; an interrupted backfill can be resumed. With the
+// global --dry-run flag the scrape only reports what it would download.
+//
+//	scrape [--community <name>]
+//	scrape --backfill --since <date> --community <name> [--sort New|TopAll] [--delay 2s] [--restart]
+func runScrapeCommand(ctx context.Context, s *scraper.Scraper, args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	backfill := fs.Bool("backfill", false, "Archive a community's history back to --since")
+	since := fs.String("since", "", "Oldest post date to backfill (RFC3339 or YYYY-MM-DD)")
+	community := fs.String("community", "", "Community to scrape or backfill")
+	sortType := fs.String("sort", "New", "Listing to walk: New or TopAll")
+	delay := fs.Duration("delay", 2*time.Second, "Pause between page requests")
+	restart := fs.Bool("restart", false, "Ignore saved backfill progress and start over")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lemmy-scraper [flags] scrape [--community <name>] [--backfill --since <date>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !*backfill {
+		var names []string
+		if *community != "" {
+			names = []string{*community}
+		}
+		if *dryRun {
+			runDryRun(ctx, s, names)
+			return
+		}
+		run := s.Run
+		if names != nil {
+			run = func(ctx context.Context) error { return s.RunCommunities(ctx, names) }
+		}
+		if err := run(ctx); err != nil {
+			log.Fatalf("Scraper error: %v", err)
+		}
+		log.Info("Scrape completed successfully")
+		return
+	}
+	if *dryRun {
+		log.Fatal("--dry-run is not supported for backfills")
+	}
+
+	if *since == "" || *community == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sinceTime, err := parseTimeArg(*since)
+	if err != nil {
+		log.Fatalf("Invalid --since %q: %v", *since, err)
+	}
+
+	err = s.Backfill(ctx, scraper.BackfillOptions{
+		Community: *community,
+		Since:     sinceTime,
+		SortType:  *sortType,
+		Delay:     *delay,
+		Restart:   *restart,
+	})
+	if err != nil {
+		log.Fatalf("Backfill failed: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/web"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// shutdownTimeout is how long a run in progress may continue after a
+	// shutdown signal before it is cancelled
+	shutdownTimeout = 30 * time.Second
+
+	// httpShutdownTimeout is how long in-flight HTTP requests get to complete
+	httpShutdownTimeout = 10 * time.Second
+)
+
+// drainRuns stops the scraper from starting new runs and waits up to
+// shutdownTimeout for the active run to finish before cancelling it. Another
+// signal on sigChan cancels the run immediately.
+func drainRuns(s *scraper.Scraper, sigChan <-chan os.Signal) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-sigChan:
+			log.Warn("Received second signal, cancelling the current run")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Warnf("Current run was cancelled during shutdown: %v", err)
+	}
+}
+
+// shutdownServices stops the web server, waiting for in-flight requests, and
+// disconnects progress WebSocket clients. webServer may be nil.
+func shutdownServices(webServer *web.Server, tracker *progress.Tracker) {
+	if webServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := webServer.Shutdown(ctx); err != nil {
+			log.Warnf("Web server did not shut down cleanly: %v", err)
+		}
+	}
+	tracker.Close()
+	log.Info("Shutdown complete")
+}
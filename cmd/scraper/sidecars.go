@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/sidecar"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSidecarsCommand writes the sidecars of every archived media item,
+// replacing existing ones, e.g. after enabling sidecars or tagging media. It
+// writes the sidecars enabled by storage.sidecar_json and storage.sidecar_nfo
+// unless --json or --nfo is set. With the global --dry-run flag it only
+// counts the media.
+//
+//	sidecars [--json] [--nfo]
+func runSidecarsCommand(db *database.DB, cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("sidecars", flag.ExitOnError)
+	writeJSON := fs.Bool("json", false, "Write .json sidecars")
+	writeNFO := fs.Bool("nfo", false, "Write .nfo sidecars for videos")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lemmy-scraper [--dry-run] sidecars [--json] [--nfo]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	w := &sidecar.Writer{
+		Storage: newStorage(cfg),
+		BaseDir: cfg.Storage.BaseDirectory,
+		JSON:    cfg.Storage.SidecarJSON,
+		NFO:     cfg.Storage.SidecarNFO,
+	}
+	if *writeJSON || *writeNFO {
+		w.JSON = *writeJSON
+		w.NFO = *writeNFO
+	}
+	if !w.Enabled() {
+		fmt.Fprintln(os.Stderr, "No sidecars enabled: set storage.sidecar_json or storage.sidecar_nfo, or pass --json or --nfo")
+		os.Exit(2)
+	}
+
+	if *dryRun {
+		media, err := db.GetAllMedia()
+		if err != nil {
+			log.Fatalf("Failed to list media: %v", err)
+		}
+		fmt.Printf("Would write sidecars of %d media items\n", len(media))
+		return
+	}
+
+	written, skipped, err := sidecar.Regenerate(context.Background(), w, db)
+	if err != nil {
+		log.Fatalf("Failed to write sidecars: %v", err)
+	}
+	fmt.Printf("Wrote sidecars of %d media items, %d skipped\n", written, skipped)
+}
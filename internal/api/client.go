@@ -2,17 +2,24 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrNotFound is returned, wrapped, when the instance reports that a
+// requested post or object does not exist
+var ErrNotFound = errors.New("not found")
+
 // Client represents a Lemmy API client
 type Client struct {
 	BaseURL    string
@@ -31,7 +38,7 @@ func NewClient(instance string) *Client {
 }
 
 // Login authenticates with the Lemmy instance and stores the JWT token
-func (c *Client) Login(username, password string) error {
+func (c *Client) Login(ctx context.Context, username, password string) error {
 	loginReq := models.LoginRequest{
 		UsernameOrEmail: username,
 		Password:        password,
@@ -42,11 +49,13 @@ func (c *Client) Login(username, password string) error {
 		return fmt.Errorf("failed to marshal login request: %w", err)
 	}
 
-	resp, err := c.HTTPClient.Post(
-		fmt.Sprintf("%s/user/login", c.BaseURL),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/user/login", c.BaseURL), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create login request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send login request: %w", err)
 	}
@@ -68,7 +77,7 @@ func (c *Client) Login(username, password string) error {
 }
 
 // GetPosts retrieves posts from the Lemmy instance
-func (c *Client) GetPosts(params GetPostsParams) (*models.GetPostsResponse, error) {
+func (c *Client) GetPosts(ctx context.Context, params GetPostsParams) (*models.GetPostsResponse, error) {
 	queryParams := url.Values{}
 
 	if params.Sort != "" {
@@ -94,7 +103,7 @@ func (c *Client) GetPosts(params GetPostsParams) (*models.GetPostsResponse, erro
 
 	log.Debugf("Requesting URL: %s", reqURL)
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -124,14 +133,104 @@ func (c *Client) GetPosts(params GetPostsParams) (*models.GetPostsResponse, erro
 	return &postsResp, nil
 }
 
+// GetPost retrieves a single post by ID
+func (c *Client) GetPost(ctx context.Context, postID int64) (*models.GetPostResponse, error) {
+	queryParams := url.Values{}
+	queryParams.Set("id", fmt.Sprintf("%d", postID))
+
+	reqURL := fmt.Sprintf("%s/post?%s", c.BaseURL, queryParams.Encode())
+
+	log.Debugf("Requesting post URL: %s", reqURL)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add Authorization header with Bearer token if authenticated
+	if c.AuthToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AuthToken))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, lookupError(resp)
+	}
+
+	var postResp models.GetPostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&postResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &postResp, nil
+}
+
+// ResolveObject looks up a federated object, such as a post on another
+// instance, by its URL or ActivityPub id. Resolving remote objects requires
+// an authenticated client.
+func (c *Client) ResolveObject(ctx context.Context, query string) (*models.ResolveObjectResponse, error) {
+	queryParams := url.Values{}
+	queryParams.Set("q", query)
+
+	reqURL := fmt.Sprintf("%s/resolve_object?%s", c.BaseURL, queryParams.Encode())
+
+	log.Debugf("Resolving object: %s", query)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add Authorization header with Bearer token if authenticated
+	if c.AuthToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AuthToken))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, lookupError(resp)
+	}
+
+	var resolveResp models.ResolveObjectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&resolveResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &resolveResp, nil
+}
+
+// lookupError describes a failed lookup of a post or object. Lemmy answers
+// 404, or 400 with a couldnt_find_* error, for ones that do not exist.
+func lookupError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	var lemmyErr struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &lemmyErr)
+	if resp.StatusCode == http.StatusNotFound || strings.HasPrefix(lemmyErr.Error, "couldnt_find") {
+		return fmt.Errorf("request failed with status %d: %s: %w", resp.StatusCode, string(body), ErrNotFound)
+	}
+	return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+}
+
 // GetCommunityID retrieves the community ID by name
-func (c *Client) GetCommunityID(communityName string) (int64, error) {
+func (c *Client) GetCommunityID(ctx context.Context, communityName string) (int64, error) {
 	queryParams := url.Values{}
 	queryParams.Set("name", communityName)
 
 	reqURL := fmt.Sprintf("%s/community?%s", c.BaseURL, queryParams.Encode())
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -166,7 +265,7 @@ func (c *Client) GetCommunityID(communityName string) (int64, error) {
 }
 
 // GetComments retrieves comments for a post from the Lemmy instance
-func (c *Client) GetComments(postID int64, maxDepth, limit int) (*models.GetCommentsResponse, error) {
+func (c *Client) GetComments(ctx context.Context, postID int64, maxDepth, limit int) (*models.GetCommentsResponse, error) {
 	queryParams := url.Values{}
 	queryParams.Set("post_id", fmt.Sprintf("%d", postID))
 
@@ -182,7 +281,7 @@ func (c *Client) GetComments(postID int64, maxDepth, limit int) (*models.GetComm
 
 	log.Debugf("Requesting comments URL: %s", reqURL)
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
 	"time"
 
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scheduler"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
 	"gopkg.in/yaml.v3"
 )
 
@@ -18,19 +22,119 @@ type Config struct {
 	WebServer   WebServerConfig   `yaml:"web_server" json:"web_server"`
 	Thumbnails  ThumbnailConfig   `yaml:"thumbnails" json:"thumbnails"`
 	Search      SearchConfig      `yaml:"search" json:"search"`
+	Filters     FilterConfig      `yaml:"filters" json:"filters"`
+
+	NearDuplicates NearDuplicateConfig `yaml:"near_duplicates" json:"near_duplicates"`
+	Transcode      TranscodeConfig     `yaml:"transcode" json:"transcode"`
 }
 
 // LemmyConfig contains Lemmy instance and authentication settings
 type LemmyConfig struct {
-	Instance    string   `yaml:"instance" json:"instance"`        // e.g., "lemmy.ml"
-	Username    string   `yaml:"username" json:"username"`
-	Password    string   `yaml:"password" json:"password"`
-	Communities []string `yaml:"communities" json:"communities"`  // Optional list of communities to scrape
+	Instance    string            `yaml:"instance" json:"instance"`        // e.g., "lemmy.ml"
+	Username    string            `yaml:"username" json:"username"`
+	Password    string            `yaml:"password" json:"password"`
+	Communities []CommunityConfig `yaml:"communities" json:"communities"`  // Optional list of communities to scrape
+}
+
+// CommunityConfig describes a community to scrape along with optional overrides
+// of the global scraper settings. Unset fields fall back to the scraper section.
+// In YAML and JSON a community may be given either as a plain name or as an object.
+type CommunityConfig struct {
+	Name              string        `yaml:"name" json:"name"`                                                   // Community name (e.g., "pics" or "pics@lemmy.world")
+	SortType          string        `yaml:"sort_type,omitempty" json:"sort_type,omitempty"`                     // Overrides scraper.sort_type
+	MaxPostsPerRun    int           `yaml:"max_posts_per_run,omitempty" json:"max_posts_per_run,omitempty"`     // Overrides scraper.max_posts_per_run
+	IncludeImages     *bool         `yaml:"include_images,omitempty" json:"include_images,omitempty"`           // Overrides scraper.include_images
+	IncludeVideos     *bool         `yaml:"include_videos,omitempty" json:"include_videos,omitempty"`           // Overrides scraper.include_videos
+	IncludeOtherMedia *bool         `yaml:"include_other_media,omitempty" json:"include_other_media,omitempty"` // Overrides scraper.include_other_media
+	StopAtSeenPosts   *bool         `yaml:"stop_at_seen_posts,omitempty" json:"stop_at_seen_posts,omitempty"`   // Overrides scraper.stop_at_seen_posts
+	Interval          time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`                       // Minimum time between scrapes of this community
+	Schedule          string        `yaml:"schedule,omitempty" json:"schedule,omitempty"`                       // Cron expression; scrape on its own schedule in continuous mode
+	Filters           *FilterConfig `yaml:"filters,omitempty" json:"filters,omitempty"`                         // Overrides individual filter rules
+}
+
+// communityConfigFields is used to decode the object form of CommunityConfig
+// without recursing into the custom unmarshalers
+type communityConfigFields CommunityConfig
+
+// hasOverrides reports whether any setting other than the name is set
+func (cc CommunityConfig) hasOverrides() bool {
+	return cc.SortType != "" || cc.MaxPostsPerRun != 0 || cc.Interval != 0 ||
+		cc.IncludeImages != nil || cc.IncludeVideos != nil || cc.IncludeOtherMedia != nil ||
+		cc.StopAtSeenPosts != nil || cc.Filters != nil || cc.Schedule != ""
+}
+
+// UnmarshalYAML accepts either a plain community name or an object
+func (cc *CommunityConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*cc = CommunityConfig{Name: value.Value}
+		return nil
+	}
+
+	var fields communityConfigFields
+	if err := value.Decode(&fields); err != nil {
+		return err
+	}
+	*cc = CommunityConfig(fields)
+	return nil
+}
+
+// MarshalYAML writes communities without overrides as a plain name
+func (cc CommunityConfig) MarshalYAML() (interface{}, error) {
+	if !cc.hasOverrides() {
+		return cc.Name, nil
+	}
+	return communityConfigFields(cc), nil
+}
+
+// UnmarshalJSON accepts either a plain community name or an object
+func (cc *CommunityConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*cc = CommunityConfig{Name: name}
+		return nil
+	}
+
+	var fields communityConfigFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*cc = CommunityConfig(fields)
+	return nil
+}
+
+// MarshalJSON writes communities without overrides as a plain name
+func (cc CommunityConfig) MarshalJSON() ([]byte, error) {
+	if !cc.hasOverrides() {
+		return json.Marshal(cc.Name)
+	}
+	return json.Marshal(communityConfigFields(cc))
 }
 
 // StorageConfig contains settings for media storage
 type StorageConfig struct {
-	BaseDirectory string `yaml:"base_directory" json:"base_directory"`  // Where to save downloaded media
+	BaseDirectory string   `yaml:"base_directory" json:"base_directory"`  // Where to save downloaded media
+	PathTemplate  string   `yaml:"path_template" json:"path_template"`    // Layout of files under base_directory, e.g. "{community}/{yyyy}/{mm}/{post_id}_{hash8}.{ext}"
+	Mode          string   `yaml:"mode" json:"mode"`                      // "path" stores files at path_template, "content" stores them by hash under objects/
+	LinkType      string   `yaml:"link_type" json:"link_type"`            // In content mode, how path_template links to objects: "hardlink", "symlink" or "none"
+	Backend       string   `yaml:"backend" json:"backend"`                // "local" stores files in base_directory, "s3" in an S3-compatible bucket
+	StripMetadata bool     `yaml:"strip_metadata" json:"strip_metadata"`  // Remove EXIF, XMP and GPS metadata from JPEG, PNG and WebP images, keeping their orientation
+	SidecarJSON   bool     `yaml:"sidecar_json" json:"sidecar_json"`      // Write a <file>.json sidecar describing the post next to each stored file
+	SidecarNFO    bool     `yaml:"sidecar_nfo" json:"sidecar_nfo"`        // Write a <name>.nfo sidecar, as read by Kodi, Jellyfin and Plex, next to each video
+	S3            S3Config `yaml:"s3,omitempty" json:"s3"`                // Bucket settings for the s3 backend
+}
+
+// S3Config contains settings for storing media in an S3-compatible bucket.
+// Files are stored under their path relative to base_directory.
+type S3Config struct {
+	Endpoint        string        `yaml:"endpoint,omitempty" json:"endpoint"`                    // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region          string        `yaml:"region,omitempty" json:"region"`                        // Defaults to "us-east-1"
+	Bucket          string        `yaml:"bucket,omitempty" json:"bucket"`
+	AccessKeyID     string        `yaml:"access_key_id,omitempty" json:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key,omitempty" json:"secret_access_key"`
+	Prefix          string        `yaml:"prefix,omitempty" json:"prefix"`                        // Prepended to every key, e.g. "archive/"
+	PathStyle       bool          `yaml:"path_style,omitempty" json:"path_style"`                // Put the bucket in the URL path, as MinIO expects
+	Presign         bool          `yaml:"presign,omitempty" json:"presign"`                      // Redirect /media/ requests to presigned URLs instead of proxying files
+	PresignExpiry   time.Duration `yaml:"presign_expiry,omitempty" json:"presign_expiry"`        // How long presigned URLs stay valid
 }
 
 // DatabaseConfig contains SQLite database settings
@@ -49,12 +153,46 @@ type ScraperConfig struct {
 	IncludeImages          bool   `yaml:"include_images" json:"include_images"`                 // Download images
 	IncludeVideos          bool   `yaml:"include_videos" json:"include_videos"`                 // Download videos
 	IncludeOtherMedia      bool   `yaml:"include_other_media" json:"include_other_media"`       // Download other media types
+	SkipFeaturedPosts      bool   `yaml:"skip_featured_posts" json:"skip_featured_posts"`       // Don't archive pinned (featured) posts
+	ScoreQueue             ScoreQueueConfig `yaml:"score_queue" json:"score_queue"`                 // Defer young posts that fail filters.min_score
+	Retries                RetryConfig      `yaml:"retries" json:"retries"`                         // Retry failed downloads on later runs
 }
 
+// ScoreQueueConfig controls deferring posts that fail the minimum score only
+// because they are too new to have collected votes
+type ScoreQueueConfig struct {
+	Enabled         bool          `yaml:"enabled" json:"enabled"`                   // Queue young posts instead of filtering them
+	Maturation      time.Duration `yaml:"maturation" json:"maturation"`             // Post age at which the score is first re-checked
+	RecheckInterval time.Duration `yaml:"recheck_interval" json:"recheck_interval"` // Time between later re-checks
+	Deadline        time.Duration `yaml:"deadline" json:"deadline"`                 // Post age after which queued posts are dropped
+}
+
+// RetryConfig controls retrying failed media downloads. The delay before a
+// retry doubles after each failed attempt, from InitialDelay up to MaxDelay.
+type RetryConfig struct {
+	MaxAttempts  int           `yaml:"max_attempts" json:"max_attempts"`   // Attempts, including the first, before a download fails permanently
+	InitialDelay time.Duration `yaml:"initial_delay" json:"initial_delay"` // Delay before the first retry
+	MaxDelay     time.Duration `yaml:"max_delay" json:"max_delay"`         // Longest delay between retries
+}
+
+// defaultRetryMaxDelay is the longest delay between retries when max_delay is
+// not set
+const defaultRetryMaxDelay = 24 * time.Hour
+
 // RunModeConfig contains run mode settings
 type RunModeConfig struct {
-	Mode     string        `yaml:"mode" json:"mode"`          // "once" or "continuous"
-	Interval time.Duration `yaml:"interval" json:"interval"`  // Interval for continuous mode (e.g., "5m", "1h")
+	Mode       string           `yaml:"mode" json:"mode"`                               // "once" or "continuous"
+	Interval   time.Duration    `yaml:"interval" json:"interval"`                       // Interval for continuous mode (e.g., "5m", "1h")
+	Schedule   string           `yaml:"schedule,omitempty" json:"schedule,omitempty"`   // Cron expression for continuous mode, replaces interval
+	Jitter     time.Duration    `yaml:"jitter,omitempty" json:"jitter,omitempty"`       // Random delay of up to this long added to each run
+	QuietHours QuietHoursConfig `yaml:"quiet_hours,omitempty" json:"quiet_hours"`       // Daily window in which no scheduled runs start
+}
+
+// QuietHoursConfig is a daily window given as local "HH:MM" times. It may wrap
+// around midnight (e.g. start "23:00", end "07:00").
+type QuietHoursConfig struct {
+	Start string `yaml:"start,omitempty" json:"start,omitempty"`
+	End   string `yaml:"end,omitempty" json:"end,omitempty"`
 }
 
 // WebServerConfig contains web UI server settings
@@ -74,11 +212,86 @@ type ThumbnailConfig struct {
 	VideoMethod string `yaml:"video_method" json:"video_method"`   // Method for video thumbnails (ffmpeg, frame_extract)
 }
 
+// FilterConfig contains rules that decide which posts are downloaded.
+// Unset rules do not filter anything.
+type FilterConfig struct {
+	MinScore               *int     `yaml:"min_score,omitempty" json:"min_score,omitempty"`                               // Skip posts with a lower score
+	NSFW                   string   `yaml:"nsfw,omitempty" json:"nsfw,omitempty"`                                         // "include" (default), "exclude" or "only"
+	TitleInclude           []string `yaml:"title_include,omitempty" json:"title_include,omitempty"`                       // Regexes, title must match at least one
+	TitleExclude           []string `yaml:"title_exclude,omitempty" json:"title_exclude,omitempty"`                       // Regexes, title must match none
+	BodyInclude            []string `yaml:"body_include,omitempty" json:"body_include,omitempty"`                         // Regexes, body must match at least one
+	BodyExclude            []string `yaml:"body_exclude,omitempty" json:"body_exclude,omitempty"`                         // Regexes, body must match none
+	AuthorAllow            []string `yaml:"author_allow,omitempty" json:"author_allow,omitempty"`                         // Only download from these authors ("name" or "name@instance")
+	AuthorDeny             []string `yaml:"author_deny,omitempty" json:"author_deny,omitempty"`                           // Never download from these authors
+	ExcludeBots            *bool    `yaml:"exclude_bots,omitempty" json:"exclude_bots,omitempty"`                         // Skip posts by bot accounts
+	Languages              []int    `yaml:"languages,omitempty" json:"languages,omitempty"`                               // Allowed Lemmy language IDs (0 = undetermined)
+	ExcludeBlockedCreators *bool    `yaml:"exclude_blocked_creators,omitempty" json:"exclude_blocked_creators,omitempty"` // Skip posts by creators the account has blocked
+}
+
+// Patterns returns all regular expressions used by the filter rules
+func (f FilterConfig) Patterns() []string {
+	var patterns []string
+	patterns = append(patterns, f.TitleInclude...)
+	patterns = append(patterns, f.TitleExclude...)
+	patterns = append(patterns, f.BodyInclude...)
+	patterns = append(patterns, f.BodyExclude...)
+	return patterns
+}
+
+// validate checks the filter rules; prefix is used in error messages
+func (f FilterConfig) validate(prefix string) error {
+	switch f.NSFW {
+	case "", "include", "exclude", "only":
+	default:
+		return fmt.Errorf("%s.nsfw must be 'include', 'exclude' or 'only'", prefix)
+	}
+	for _, pattern := range f.Patterns() {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%s: invalid pattern %q: %w", prefix, pattern, err)
+		}
+	}
+	return nil
+}
+
 // SearchConfig contains search settings
 type SearchConfig struct {
 	RebuildIndex bool `yaml:"rebuild_index" json:"rebuild_index"` // Rebuild FTS index on startup
 }
 
+// Near-duplicate actions
+const (
+	NearDuplicateLink = "link" // Download the copy and record it as a near-duplicate
+	NearDuplicateSkip = "skip" // Link the post to the archived copy instead of downloading
+)
+
+// NearDuplicateConfig contains perceptual-hash duplicate detection settings
+type NearDuplicateConfig struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"`           // Hash images and video keyframes
+	MaxDistance int    `yaml:"max_distance" json:"max_distance"` // Largest Hamming distance between near-duplicates (1-64, default 8)
+	Action      string `yaml:"action" json:"action"`             // "link" (default) or "skip"
+}
+
+// Formats animated GIFs are converted to
+const (
+	GIFToMP4  = "mp4"
+	GIFToWebM = "webm"
+	GIFKeep   = "none" // Keep GIFs as they are
+)
+
+// bitratePattern matches ffmpeg bitrates such as "800k" or "2.5M"
+var bitratePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmM]?$`)
+
+// TranscodeConfig contains settings for converting downloaded videos and
+// animated GIFs with ffmpeg. The converted files are stored as derivatives of
+// the originals, which are kept.
+type TranscodeConfig struct {
+	Enabled    bool   `yaml:"enabled" json:"enabled"`           // Convert new downloads, and at startup earlier ones
+	GIFFormat  string `yaml:"gif_format" json:"gif_format"`     // Convert animated GIFs to "mp4" (default) or "webm", or "none"
+	Remux      bool   `yaml:"remux" json:"remux"`               // Remux MKV and MOV videos to MP4 with faststart
+	MaxHeight  int    `yaml:"max_height" json:"max_height"`     // Scale converted videos down to this height, 0 for no limit
+	MaxBitrate string `yaml:"max_bitrate" json:"max_bitrate"`   // Cap the video bitrate of converted videos, e.g. "2M"
+}
+
 // LoadConfig loads configuration from a YAML file
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
@@ -132,20 +345,131 @@ func (c *Config) Validate() error {
 	if c.Storage.BaseDirectory == "" {
 		return fmt.Errorf("storage.base_directory is required")
 	}
+	if c.Storage.PathTemplate != "" {
+		if err := storage.ValidateTemplate(c.Storage.PathTemplate); err != nil {
+			return fmt.Errorf("storage.path_template: %w", err)
+		}
+	}
+	if c.Storage.Mode != "" && c.Storage.Mode != storage.ModePath && c.Storage.Mode != storage.ModeContent {
+		return fmt.Errorf("storage.mode must be 'path' or 'content'")
+	}
+	switch c.Storage.LinkType {
+	case "", storage.LinkHard, storage.LinkSymbolic, storage.LinkNone:
+	default:
+		return fmt.Errorf("storage.link_type must be 'hardlink', 'symlink' or 'none'")
+	}
+	switch c.Storage.Backend {
+	case "", storage.BackendLocal:
+	case storage.BackendS3:
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return fmt.Errorf("storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+		if c.Storage.S3.PresignExpiry < 0 {
+			return fmt.Errorf("storage.s3.presign_expiry must not be negative")
+		}
+	default:
+		return fmt.Errorf("storage.backend must be 'local' or 's3'")
+	}
 	if c.Database.Path == "" {
 		return fmt.Errorf("database.path is required")
 	}
 	if c.RunMode.Mode != "once" && c.RunMode.Mode != "continuous" {
 		return fmt.Errorf("run_mode.mode must be 'once' or 'continuous'")
 	}
-	if c.RunMode.Mode == "continuous" && c.RunMode.Interval == 0 {
+	if c.RunMode.Mode == "continuous" && c.RunMode.Interval == 0 && c.RunMode.Schedule == "" {
 		return fmt.Errorf("run_mode.interval is required for continuous mode")
 	}
+	if c.RunMode.Schedule != "" {
+		if _, err := scheduler.ParseCron(c.RunMode.Schedule); err != nil {
+			return fmt.Errorf("run_mode.schedule: %w", err)
+		}
+	}
+	if c.RunMode.Jitter < 0 {
+		return fmt.Errorf("run_mode.jitter must not be negative")
+	}
+	if _, err := scheduler.ParseQuietHours(c.RunMode.QuietHours.Start, c.RunMode.QuietHours.End); err != nil {
+		return fmt.Errorf("run_mode.quiet_hours: %w", err)
+	}
+	for i, community := range c.Lemmy.Communities {
+		if community.Name == "" {
+			return fmt.Errorf("lemmy.communities[%d].name is required", i)
+		}
+		if community.MaxPostsPerRun < 0 {
+			return fmt.Errorf("lemmy.communities[%d].max_posts_per_run must not be negative", i)
+		}
+		if community.Interval < 0 {
+			return fmt.Errorf("lemmy.communities[%d].interval must not be negative", i)
+		}
+		if community.Schedule != "" {
+			if _, err := scheduler.ParseCron(community.Schedule); err != nil {
+				return fmt.Errorf("lemmy.communities[%d].schedule: %w", i, err)
+			}
+		}
+		if community.Filters != nil {
+			if err := community.Filters.validate(fmt.Sprintf("lemmy.communities[%d].filters", i)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Filters.validate("filters"); err != nil {
+		return err
+	}
+	if c.NearDuplicates.MaxDistance < 0 || c.NearDuplicates.MaxDistance > 64 {
+		return fmt.Errorf("near_duplicates.max_distance must be between 1 and 64")
+	}
+	switch c.NearDuplicates.Action {
+	case "", NearDuplicateLink, NearDuplicateSkip:
+	default:
+		return fmt.Errorf("near_duplicates.action must be 'link' or 'skip'")
+	}
+	switch c.Transcode.GIFFormat {
+	case "", GIFToMP4, GIFToWebM, GIFKeep:
+	default:
+		return fmt.Errorf("transcode.gif_format must be 'mp4', 'webm' or 'none'")
+	}
+	if c.Transcode.MaxHeight < 0 {
+		return fmt.Errorf("transcode.max_height must not be negative")
+	}
+	if c.Transcode.MaxBitrate != "" && !bitratePattern.MatchString(c.Transcode.MaxBitrate) {
+		return fmt.Errorf("transcode.max_bitrate must be a bitrate such as '800k' or '2M'")
+	}
+	if r := c.Scraper.Retries; r.MaxAttempts < 0 || r.InitialDelay < 0 || r.MaxDelay < 0 {
+		return fmt.Errorf("scraper.retries settings must not be negative")
+	}
+	if r := c.Scraper.Retries; r.MaxDelay != 0 && r.MaxDelay < r.InitialDelay {
+		return fmt.Errorf("scraper.retries.max_delay must not be shorter than initial_delay")
+	} else if r.MaxDelay == 0 && r.InitialDelay > defaultRetryMaxDelay {
+		return fmt.Errorf("scraper.retries.initial_delay must not be longer than the default max_delay of %s unless max_delay is set", defaultRetryMaxDelay)
+	}
+	if sq := c.Scraper.ScoreQueue; sq.Enabled {
+		if sq.Maturation < 0 || sq.RecheckInterval < 0 || sq.Deadline < 0 {
+			return fmt.Errorf("scraper.score_queue durations must not be negative")
+		}
+		if sq.Deadline != 0 && sq.Deadline < sq.Maturation {
+			return fmt.Errorf("scraper.score_queue.deadline must not be shorter than maturation")
+		}
+	}
 	return nil
 }
 
 // SetDefaults sets default values for optional configuration fields
 func (c *Config) SetDefaults() {
+	if c.Storage.PathTemplate == "" {
+		c.Storage.PathTemplate = storage.DefaultPathTemplate
+	}
+	if c.Storage.Mode == "" {
+		c.Storage.Mode = storage.ModePath
+	}
+	if c.Storage.LinkType == "" {
+		c.Storage.LinkType = storage.LinkHard
+	}
+	if c.Storage.Backend == "" {
+		c.Storage.Backend = storage.BackendLocal
+	}
+	if c.Storage.S3.PresignExpiry == 0 {
+		c.Storage.S3.PresignExpiry = time.Hour
+	}
+
 	if c.Scraper.MaxPostsPerRun == 0 {
 		c.Scraper.MaxPostsPerRun = 50
 	}
@@ -171,6 +495,33 @@ func (c *Config) SetDefaults() {
 		c.Scraper.IncludeVideos = true
 		c.Scraper.IncludeOtherMedia = true
 	}
+
+	if c.Scraper.Retries.MaxAttempts == 0 {
+		c.Scraper.Retries.MaxAttempts = 5
+	}
+	if c.Scraper.Retries.InitialDelay == 0 {
+		c.Scraper.Retries.InitialDelay = 30 * time.Minute
+	}
+	if c.Scraper.Retries.MaxDelay == 0 {
+		c.Scraper.Retries.MaxDelay = defaultRetryMaxDelay
+	}
+
+	if c.Scraper.ScoreQueue.Maturation == 0 {
+		c.Scraper.ScoreQueue.Maturation = 6 * time.Hour
+	}
+	if c.Scraper.ScoreQueue.RecheckInterval == 0 {
+		c.Scraper.ScoreQueue.RecheckInterval = time.Hour
+	}
+	if c.Scraper.ScoreQueue.Deadline == 0 {
+		c.Scraper.ScoreQueue.Deadline = 24 * time.Hour
+	}
+
+	// Normalize per-community sort overrides the same way as the global one
+	for i := range c.Lemmy.Communities {
+		if c.Lemmy.Communities[i].SortType != "" {
+			c.Lemmy.Communities[i].SortType = normalizeSortType(c.Lemmy.Communities[i].SortType)
+		}
+	}
 	if c.RunMode.Mode == "" {
 		c.RunMode.Mode = "once"
 	}
@@ -202,6 +553,93 @@ func (c *Config) SetDefaults() {
 		c.Thumbnails.VideoMethod = "ffmpeg"
 	}
 
+	if c.NearDuplicates.MaxDistance == 0 {
+		c.NearDuplicates.MaxDistance = 8
+	}
+	if c.NearDuplicates.Action == "" {
+		c.NearDuplicates.Action = NearDuplicateLink
+	}
+	if c.Transcode.GIFFormat == "" {
+		c.Transcode.GIFFormat = GIFToMP4
+	}
+
+}
+
+// ScraperFor returns the effective scraper settings for a community, applying
+// its overrides on top of the global scraper section
+func (c *Config) ScraperFor(community CommunityConfig) ScraperConfig {
+	sc := c.Scraper
+
+	if community.SortType != "" {
+		sc.SortType = normalizeSortType(community.SortType)
+	}
+	if community.MaxPostsPerRun > 0 {
+		sc.MaxPostsPerRun = community.MaxPostsPerRun
+		// Without pagination a single request can return at most 50 posts
+		if !sc.EnablePagination && sc.MaxPostsPerRun > 50 {
+			sc.MaxPostsPerRun = 50
+		}
+	}
+	if community.IncludeImages != nil {
+		sc.IncludeImages = *community.IncludeImages
+	}
+	if community.IncludeVideos != nil {
+		sc.IncludeVideos = *community.IncludeVideos
+	}
+	if community.IncludeOtherMedia != nil {
+		sc.IncludeOtherMedia = *community.IncludeOtherMedia
+	}
+	if community.StopAtSeenPosts != nil {
+		sc.StopAtSeenPosts = *community.StopAtSeenPosts
+	}
+
+	return sc
+}
+
+// FiltersFor returns the effective filter rules for a community. Rules set on
+// the community replace the corresponding global rule; unset rules are inherited.
+func (c *Config) FiltersFor(community CommunityConfig) FilterConfig {
+	fc := c.Filters
+	o := community.Filters
+	if o == nil {
+		return fc
+	}
+
+	if o.MinScore != nil {
+		fc.MinScore = o.MinScore
+	}
+	if o.NSFW != "" {
+		fc.NSFW = o.NSFW
+	}
+	if o.TitleInclude != nil {
+		fc.TitleInclude = o.TitleInclude
+	}
+	if o.TitleExclude != nil {
+		fc.TitleExclude = o.TitleExclude
+	}
+	if o.BodyInclude != nil {
+		fc.BodyInclude = o.BodyInclude
+	}
+	if o.BodyExclude != nil {
+		fc.BodyExclude = o.BodyExclude
+	}
+	if o.AuthorAllow != nil {
+		fc.AuthorAllow = o.AuthorAllow
+	}
+	if o.AuthorDeny != nil {
+		fc.AuthorDeny = o.AuthorDeny
+	}
+	if o.ExcludeBots != nil {
+		fc.ExcludeBots = o.ExcludeBots
+	}
+	if o.Languages != nil {
+		fc.Languages = o.Languages
+	}
+	if o.ExcludeBlockedCreators != nil {
+		fc.ExcludeBlockedCreators = o.ExcludeBlockedCreators
+	}
+
+	return fc
 }
 
 // normalizeSortType converts user-friendly sort type names to API format
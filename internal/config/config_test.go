@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -130,6 +131,28 @@ func TestValidate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "database.path is required",
 		},
+		{
+			name: "invalid path template",
+			config: Config{
+				Lemmy: LemmyConfig{
+					Instance: "lemmy.ml",
+					Username: "testuser",
+					Password: "testpass",
+				},
+				Storage: StorageConfig{
+					BaseDirectory: "/tmp/media",
+					PathTemplate:  "{community}/{colour}_{post_id}",
+				},
+				Database: DatabaseConfig{
+					Path: "/tmp/test.db",
+				},
+				RunMode: RunModeConfig{
+					Mode: "once",
+				},
+			},
+			wantErr: true,
+			errMsg:  "storage.path_template: unknown placeholder {colour}",
+		},
 		{
 			name: "invalid run mode",
 			config: Config{
@@ -471,11 +494,80 @@ run_mode:
 				if len(c.Lemmy.Communities) != 2 {
 					t.Errorf("Communities length = %d, want 2", len(c.Lemmy.Communities))
 				}
-				if c.Lemmy.Communities[0] != "technology" {
-					t.Errorf("Communities[0] = %s, want technology", c.Lemmy.Communities[0])
+				if c.Lemmy.Communities[0].Name != "technology" {
+					t.Errorf("Communities[0].Name = %s, want technology", c.Lemmy.Communities[0].Name)
 				}
 			},
 		},
+		{
+			name: "config with community overrides",
+			yaml: `
+lemmy:
+  instance: "lemmy.ml"
+  username: "testuser"
+  password: "testpass"
+  communities:
+    - "technology"
+    - name: "memes"
+      sort_type: "new"
+      max_posts_per_run: 200
+      include_videos: false
+      interval: "2h"
+      stop_at_seen_posts: true
+storage:
+  base_directory: "/tmp/media"
+database:
+  path: "/tmp/db.sqlite"
+run_mode:
+  mode: "once"
+`,
+			wantErr: false,
+			validate: func(t *testing.T, c *Config) {
+				if len(c.Lemmy.Communities) != 2 {
+					t.Fatalf("Communities length = %d, want 2", len(c.Lemmy.Communities))
+				}
+				memes := c.Lemmy.Communities[1]
+				if memes.Name != "memes" {
+					t.Errorf("Communities[1].Name = %s, want memes", memes.Name)
+				}
+				if memes.SortType != "new" {
+					t.Errorf("SortType = %s, want new", memes.SortType)
+				}
+				if memes.MaxPostsPerRun != 200 {
+					t.Errorf("MaxPostsPerRun = %d, want 200", memes.MaxPostsPerRun)
+				}
+				if memes.IncludeVideos == nil || *memes.IncludeVideos {
+					t.Errorf("IncludeVideos = %v, want false", memes.IncludeVideos)
+				}
+				if memes.IncludeImages != nil {
+					t.Errorf("IncludeImages = %v, want nil", memes.IncludeImages)
+				}
+				if memes.Interval != 2*time.Hour {
+					t.Errorf("Interval = %s, want 2h", memes.Interval)
+				}
+				if memes.StopAtSeenPosts == nil || !*memes.StopAtSeenPosts {
+					t.Errorf("StopAtSeenPosts = %v, want true", memes.StopAtSeenPosts)
+				}
+			},
+		},
+		{
+			name: "community object without name",
+			yaml: `
+lemmy:
+  instance: "lemmy.ml"
+  username: "testuser"
+  password: "testpass"
+  communities:
+    - sort_type: "New"
+storage:
+  base_directory: "/tmp/media"
+database:
+  path: "/tmp/db.sqlite"
+run_mode:
+  mode: "once"
+`,
+			wantErr: true,
+		},
 		{
 			name: "invalid yaml",
 			yaml: `
@@ -536,3 +628,423 @@ func TestLoadConfigNonexistentFile(t *testing.T) {
 		t.Errorf("LoadConfig() with nonexistent file should return error")
 	}
 }
+
+func TestScraperFor(t *testing.T) {
+	boolPtr := func(b bool) *bool { return &b }
+
+	base := Config{
+		Scraper: ScraperConfig{
+			MaxPostsPerRun:    50,
+			SortType:          "Hot",
+			StopAtSeenPosts:   false,
+			IncludeImages:     true,
+			IncludeVideos:     true,
+			IncludeOtherMedia: true,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		community  CommunityConfig
+		pagination bool
+		check      func(*testing.T, ScraperConfig)
+	}{
+		{
+			name:      "no overrides uses global settings",
+			community: CommunityConfig{Name: "technology"},
+			check: func(t *testing.T, sc ScraperConfig) {
+				if sc.SortType != "Hot" || sc.MaxPostsPerRun != 50 || !sc.IncludeVideos || sc.StopAtSeenPosts {
+					t.Errorf("unexpected settings: %+v", sc)
+				}
+			},
+		},
+		{
+			name: "overrides applied",
+			community: CommunityConfig{
+				Name:            "memes",
+				SortType:        "new",
+				MaxPostsPerRun:  20,
+				IncludeVideos:   boolPtr(false),
+				StopAtSeenPosts: boolPtr(true),
+			},
+			check: func(t *testing.T, sc ScraperConfig) {
+				if sc.SortType != "New" {
+					t.Errorf("SortType = %s, want New", sc.SortType)
+				}
+				if sc.MaxPostsPerRun != 20 {
+					t.Errorf("MaxPostsPerRun = %d, want 20", sc.MaxPostsPerRun)
+				}
+				if sc.IncludeVideos {
+					t.Errorf("IncludeVideos = true, want false")
+				}
+				if !sc.IncludeImages {
+					t.Errorf("IncludeImages = false, want true (inherited)")
+				}
+				if !sc.StopAtSeenPosts {
+					t.Errorf("StopAtSeenPosts = false, want true")
+				}
+			},
+		},
+		{
+			name:      "max posts capped without pagination",
+			community: CommunityConfig{Name: "memes", MaxPostsPerRun: 500},
+			check: func(t *testing.T, sc ScraperConfig) {
+				if sc.MaxPostsPerRun != 50 {
+					t.Errorf("MaxPostsPerRun = %d, want 50", sc.MaxPostsPerRun)
+				}
+			},
+		},
+		{
+			name:       "max posts not capped with pagination",
+			community:  CommunityConfig{Name: "memes", MaxPostsPerRun: 500},
+			pagination: true,
+			check: func(t *testing.T, sc ScraperConfig) {
+				if sc.MaxPostsPerRun != 500 {
+					t.Errorf("MaxPostsPerRun = %d, want 500", sc.MaxPostsPerRun)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Scraper.EnablePagination = tt.pagination
+			tt.check(t, cfg.ScraperFor(tt.community))
+		})
+	}
+}
+
+func TestCommunityConfigJSON(t *testing.T) {
+	var communities []CommunityConfig
+	data := `["technology", {"name": "memes", "sort_type": "New"}]`
+	if err := json.Unmarshal([]byte(data), &communities); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(communities) != 2 {
+		t.Fatalf("len = %d, want 2", len(communities))
+	}
+	if communities[0].Name != "technology" || communities[1].SortType != "New" {
+		t.Errorf("unexpected communities: %+v", communities)
+	}
+
+	// Communities without overrides round-trip as plain names
+	out, err := json.Marshal(communities)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	want := `["technology",{"name":"memes","sort_type":"New"}]`
+	if string(out) != want {
+		t.Errorf("Marshal() = %s, want %s", out, want)
+	}
+}
+
+func TestFiltersFor(t *testing.T) {
+	minScore := 10
+	override := 50
+	excludeBots := true
+
+	cfg := Config{
+		Filters: FilterConfig{
+			MinScore:     &minScore,
+			NSFW:         "exclude",
+			TitleExclude: []string{"spoiler"},
+			ExcludeBots:  &excludeBots,
+		},
+	}
+
+	// No overrides returns the global rules
+	fc := cfg.FiltersFor(CommunityConfig{Name: "pics"})
+	if fc.MinScore == nil || *fc.MinScore != 10 || fc.NSFW != "exclude" {
+		t.Errorf("unexpected global filters: %+v", fc)
+	}
+
+	// Overrides replace individual rules and inherit the rest
+	fc = cfg.FiltersFor(CommunityConfig{
+		Name: "art",
+		Filters: &FilterConfig{
+			MinScore:     &override,
+			NSFW:         "include",
+			TitleExclude: []string{},
+		},
+	})
+	if fc.MinScore == nil || *fc.MinScore != 50 {
+		t.Errorf("MinScore = %v, want 50", fc.MinScore)
+	}
+	if fc.NSFW != "include" {
+		t.Errorf("NSFW = %s, want include", fc.NSFW)
+	}
+	if len(fc.TitleExclude) != 0 {
+		t.Errorf("TitleExclude = %v, want empty", fc.TitleExclude)
+	}
+	if fc.ExcludeBots == nil || !*fc.ExcludeBots {
+		t.Errorf("ExcludeBots = %v, want inherited true", fc.ExcludeBots)
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Storage:  StorageConfig{BaseDirectory: "/tmp/media"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "once"},
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{name: "valid filters", modify: func(c *Config) { c.Filters.TitleExclude = []string{"(?i)nsfl"} }},
+		{name: "invalid global pattern", modify: func(c *Config) { c.Filters.BodyInclude = []string{"["} }, wantErr: true},
+		{name: "invalid nsfw mode", modify: func(c *Config) { c.Filters.NSFW = "maybe" }, wantErr: true},
+		{
+			name: "invalid community pattern",
+			modify: func(c *Config) {
+				c.Lemmy.Communities = []CommunityConfig{{Name: "pics", Filters: &FilterConfig{TitleInclude: []string{"("}}}}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateScoreQueue(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Storage:  StorageConfig{BaseDirectory: "/tmp/media"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "once"},
+	}
+
+	tests := []struct {
+		name    string
+		queue   ScoreQueueConfig
+		wantErr bool
+	}{
+		{name: "disabled ignores values", queue: ScoreQueueConfig{Maturation: -time.Hour}},
+		{name: "enabled with defaults", queue: ScoreQueueConfig{Enabled: true}},
+		{name: "valid windows", queue: ScoreQueueConfig{Enabled: true, Maturation: 6 * time.Hour, Deadline: 24 * time.Hour}},
+		{name: "negative recheck interval", queue: ScoreQueueConfig{Enabled: true, RecheckInterval: -time.Minute}, wantErr: true},
+		{name: "deadline before maturation", queue: ScoreQueueConfig{Enabled: true, Maturation: 6 * time.Hour, Deadline: time.Hour}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Scraper.ScoreQueue = tt.queue
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRetries(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Storage:  StorageConfig{BaseDirectory: "/tmp/media"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "once"},
+	}
+
+	tests := []struct {
+		name    string
+		retries RetryConfig
+		wantErr bool
+	}{
+		{name: "defaults", retries: RetryConfig{}},
+		{name: "no retries", retries: RetryConfig{MaxAttempts: 1}},
+		{name: "valid delays", retries: RetryConfig{MaxAttempts: 3, InitialDelay: time.Minute, MaxDelay: time.Hour}},
+		{name: "negative attempts", retries: RetryConfig{MaxAttempts: -1}, wantErr: true},
+		{name: "max delay before initial delay", retries: RetryConfig{InitialDelay: time.Hour, MaxDelay: time.Minute}, wantErr: true},
+		{name: "initial delay past the default max delay", retries: RetryConfig{InitialDelay: 48 * time.Hour}, wantErr: true},
+		{name: "long delays", retries: RetryConfig{InitialDelay: 48 * time.Hour, MaxDelay: 96 * time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Scraper.Retries = tt.retries
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateStorageBackend(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "once"},
+	}
+	bucket := S3Config{Endpoint: "http://localhost:9000", Bucket: "media"}
+
+	tests := []struct {
+		name    string
+		storage StorageConfig
+		wantErr bool
+	}{
+		{name: "default backend", storage: StorageConfig{}},
+		{name: "local", storage: StorageConfig{Backend: "local"}},
+		{name: "s3", storage: StorageConfig{Backend: "s3", S3: bucket}},
+		{name: "s3 without bucket", storage: StorageConfig{Backend: "s3", S3: S3Config{Endpoint: "http://localhost:9000"}}, wantErr: true},
+		{name: "unknown backend", storage: StorageConfig{Backend: "ftp"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Storage = tt.storage
+			cfg.Storage.BaseDirectory = "/tmp/media"
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNearDuplicates(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Storage:  StorageConfig{BaseDirectory: "/tmp/media"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "once"},
+	}
+
+	tests := []struct {
+		name    string
+		nd      NearDuplicateConfig
+		wantErr bool
+	}{
+		{name: "defaults", nd: NearDuplicateConfig{Enabled: true}},
+		{name: "skip", nd: NearDuplicateConfig{Enabled: true, MaxDistance: 64, Action: "skip"}},
+		{name: "distance too large", nd: NearDuplicateConfig{MaxDistance: 65}, wantErr: true},
+		{name: "negative distance", nd: NearDuplicateConfig{MaxDistance: -1}, wantErr: true},
+		{name: "unknown action", nd: NearDuplicateConfig{Action: "delete"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.NearDuplicates = tt.nd
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := base
+	cfg.SetDefaults()
+	if cfg.NearDuplicates.MaxDistance != 8 || cfg.NearDuplicates.Action != NearDuplicateLink {
+		t.Errorf("defaults = %+v, want max_distance 8 and action link", cfg.NearDuplicates)
+	}
+}
+
+func TestValidateTranscode(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Storage:  StorageConfig{BaseDirectory: "/tmp/media"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "once"},
+	}
+
+	tests := []struct {
+		name    string
+		tc      TranscodeConfig
+		wantErr bool
+	}{
+		{name: "defaults", tc: TranscodeConfig{Enabled: true}},
+		{name: "webm with caps", tc: TranscodeConfig{Enabled: true, GIFFormat: "webm", Remux: true, MaxHeight: 720, MaxBitrate: "2.5M"}},
+		{name: "keep gifs", tc: TranscodeConfig{GIFFormat: "none", MaxBitrate: "800k"}},
+		{name: "unknown format", tc: TranscodeConfig{GIFFormat: "avi"}, wantErr: true},
+		{name: "negative height", tc: TranscodeConfig{MaxHeight: -1}, wantErr: true},
+		{name: "invalid bitrate", tc: TranscodeConfig{MaxBitrate: "fast"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Transcode = tt.tc
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := base
+	cfg.SetDefaults()
+	if cfg.Transcode.GIFFormat != GIFToMP4 {
+		t.Errorf("default gif_format = %q, want %q", cfg.Transcode.GIFFormat, GIFToMP4)
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	base := Config{
+		Lemmy:    LemmyConfig{Instance: "lemmy.ml", Username: "u", Password: "p"},
+		Storage:  StorageConfig{BaseDirectory: "/tmp/media"},
+		Database: DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:  RunModeConfig{Mode: "continuous"},
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{name: "schedule instead of interval", modify: func(c *Config) { c.RunMode.Schedule = "*/15 * * * *" }},
+		{name: "neither schedule nor interval", modify: func(c *Config) {}, wantErr: true},
+		{name: "invalid schedule", modify: func(c *Config) { c.RunMode.Schedule = "every 5 minutes" }, wantErr: true},
+		{name: "negative jitter", modify: func(c *Config) { c.RunMode.Interval = time.Hour; c.RunMode.Jitter = -time.Minute }, wantErr: true},
+		{
+			name: "quiet hours",
+			modify: func(c *Config) {
+				c.RunMode.Interval = time.Hour
+				c.RunMode.QuietHours = QuietHoursConfig{Start: "23:00", End: "07:00"}
+			},
+		},
+		{
+			name: "quiet hours without end",
+			modify: func(c *Config) {
+				c.RunMode.Interval = time.Hour
+				c.RunMode.QuietHours = QuietHoursConfig{Start: "23:00"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid community schedule",
+			modify: func(c *Config) {
+				c.RunMode.Interval = time.Hour
+				c.Lemmy.Communities = []CommunityConfig{{Name: "pics", Schedule: "* * *"}}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
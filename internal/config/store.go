@@ -0,0 +1,115 @@
+package config
+
+import (
+	"sync"
+)
+
+// Store holds the active configuration and notifies subscribers when it is
+// replaced. A Config obtained from the store must be treated as read-only;
+// changes are made by passing a new Config to Update.
+type Store struct {
+	path string
+
+	mu  sync.RWMutex
+	cfg *Config
+
+	// updateMu serializes updates so subscribers see them in order
+	updateMu    sync.Mutex
+	subscribers []func(old, new *Config)
+}
+
+// NewStore creates a store for a configuration loaded from path
+func NewStore(path string, cfg *Config) *Store {
+	return &Store{path: path, cfg: cfg}
+}
+
+// Get returns the active configuration
+func (s *Store) Get() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// Path returns the path of the configuration file
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Subscribe registers fn to be called with the old and new configuration
+// after every update
+func (s *Store) Subscribe(fn func(old, new *Config)) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// Update validates cfg, saves it to the configuration file and makes it the
+// active configuration. Returns the changed settings that only take effect
+// after a restart.
+func (s *Store) Update(cfg *Config) ([]string, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	if err := SaveConfig(s.path, cfg); err != nil {
+		return nil, err
+	}
+	return s.replace(cfg), nil
+}
+
+// Reload re-reads the configuration file and makes it the active
+// configuration. The active configuration is kept if the file is invalid.
+// Returns the changed settings that only take effect after a restart.
+func (s *Store) Reload() ([]string, error) {
+	cfg, err := LoadConfig(s.path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	return s.replace(cfg), nil
+}
+
+// replace swaps in cfg and notifies subscribers. The caller must hold updateMu.
+func (s *Store) replace(cfg *Config) []string {
+	s.mu.Lock()
+	old := s.cfg
+	// Flags such as --no-web are applied after loading and cannot be changed live
+	cfg.WebServer.Enabled = old.WebServer.Enabled
+	s.cfg = cfg
+	s.mu.Unlock()
+
+	for _, fn := range s.subscribers {
+		fn(old, cfg)
+	}
+	return RestartRequired(old, cfg)
+}
+
+// RestartRequired lists the settings that differ between old and new and
+// are only read at startup
+func RestartRequired(old, new *Config) []string {
+	var changed []string
+	check := func(name string, a, b interface{}) {
+		if a != b {
+			changed = append(changed, name)
+		}
+	}
+	check("lemmy.instance", old.Lemmy.Instance, new.Lemmy.Instance)
+	check("lemmy.username", old.Lemmy.Username, new.Lemmy.Username)
+	check("lemmy.password", old.Lemmy.Password, new.Lemmy.Password)
+	check("storage.base_directory", old.Storage.BaseDirectory, new.Storage.BaseDirectory)
+	check("storage.backend", old.Storage.Backend, new.Storage.Backend)
+	check("storage.s3", old.Storage.S3, new.Storage.S3)
+	check("near_duplicates.enabled", old.NearDuplicates.Enabled, new.NearDuplicates.Enabled)
+	check("database.path", old.Database.Path, new.Database.Path)
+	check("run_mode.mode", old.RunMode.Mode, new.RunMode.Mode)
+	check("web_server.host", old.WebServer.Host, new.WebServer.Host)
+	check("web_server.port", old.WebServer.Port, new.WebServer.Port)
+	return changed
+}
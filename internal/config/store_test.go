@@ -0,0 +1,114 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	cfg := &Config{
+		Lemmy:     LemmyConfig{Instance: "lemmy.ml", Username: "user", Password: "pass"},
+		Storage:   StorageConfig{BaseDirectory: "/tmp/media"},
+		Database:  DatabaseConfig{Path: "/tmp/db.sqlite"},
+		RunMode:   RunModeConfig{Mode: "continuous", Interval: time.Hour},
+		WebServer: WebServerConfig{Enabled: true, Host: "localhost", Port: 8080},
+	}
+	cfg.SetDefaults()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := SaveConfig(path, cfg); err != nil {
+		t.Fatalf("SaveConfig() error = %v", err)
+	}
+	return NewStore(path, cfg)
+}
+
+func TestStoreUpdate(t *testing.T) {
+	store := newTestStore(t)
+	original := store.Get()
+
+	var gotOld, gotNew *Config
+	store.Subscribe(func(old, new *Config) {
+		gotOld, gotNew = old, new
+	})
+
+	updated := *original
+	updated.Lemmy.Communities = []CommunityConfig{{Name: "pics"}}
+	updated.WebServer.Port = 9090
+	restart, err := store.Update(&updated)
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	if want := []string{"web_server.port"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("Update() restart required = %v, want %v", restart, want)
+	}
+	if store.Get() != &updated {
+		t.Error("Get() did not return the updated config")
+	}
+	if gotOld != original || gotNew != &updated {
+		t.Error("subscriber was not called with the old and new config")
+	}
+
+	saved, err := LoadConfig(store.Path())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(saved.Lemmy.Communities) != 1 || saved.Lemmy.Communities[0].Name != "pics" {
+		t.Errorf("saved communities = %+v, want [pics]", saved.Lemmy.Communities)
+	}
+}
+
+func TestStoreUpdateInvalid(t *testing.T) {
+	store := newTestStore(t)
+	original := store.Get()
+
+	called := false
+	store.Subscribe(func(old, new *Config) { called = true })
+
+	invalid := *original
+	invalid.Lemmy.Instance = ""
+	if _, err := store.Update(&invalid); err == nil {
+		t.Fatal("Update() with invalid config error = nil, want error")
+	}
+	if store.Get() != original || called {
+		t.Error("invalid config replaced the active config")
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	store := newTestStore(t)
+
+	edited := *store.Get()
+	edited.Database.Path = "/tmp/other.sqlite"
+	minScore := 10
+	edited.Filters.MinScore = &minScore
+	if err := SaveConfig(store.Path(), &edited); err != nil {
+		t.Fatalf("SaveConfig() error = %v", err)
+	}
+
+	restart, err := store.Reload()
+	if err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if want := []string{"database.path"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("Reload() restart required = %v, want %v", restart, want)
+	}
+	if got := store.Get().Filters.MinScore; got == nil || *got != 10 {
+		t.Errorf("MinScore after reload = %v, want 10", got)
+	}
+
+	// A broken file keeps the active config
+	active := store.Get()
+	if err := os.WriteFile(store.Path(), []byte("lemmy: ["), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := store.Reload(); err == nil {
+		t.Error("Reload() with invalid file error = nil, want error")
+	}
+	if store.Get() != active {
+		t.Error("invalid file replaced the active config")
+	}
+}
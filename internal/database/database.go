@@ -2,9 +2,13 @@ package database
 
 import (
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
@@ -96,6 +100,7 @@ func (db *DB) initSchema() error {
 
 	CREATE INDEX IF NOT EXISTS idx_media_hash ON scraped_media(media_hash);
 	CREATE INDEX IF NOT EXISTS idx_post_id ON scraped_media(post_id);
+	CREATE INDEX IF NOT EXISTS idx_media_url ON scraped_media(media_url);
 	CREATE INDEX IF NOT EXISTS idx_community_name ON scraped_media(community_name);
 	CREATE INDEX IF NOT EXISTS idx_downloaded_at ON scraped_media(downloaded_at);
 	CREATE INDEX IF NOT EXISTS idx_scraped_posts_community ON scraped_posts(community_name);
@@ -162,12 +167,136 @@ func (db *DB) initSchema() error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_runs_started ON scraper_runs(started_at);
+
+	-- Newest post processed per source, used to stop New-sorted runs
+	CREATE TABLE IF NOT EXISTS source_checkpoints (
+		source TEXT PRIMARY KEY,
+		last_published DATETIME NOT NULL,
+		last_post_id INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Resumable progress of historical backfills
+	CREATE TABLE IF NOT EXISTS backfill_jobs (
+		source TEXT NOT NULL,
+		sort_type TEXT NOT NULL,
+		since DATETIME NOT NULL,
+		next_page INTEGER NOT NULL DEFAULT 1,
+		posts_processed INTEGER NOT NULL DEFAULT 0,
+		media_downloaded INTEGER NOT NULL DEFAULT 0,
+		started_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		completed_at DATETIME,
+		PRIMARY KEY (source, sort_type, since)
+	);
+
+	-- Young posts waiting for their score to mature before being re-checked
+	CREATE TABLE IF NOT EXISTS score_queue (
+		instance TEXT NOT NULL DEFAULT '',
+		post_id INTEGER NOT NULL,
+		ap_id TEXT NOT NULL DEFAULT '',
+		source TEXT NOT NULL,
+		post_title TEXT,
+		community_name TEXT,
+		post_created DATETIME NOT NULL,
+		check_after DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		checks INTEGER NOT NULL DEFAULT 0,
+		last_score INTEGER NOT NULL DEFAULT 0,
+		enqueued_at DATETIME NOT NULL,
+		PRIMARY KEY (instance, post_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_score_queue_check_after ON score_queue(check_after);
+
+	-- Local ids under which each federated post was seen on each instance
+	CREATE TABLE IF NOT EXISTS post_aliases (
+		instance TEXT NOT NULL,
+		post_id INTEGER NOT NULL,
+		ap_id TEXT NOT NULL,
+		first_seen DATETIME NOT NULL,
+		PRIMARY KEY (instance, post_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_post_aliases_ap_id ON post_aliases(ap_id);
+
+	-- Every post a media item appeared in, including crossposts and reposts
+	CREATE TABLE IF NOT EXISTS media_posts (
+		media_id INTEGER NOT NULL,
+		instance TEXT NOT NULL DEFAULT '',
+		post_id INTEGER NOT NULL,
+		post_title TEXT NOT NULL,
+		community_name TEXT NOT NULL,
+		community_id INTEGER NOT NULL,
+		author_name TEXT NOT NULL,
+		post_created DATETIME NOT NULL,
+		detected_by TEXT NOT NULL,
+		linked_at DATETIME NOT NULL,
+		PRIMARY KEY (media_id, instance, post_id),
+		FOREIGN KEY (media_id) REFERENCES scraped_media(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_media_posts_post ON media_posts(post_id);
+
+	-- Perceptual hash of each image and video, NULL when it could not be computed
+	CREATE TABLE IF NOT EXISTS media_phashes (
+		media_id INTEGER PRIMARY KEY,
+		phash INTEGER,
+		computed_at DATETIME NOT NULL,
+		FOREIGN KEY (media_id) REFERENCES scraped_media(id) ON DELETE CASCADE
+	);
+
+	-- Pairs of media whose perceptual hashes are close, with the lower id first
+	CREATE TABLE IF NOT EXISTS media_duplicates (
+		media_id INTEGER NOT NULL,
+		duplicate_id INTEGER NOT NULL,
+		distance INTEGER NOT NULL,
+		detected_at DATETIME NOT NULL,
+		PRIMARY KEY (media_id, duplicate_id),
+		FOREIGN KEY (media_id) REFERENCES scraped_media(id) ON DELETE CASCADE,
+		FOREIGN KEY (duplicate_id) REFERENCES scraped_media(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_media_duplicates_duplicate ON media_duplicates(duplicate_id);
+
+	-- Files converted from media, such as MP4s of animated GIFs. A row without
+	-- a file_path records why none was made, so the media is not retried.
+	CREATE TABLE IF NOT EXISTS media_derivatives (
+		media_id INTEGER NOT NULL,
+		format TEXT NOT NULL,
+		file_path TEXT NOT NULL DEFAULT '',
+		mime_type TEXT NOT NULL DEFAULT '',
+		file_size INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (media_id, format),
+		FOREIGN KEY (media_id) REFERENCES scraped_media(id) ON DELETE CASCADE
+	);
+
+	-- Media downloads that failed, retried with backoff until they succeed or fail permanently
+	CREATE TABLE IF NOT EXISTS download_failures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER NOT NULL,
+		instance TEXT NOT NULL DEFAULT '',
+		ap_id TEXT NOT NULL DEFAULT '',
+		media_url TEXT NOT NULL,
+		post_title TEXT NOT NULL DEFAULT '',
+		community_name TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 1,
+		last_error TEXT NOT NULL,
+		status TEXT NOT NULL,
+		first_failed_at DATETIME NOT NULL,
+		last_attempt_at DATETIME NOT NULL,
+		next_retry_at DATETIME,
+		UNIQUE(instance, post_id, media_url)
+	);
+	CREATE INDEX IF NOT EXISTS idx_download_failures_next_retry ON download_failures(status, next_retry_at);
 	`
 
 	if _, err := db.Exec(schema); err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
 
+	if err := db.migrateSchema(); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
 	// Initialize FTS5 search index (optional - gracefully fails if FTS5 not available)
 	if err := db.initSearchIndex(); err != nil {
 		// FTS5 might not be available in all SQLite builds
@@ -183,6 +312,284 @@ func (db *DB) initSchema() error {
 	return nil
 }
 
+// migrateSchema adds columns introduced after the initial schema to existing databases
+func (db *DB) migrateSchema() error {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"scraper_runs", "posts_filtered", "INTEGER DEFAULT 0"},
+		{"scraper_runs", "skip_reasons", "TEXT"},
+		{"scraped_posts", "featured", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"scraped_posts", "ap_id", "TEXT"},
+		{"scraped_media", "instance", "TEXT NOT NULL DEFAULT ''"},
+		{"scraped_media", "link_path", "TEXT NOT NULL DEFAULT ''"},
+		{"scraped_media", "sanitized_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"scraped_posts", "comment_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"download_failures", "instance", "TEXT NOT NULL DEFAULT ''"},
+		{"download_failures", "ap_id", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	for _, c := range columns {
+		if err := db.ensureColumn(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := db.keyPostsByInstance(); err != nil {
+		return err
+	}
+	if err := db.keyScoreQueueByInstance(); err != nil {
+		return err
+	}
+	if err := db.keyMediaPostsByInstance(); err != nil {
+		return err
+	}
+	if err := db.keyDownloadFailuresByInstance(); err != nil {
+		return err
+	}
+
+	// Indexes on migrated columns can only be created once the columns exist
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_scraped_posts_ap_id ON scraped_posts(ap_id)`); err != nil {
+		return fmt.Errorf("failed to create ap_id index: %w", err)
+	}
+
+	// Media downloaded before media_posts existed is linked to its original post
+	var linked bool
+	if err := db.Get(&linked, `SELECT EXISTS(SELECT 1 FROM media_posts)`); err != nil {
+		return fmt.Errorf("failed to inspect media_posts: %w", err)
+	}
+	if !linked {
+		query := `
+			INSERT OR IGNORE INTO media_posts (
+				media_id, instance, post_id, post_title, community_name, community_id,
+				author_name, post_created, detected_by, linked_at
+			)
+			SELECT id, '', post_id, post_title, community_name, community_id,
+				author_name, post_created, ?, downloaded_at
+			FROM scraped_media
+		`
+		if _, err := db.Exec(query, LinkOriginal); err != nil {
+			return fmt.Errorf("failed to backfill media_posts: %w", err)
+		}
+	}
+	return nil
+}
+
+// rebuildKeyedByInstance rebuilds a table with the given statements in one
+// transaction, unless one of its keys already includes the instance column.
+// SQLite cannot change the key of an existing table.
+func (db *DB) rebuildKeyedByInstance(table string, statements []string) error {
+	var keyed bool
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM pragma_index_list(?) l JOIN pragma_index_info(l.name) i
+			WHERE l."unique" AND i.name = 'instance'
+		)
+	`
+	if err := db.Get(&keyed, query, table); err != nil {
+		return fmt.Errorf("failed to inspect the keys of %s: %w", table, err)
+	}
+	if keyed {
+		return nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to key %s by instance: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to key %s by instance: %w", table, err)
+	}
+	log.Debugf("Keyed %s by instance", table)
+	return nil
+}
+
+// keyPostsByInstance rebuilds scraped_posts so posts are keyed by the
+// instance they were scraped from and their local id on it, as local ids are
+// only unique per instance. Posts with an alias keep its instance; the
+// instance of older posts is unknown until AdoptLegacyPosts records it.
+func (db *DB) keyPostsByInstance() error {
+	return db.rebuildKeyedByInstance("scraped_posts", []string{
+		`CREATE TABLE scraped_posts_new (
+			instance TEXT NOT NULL DEFAULT '',
+			post_id INTEGER NOT NULL,
+			post_title TEXT NOT NULL,
+			community_name TEXT NOT NULL,
+			community_id INTEGER NOT NULL,
+			author_name TEXT NOT NULL,
+			author_id INTEGER NOT NULL,
+			post_created DATETIME NOT NULL,
+			scraped_at DATETIME NOT NULL,
+			had_media BOOLEAN NOT NULL,
+			media_count INTEGER NOT NULL,
+			featured BOOLEAN NOT NULL DEFAULT 0,
+			ap_id TEXT,
+			comment_count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (instance, post_id)
+		)`,
+		`INSERT INTO scraped_posts_new (
+			instance, post_id, post_title, community_name, community_id,
+			author_name, author_id, post_created, scraped_at, had_media,
+			media_count, featured, ap_id, comment_count
+		)
+		SELECT
+			COALESCE((SELECT a.instance FROM post_aliases a WHERE a.ap_id = p.ap_id AND a.post_id = p.post_id LIMIT 1), ''),
+			post_id, post_title, community_name, community_id,
+			author_name, author_id, post_created, scraped_at, had_media,
+			media_count, featured, ap_id, comment_count
+		FROM scraped_posts p`,
+		`DROP TABLE scraped_posts`,
+		`ALTER TABLE scraped_posts_new RENAME TO scraped_posts`,
+		`CREATE INDEX IF NOT EXISTS idx_scraped_posts_community ON scraped_posts(community_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_scraped_posts_scraped_at ON scraped_posts(scraped_at)`,
+	})
+}
+
+// keyScoreQueueByInstance rebuilds score_queue so queued posts are keyed by
+// the instance they were queued from, like scraped_posts
+func (db *DB) keyScoreQueueByInstance() error {
+	return db.rebuildKeyedByInstance("score_queue", []string{
+		`CREATE TABLE score_queue_new (
+			instance TEXT NOT NULL DEFAULT '',
+			post_id INTEGER NOT NULL,
+			ap_id TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL,
+			post_title TEXT,
+			community_name TEXT,
+			post_created DATETIME NOT NULL,
+			check_after DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			checks INTEGER NOT NULL DEFAULT 0,
+			last_score INTEGER NOT NULL DEFAULT 0,
+			enqueued_at DATETIME NOT NULL,
+			PRIMARY KEY (instance, post_id)
+		)`,
+		`INSERT INTO score_queue_new (
+			post_id, source, post_title, community_name, post_created,
+			check_after, expires_at, checks, last_score, enqueued_at
+		)
+		SELECT post_id, source, post_title, community_name, post_created,
+			check_after, expires_at, checks, last_score, enqueued_at
+		FROM score_queue`,
+		`DROP TABLE score_queue`,
+		`ALTER TABLE score_queue_new RENAME TO score_queue`,
+		`CREATE INDEX IF NOT EXISTS idx_score_queue_check_after ON score_queue(check_after)`,
+	})
+}
+
+// keyMediaPostsByInstance rebuilds media_posts so the posts a media item
+// appeared in are keyed by the instance they were seen on, like scraped_posts
+func (db *DB) keyMediaPostsByInstance() error {
+	return db.rebuildKeyedByInstance("media_posts", []string{
+		`CREATE TABLE media_posts_new (
+			media_id INTEGER NOT NULL,
+			instance TEXT NOT NULL DEFAULT '',
+			post_id INTEGER NOT NULL,
+			post_title TEXT NOT NULL,
+			community_name TEXT NOT NULL,
+			community_id INTEGER NOT NULL,
+			author_name TEXT NOT NULL,
+			post_created DATETIME NOT NULL,
+			detected_by TEXT NOT NULL,
+			linked_at DATETIME NOT NULL,
+			PRIMARY KEY (media_id, instance, post_id),
+			FOREIGN KEY (media_id) REFERENCES scraped_media(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO media_posts_new (
+			media_id, post_id, post_title, community_name, community_id,
+			author_name, post_created, detected_by, linked_at
+		)
+		SELECT media_id, post_id, post_title, community_name, community_id,
+			author_name, post_created, detected_by, linked_at
+		FROM media_posts`,
+		`DROP TABLE media_posts`,
+		`ALTER TABLE media_posts_new RENAME TO media_posts`,
+		`CREATE INDEX IF NOT EXISTS idx_media_posts_post ON media_posts(post_id)`,
+	})
+}
+
+// keyDownloadFailuresByInstance rebuilds download_failures so failures are
+// keyed by the instance their post was scraped from, like scraped_posts
+func (db *DB) keyDownloadFailuresByInstance() error {
+	return db.rebuildKeyedByInstance("download_failures", []string{
+		`CREATE TABLE download_failures_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_id INTEGER NOT NULL,
+			instance TEXT NOT NULL DEFAULT '',
+			ap_id TEXT NOT NULL DEFAULT '',
+			media_url TEXT NOT NULL,
+			post_title TEXT NOT NULL DEFAULT '',
+			community_name TEXT NOT NULL DEFAULT '',
+			attempts INTEGER NOT NULL DEFAULT 1,
+			last_error TEXT NOT NULL,
+			status TEXT NOT NULL,
+			first_failed_at DATETIME NOT NULL,
+			last_attempt_at DATETIME NOT NULL,
+			next_retry_at DATETIME,
+			UNIQUE(instance, post_id, media_url)
+		)`,
+		`INSERT INTO download_failures_new (
+			id, post_id, instance, ap_id, media_url, post_title, community_name, attempts,
+			last_error, status, first_failed_at, last_attempt_at, next_retry_at
+		)
+		SELECT id, post_id, instance, ap_id, media_url, post_title, community_name, attempts,
+			last_error, status, first_failed_at, last_attempt_at, next_retry_at
+		FROM download_failures`,
+		`DROP TABLE download_failures`,
+		`ALTER TABLE download_failures_new RENAME TO download_failures`,
+		`CREATE INDEX IF NOT EXISTS idx_download_failures_next_retry ON download_failures(status, next_retry_at)`,
+	})
+}
+
+// AdoptLegacyPosts records the given instance on archived posts, and on the
+// queued posts, media appearances and download failures, whose instance is
+// unknown because they were recorded before it was stored. They can only have
+// come from the instance configured at the time, so this is called with the
+// configured instance on startup. Returns the number of posts updated.
+func (db *DB) AdoptLegacyPosts(instance string) (int64, error) {
+	if instance == "" {
+		return 0, nil
+	}
+	for _, table := range []string{"score_queue", "media_posts", "download_failures"} {
+		query := fmt.Sprintf(`UPDATE OR IGNORE %s SET instance = ? WHERE instance = ''`, table)
+		if _, err := db.Exec(query, instance); err != nil {
+			return 0, fmt.Errorf("failed to adopt legacy rows of %s: %w", table, err)
+		}
+	}
+	result, err := db.Exec(`UPDATE OR IGNORE scraped_posts SET instance = ? WHERE instance = ''`, instance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to adopt legacy posts: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// ensureColumn adds a column to a table if it does not exist yet
+func (db *DB) ensureColumn(table, column, definition string) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`
+	if err := db.Get(&exists, query, table, column); err != nil {
+		return fmt.Errorf("failed to inspect %s.%s: %w", table, column, err)
+	}
+	if exists {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	log.Debugf("Added column %s.%s", table, column)
+	return nil
+}
+
 // MediaExists checks if media with the given hash already exists
 func (db *DB) MediaExists(hash string) (bool, error) {
 	var exists bool
@@ -194,33 +601,140 @@ func (db *DB) MediaExists(hash string) (bool, error) {
 	return exists, nil
 }
 
-// PostExists checks if a post has already been scraped
-func (db *DB) PostExists(postID int64) (bool, error) {
+// MediaURLExists checks if media has already been downloaded from the given URL
+func (db *DB) MediaURLExists(mediaURL string) (bool, error) {
 	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM scraped_posts WHERE post_id = ?)`
-	err := db.Get(&exists, query, postID)
+	query := `SELECT EXISTS(SELECT 1 FROM scraped_media WHERE media_url = ?)`
+	err := db.Get(&exists, query, mediaURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to check media existence: %w", err)
+	}
+	return exists, nil
+}
+
+// PostExists checks if a post has already been scraped from an instance
+func (db *DB) PostExists(instance string, postID int64) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM scraped_posts WHERE instance = ? AND post_id = ?)`
+	err := db.Get(&exists, query, instance, postID)
 	if err != nil {
 		return false, fmt.Errorf("failed to check post existence: %w", err)
 	}
 	return exists, nil
 }
 
-// MarkPostAsScraped records that we've processed a post (with or without media)
-func (db *DB) MarkPostAsScraped(postView *models.PostView, mediaCount int) error {
+// ArchivedPost identifies the record a post is archived under: the instance
+// it was first scraped from and its local id there
+type ArchivedPost struct {
+	Instance string `db:"instance"`
+	PostID   int64  `db:"post_id"`
+}
+
+// FindPost looks up a post seen on an instance that has already been
+// scraped. Posts are matched by their ActivityPub id, so a federated post
+// archived from another instance is found under the record it was first
+// archived with. Posts recorded before ActivityPub ids were stored, or seen
+// without one, are matched by their local id on the same instance only;
+// SetPostApID records their ActivityPub id. Returns nil if the post is not
+// archived.
+func (db *DB) FindPost(instance string, postID int64, apID string) (*ArchivedPost, error) {
+	var archived ArchivedPost
+	if apID != "" {
+		err := db.Get(&archived, `SELECT instance, post_id FROM scraped_posts WHERE ap_id = ?`, apID)
+		if err == nil {
+			return &archived, nil
+		}
+		if err.Error() != "sql: no rows in result set" {
+			return nil, fmt.Errorf("failed to find post: %w", err)
+		}
+	}
+
+	query := `
+		SELECT instance, post_id FROM scraped_posts
+		WHERE instance = ? AND post_id = ? AND (ap_id IS NULL OR ? = '')
+	`
+	if err := db.Get(&archived, query, instance, postID, apID); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find post: %w", err)
+	}
+	return &archived, nil
+}
+
+// SetPostApID records the ActivityPub id of a post archived without one
+func (db *DB) SetPostApID(instance string, postID int64, apID string) error {
+	query := `UPDATE scraped_posts SET ap_id = ? WHERE instance = ? AND post_id = ? AND ap_id IS NULL`
+	if _, err := db.Exec(query, apID, instance, postID); err != nil {
+		return fmt.Errorf("failed to update post ap_id: %w", err)
+	}
+	return nil
+}
+
+// SavePostAlias records the local id a federated post has on an instance
+func (db *DB) SavePostAlias(instance string, postID int64, apID string) error {
+	query := `
+		INSERT INTO post_aliases (instance, post_id, ap_id, first_seen)
+		VALUES (?, ?, ?, datetime('now'))
+		ON CONFLICT(instance, post_id) DO UPDATE SET ap_id = excluded.ap_id
+	`
+	if _, err := db.Exec(query, instance, postID, apID); err != nil {
+		return fmt.Errorf("failed to save post alias: %w", err)
+	}
+	return nil
+}
+
+// PostAlias is a local id of a federated post on one instance
+type PostAlias struct {
+	Instance  string    `db:"instance" json:"instance"`
+	PostID    int64     `db:"post_id" json:"post_id"`
+	FirstSeen time.Time `db:"first_seen" json:"first_seen"`
+}
+
+// GetPostAliases returns the local ids recorded for a federated post
+func (db *DB) GetPostAliases(apID string) ([]PostAlias, error) {
+	var aliases []PostAlias
+	query := `SELECT instance, post_id, first_seen FROM post_aliases WHERE ap_id = ? ORDER BY first_seen, instance`
+	if err := db.Select(&aliases, query, apID); err != nil {
+		return nil, fmt.Errorf("failed to get post aliases: %w", err)
+	}
+	return aliases, nil
+}
+
+// MarkPostAsScraped records that we've processed a post seen on an instance
+// (with or without media). A post with an ActivityPub id that is already
+// archived from another instance or under another local id updates that
+// record instead of adding a second one.
+func (db *DB) MarkPostAsScraped(instance string, postView *models.PostView, mediaCount int) error {
+	postID := postView.Post.ID
+	var apID interface{}
+	if postView.Post.ApID != "" {
+		apID = postView.Post.ApID
+		archived, err := db.FindPost(instance, postID, postView.Post.ApID)
+		if err != nil {
+			return err
+		}
+		if archived != nil {
+			instance = archived.Instance
+			postID = archived.PostID
+		}
+	}
+
 	query := `
 		INSERT OR REPLACE INTO scraped_posts (
-			post_id, post_title, community_name, community_id,
+			instance, post_id, post_title, community_name, community_id,
 			author_name, author_id, post_created, scraped_at,
-			had_media, media_count
+			had_media, media_count, featured, ap_id, comment_count
 		) VALUES (
-			:post_id, :post_title, :community_name, :community_id,
+			:instance, :post_id, :post_title, :community_name, :community_id,
 			:author_name, :author_id, :post_created, datetime('now'),
-			:had_media, :media_count
+			:had_media, :media_count, :featured, :ap_id, :comment_count
 		)
 	`
 
 	params := map[string]interface{}{
-		"post_id":        postView.Post.ID,
+		"instance":       instance,
+		"post_id":        postID,
 		"post_title":     postView.Post.Name,
 		"community_name": postView.Community.Name,
 		"community_id":   postView.Community.ID,
@@ -229,6 +743,9 @@ func (db *DB) MarkPostAsScraped(postView *models.PostView, mediaCount int) error
 		"post_created":   postView.Post.Published,
 		"had_media":      mediaCount > 0,
 		"media_count":    mediaCount,
+		"featured":       postView.Post.FeaturedCommunity || postView.Post.FeaturedLocal,
+		"ap_id":          apID,
+		"comment_count":  postView.Counts.Comments,
 	}
 
 	_, err := db.NamedExec(query, params)
@@ -239,18 +756,32 @@ func (db *DB) MarkPostAsScraped(postView *models.PostView, mediaCount int) error
 	return nil
 }
 
-// SaveMedia saves a scraped media record to the database
-func (db *DB) SaveMedia(media *models.ScrapedMedia) error {
+// AddPostMedia counts media downloaded for an archived post after it was
+// marked as scraped, such as a retried download
+func (db *DB) AddPostMedia(instance string, postID int64, count int) error {
+	query := `
+		UPDATE scraped_posts SET media_count = media_count + ?, had_media = 1
+		WHERE instance = ? AND post_id = ?
+	`
+	if _, err := db.Exec(query, count, instance, postID); err != nil {
+		return fmt.Errorf("failed to add post media: %w", err)
+	}
+	return nil
+}
+
+// SaveMedia saves a scraped media record to the database and links it to
+// its post, seen on the given instance
+func (db *DB) SaveMedia(instance string, media *models.ScrapedMedia) error {
 	query := `
 		INSERT INTO scraped_media (
-			post_id, post_title, community_name, community_id,
-			author_name, author_id, media_url, media_hash,
-			file_name, file_path, file_size, media_type,
+			post_id, post_title, community_name, community_id, instance,
+			author_name, author_id, media_url, media_hash, sanitized_hash,
+			file_name, file_path, link_path, file_size, media_type,
 			post_url, post_score, post_created, downloaded_at
 		) VALUES (
-			:post_id, :post_title, :community_name, :community_id,
-			:author_name, :author_id, :media_url, :media_hash,
-			:file_name, :file_path, :file_size, :media_type,
+			:post_id, :post_title, :community_name, :community_id, :instance,
+			:author_name, :author_id, :media_url, :media_hash, :sanitized_hash,
+			:file_name, :file_path, :link_path, :file_size, :media_type,
 			:post_url, :post_score, :post_created, :downloaded_at
 		)
 	`
@@ -266,9 +797,73 @@ func (db *DB) SaveMedia(media *models.ScrapedMedia) error {
 	}
 
 	media.ID = id
+
+	linkQuery := `
+		INSERT OR IGNORE INTO media_posts (
+			media_id, instance, post_id, post_title, community_name, community_id,
+			author_name, post_created, detected_by, linked_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	if _, err := db.Exec(linkQuery, media.ID, instance, media.PostID, media.PostTitle, media.CommunityName,
+		media.CommunityID, media.AuthorName, media.PostCreated, LinkOriginal, media.DownloadedAt); err != nil {
+		return fmt.Errorf("failed to link media to post: %w", err)
+	}
 	return nil
 }
 
+// How a post was found to contain a media item
+const (
+	LinkOriginal  = "original"   // The post the media was downloaded from
+	LinkHash      = "hash"       // Another post whose download had the same content
+	LinkURL       = "url"        // Another post linking to an already downloaded URL
+	LinkCrossPost = "cross_post" // A crosspost reported by the instance
+	LinkPHash     = "phash"      // Another post whose download looked the same, or a merged near-duplicate
+)
+
+// MediaPost is a post a media item appeared in
+type MediaPost struct {
+	Instance      string    `db:"instance" json:"instance"` // Instance the post was seen on
+	PostID        int64     `db:"post_id" json:"post_id"`
+	PostTitle     string    `db:"post_title" json:"post_title"`
+	CommunityName string    `db:"community_name" json:"community_name"`
+	CommunityID   int64     `db:"community_id" json:"community_id"`
+	AuthorName    string    `db:"author_name" json:"author_name"`
+	PostCreated   time.Time `db:"post_created" json:"post_created"`
+	DetectedBy    string    `db:"detected_by" json:"detected_by"`
+	LinkedAt      time.Time `db:"linked_at" json:"linked_at"`
+}
+
+// LinkMediaPost records that a media item appeared in a post seen on an
+// instance. Links that already exist are kept as they are.
+func (db *DB) LinkMediaPost(mediaID int64, instance string, postView *models.PostView, detectedBy string) error {
+	query := `
+		INSERT OR IGNORE INTO media_posts (
+			media_id, instance, post_id, post_title, community_name, community_id,
+			author_name, post_created, detected_by, linked_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))
+	`
+	if _, err := db.Exec(query, mediaID, instance, postView.Post.ID, postView.Post.Name, postView.Community.Name,
+		postView.Community.ID, postView.Creator.Name, postView.Post.Published, detectedBy); err != nil {
+		return fmt.Errorf("failed to link media to post: %w", err)
+	}
+	return nil
+}
+
+// GetMediaPosts returns the posts a media item appeared in, oldest first
+func (db *DB) GetMediaPosts(mediaID int64) ([]MediaPost, error) {
+	posts := []MediaPost{}
+	query := `
+		SELECT instance, post_id, post_title, community_name, community_id, author_name,
+			post_created, detected_by, linked_at
+		FROM media_posts WHERE media_id = ?
+		ORDER BY post_created, post_id
+	`
+	if err := db.Select(&posts, query, mediaID); err != nil {
+		return nil, fmt.Errorf("failed to get media posts: %w", err)
+	}
+	return posts, nil
+}
+
 // GetMediaByHash retrieves a media record by its hash
 func (db *DB) GetMediaByHash(hash string) (*models.ScrapedMedia, error) {
 	media := &models.ScrapedMedia{}
@@ -286,6 +881,22 @@ func (db *DB) GetMediaByHash(hash string) (*models.ScrapedMedia, error) {
 	return media, nil
 }
 
+// GetMediaByURL retrieves the media downloaded from a URL, or nil if there is none
+func (db *DB) GetMediaByURL(mediaURL string) (*models.ScrapedMedia, error) {
+	media := &models.ScrapedMedia{}
+	query := `SELECT * FROM scraped_media WHERE media_url = ? ORDER BY id LIMIT 1`
+
+	err := db.Get(media, query, mediaURL)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get media by URL: %w", err)
+	}
+
+	return media, nil
+}
+
 // GetMediaByID retrieves a media record by its ID
 func (db *DB) GetMediaByID(id int64) (*models.ScrapedMedia, error) {
 	media := &models.ScrapedMedia{}
@@ -493,6 +1104,45 @@ func (db *DB) GetPostIDByMediaID(mediaID int64) (int64, error) {
 	return postID, nil
 }
 
+// PostDetails holds details of an archived post that are not kept with its media
+type PostDetails struct {
+	ApID         string `db:"ap_id"`
+	CommentCount int    `db:"comment_count"`
+}
+
+// GetPostDetails returns the details of the archived post a media item was
+// downloaded from, or empty details when the post is not archived. Local post
+// ids are only unique per instance, so if posts from several instances share
+// the media's post id, the one with the media's title is used.
+func (db *DB) GetPostDetails(media *models.ScrapedMedia) (*PostDetails, error) {
+	var details PostDetails
+	query := `
+		SELECT COALESCE(ap_id, '') AS ap_id, comment_count FROM scraped_posts
+		WHERE post_id = ?
+		ORDER BY post_title = ? DESC, scraped_at DESC
+		LIMIT 1
+	`
+	if err := db.Get(&details, query, media.PostID, media.PostTitle); err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, fmt.Errorf("failed to get post details: %w", err)
+	}
+	return &details, nil
+}
+
+// GetMediaTags returns the names of the tags assigned to a media item
+func (db *DB) GetMediaTags(mediaID int64) ([]string, error) {
+	tags := []string{}
+	query := `
+		SELECT t.name FROM media_tags t
+		JOIN media_tag_assignments a ON a.tag_id = t.id
+		WHERE a.media_id = ?
+		ORDER BY t.name
+	`
+	if err := db.Select(&tags, query, mediaID); err != nil {
+		return nil, fmt.Errorf("failed to get media tags: %w", err)
+	}
+	return tags, nil
+}
+
 // MediaFilter represents filter options for querying media
 type MediaFilter struct {
 	Community string
@@ -762,6 +1412,81 @@ func (db *DB) GetMediaWithoutThumbnails() ([]models.ScrapedMedia, error) {
 	return media, nil
 }
 
+// GetAllMedia returns every media record, oldest first
+func (db *DB) GetAllMedia() ([]models.ScrapedMedia, error) {
+	var media []models.ScrapedMedia
+	if err := db.Select(&media, `SELECT * FROM scraped_media ORDER BY id ASC`); err != nil {
+		return nil, fmt.Errorf("failed to query media: %w", err)
+	}
+	return media, nil
+}
+
+// SharedFile is a file path recorded for more than one media item
+type SharedFile struct {
+	FilePath string
+	Media    []models.ScrapedMedia
+}
+
+// GetSharedFiles returns the file paths that several media records point at.
+// Only one of the records can match the file's content.
+func (db *DB) GetSharedFiles() ([]SharedFile, error) {
+	query := `
+		SELECT * FROM scraped_media
+		WHERE file_path IN (
+			SELECT file_path FROM scraped_media GROUP BY file_path HAVING COUNT(*) > 1
+		)
+		ORDER BY file_path, id
+	`
+	var media []models.ScrapedMedia
+	if err := db.Select(&media, query); err != nil {
+		return nil, fmt.Errorf("failed to query shared files: %w", err)
+	}
+
+	var shared []SharedFile
+	for _, m := range media {
+		if len(shared) == 0 || shared[len(shared)-1].FilePath != m.FilePath {
+			shared = append(shared, SharedFile{FilePath: m.FilePath})
+		}
+		last := &shared[len(shared)-1]
+		last.Media = append(last.Media, m)
+	}
+	return shared, nil
+}
+
+// MediaPathUpdate is a new location for a media file
+type MediaPathUpdate struct {
+	MediaID  int64
+	FileName string
+	FilePath string
+	LinkPath string
+}
+
+// UpdateMediaPaths records new file locations in a single transaction, so
+// either every record is updated or none is
+func (db *DB) UpdateMediaPaths(updates []MediaPathUpdate) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, u := range updates {
+		result, err := tx.Exec(`UPDATE scraped_media SET file_name = ?, file_path = ?, link_path = ? WHERE id = ?`,
+			u.FileName, u.FilePath, u.LinkPath, u.MediaID)
+		if err != nil {
+			return fmt.Errorf("failed to update path of media %d: %w", u.MediaID, err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("failed to update path of media %d: media not found", u.MediaID)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit path updates: %w", err)
+	}
+	return nil
+}
+
 // Scraper run tracking methods
 
 // StartScraperRun creates a new scraper run record
@@ -784,6 +1509,20 @@ func (db *DB) UpdateScraperRun(runID int64, postsProcessed int, mediaDownloaded
 	return nil
 }
 
+// UpdateScraperRunFilters records how many posts were rejected by filters and why
+func (db *DB) UpdateScraperRunFilters(runID int64, postsFiltered int, skipReasons map[string]int) error {
+	reasons, err := json.Marshal(skipReasons)
+	if err != nil {
+		return fmt.Errorf("failed to marshal skip reasons: %w", err)
+	}
+
+	query := `UPDATE scraper_runs SET posts_filtered = ?, skip_reasons = ? WHERE id = ?`
+	if _, err := db.Exec(query, postsFiltered, string(reasons), runID); err != nil {
+		return fmt.Errorf("failed to update scraper run filters: %w", err)
+	}
+	return nil
+}
+
 // CompleteScraperRun marks a scraper run as completed
 func (db *DB) CompleteScraperRun(runID int64, status string) error {
 	query := `UPDATE scraper_runs SET status = ?, completed_at = datetime('now') WHERE id = ?`
@@ -944,3 +1683,666 @@ func (db *DB) GetStorageBreakdown() (map[string]interface{}, error) {
 
 	return result, nil
 }
+
+// Checkpoint records the newest post processed for a source (community or feed)
+type Checkpoint struct {
+	Source        string    `db:"source" json:"source"`
+	LastPublished time.Time `db:"last_published" json:"last_published"`
+	LastPostID    int64     `db:"last_post_id" json:"last_post_id"`
+	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// IsBefore reports whether a post published at the given time with the given ID
+// is at or before the checkpoint in New-sort order
+func (c *Checkpoint) IsBefore(published time.Time, postID int64) bool {
+	if published.Equal(c.LastPublished) {
+		return postID <= c.LastPostID
+	}
+	return published.Before(c.LastPublished)
+}
+
+// GetCheckpoint retrieves the checkpoint for a source, or nil if there is none
+func (db *DB) GetCheckpoint(source string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{}
+	query := `SELECT source, last_published, last_post_id, updated_at FROM source_checkpoints WHERE source = ?`
+	if err := db.Get(checkpoint, query, source); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// SaveCheckpoint creates or replaces the checkpoint for a source
+func (db *DB) SaveCheckpoint(source string, lastPublished time.Time, lastPostID int64) error {
+	query := `INSERT OR REPLACE INTO source_checkpoints (source, last_published, last_post_id, updated_at)
+	          VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(query, source, lastPublished.UTC(), lastPostID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// DeleteCheckpoint removes the checkpoint for a source. Returns false if none existed.
+func (db *DB) DeleteCheckpoint(source string) (bool, error) {
+	result, err := db.Exec(`DELETE FROM source_checkpoints WHERE source = ?`, source)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	return rows > 0, nil
+}
+
+// ListCheckpoints returns all source checkpoints ordered by source
+func (db *DB) ListCheckpoints() ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	query := `SELECT source, last_published, last_post_id, updated_at FROM source_checkpoints ORDER BY source ASC`
+	if err := db.Select(&checkpoints, query); err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	return checkpoints, nil
+}
+
+// BackfillJob records how far a historical backfill of a source has progressed
+type BackfillJob struct {
+	Source          string     `db:"source" json:"source"`
+	SortType        string     `db:"sort_type" json:"sort_type"`
+	Since           time.Time  `db:"since" json:"since"`
+	NextPage        int        `db:"next_page" json:"next_page"`
+	PostsProcessed  int        `db:"posts_processed" json:"posts_processed"`
+	MediaDownloaded int        `db:"media_downloaded" json:"media_downloaded"`
+	StartedAt       time.Time  `db:"started_at" json:"started_at"`
+	UpdatedAt       time.Time  `db:"updated_at" json:"updated_at"`
+	CompletedAt     *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+}
+
+// GetBackfillJob retrieves the backfill job for a source, sort and date bound, or nil if there is none
+func (db *DB) GetBackfillJob(source, sortType string, since time.Time) (*BackfillJob, error) {
+	job := &BackfillJob{}
+	query := `SELECT source, sort_type, since, next_page, posts_processed, media_downloaded,
+	                 started_at, updated_at, completed_at
+	          FROM backfill_jobs WHERE source = ? AND sort_type = ? AND since = ?`
+	if err := db.Get(job, query, source, sortType, since.UTC()); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get backfill job: %w", err)
+	}
+	return job, nil
+}
+
+// SaveBackfillJob creates or replaces a backfill job
+func (db *DB) SaveBackfillJob(job *BackfillJob) error {
+	job.UpdatedAt = time.Now().UTC()
+
+	var completedAt interface{}
+	if job.CompletedAt != nil {
+		completedAt = job.CompletedAt.UTC()
+	}
+
+	query := `INSERT OR REPLACE INTO backfill_jobs
+	          (source, sort_type, since, next_page, posts_processed, media_downloaded, started_at, updated_at, completed_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, job.Source, job.SortType, job.Since.UTC(), job.NextPage, job.PostsProcessed,
+		job.MediaDownloaded, job.StartedAt.UTC(), job.UpdatedAt, completedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save backfill job: %w", err)
+	}
+	return nil
+}
+
+// ScoreQueueEntry is a post deferred until its score has had time to mature
+type ScoreQueueEntry struct {
+	Instance      string    `db:"instance" json:"instance"` // Instance the post was queued from
+	PostID        int64     `db:"post_id" json:"post_id"`   // Local ID on the instance
+	ApID          string    `db:"ap_id" json:"ap_id"`       // ActivityPub id of the post
+	Source        string    `db:"source" json:"source"`
+	PostTitle     string    `db:"post_title" json:"post_title"`
+	CommunityName string    `db:"community_name" json:"community_name"`
+	PostCreated   time.Time `db:"post_created" json:"post_created"`
+	CheckAfter    time.Time `db:"check_after" json:"check_after"`
+	ExpiresAt     time.Time `db:"expires_at" json:"expires_at"`
+	Checks        int       `db:"checks" json:"checks"`
+	LastScore     int       `db:"last_score" json:"last_score"`
+	EnqueuedAt    time.Time `db:"enqueued_at" json:"enqueued_at"`
+}
+
+// EnqueueScoreCheck adds a post to the score queue. Posts that are already
+// queued keep their original schedule. Returns true if the post was added.
+func (db *DB) EnqueueScoreCheck(entry *ScoreQueueEntry) (bool, error) {
+	query := `INSERT OR IGNORE INTO score_queue
+	          (instance, post_id, ap_id, source, post_title, community_name, post_created, check_after, expires_at, last_score, enqueued_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, entry.Instance, entry.PostID, entry.ApID, entry.Source, entry.PostTitle, entry.CommunityName,
+		entry.PostCreated.UTC(), entry.CheckAfter.UTC(), entry.ExpiresAt.UTC(), entry.LastScore, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to enqueue score check: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	return rows > 0, nil
+}
+
+// GetDueScoreChecks returns queued posts whose next check is due at the given time
+func (db *DB) GetDueScoreChecks(now time.Time) ([]ScoreQueueEntry, error) {
+	var entries []ScoreQueueEntry
+	query := `SELECT instance, post_id, ap_id, source, post_title, community_name, post_created, check_after,
+	                 expires_at, checks, last_score, enqueued_at
+	          FROM score_queue WHERE check_after <= ? ORDER BY check_after ASC`
+	if err := db.Select(&entries, query, now.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to get due score checks: %w", err)
+	}
+	return entries, nil
+}
+
+// RescheduleScoreCheck records a failed re-check and schedules the next one
+func (db *DB) RescheduleScoreCheck(instance string, postID int64, score int, nextCheck time.Time) error {
+	query := `UPDATE score_queue SET checks = checks + 1, last_score = ?, check_after = ? WHERE instance = ? AND post_id = ?`
+	if _, err := db.Exec(query, score, nextCheck.UTC(), instance, postID); err != nil {
+		return fmt.Errorf("failed to reschedule score check: %w", err)
+	}
+	return nil
+}
+
+// RemoveScoreCheck removes a post queued from an instance from the score queue
+func (db *DB) RemoveScoreCheck(instance string, postID int64) error {
+	if _, err := db.Exec(`DELETE FROM score_queue WHERE instance = ? AND post_id = ?`, instance, postID); err != nil {
+		return fmt.Errorf("failed to remove score check: %w", err)
+	}
+	return nil
+}
+
+// Perceptual hash methods
+
+// PerceptualHash is the perceptual hash of a media item
+type PerceptualHash struct {
+	MediaID int64
+	Hash    uint64
+}
+
+// SavePerceptualHash records the perceptual hash of a media item, or that it
+// could not be computed when hash is nil
+func (db *DB) SavePerceptualHash(mediaID int64, hash *uint64) error {
+	var value interface{}
+	if hash != nil {
+		// SQLite integers are signed; the bits are stored as they are
+		value = int64(*hash)
+	}
+	query := `INSERT OR REPLACE INTO media_phashes (media_id, phash, computed_at) VALUES (?, ?, datetime('now'))`
+	if _, err := db.Exec(query, mediaID, value); err != nil {
+		return fmt.Errorf("failed to save perceptual hash: %w", err)
+	}
+	return nil
+}
+
+// GetPerceptualHashes returns every computed perceptual hash
+func (db *DB) GetPerceptualHashes() ([]PerceptualHash, error) {
+	var rows []struct {
+		MediaID int64 `db:"media_id"`
+		Hash    int64 `db:"phash"`
+	}
+	query := `SELECT media_id, phash FROM media_phashes WHERE phash IS NOT NULL`
+	if err := db.Select(&rows, query); err != nil {
+		return nil, fmt.Errorf("failed to get perceptual hashes: %w", err)
+	}
+
+	hashes := make([]PerceptualHash, len(rows))
+	for i, r := range rows {
+		hashes[i] = PerceptualHash{MediaID: r.MediaID, Hash: uint64(r.Hash)}
+	}
+	return hashes, nil
+}
+
+// GetMediaWithoutPerceptualHash returns images and videos whose perceptual
+// hash has not been computed yet, oldest first
+func (db *DB) GetMediaWithoutPerceptualHash() ([]models.ScrapedMedia, error) {
+	query := `
+		SELECT sm.* FROM scraped_media sm
+		LEFT JOIN media_phashes mp ON sm.id = mp.media_id
+		WHERE mp.media_id IS NULL
+		  AND sm.media_type IN ('image', 'video')
+		ORDER BY sm.id ASC
+	`
+	var media []models.ScrapedMedia
+	if err := db.Select(&media, query); err != nil {
+		return nil, fmt.Errorf("failed to query media without perceptual hash: %w", err)
+	}
+	return media, nil
+}
+
+// DuplicatePair is two media items whose perceptual hashes are close
+type DuplicatePair struct {
+	MediaID     int64     `db:"media_id" json:"media_id"`
+	DuplicateID int64     `db:"duplicate_id" json:"duplicate_id"`
+	Distance    int       `db:"distance" json:"distance"`
+	DetectedAt  time.Time `db:"detected_at" json:"detected_at"`
+}
+
+// SaveDuplicate records two media items as near-duplicates
+func (db *DB) SaveDuplicate(mediaID, duplicateID int64, distance int) error {
+	if mediaID > duplicateID {
+		mediaID, duplicateID = duplicateID, mediaID
+	}
+	query := `INSERT OR IGNORE INTO media_duplicates (media_id, duplicate_id, distance, detected_at)
+	          VALUES (?, ?, ?, datetime('now'))`
+	if _, err := db.Exec(query, mediaID, duplicateID, distance); err != nil {
+		return fmt.Errorf("failed to save duplicate: %w", err)
+	}
+	return nil
+}
+
+// DuplicateGroup is a set of media connected by near-duplicate pairs
+type DuplicateGroup struct {
+	Media []models.ScrapedMedia
+	Pairs []DuplicatePair
+}
+
+// GetDuplicateGroups returns the groups of near-duplicate media, most
+// recently downloaded first. Media in a group are ordered by id.
+func (db *DB) GetDuplicateGroups() ([]DuplicateGroup, error) {
+	var pairs []DuplicatePair
+	if err := db.Select(&pairs, `SELECT * FROM media_duplicates ORDER BY media_id, duplicate_id`); err != nil {
+		return nil, fmt.Errorf("failed to get duplicates: %w", err)
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	// Union-find over the pairs
+	parent := make(map[int64]int64)
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+		parent[id] = id
+		return id
+	}
+	for _, p := range pairs {
+		a, b := find(p.MediaID), find(p.DuplicateID)
+		if a != b {
+			parent[b] = a
+		}
+	}
+
+	ids := make([]int64, 0, len(parent))
+	for id := range parent {
+		ids = append(ids, id)
+	}
+	query, args, err := sqlx.In(`SELECT * FROM scraped_media WHERE id IN (?) ORDER BY id`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build duplicate query: %w", err)
+	}
+	var media []models.ScrapedMedia
+	if err := db.Select(&media, db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("failed to get duplicate media: %w", err)
+	}
+
+	groups := make(map[int64]*DuplicateGroup)
+	for _, m := range media {
+		root := find(m.ID)
+		if groups[root] == nil {
+			groups[root] = &DuplicateGroup{}
+		}
+		groups[root].Media = append(groups[root].Media, m)
+	}
+	for _, p := range pairs {
+		if g := groups[find(p.MediaID)]; g != nil {
+			g.Pairs = append(g.Pairs, p)
+		}
+	}
+
+	result := make([]DuplicateGroup, 0, len(groups))
+	for _, g := range groups {
+		if len(g.Media) > 1 {
+			result = append(result, *g)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Media[len(result[i].Media)-1].ID > result[j].Media[len(result[j].Media)-1].ID
+	})
+	return result, nil
+}
+
+// ErrMediaNotFound is returned by MergeMedia for unknown media IDs
+var ErrMediaNotFound = errors.New("media not found")
+
+// MergedMedia is a media record removed by MergeMedia
+type MergedMedia struct {
+	Media           models.ScrapedMedia
+	ThumbnailPath   string
+	DerivativePaths []string
+	FileShared      bool // Another record still points at the file, which must be kept
+}
+
+// MergeMedia merges near-duplicates into the media item to keep: their posts
+// are linked to it and their records are removed, in a single transaction.
+// The caller removes the files of the returned records.
+func (db *DB) MergeMedia(keepID int64, mergeIDs []int64) ([]MergedMedia, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM scraped_media WHERE id = ?)`, keepID); err != nil {
+		return nil, fmt.Errorf("failed to check media %d: %w", keepID, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("media %d: %w", keepID, ErrMediaNotFound)
+	}
+
+	var merged []MergedMedia
+	for _, id := range mergeIDs {
+		if id == keepID {
+			return nil, fmt.Errorf("media %d cannot be merged into itself", id)
+		}
+		var m models.ScrapedMedia
+		if err := tx.Get(&m, `SELECT * FROM scraped_media WHERE id = ?`, id); err != nil {
+			if err.Error() == "sql: no rows in result set" {
+				return nil, fmt.Errorf("media %d: %w", id, ErrMediaNotFound)
+			}
+			return nil, fmt.Errorf("failed to get media %d: %w", id, err)
+		}
+
+		linkQuery := `
+			INSERT OR IGNORE INTO media_posts (
+				media_id, instance, post_id, post_title, community_name, community_id,
+				author_name, post_created, detected_by, linked_at
+			)
+			SELECT ?, instance, post_id, post_title, community_name, community_id,
+				author_name, post_created, ?, linked_at
+			FROM media_posts WHERE media_id = ?
+		`
+		if _, err := tx.Exec(linkQuery, keepID, LinkPHash, id); err != nil {
+			return nil, fmt.Errorf("failed to link posts of media %d: %w", id, err)
+		}
+
+		var thumbnail string
+		if err := tx.Get(&thumbnail, `SELECT thumbnail_path FROM media_thumbnails WHERE media_id = ?`, id); err != nil && err.Error() != "sql: no rows in result set" {
+			return nil, fmt.Errorf("failed to get thumbnail of media %d: %w", id, err)
+		}
+		var derivatives []string
+		if err := tx.Select(&derivatives, `SELECT file_path FROM media_derivatives WHERE media_id = ? AND file_path != ''`, id); err != nil {
+			return nil, fmt.Errorf("failed to get derivatives of media %d: %w", id, err)
+		}
+
+		// Foreign keys are not enforced, so dependent rows are removed here
+		for _, query := range []string{
+			`DELETE FROM media_posts WHERE media_id = ?`,
+			`DELETE FROM media_phashes WHERE media_id = ?`,
+			`DELETE FROM media_duplicates WHERE media_id = ?1 OR duplicate_id = ?1`,
+			`DELETE FROM media_thumbnails WHERE media_id = ?`,
+			`DELETE FROM media_derivatives WHERE media_id = ?`,
+			`DELETE FROM scraped_media WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return nil, fmt.Errorf("failed to remove media %d: %w", id, err)
+			}
+		}
+
+		var shared bool
+		if err := tx.Get(&shared, `SELECT EXISTS(SELECT 1 FROM scraped_media WHERE file_path = ?)`, m.FilePath); err != nil {
+			return nil, fmt.Errorf("failed to check file of media %d: %w", id, err)
+		}
+		merged = append(merged, MergedMedia{Media: m, ThumbnailPath: thumbnail, DerivativePaths: derivatives, FileShared: shared})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit merge: %w", err)
+	}
+	return merged, nil
+}
+
+// Derivative methods
+
+// Derivative is a file converted from a media item, such as an MP4 of an
+// animated GIF
+type Derivative struct {
+	MediaID   int64     `db:"media_id" json:"media_id"`
+	Format    string    `db:"format" json:"format"` // Container of the file, e.g. "mp4"
+	FilePath  string    `db:"file_path" json:"-"`
+	MimeType  string    `db:"mime_type" json:"mime_type"`
+	FileSize  int64     `db:"file_size" json:"file_size"`
+	Error     string    `db:"error" json:"error,omitempty"` // Why no file was made, when FilePath is empty
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// SaveDerivative records a derivative of a media item, replacing an earlier
+// one in the same format
+func (db *DB) SaveDerivative(d *Derivative) error {
+	query := `
+		INSERT OR REPLACE INTO media_derivatives (
+			media_id, format, file_path, mime_type, file_size, error, created_at
+		) VALUES (
+			:media_id, :format, :file_path, :mime_type, :file_size, :error, :created_at
+		)
+	`
+	if _, err := db.NamedExec(query, d); err != nil {
+		return fmt.Errorf("failed to save derivative: %w", err)
+	}
+	return nil
+}
+
+// GetDerivative returns the newest derivative file of a media item, or nil
+// if it has none
+func (db *DB) GetDerivative(mediaID int64) (*Derivative, error) {
+	var d Derivative
+	query := `
+		SELECT * FROM media_derivatives
+		WHERE media_id = ? AND file_path != ''
+		ORDER BY created_at DESC, format ASC
+		LIMIT 1
+	`
+	if err := db.Get(&d, query, mediaID); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get derivative: %w", err)
+	}
+	return &d, nil
+}
+
+// GetDerivatives returns the newest derivative file of each of the given
+// media items that has one, keyed by media ID
+func (db *DB) GetDerivatives(mediaIDs []int64) (map[int64]*Derivative, error) {
+	derivatives := make(map[int64]*Derivative)
+	if len(mediaIDs) == 0 {
+		return derivatives, nil
+	}
+
+	query, args, err := sqlx.In(`
+		SELECT * FROM media_derivatives
+		WHERE media_id IN (?) AND file_path != ''
+		ORDER BY media_id, created_at DESC, format ASC
+	`, mediaIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build derivative query: %w", err)
+	}
+	var rows []Derivative
+	if err := db.Select(&rows, db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("failed to get derivatives: %w", err)
+	}
+	for i := range rows {
+		if _, ok := derivatives[rows[i].MediaID]; !ok {
+			derivatives[rows[i].MediaID] = &rows[i]
+		}
+	}
+	return derivatives, nil
+}
+
+// HasDerivative reports whether a derivative of a media item, or why none
+// was made, has been recorded
+func (db *DB) HasDerivative(mediaID int64) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM media_derivatives WHERE media_id = ?)`
+	if err := db.Get(&exists, query, mediaID); err != nil {
+		return false, fmt.Errorf("failed to check derivatives: %w", err)
+	}
+	return exists, nil
+}
+
+// GetMediaWithoutDerivatives returns the images and videos with one of the
+// given file extensions that have no derivative recorded yet, oldest first
+func (db *DB) GetMediaWithoutDerivatives(extensions []string) ([]models.ScrapedMedia, error) {
+	if len(extensions) == 0 {
+		return nil, nil
+	}
+	var conditions []string
+	var args []interface{}
+	for _, ext := range extensions {
+		conditions = append(conditions, "LOWER(sm.file_path) LIKE ?")
+		args = append(args, "%."+strings.ToLower(ext))
+	}
+	query := fmt.Sprintf(`
+		SELECT sm.* FROM scraped_media sm
+		LEFT JOIN media_derivatives md ON sm.id = md.media_id
+		WHERE md.media_id IS NULL
+		  AND sm.media_type IN ('image', 'video')
+		  AND (%s)
+		ORDER BY sm.id ASC
+	`, strings.Join(conditions, " OR "))
+
+	var media []models.ScrapedMedia
+	if err := db.Select(&media, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query media without derivatives: %w", err)
+	}
+	return media, nil
+}
+
+// Download failure methods
+
+// Download failure states
+const (
+	FailurePending   = "pending"   // Retried once next_retry_at has passed
+	FailurePermanent = "permanent" // Only retried on request
+)
+
+// DownloadFailure is a media download that failed
+type DownloadFailure struct {
+	ID            int64      `db:"id" json:"id"`
+	PostID        int64      `db:"post_id" json:"post_id"`   // Local ID on the instance
+	Instance      string     `db:"instance" json:"instance"` // Instance the post was scraped from
+	ApID          string     `db:"ap_id" json:"ap_id"`       // ActivityPub id of the post
+	MediaURL      string     `db:"media_url" json:"media_url"`
+	PostTitle     string     `db:"post_title" json:"post_title"`
+	CommunityName string     `db:"community_name" json:"community_name"`
+	Attempts      int        `db:"attempts" json:"attempts"`
+	LastError     string     `db:"last_error" json:"last_error"`
+	Status        string     `db:"status" json:"status"`
+	FirstFailedAt time.Time  `db:"first_failed_at" json:"first_failed_at"`
+	LastAttemptAt time.Time  `db:"last_attempt_at" json:"last_attempt_at"`
+	NextRetryAt   *time.Time `db:"next_retry_at" json:"next_retry_at"` // nil for permanent failures
+}
+
+// SaveDownloadFailure records a failed download, replacing the earlier
+// failure of the same media URL in the same post on the same instance, whose
+// ID and first failure time are kept. The ID is set on f.
+func (db *DB) SaveDownloadFailure(f *DownloadFailure) error {
+	var nextRetry interface{}
+	if f.NextRetryAt != nil {
+		nextRetry = f.NextRetryAt.UTC()
+	}
+	query := `
+		INSERT INTO download_failures (
+			post_id, instance, ap_id, media_url, post_title, community_name, attempts,
+			last_error, status, first_failed_at, last_attempt_at, next_retry_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(instance, post_id, media_url) DO UPDATE SET
+			ap_id = excluded.ap_id,
+			post_title = excluded.post_title,
+			community_name = excluded.community_name,
+			attempts = excluded.attempts,
+			last_error = excluded.last_error,
+			status = excluded.status,
+			last_attempt_at = excluded.last_attempt_at,
+			next_retry_at = excluded.next_retry_at
+	`
+	if _, err := db.Exec(query, f.PostID, f.Instance, f.ApID, f.MediaURL, f.PostTitle, f.CommunityName, f.Attempts, f.LastError,
+		f.Status, f.FirstFailedAt.UTC(), f.LastAttemptAt.UTC(), nextRetry); err != nil {
+		return fmt.Errorf("failed to save download failure: %w", err)
+	}
+	query = `SELECT id FROM download_failures WHERE instance = ? AND post_id = ? AND media_url = ?`
+	if err := db.Get(&f.ID, query, f.Instance, f.PostID, f.MediaURL); err != nil {
+		return fmt.Errorf("failed to get download failure id: %w", err)
+	}
+	return nil
+}
+
+// GetDownloadFailure returns a download failure by its ID, or nil if there is none
+func (db *DB) GetDownloadFailure(id int64) (*DownloadFailure, error) {
+	var f DownloadFailure
+	if err := db.Get(&f, `SELECT * FROM download_failures WHERE id = ?`, id); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get download failure: %w", err)
+	}
+	return &f, nil
+}
+
+// FindDownloadFailure returns the failure of a media URL in a post scraped
+// from an instance, or nil if there is none
+func (db *DB) FindDownloadFailure(instance string, postID int64, mediaURL string) (*DownloadFailure, error) {
+	var f DownloadFailure
+	query := `SELECT * FROM download_failures WHERE instance = ? AND post_id = ? AND media_url = ?`
+	if err := db.Get(&f, query, instance, postID, mediaURL); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get download failure: %w", err)
+	}
+	return &f, nil
+}
+
+// GetDueDownloadFailures returns the pending failures whose retry is due at
+// the given time, oldest first
+func (db *DB) GetDueDownloadFailures(now time.Time) ([]DownloadFailure, error) {
+	var failures []DownloadFailure
+	query := `SELECT * FROM download_failures WHERE status = ? AND next_retry_at <= ? ORDER BY next_retry_at ASC, id ASC`
+	if err := db.Select(&failures, query, FailurePending, now.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to get due download failures: %w", err)
+	}
+	return failures, nil
+}
+
+// ListDownloadFailures returns the download failures with the given status,
+// or all of them when status is empty, most recent attempt first
+func (db *DB) ListDownloadFailures(status string, limit, offset int) ([]DownloadFailure, int, error) {
+	where := ""
+	var args []interface{}
+	if status != "" {
+		where = "WHERE status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := db.Get(&total, `SELECT COUNT(*) FROM download_failures `+where, args...); err != nil {
+		return nil, 0, fmt.Errorf("failed to count download failures: %w", err)
+	}
+
+	failures := []DownloadFailure{}
+	query := `SELECT * FROM download_failures ` + where + ` ORDER BY last_attempt_at DESC, id DESC LIMIT ? OFFSET ?`
+	if err := db.Select(&failures, query, append(args, limit, offset)...); err != nil {
+		return nil, 0, fmt.Errorf("failed to list download failures: %w", err)
+	}
+	return failures, total, nil
+}
+
+// RemoveDownloadFailure removes the failure of a media URL in a post scraped
+// from an instance, once the media was downloaded
+func (db *DB) RemoveDownloadFailure(instance string, postID int64, mediaURL string) error {
+	query := `DELETE FROM download_failures WHERE instance = ? AND post_id = ? AND media_url = ?`
+	if _, err := db.Exec(query, instance, postID, mediaURL); err != nil {
+		return fmt.Errorf("failed to remove download failure: %w", err)
+	}
+	return nil
+}
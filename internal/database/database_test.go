@@ -2,12 +2,15 @@ package database
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	"github.com/jmoiron/sqlx"
 )
 
 func TestHashContent(t *testing.T) {
@@ -180,7 +183,7 @@ func TestMediaExists(t *testing.T) {
 		DownloadedAt:  time.Now(),
 	}
 
-	if err := db.SaveMedia(media); err != nil {
+	if err := db.SaveMedia("lemmy.example", media); err != nil {
 		t.Fatalf("SaveMedia() error = %v", err)
 	}
 
@@ -207,7 +210,7 @@ func TestPostExists(t *testing.T) {
 	postID := int64(123)
 
 	// Should not exist initially
-	exists, err := db.PostExists(postID)
+	exists, err := db.PostExists("lemmy.test", postID)
 	if err != nil {
 		t.Fatalf("PostExists() error = %v", err)
 	}
@@ -232,18 +235,359 @@ func TestPostExists(t *testing.T) {
 		},
 	}
 
-	if err := db.MarkPostAsScraped(postView, 0); err != nil {
+	if err := db.MarkPostAsScraped("lemmy.test", postView, 0); err != nil {
 		t.Fatalf("MarkPostAsScraped() error = %v", err)
 	}
 
 	// Should exist now
-	exists, err = db.PostExists(postID)
+	exists, err = db.PostExists("lemmy.test", postID)
 	if err != nil {
 		t.Fatalf("PostExists() after mark error = %v", err)
 	}
 	if !exists {
 		t.Errorf("PostExists() = false, want true after marking")
 	}
+
+	// Local ids are only unique per instance
+	if exists, _ := db.PostExists("lemmy.world", postID); exists {
+		t.Errorf("PostExists() on another instance = true, want false")
+	}
+}
+
+func TestFindPostByApID(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	post := func(id int64, apID string) *models.PostView {
+		return &models.PostView{
+			Post:      models.Post{ID: id, Name: "Federated post", Published: time.Now(), ApID: apID},
+			Community: models.Community{ID: 1, Name: "test"},
+			Creator:   models.Person{ID: 1, Name: "testuser"},
+		}
+	}
+	const apID = "https://lemmy.world/post/42"
+
+	// Archived from lemmy.world as local post 10
+	if err := db.MarkPostAsScraped("lemmy.world", post(10, apID), 1); err != nil {
+		t.Fatalf("MarkPostAsScraped() error = %v", err)
+	}
+	archivedOnWorld := &ArchivedPost{Instance: "lemmy.world", PostID: 10}
+
+	tests := []struct {
+		name     string
+		instance string
+		postID   int64
+		apID     string
+		want     *ArchivedPost
+	}{
+		{name: "same ap_id under another local id", instance: "lemmy.ml", postID: 77, apID: apID, want: archivedOnWorld},
+		{name: "same local id on another instance", instance: "lemmy.ml", postID: 10, apID: "https://lemmy.ml/post/10"},
+		{name: "same local id on another instance without ap_id", instance: "lemmy.ml", postID: 10},
+		{name: "local id without ap_id", instance: "lemmy.world", postID: 10, want: archivedOnWorld},
+		{name: "unknown post", instance: "lemmy.world", postID: 11, apID: "https://lemmy.world/post/11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archived, err := db.FindPost(tt.instance, tt.postID, tt.apID)
+			if err != nil {
+				t.Fatalf("FindPost() error = %v", err)
+			}
+			if (archived == nil) != (tt.want == nil) || (archived != nil && *archived != *tt.want) {
+				t.Errorf("FindPost() = %+v, want %+v", archived, tt.want)
+			}
+		})
+	}
+
+	// Seeing it again on another instance updates the archived record
+	if err := db.MarkPostAsScraped("lemmy.ml", post(77, apID), 2); err != nil {
+		t.Fatalf("MarkPostAsScraped() under another id error = %v", err)
+	}
+	var count int
+	if err := db.Get(&count, `SELECT COUNT(*) FROM scraped_posts`); err != nil {
+		t.Fatalf("failed to count posts: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("scraped_posts has %d rows, want 1", count)
+	}
+
+	// A different post with the same local id on another instance is archived too
+	if err := db.MarkPostAsScraped("lemmy.ml", post(10, "https://lemmy.ml/post/10"), 0); err != nil {
+		t.Fatalf("MarkPostAsScraped() with a clashing local id error = %v", err)
+	}
+	for _, instance := range []string{"lemmy.world", "lemmy.ml"} {
+		if exists, err := db.PostExists(instance, 10); err != nil || !exists {
+			t.Errorf("PostExists(%s, 10) = %v, %v; want true", instance, exists, err)
+		}
+	}
+	if archived, err := db.FindPost("lemmy.world", 10, apID); err != nil || archived == nil || *archived != *archivedOnWorld {
+		t.Errorf("FindPost() after a clashing post = %+v, %v; want %+v", archived, err, archivedOnWorld)
+	}
+
+	for _, alias := range []struct {
+		instance string
+		postID   int64
+	}{{"lemmy.world", 10}, {"lemmy.ml", 77}} {
+		if err := db.SavePostAlias(alias.instance, alias.postID, apID); err != nil {
+			t.Fatalf("SavePostAlias() error = %v", err)
+		}
+	}
+	// Saving an alias again is a no-op
+	if err := db.SavePostAlias("lemmy.ml", 77, apID); err != nil {
+		t.Fatalf("SavePostAlias() again error = %v", err)
+	}
+	aliases, err := db.GetPostAliases(apID)
+	if err != nil {
+		t.Fatalf("GetPostAliases() error = %v", err)
+	}
+	if len(aliases) != 2 {
+		t.Errorf("GetPostAliases() returned %d aliases, want 2: %+v", len(aliases), aliases)
+	}
+}
+
+func TestFindPostUpgradesLegacyPosts(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	// Posts recorded before ap_ids and instances were stored have neither
+	legacy := &models.PostView{
+		Post:      models.Post{ID: 5, Name: "Old post", Published: time.Now()},
+		Community: models.Community{ID: 1, Name: "test"},
+		Creator:   models.Person{ID: 1, Name: "testuser"},
+	}
+	if err := db.MarkPostAsScraped("", legacy, 0); err != nil {
+		t.Fatalf("MarkPostAsScraped() error = %v", err)
+	}
+	now := time.Now()
+	failure := &DownloadFailure{PostID: 5, MediaURL: "https://example.com/a.png", Attempts: 1, LastError: "timeout",
+		Status: FailurePending, FirstFailedAt: now, LastAttemptAt: now, NextRetryAt: &now}
+	if err := db.SaveDownloadFailure(failure); err != nil {
+		t.Fatalf("SaveDownloadFailure() error = %v", err)
+	}
+
+	const apID = "https://lemmy.world/post/5"
+	if archived, err := db.FindPost("lemmy.world", 5, apID); err != nil || archived != nil {
+		t.Fatalf("FindPost() before adopting legacy posts = %+v, %v; want nil", archived, err)
+	}
+	if adopted, err := db.AdoptLegacyPosts("lemmy.world"); err != nil || adopted != 1 {
+		t.Fatalf("AdoptLegacyPosts() = %d, %v; want 1", adopted, err)
+	}
+	if f, err := db.GetDownloadFailure(failure.ID); err != nil || f.Instance != "lemmy.world" {
+		t.Errorf("download failure after adopting legacy posts = %+v, %v; want instance lemmy.world", f, err)
+	}
+
+	// An unrelated post with the same local id on another instance does not claim it
+	if archived, err := db.FindPost("lemmy.ml", 5, "https://lemmy.ml/post/5"); err != nil || archived != nil {
+		t.Errorf("FindPost() on another instance = %+v, %v; want nil", archived, err)
+	}
+
+	want := ArchivedPost{Instance: "lemmy.world", PostID: 5}
+	if archived, err := db.FindPost("lemmy.world", 5, apID); err != nil || archived == nil || *archived != want {
+		t.Fatalf("FindPost() = %+v, %v; want %+v", archived, err, want)
+	}
+	// FindPost only reads; once the ap_id is recorded the post is found
+	// from other instances too
+	if archived, err := db.FindPost("lemmy.ml", 99, apID); err != nil || archived != nil {
+		t.Errorf("FindPost() by ap_id before it was recorded = %+v, %v; want nil", archived, err)
+	}
+	if err := db.SetPostApID("lemmy.world", 5, apID); err != nil {
+		t.Fatalf("SetPostApID() error = %v", err)
+	}
+	if archived, err := db.FindPost("lemmy.ml", 99, apID); err != nil || archived == nil || *archived != want {
+		t.Errorf("FindPost() by ap_id = %+v, %v; want %+v", archived, err, want)
+	}
+}
+
+func TestKeyPostsByInstance(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	// A database from before scraped_posts was keyed by instance
+	old, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE scraped_posts (
+			post_id INTEGER PRIMARY KEY, post_title TEXT NOT NULL, community_name TEXT NOT NULL,
+			community_id INTEGER NOT NULL, author_name TEXT NOT NULL, author_id INTEGER NOT NULL,
+			post_created DATETIME NOT NULL, scraped_at DATETIME NOT NULL, had_media BOOLEAN NOT NULL,
+			media_count INTEGER NOT NULL, featured BOOLEAN NOT NULL DEFAULT 0, ap_id TEXT,
+			comment_count INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE post_aliases (
+			instance TEXT NOT NULL, post_id INTEGER NOT NULL, ap_id TEXT NOT NULL,
+			first_seen DATETIME NOT NULL, PRIMARY KEY (instance, post_id)
+		)`,
+		`INSERT INTO scraped_posts VALUES (1, 'Old', 'pics', 1, 'alice', 1, datetime('now'), datetime('now'), 0, 0, 0, NULL, 0)`,
+		`INSERT INTO scraped_posts VALUES (2, 'New', 'pics', 1, 'alice', 1, datetime('now'), datetime('now'), 1, 1, 0, 'https://lemmy.ml/post/2', 3)`,
+		`INSERT INTO post_aliases VALUES ('lemmy.ml', 2, 'https://lemmy.ml/post/2', datetime('now'))`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("failed to set up old schema: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	// Posts with an alias take its instance, older ones are adopted later
+	if exists, err := db.PostExists("lemmy.ml", 2); err != nil || !exists {
+		t.Errorf("PostExists(lemmy.ml, 2) = %v, %v; want true", exists, err)
+	}
+	if exists, _ := db.PostExists("lemmy.ml", 1); exists {
+		t.Error("legacy post was given an instance before being adopted")
+	}
+	if _, err := db.AdoptLegacyPosts("lemmy.ml"); err != nil {
+		t.Fatalf("AdoptLegacyPosts() error = %v", err)
+	}
+	if exists, _ := db.PostExists("lemmy.ml", 1); !exists {
+		t.Error("legacy post was not adopted")
+	}
+	details, err := db.GetPostDetails(&models.ScrapedMedia{PostID: 2, PostTitle: "New"})
+	if err != nil || details.ApID != "https://lemmy.ml/post/2" || details.CommentCount != 3 {
+		t.Errorf("GetPostDetails() = %+v, %v", details, err)
+	}
+}
+
+func TestKeyQueueAndMediaPostsByInstance(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	// A database from before queued posts and media appearances had an instance
+	old, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE score_queue (
+			post_id INTEGER PRIMARY KEY, source TEXT NOT NULL, post_title TEXT, community_name TEXT,
+			post_created DATETIME NOT NULL, check_after DATETIME NOT NULL, expires_at DATETIME NOT NULL,
+			checks INTEGER NOT NULL DEFAULT 0, last_score INTEGER NOT NULL DEFAULT 0, enqueued_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE media_posts (
+			media_id INTEGER NOT NULL, post_id INTEGER NOT NULL, post_title TEXT NOT NULL,
+			community_name TEXT NOT NULL, community_id INTEGER NOT NULL, author_name TEXT NOT NULL,
+			post_created DATETIME NOT NULL, detected_by TEXT NOT NULL, linked_at DATETIME NOT NULL,
+			PRIMARY KEY (media_id, post_id)
+		)`,
+		`INSERT INTO score_queue VALUES (5, 'hot', 'Young', 'pics', datetime('now'), datetime('now', '-1 minute'), datetime('now', '+1 day'), 0, 2, datetime('now'))`,
+		`INSERT INTO media_posts VALUES (1, 5, 'Young', 'pics', 1, 'alice', datetime('now'), 'original', datetime('now'))`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("failed to set up old schema: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+	if _, err := db.AdoptLegacyPosts("lemmy.ml"); err != nil {
+		t.Fatalf("AdoptLegacyPosts() error = %v", err)
+	}
+
+	due, err := db.GetDueScoreChecks(time.Now())
+	if err != nil || len(due) != 1 || due[0].Instance != "lemmy.ml" || due[0].PostID != 5 {
+		t.Fatalf("GetDueScoreChecks() = %+v, %v; want post 5 adopted by lemmy.ml", due, err)
+	}
+	posts, err := db.GetMediaPosts(1)
+	if err != nil || len(posts) != 1 || posts[0].Instance != "lemmy.ml" {
+		t.Fatalf("GetMediaPosts() = %+v, %v; want the post adopted by lemmy.ml", posts, err)
+	}
+
+	// The same local id on another instance is another post
+	other := &ScoreQueueEntry{Instance: "lemmy.world", PostID: 5, Source: "hot", PostCreated: time.Now(),
+		CheckAfter: time.Now().Add(-time.Minute), ExpiresAt: time.Now().Add(time.Hour)}
+	if added, err := db.EnqueueScoreCheck(other); err != nil || !added {
+		t.Errorf("EnqueueScoreCheck() on another instance = %v, %v; want added", added, err)
+	}
+	postView := &models.PostView{Post: models.Post{ID: 5, Name: "Other"}, Community: models.Community{ID: 2, Name: "art"}}
+	if err := db.LinkMediaPost(1, "lemmy.world", postView, LinkURL); err != nil {
+		t.Fatalf("LinkMediaPost() error = %v", err)
+	}
+	if posts, _ := db.GetMediaPosts(1); len(posts) != 2 {
+		t.Errorf("GetMediaPosts() = %+v, want the posts of both instances", posts)
+	}
+	if err := db.RemoveScoreCheck("lemmy.world", 5); err != nil {
+		t.Fatalf("RemoveScoreCheck() error = %v", err)
+	}
+	if due, _ := db.GetDueScoreChecks(time.Now()); len(due) != 1 || due[0].Instance != "lemmy.ml" {
+		t.Errorf("GetDueScoreChecks() after removing the other instance's post = %+v", due)
+	}
+}
+
+func TestDownloadFailuresKeyedByInstance(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	// A database from before failures were keyed by instance
+	old, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE download_failures (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, post_id INTEGER NOT NULL, media_url TEXT NOT NULL,
+			post_title TEXT NOT NULL DEFAULT '', community_name TEXT NOT NULL DEFAULT '',
+			attempts INTEGER NOT NULL DEFAULT 1, last_error TEXT NOT NULL, status TEXT NOT NULL,
+			first_failed_at DATETIME NOT NULL, last_attempt_at DATETIME NOT NULL, next_retry_at DATETIME,
+			UNIQUE(post_id, media_url)
+		)`,
+		`INSERT INTO download_failures (post_id, media_url, last_error, status, first_failed_at, last_attempt_at)
+			VALUES (5, 'https://example.com/a.png', 'timeout', 'permanent', datetime('now'), datetime('now'))`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("failed to set up old schema: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+	if _, err := db.AdoptLegacyPosts("lemmy.ml"); err != nil {
+		t.Fatalf("AdoptLegacyPosts() error = %v", err)
+	}
+	const url = "https://example.com/a.png"
+	legacy, err := db.FindDownloadFailure("lemmy.ml", 5, url)
+	if err != nil || legacy == nil || legacy.ID != 1 {
+		t.Fatalf("FindDownloadFailure() of the migrated failure = %+v, %v", legacy, err)
+	}
+
+	// The same local id and URL on another instance is another failure
+	now := time.Now()
+	other := &DownloadFailure{Instance: "lemmy.world", PostID: 5, ApID: "https://lemmy.world/post/5", MediaURL: url,
+		Attempts: 1, LastError: "timeout", Status: FailurePending, FirstFailedAt: now, LastAttemptAt: now, NextRetryAt: &now}
+	if err := db.SaveDownloadFailure(other); err != nil {
+		t.Fatalf("SaveDownloadFailure() error = %v", err)
+	}
+	if other.ID == legacy.ID {
+		t.Errorf("failure on another instance replaced failure %d", legacy.ID)
+	}
+	if f, err := db.FindDownloadFailure("lemmy.ml", 5, url); err != nil || f == nil || f.ApID != "" || f.Status != FailurePermanent {
+		t.Errorf("FindDownloadFailure(lemmy.ml) after saving another instance's failure = %+v, %v", f, err)
+	}
+
+	if err := db.RemoveDownloadFailure("lemmy.world", 5, url); err != nil {
+		t.Fatalf("RemoveDownloadFailure() error = %v", err)
+	}
+	if f, _ := db.FindDownloadFailure("lemmy.world", 5, url); f != nil {
+		t.Errorf("removed failure still recorded: %+v", f)
+	}
+	if f, _ := db.FindDownloadFailure("lemmy.ml", 5, url); f == nil {
+		t.Error("removing another instance's failure removed this one")
+	}
 }
 
 func TestSaveAndGetMediaByHash(t *testing.T) {
@@ -277,7 +621,7 @@ func TestSaveAndGetMediaByHash(t *testing.T) {
 	}
 
 	// Save media
-	if err := db.SaveMedia(media); err != nil {
+	if err := db.SaveMedia("lemmy.example", media); err != nil {
 		t.Fatalf("SaveMedia() error = %v", err)
 	}
 
@@ -409,7 +753,7 @@ func TestGetStats(t *testing.T) {
 			PostCreated:   time.Now(),
 			DownloadedAt:  time.Now(),
 		}
-		if err := db.SaveMedia(media); err != nil {
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
 			t.Fatalf("SaveMedia() error = %v", err)
 		}
 	}
@@ -502,15 +846,466 @@ func TestSaveMediaDuplicate(t *testing.T) {
 	}
 
 	// First save should succeed
-	if err := db.SaveMedia(media); err != nil {
+	if err := db.SaveMedia("lemmy.example", media); err != nil {
 		t.Fatalf("First SaveMedia() error = %v", err)
 	}
 
 	// Second save with same hash should fail (unique constraint)
 	mediaDup := *media
 	mediaDup.PostID = 2 // Different post
-	err = db.SaveMedia(&mediaDup)
+	err = db.SaveMedia("lemmy.example", &mediaDup)
 	if err == nil {
 		t.Errorf("SaveMedia() with duplicate hash should fail, but succeeded")
 	}
 }
+
+func TestScraperRunFilters(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	runID, err := db.StartScraperRun()
+	if err != nil {
+		t.Fatalf("StartScraperRun() error = %v", err)
+	}
+
+	if err := db.UpdateScraperRunFilters(runID, 3, map[string]int{"nsfw": 2, "score": 1}); err != nil {
+		t.Fatalf("UpdateScraperRunFilters() error = %v", err)
+	}
+
+	var run struct {
+		PostsFiltered int    `db:"posts_filtered"`
+		SkipReasons   string `db:"skip_reasons"`
+	}
+	if err := db.Get(&run, `SELECT posts_filtered, skip_reasons FROM scraper_runs WHERE id = ?`, runID); err != nil {
+		t.Fatalf("failed to read run: %v", err)
+	}
+	if run.PostsFiltered != 3 {
+		t.Errorf("posts_filtered = %d, want 3", run.PostsFiltered)
+	}
+	if run.SkipReasons != `{"nsfw":2,"score":1}` {
+		t.Errorf("skip_reasons = %s, want {\"nsfw\":2,\"score\":1}", run.SkipReasons)
+	}
+}
+
+func TestMigrateSchemaIdempotent(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	db.Close()
+
+	// Reopening runs the migrations again against the existing schema
+	db, err = New(dbPath)
+	if err != nil {
+		t.Fatalf("New() on existing database error = %v", err)
+	}
+	defer db.Close()
+}
+
+func TestMediaPosts(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	media := &models.ScrapedMedia{
+		PostID:        1,
+		PostTitle:     "Original",
+		CommunityName: "pics",
+		CommunityID:   1,
+		AuthorName:    "alice",
+		AuthorID:      1,
+		MediaURL:      "https://example.com/image.jpg",
+		MediaHash:     "media_posts_hash",
+		FileName:      "image.jpg",
+		FilePath:      "/tmp/image.jpg",
+		FileSize:      1024,
+		MediaType:     "image",
+		PostURL:       "https://example.com/image.jpg",
+		PostCreated:   time.Now(),
+		DownloadedAt:  time.Now(),
+	}
+	if err := db.SaveMedia("lemmy.example", media); err != nil {
+		t.Fatalf("SaveMedia() error = %v", err)
+	}
+
+	crossPost := &models.PostView{
+		Post:      models.Post{ID: 2, Name: "Crossposted", Published: time.Now()},
+		Community: models.Community{ID: 2, Name: "art"},
+		Creator:   models.Person{ID: 2, Name: "bob"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.LinkMediaPost(media.ID, "lemmy.example", crossPost, LinkCrossPost); err != nil {
+			t.Fatalf("LinkMediaPost() error = %v", err)
+		}
+	}
+
+	posts, err := db.GetMediaPosts(media.ID)
+	if err != nil {
+		t.Fatalf("GetMediaPosts() error = %v", err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("GetMediaPosts() = %+v, want 2 posts", posts)
+	}
+	if posts[0].PostID != 1 || posts[0].DetectedBy != LinkOriginal {
+		t.Errorf("first post = %+v, want the original post 1", posts[0])
+	}
+	if posts[1].PostID != 2 || posts[1].CommunityName != "art" || posts[1].DetectedBy != LinkCrossPost {
+		t.Errorf("second post = %+v, want the crosspost in art", posts[1])
+	}
+
+	byURL, err := db.GetMediaByURL(media.MediaURL)
+	if err != nil || byURL == nil || byURL.ID != media.ID {
+		t.Errorf("GetMediaByURL() = %+v, %v; want media %d", byURL, err, media.ID)
+	}
+	if missing, err := db.GetMediaByURL("https://example.com/other.jpg"); err != nil || missing != nil {
+		t.Errorf("GetMediaByURL() for unknown URL = %+v, %v; want nil", missing, err)
+	}
+
+	// Databases from before media_posts link existing media to its post
+	if _, err := db.Exec(`DELETE FROM media_posts`); err != nil {
+		t.Fatalf("failed to clear media_posts: %v", err)
+	}
+	if err := db.migrateSchema(); err != nil {
+		t.Fatalf("migrateSchema() error = %v", err)
+	}
+	posts, err = db.GetMediaPosts(media.ID)
+	if err != nil {
+		t.Fatalf("GetMediaPosts() error = %v", err)
+	}
+	if len(posts) != 1 || posts[0].PostID != 1 || posts[0].DetectedBy != LinkOriginal {
+		t.Errorf("backfilled posts = %+v, want the original post 1", posts)
+	}
+}
+
+func TestGetSharedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	paths := []string{"/media/pics/1_image.jpg", "/media/pics/1_image.jpg", "/media/pics/2_photo.png"}
+	for i, path := range paths {
+		media := &models.ScrapedMedia{
+			PostID:        int64(i + 1),
+			PostTitle:     "Post",
+			CommunityName: "pics",
+			AuthorName:    "alice",
+			MediaURL:      fmt.Sprintf("https://host%d.example/image.jpg", i),
+			MediaHash:     fmt.Sprintf("shared_hash_%d", i),
+			FileName:      filepath.Base(path),
+			FilePath:      path,
+			MediaType:     "image",
+			PostCreated:   time.Now(),
+			DownloadedAt:  time.Now(),
+		}
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
+			t.Fatalf("SaveMedia() error = %v", err)
+		}
+	}
+
+	shared, err := db.GetSharedFiles()
+	if err != nil {
+		t.Fatalf("GetSharedFiles() error = %v", err)
+	}
+	if len(shared) != 1 || shared[0].FilePath != paths[0] || len(shared[0].Media) != 2 {
+		t.Fatalf("GetSharedFiles() = %+v, want %s shared by 2 media", shared, paths[0])
+	}
+	if shared[0].Media[0].PostID != 1 || shared[0].Media[1].PostID != 2 {
+		t.Errorf("shared media = posts %d and %d, want 1 and 2", shared[0].Media[0].PostID, shared[0].Media[1].PostID)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := New(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	checkpoint, err := db.GetCheckpoint("pics")
+	if err != nil {
+		t.Fatalf("GetCheckpoint() error = %v", err)
+	}
+	if checkpoint != nil {
+		t.Fatalf("GetCheckpoint() = %+v, want nil for unknown source", checkpoint)
+	}
+
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := db.SaveCheckpoint("pics", published, 42); err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+	if err := db.SaveCheckpoint("pics", published.Add(time.Hour), 43); err != nil {
+		t.Fatalf("SaveCheckpoint() update error = %v", err)
+	}
+
+	checkpoint, err = db.GetCheckpoint("pics")
+	if err != nil {
+		t.Fatalf("GetCheckpoint() error = %v", err)
+	}
+	if checkpoint == nil || checkpoint.LastPostID != 43 || !checkpoint.LastPublished.Equal(published.Add(time.Hour)) {
+		t.Fatalf("GetCheckpoint() = %+v, want post 43 at %s", checkpoint, published.Add(time.Hour))
+	}
+
+	if err := db.SaveCheckpoint("hot", published, 7); err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+	checkpoints, err := db.ListCheckpoints()
+	if err != nil {
+		t.Fatalf("ListCheckpoints() error = %v", err)
+	}
+	if len(checkpoints) != 2 {
+		t.Fatalf("ListCheckpoints() returned %d checkpoints, want 2", len(checkpoints))
+	}
+
+	deleted, err := db.DeleteCheckpoint("pics")
+	if err != nil || !deleted {
+		t.Fatalf("DeleteCheckpoint() = %v, %v, want true, nil", deleted, err)
+	}
+	deleted, err = db.DeleteCheckpoint("pics")
+	if err != nil || deleted {
+		t.Fatalf("DeleteCheckpoint() second call = %v, %v, want false, nil", deleted, err)
+	}
+}
+
+func TestCheckpointIsBefore(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cp := &Checkpoint{LastPublished: at, LastPostID: 10}
+
+	tests := []struct {
+		name      string
+		published time.Time
+		postID    int64
+		want      bool
+	}{
+		{name: "older post", published: at.Add(-time.Minute), postID: 99, want: true},
+		{name: "newer post", published: at.Add(time.Minute), postID: 1, want: false},
+		{name: "same time, checkpoint post", published: at, postID: 10, want: true},
+		{name: "same time, lower id", published: at, postID: 9, want: true},
+		{name: "same time, higher id", published: at, postID: 11, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cp.IsBefore(tt.published, tt.postID); got != tt.want {
+				t.Errorf("IsBefore(%s, %d) = %v, want %v", tt.published, tt.postID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackfillJobs(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := New(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job, err := db.GetBackfillJob("pics", "New", since)
+	if err != nil {
+		t.Fatalf("GetBackfillJob() error = %v", err)
+	}
+	if job != nil {
+		t.Fatalf("GetBackfillJob() = %+v, want nil", job)
+	}
+
+	job = &BackfillJob{Source: "pics", SortType: "New", Since: since, NextPage: 4, PostsProcessed: 150, StartedAt: time.Now()}
+	if err := db.SaveBackfillJob(job); err != nil {
+		t.Fatalf("SaveBackfillJob() error = %v", err)
+	}
+
+	got, err := db.GetBackfillJob("pics", "New", since)
+	if err != nil {
+		t.Fatalf("GetBackfillJob() error = %v", err)
+	}
+	if got == nil || got.NextPage != 4 || got.PostsProcessed != 150 || got.CompletedAt != nil {
+		t.Fatalf("GetBackfillJob() = %+v, want page 4, 150 posts, not completed", got)
+	}
+
+	completed := time.Now()
+	job.CompletedAt = &completed
+	if err := db.SaveBackfillJob(job); err != nil {
+		t.Fatalf("SaveBackfillJob() error = %v", err)
+	}
+	got, err = db.GetBackfillJob("pics", "New", since)
+	if err != nil {
+		t.Fatalf("GetBackfillJob() error = %v", err)
+	}
+	if got.CompletedAt == nil {
+		t.Error("CompletedAt not stored")
+	}
+
+	// A different date bound is a separate job
+	other, err := db.GetBackfillJob("pics", "New", since.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatalf("GetBackfillJob() error = %v", err)
+	}
+	if other != nil {
+		t.Errorf("GetBackfillJob() for other since = %+v, want nil", other)
+	}
+}
+
+func TestPerceptualHashes(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	var ids []int64
+	for i, mediaType := range []string{"image", "video", "other"} {
+		media := &models.ScrapedMedia{
+			PostID:        int64(i + 1),
+			PostTitle:     "Post",
+			CommunityName: "pics",
+			AuthorName:    "alice",
+			MediaURL:      fmt.Sprintf("https://host%d.example/media", i),
+			MediaHash:     fmt.Sprintf("phash_hash_%d", i),
+			FileName:      fmt.Sprintf("%d_media", i),
+			FilePath:      fmt.Sprintf("/media/pics/%d_media", i),
+			MediaType:     mediaType,
+			PostCreated:   time.Now(),
+			DownloadedAt:  time.Now(),
+		}
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
+			t.Fatalf("SaveMedia() error = %v", err)
+		}
+		ids = append(ids, media.ID)
+	}
+
+	pending, err := db.GetMediaWithoutPerceptualHash()
+	if err != nil {
+		t.Fatalf("GetMediaWithoutPerceptualHash() error = %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("GetMediaWithoutPerceptualHash() returned %d media, want the image and the video", len(pending))
+	}
+
+	// Hashes with the top bit set survive the signed SQLite integer
+	hash := uint64(0xfedcba9876543210)
+	if err := db.SavePerceptualHash(ids[0], &hash); err != nil {
+		t.Fatalf("SavePerceptualHash() error = %v", err)
+	}
+	if err := db.SavePerceptualHash(ids[1], nil); err != nil {
+		t.Fatalf("SavePerceptualHash(nil) error = %v", err)
+	}
+
+	hashes, err := db.GetPerceptualHashes()
+	if err != nil {
+		t.Fatalf("GetPerceptualHashes() error = %v", err)
+	}
+	if len(hashes) != 1 || hashes[0].MediaID != ids[0] || hashes[0].Hash != hash {
+		t.Errorf("GetPerceptualHashes() = %+v, want media %d with %x", hashes, ids[0], hash)
+	}
+	if pending, _ := db.GetMediaWithoutPerceptualHash(); len(pending) != 0 {
+		t.Errorf("GetMediaWithoutPerceptualHash() after hashing = %d media, want none", len(pending))
+	}
+}
+
+func TestDuplicateGroupsAndMerge(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer db.Close()
+
+	// Media 3 shares its file with media 5, which is not a duplicate
+	paths := []string{"/media/1.jpg", "/media/2.jpg", "/media/3.jpg", "/media/4.jpg", "/media/3.jpg"}
+	var ids []int64
+	for i, path := range paths {
+		media := &models.ScrapedMedia{
+			PostID:        int64(i + 1),
+			PostTitle:     fmt.Sprintf("Post %d", i+1),
+			CommunityName: "pics",
+			AuthorName:    "alice",
+			MediaURL:      fmt.Sprintf("https://host%d.example/image.jpg", i),
+			MediaHash:     fmt.Sprintf("dup_hash_%d", i),
+			FileName:      filepath.Base(path),
+			FilePath:      path,
+			MediaType:     "image",
+			PostCreated:   time.Now(),
+			DownloadedAt:  time.Now(),
+		}
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
+			t.Fatalf("SaveMedia() error = %v", err)
+		}
+		ids = append(ids, media.ID)
+	}
+
+	// 1-2 and 3-2 form one group, 4 stands alone
+	if err := db.SaveDuplicate(ids[1], ids[0], 3); err != nil {
+		t.Fatalf("SaveDuplicate() error = %v", err)
+	}
+	if err := db.SaveDuplicate(ids[1], ids[2], 5); err != nil {
+		t.Fatalf("SaveDuplicate() error = %v", err)
+	}
+	if err := db.SaveDuplicate(ids[0], ids[1], 3); err != nil {
+		t.Fatalf("SaveDuplicate() of a recorded pair error = %v", err)
+	}
+	if err := db.SaveThumbnail(ids[2], "/thumbs/3.jpg", 10, 10); err != nil {
+		t.Fatalf("SaveThumbnail() error = %v", err)
+	}
+
+	groups, err := db.GetDuplicateGroups()
+	if err != nil {
+		t.Fatalf("GetDuplicateGroups() error = %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Media) != 3 || len(groups[0].Pairs) != 2 {
+		t.Fatalf("GetDuplicateGroups() = %+v, want one group of 3 media and 2 pairs", groups)
+	}
+	if groups[0].Pairs[0].MediaID != ids[0] || groups[0].Pairs[0].DuplicateID != ids[1] {
+		t.Errorf("first pair = %+v, want the lower id first", groups[0].Pairs[0])
+	}
+
+	if _, err := db.MergeMedia(ids[0], []int64{999}); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("MergeMedia() of unknown media error = %v, want ErrMediaNotFound", err)
+	}
+
+	merged, err := db.MergeMedia(ids[0], []int64{ids[1], ids[2]})
+	if err != nil {
+		t.Fatalf("MergeMedia() error = %v", err)
+	}
+	if len(merged) != 2 || merged[0].FileShared || !merged[1].FileShared || merged[1].ThumbnailPath != "/thumbs/3.jpg" {
+		t.Errorf("MergeMedia() = %+v, want 2 with the second file shared and its thumbnail", merged)
+	}
+
+	posts, err := db.GetMediaPosts(ids[0])
+	if err != nil {
+		t.Fatalf("GetMediaPosts() error = %v", err)
+	}
+	if len(posts) != 3 || posts[1].DetectedBy != LinkPHash || posts[2].PostTitle != "Post 3" {
+		t.Errorf("posts after merge = %+v, want the original and 2 merged posts", posts)
+	}
+	if _, err := db.GetMediaByID(ids[1]); err == nil {
+		t.Error("merged media still exists")
+	}
+	if groups, _ := db.GetDuplicateGroups(); len(groups) != 0 {
+		t.Errorf("GetDuplicateGroups() after merge = %+v, want none", groups)
+	}
+}
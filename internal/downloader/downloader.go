@@ -2,26 +2,100 @@ package downloader
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/phash"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/sanitize"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/sidecar"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
 	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 	log "github.com/sirupsen/logrus"
 )
 
+// MaxFileSize is the largest media file that will be downloaded
+const MaxFileSize = 500 * 1024 * 1024 // 500 MB limit
+
+// ErrInvalidURL is returned for media URLs that are malformed or point at
+// local or private addresses
+var ErrInvalidURL = errors.New("invalid media URL")
+
+// ErrTooLarge is returned for media files larger than MaxFileSize
+var ErrTooLarge = errors.New("file too large")
+
+// StatusError is returned when a media server answers with a status other
+// than 200 OK
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("download failed with status %d", e.StatusCode)
+}
+
+// Permanent reports whether a download failed in a way that retrying will
+// not fix: an invalid URL, a file that is too large, or a client error other
+// than a timeout or rate limit. Network errors and server errors are
+// temporary.
+func Permanent(err error) bool {
+	if errors.Is(err, ErrInvalidURL) || errors.Is(err, ErrTooLarge) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+			return false
+		}
+		return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500
+	}
+	return false
+}
+
 // Downloader handles downloading and storing media files
 type Downloader struct {
-	DB          *database.DB
-	HTTPClient  *http.Client
-	BaseDir     string
+	DB           *database.DB
+	HTTPClient   *http.Client
+	BaseDir      string
+	PathTemplate string // Layout of files under BaseDir, see storage.Render
+	Instance     string // Configured instance, used for local communities
+	Mode         string // storage.ModePath or storage.ModeContent
+	LinkType     string // How PathTemplate links to objects in content mode
+
+	// Storage holds the files. A *storage.Local rooted at BaseDir is written
+	// to directly, so that files can be created exclusively and linked. Other
+	// backends store each file under its path relative to BaseDir.
+	Storage storage.Storage
+
+	// StripMetadata removes EXIF, XMP and GPS metadata from JPEG, PNG and
+	// WebP images before they are stored, keeping their orientation
+	StripMetadata bool
+
+	// SidecarJSON and SidecarNFO write a <file>.json sidecar describing the
+	// post next to each stored file, and a <name>.nfo sidecar next to videos
+	SidecarJSON bool
+	SidecarNFO  bool
+
+	// NearDuplicates detects re-encoded, resized or re-compressed copies of
+	// archived media by their perceptual hash when set. A copy within
+	// NearDuplicateDistance bits is linked to the archived media instead of
+	// being stored when SkipNearDuplicates is set, and is stored and recorded
+	// as a near-duplicate otherwise.
+	NearDuplicates        *phash.Detector
+	NearDuplicateDistance int
+	SkipNearDuplicates    bool
 }
 
 // New creates a new Downloader instance
@@ -31,12 +105,16 @@ func New(db *database.DB, baseDir string) *Downloader {
 		HTTPClient: &http.Client{
 			Timeout: 60 * time.Second,
 		},
-		BaseDir: baseDir,
+		BaseDir:      baseDir,
+		PathTemplate: storage.DefaultPathTemplate,
+		Mode:         storage.ModePath,
+		LinkType:     storage.LinkHard,
+		Storage:      storage.NewLocal(baseDir),
 	}
 }
 
 // DownloadMedia downloads a media file from a URL and stores it with deduplication
-func (d *Downloader) DownloadMedia(mediaURL string, postView models.PostView) (*models.ScrapedMedia, error) {
+func (d *Downloader) DownloadMedia(ctx context.Context, mediaURL string, postView models.PostView) (*models.ScrapedMedia, error) {
 	// Skip empty URLs
 	if mediaURL == "" {
 		return nil, fmt.Errorf("empty media URL")
@@ -44,43 +122,28 @@ func (d *Downloader) DownloadMedia(mediaURL string, postView models.PostView) (*
 
 	// Validate URL to prevent SSRF attacks
 	if err := validateURL(mediaURL); err != nil {
-		return nil, fmt.Errorf("invalid media URL: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidURL, err)
 	}
 
-	log.Debugf("Attempting to download media from: %s", mediaURL)
-
-	// Download the file content
-	resp, err := d.HTTPClient.Get(mediaURL)
+	// Media already downloaded from this URL, e.g. by a crosspost, is linked
+	// to this post instead of being fetched again
+	existing, err := d.DB.GetMediaByURL(mediaURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download media: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("download failed with status %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to check media existence: %w", err)
 	}
-
-	// Check Content-Length header if available
-	const maxFileSize = 500 * 1024 * 1024 // 500 MB limit
-	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
-		if size, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
-			if size > maxFileSize {
-				return nil, fmt.Errorf("file too large: %d bytes (max %d)", size, maxFileSize)
-			}
+	if existing != nil {
+		log.Debugf("Media already downloaded from %s, linking post %d", mediaURL, postView.Post.ID)
+		if err := d.DB.LinkMediaPost(existing.ID, d.Instance, &postView, database.LinkURL); err != nil {
+			return nil, err
 		}
+		return existing, nil
 	}
 
-	// Read content into memory with size limit for hashing and writing
-	// Use LimitReader to prevent memory exhaustion
-	limitedReader := io.LimitReader(resp.Body, maxFileSize+1) // +1 to detect oversized files
-	content, err := io.ReadAll(limitedReader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read media content: %w", err)
-	}
+	log.Debugf("Attempting to download media from: %s", mediaURL)
 
-	// Check if file exceeded size limit
-	if int64(len(content)) > maxFileSize {
-		return nil, fmt.Errorf("file too large: exceeds %d bytes", maxFileSize)
+	content, contentType, err := d.Fetch(ctx, mediaURL)
+	if err != nil {
+		return nil, err
 	}
 
 	// Calculate hash
@@ -101,38 +164,60 @@ func (d *Downloader) DownloadMedia(mediaURL string, postView models.PostView) (*
 		if err != nil {
 			return nil, fmt.Errorf("failed to get existing media: %w", err)
 		}
+		if err := d.DB.LinkMediaPost(existing.ID, d.Instance, &postView, database.LinkHash); err != nil {
+			return nil, err
+		}
 		return existing, nil
 	}
 
 	// Determine media type and file extension
-	mediaType := determineMediaType(resp.Header.Get("Content-Type"), mediaURL)
-	fileExt := getFileExtension(resp.Header.Get("Content-Type"), mediaURL)
-
-	// Create filename: postID_originalname or postID.ext
-	originalName := filepath.Base(mediaURL)
-	// Clean the original name
-	originalName = strings.Split(originalName, "?")[0] // Remove query parameters
-
-	fileName := fmt.Sprintf("%d_%s", postView.Post.ID, originalName)
-	if !strings.Contains(fileName, ".") {
-		fileName = fmt.Sprintf("%d%s", postView.Post.ID, fileExt)
+	mediaType := determineMediaType(contentType, mediaURL)
+	fileExt := getFileExtension(contentType, mediaURL)
+
+	// Copies that are not byte-identical have a different SHA-256 but a
+	// close perceptual hash
+	var perceptualHash *uint64
+	var perceptualErr error
+	if d.NearDuplicates != nil && (mediaType == "image" || mediaType == "video") {
+		h, err := d.NearDuplicates.HashContent(ctx, content, mediaType, fileExt)
+		if err != nil {
+			log.Debugf("Failed to compute perceptual hash of %s: %v", mediaURL, err)
+			perceptualErr = err
+		} else {
+			perceptualHash = &h
+		}
 	}
-
-	// Sanitize filename to prevent issues with special characters
-	fileName = sanitizePath(fileName)
-
-	// Create community directory with restrictive permissions
-	communityDir := filepath.Join(d.BaseDir, sanitizePath(postView.Community.Name))
-	if err := os.MkdirAll(communityDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed to create community directory: %w", err)
+	if perceptualHash != nil && d.SkipNearDuplicates {
+		if matches := d.NearDuplicates.Find(*perceptualHash, d.NearDuplicateDistance); len(matches) > 0 {
+			existing, err := d.DB.GetMediaByID(matches[0].MediaID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get near-duplicate media: %w", err)
+			}
+			log.Debugf("Media from %s is a near-duplicate of media %d (distance %d), skipping download",
+				mediaURL, existing.ID, matches[0].Distance)
+			if err := d.DB.LinkMediaPost(existing.ID, d.Instance, &postView, database.LinkPHash); err != nil {
+				return nil, err
+			}
+			return existing, nil
+		}
 	}
 
-	// Full file path
-	filePath := filepath.Join(communityDir, fileName)
-
-	// Write file to disk with restrictive permissions (owner read/write only)
-	if err := os.WriteFile(filePath, content, 0600); err != nil {
-		return nil, fmt.Errorf("failed to write file: %w", err)
+	// The stored file may differ from the download; the media hash stays
+	// the hash of the download, so later copies of it are still recognised
+	stored := content
+	var sanitizedHash string
+	if d.StripMetadata && mediaType == "image" {
+		stripped, changed, err := sanitize.Strip(content)
+		switch {
+		case err != nil:
+			log.Warnf("Failed to strip metadata from %s, storing it as downloaded: %v", mediaURL, err)
+		case changed:
+			stored = stripped
+			if sanitizedHash, err = database.HashContent(bytes.NewReader(stored)); err != nil {
+				return nil, fmt.Errorf("failed to hash sanitized content: %w", err)
+			}
+			log.Debugf("Stripped %d bytes of metadata from %s", len(content)-len(stored), mediaURL)
+		}
 	}
 
 	// Create database record
@@ -141,13 +226,13 @@ func (d *Downloader) DownloadMedia(mediaURL string, postView models.PostView) (*
 		PostTitle:     postView.Post.Name,
 		CommunityName: postView.Community.Name,
 		CommunityID:   postView.Community.ID,
+		Instance:      d.communityInstance(postView.Community),
 		AuthorName:    postView.Creator.Name,
 		AuthorID:      postView.Creator.ID,
 		MediaURL:      mediaURL,
 		MediaHash:     hash,
-		FileName:      fileName,
-		FilePath:      filePath,
-		FileSize:      int64(len(content)),
+		SanitizedHash: sanitizedHash,
+		FileSize:      int64(len(stored)),
 		MediaType:     mediaType,
 		PostURL:       mediaURL,
 		PostScore:     postView.Counts.Score,
@@ -155,17 +240,279 @@ func (d *Downloader) DownloadMedia(mediaURL string, postView models.PostView) (*
 		DownloadedAt:  time.Now(),
 	}
 
+	// Store the file according to the storage backend and mode
+	remove, err := d.store(ctx, scrapedMedia, stored, fileExt, contentType)
+	if err != nil {
+		return nil, err
+	}
+
 	// Save to database
-	if err := d.DB.SaveMedia(scrapedMedia); err != nil {
-		// Clean up file if database save fails
-		os.Remove(filePath)
+	if err := d.DB.SaveMedia(d.Instance, scrapedMedia); err != nil {
+		// Clean up files if database save fails
+		remove()
 		return nil, fmt.Errorf("failed to save media to database: %w", err)
 	}
 
-	log.Infof("Downloaded media: %s (%s, %d bytes)", fileName, mediaType, len(content))
+	// Media that cannot be hashed is recorded as such, unless only ffmpeg was
+	// missing and the backfill can hash it later
+	if d.NearDuplicates != nil && (perceptualHash != nil || (perceptualErr != nil && !errors.Is(perceptualErr, phash.ErrNoFFmpeg))) {
+		if err := d.NearDuplicates.Record(scrapedMedia.ID, perceptualHash, d.NearDuplicateDistance); err != nil {
+			log.Warnf("Failed to record perceptual hash of media %d: %v", scrapedMedia.ID, err)
+		}
+	}
+
+	// The file is kept when its sidecars cannot be written; the sidecars
+	// command writes them again
+	sidecars := &sidecar.Writer{Storage: d.Storage, BaseDir: d.BaseDir, JSON: d.SidecarJSON, NFO: d.SidecarNFO}
+	if sidecars.Enabled() {
+		metadata := sidecar.New(scrapedMedia, postView.Post.ApID, postView.Counts.Comments, nil)
+		if err := sidecars.Write(ctx, scrapedMedia, metadata); err != nil {
+			log.Warnf("Failed to write sidecars of %s: %v", scrapedMedia.FileName, err)
+		}
+	}
+
+	log.Infof("Downloaded media: %s (%s, %d bytes)", scrapedMedia.FileName, mediaType, len(stored))
 	return scrapedMedia, nil
 }
 
+// Fetch downloads the content of a media URL without storing it and returns
+// it with its content type. Files larger than MaxFileSize are rejected.
+func (d *Downloader) Fetch(ctx context.Context, mediaURL string) ([]byte, string, error) {
+	if err := validateURL(mediaURL); err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrInvalidURL, err)
+	}
+
+	// Download the file content
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	// Check Content-Length header if available
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		if size, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
+			if size > MaxFileSize {
+				return nil, "", fmt.Errorf("%w: %d bytes (max %d)", ErrTooLarge, size, MaxFileSize)
+			}
+		}
+	}
+
+	// Read content into memory with size limit for hashing and writing
+	// Use LimitReader to prevent memory exhaustion
+	limitedReader := io.LimitReader(resp.Body, MaxFileSize+1) // +1 to detect oversized files
+	content, err := io.ReadAll(limitedReader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read media content: %w", err)
+	}
+
+	// Check if file exceeded size limit
+	if int64(len(content)) > MaxFileSize {
+		return nil, "", fmt.Errorf("%w: exceeds %d bytes", ErrTooLarge, MaxFileSize)
+	}
+
+	return content, resp.Header.Get("Content-Type"), nil
+}
+
+// store writes a downloaded file and returns a function that removes what
+// it wrote
+func (d *Downloader) store(ctx context.Context, media *models.ScrapedMedia, content []byte, ext, contentType string) (func(), error) {
+	if _, local := d.Storage.(*storage.Local); !local && d.Storage != nil {
+		keys, err := d.storeRemote(ctx, media, content, ext, contentType)
+		return func() {
+			for _, key := range keys {
+				if err := d.Storage.Delete(context.Background(), key); err != nil {
+					log.Warnf("Failed to remove %s: %v", key, err)
+				}
+			}
+		}, err
+	}
+
+	var written []string
+	var err error
+	if d.Mode == storage.ModeContent {
+		written, err = d.storeObject(media, content, ext)
+	} else {
+		written, err = d.storeFile(media, content, ext)
+	}
+	return func() { removeAll(written) }, err
+}
+
+// storeFile writes a file at the path template and returns the paths written
+func (d *Downloader) storeFile(media *models.ScrapedMedia, content []byte, ext string) ([]string, error) {
+	relPath, err := storage.Render(d.PathTemplate, storage.MediaVars(media, ext))
+	if err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(d.BaseDir, relPath)
+
+	// Create the file's directory with restrictive permissions
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create media directory: %w", err)
+	}
+
+	// Write file to disk with restrictive permissions (owner read/write only).
+	// A different file already stored under the same name, e.g. an image.jpg
+	// from another host, is never replaced; the new file gets a unique name.
+	filePath, err = storage.WriteNew(filePath, media.MediaHash, content)
+	if err != nil {
+		return nil, err
+	}
+	media.FileName = filepath.Base(filePath)
+	media.FilePath = filePath
+	return []string{filePath}, nil
+}
+
+// storeObject writes a file under objects/ by its hash and links it from the
+// path template. It returns the paths created.
+func (d *Downloader) storeObject(media *models.ScrapedMedia, content []byte, ext string) ([]string, error) {
+	var written []string
+	objectPath := storage.ObjectPath(d.BaseDir, media.MediaHash, ext)
+	created, err := storage.WriteObject(objectPath, content)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		written = append(written, objectPath)
+	}
+	media.FileName = filepath.Base(objectPath)
+	media.FilePath = objectPath
+
+	if d.LinkType == storage.LinkNone {
+		return written, nil
+	}
+	relPath, err := storage.Render(d.PathTemplate, storage.MediaVars(media, ext))
+	if err != nil {
+		removeAll(written)
+		return nil, err
+	}
+	linkPath, err := storage.LinkNew(objectPath, filepath.Join(d.BaseDir, relPath), media.MediaHash, d.LinkType)
+	if err != nil {
+		removeAll(written)
+		return nil, err
+	}
+	media.FileName = filepath.Base(linkPath)
+	media.LinkPath = linkPath
+	return append(written, linkPath), nil
+}
+
+// storeRemote stores a file in a backend other than the local filesystem,
+// at the path template or, in content mode, at its object path. Object stores
+// have no links, so the template is not linked to objects. It returns the keys
+// written.
+func (d *Downloader) storeRemote(ctx context.Context, media *models.ScrapedMedia, content []byte, ext, contentType string) ([]string, error) {
+	var filePath string
+	if d.Mode == storage.ModeContent {
+		filePath = storage.ObjectPath(d.BaseDir, media.MediaHash, ext)
+	} else {
+		relPath, err := storage.Render(d.PathTemplate, storage.MediaVars(media, ext))
+		if err != nil {
+			return nil, err
+		}
+		filePath = filepath.Join(d.BaseDir, relPath)
+	}
+	key, err := storage.Key(d.BaseDir, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var written []string
+	if d.Mode == storage.ModeContent {
+		// An existing object holds the same content
+		_, err := d.Storage.Stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = d.Storage.Put(ctx, key, bytes.NewReader(content), int64(len(content)), contentType)
+			written = append(written, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to store %s: %w", key, err)
+		}
+	} else {
+		if key, err = storage.PutNew(ctx, d.Storage, key, media.MediaHash, content, contentType); err != nil {
+			return nil, fmt.Errorf("failed to store file: %w", err)
+		}
+		written = append(written, key)
+	}
+
+	media.FilePath = filepath.Join(d.BaseDir, filepath.FromSlash(key))
+	media.FileName = path.Base(key)
+	return written, nil
+}
+
+// removeAll removes the given files
+func removeAll(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// communityInstance returns the host of the instance a community lives on
+func (d *Downloader) communityInstance(community models.Community) string {
+	if !community.Local {
+		if u, err := url.Parse(community.ActorID); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	return d.Instance
+}
+
+// ProbeResult describes a media URL as reported by its server, without
+// downloading it
+type ProbeResult struct {
+	ContentType string `json:"content_type,omitempty"`
+	MediaType   string `json:"media_type"`
+	Size        int64  `json:"size"` // -1 when the server does not report it
+}
+
+// Probe asks the server for a media URL's type and size. It sends a HEAD
+// request, falling back to a GET whose body is not read for servers that
+// do not support HEAD.
+func (d *Downloader) Probe(ctx context.Context, mediaURL string) (*ProbeResult, error) {
+	if err := validateURL(mediaURL); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidURL, err)
+	}
+
+	resp, err := d.probeRequest(ctx, http.MethodHead, mediaURL)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = d.probeRequest(ctx, http.MethodGet, mediaURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe media: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("probe failed with status %d", resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	return &ProbeResult{
+		ContentType: contentType,
+		MediaType:   determineMediaType(contentType, mediaURL),
+		Size:        resp.ContentLength,
+	}, nil
+}
+
+// probeRequest sends a request and closes the response body without reading it
+func (d *Downloader) probeRequest(ctx context.Context, method, mediaURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
 // determineMediaType determines the media type from content type and URL
 func determineMediaType(contentType, url string) string {
 	contentType = strings.ToLower(contentType)
@@ -218,17 +565,6 @@ func getFileExtension(contentType, url string) string {
 	}
 }
 
-// sanitizePath removes invalid characters from path names
-func sanitizePath(path string) string {
-	// Replace invalid characters with underscores
-	invalid := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|"}
-	result := path
-	for _, char := range invalid {
-		result = strings.ReplaceAll(result, char, "_")
-	}
-	return result
-}
-
 // ShouldDownload checks if a media URL should be downloaded based on type and config
 func ShouldDownload(url string, includeImages, includeVideos, includeOther bool) bool {
 	mediaType := determineMediaType("", url)
@@ -1,7 +1,28 @@
 package downloader
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/phash"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/sidecar"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 )
 
 func TestDetermineMediaType(t *testing.T) {
@@ -250,84 +271,6 @@ func TestGetFileExtension(t *testing.T) {
 	}
 }
 
-func TestSanitizePath(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
-		{
-			name:     "clean path",
-			input:    "technology",
-			expected: "technology",
-		},
-		{
-			name:     "path with slash",
-			input:    "tech/programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "path with backslash",
-			input:    "tech\\programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "path with colon",
-			input:    "tech:programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "path with asterisk",
-			input:    "tech*programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "path with question mark",
-			input:    "tech?programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "path with quotes",
-			input:    "tech\"programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "path with angle brackets",
-			input:    "tech<programming>",
-			expected: "tech_programming_",
-		},
-		{
-			name:     "path with pipe",
-			input:    "tech|programming",
-			expected: "tech_programming",
-		},
-		{
-			name:     "multiple invalid characters",
-			input:    "tech/prog:ram*ming?",
-			expected: "tech_prog_ram_ming_",
-		},
-		{
-			name:     "path with @ symbol (valid)",
-			input:    "technology@lemmy.ml",
-			expected: "technology@lemmy.ml",
-		},
-		{
-			name:     "empty string",
-			input:    "",
-			expected: "",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := sanitizePath(tt.input)
-			if result != tt.expected {
-				t.Errorf("sanitizePath(%q) = %q, want %q", tt.input, result, tt.expected)
-			}
-		})
-	}
-}
-
 func TestShouldDownload(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -451,3 +394,310 @@ func TestShouldDownload(t *testing.T) {
 		})
 	}
 }
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"invalid URL", fmt.Errorf("%w: %w", ErrInvalidURL, errors.New("private address")), true},
+		{"too large", fmt.Errorf("%w: exceeds %d bytes", ErrTooLarge, MaxFileSize), true},
+		{"not found", &StatusError{StatusCode: http.StatusNotFound}, true},
+		{"forbidden", fmt.Errorf("failed to download: %w", &StatusError{StatusCode: http.StatusForbidden}), true},
+		{"rate limited", &StatusError{StatusCode: http.StatusTooManyRequests}, false},
+		{"request timeout", &StatusError{StatusCode: http.StatusRequestTimeout}, false},
+		{"server error", &StatusError{StatusCode: http.StatusBadGateway}, false},
+		{"network error", errors.New("connection reset by peer"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Permanent(tt.err); got != tt.expected {
+				t.Errorf("Permanent(%v) = %v, want %v", tt.err, got, tt.expected)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) *http.Response
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r), nil
+}
+
+// newTestDownloader returns a Downloader with a temporary database and base
+// directory whose downloads are answered with files by host and path, e.g.
+// "media.example/photo.png", or 404 Not Found
+func newTestDownloader(t *testing.T, files map[string][]byte) *Downloader {
+	t.Helper()
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	d := New(db, t.TempDir())
+	d.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		content, ok := files[r.URL.Host+r.URL.Path]
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("")), Request: r}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(content)), Request: r}
+	})}
+	return d
+}
+
+func testPost(id int64) models.PostView {
+	return models.PostView{
+		Post:      models.Post{ID: id, Name: "Post " + strconv.FormatInt(id, 10), Published: time.Now()},
+		Community: models.Community{ID: 1, Name: "pics"},
+		Creator:   models.Person{ID: 1, Name: "alice"},
+	}
+}
+
+func TestDownloadMediaKeepsFilesWithTheSameName(t *testing.T) {
+	d := newTestDownloader(t, map[string][]byte{
+		"a.media.example/clip.mp4": []byte("video from a"),
+		"b.media.example/clip.mp4": []byte("video from b"),
+	})
+
+	paths := map[string]bool{}
+	for _, host := range []string{"a", "b"} {
+		media, err := d.DownloadMedia(context.Background(), "https://"+host+".media.example/clip.mp4", testPost(8))
+		if err != nil {
+			t.Fatalf("DownloadMedia() error = %v", err)
+		}
+		content, err := os.ReadFile(media.FilePath)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", media.FilePath, err)
+		}
+		if want := "video from " + host; string(content) != want {
+			t.Errorf("%s holds %q, want %q", media.FilePath, content, want)
+		}
+		paths[media.FilePath] = true
+	}
+	if len(paths) != 2 {
+		t.Errorf("both media were stored at %v", paths)
+	}
+}
+
+func TestDownloadMediaContentStorage(t *testing.T) {
+	d := newTestDownloader(t, map[string][]byte{"media.example/photo.png": []byte("png data")})
+	d.Mode = storage.ModeContent
+	d.LinkType = storage.LinkHard
+
+	media, err := d.DownloadMedia(context.Background(), "https://media.example/photo.png", testPost(9))
+	if err != nil {
+		t.Fatalf("DownloadMedia() error = %v", err)
+	}
+
+	object := storage.ObjectPath(d.BaseDir, media.MediaHash, "png")
+	if media.FilePath != object {
+		t.Errorf("FilePath = %s, want %s", media.FilePath, object)
+	}
+	wantLink := filepath.Join(d.BaseDir, "pics", "9_photo.png")
+	if media.LinkPath != wantLink || media.FileName != "9_photo.png" {
+		t.Errorf("LinkPath = %s (%s), want %s", media.LinkPath, media.FileName, wantLink)
+	}
+	objectInfo, err := os.Stat(object)
+	if err != nil {
+		t.Fatalf("object is missing: %v", err)
+	}
+	linkInfo, err := os.Stat(wantLink)
+	if err != nil || !os.SameFile(objectInfo, linkInfo) {
+		t.Errorf("%s is not a link to the object: %v", wantLink, err)
+	}
+
+	// The same content from another URL is stored once
+	again, err := d.DownloadMedia(context.Background(), "https://media.example/photo.png?copy=1", testPost(10))
+	if err != nil {
+		t.Fatalf("second DownloadMedia() error = %v", err)
+	}
+	if again.ID != media.ID {
+		t.Errorf("second DownloadMedia() = media %d, want %d", again.ID, media.ID)
+	}
+}
+
+// remoteStorage hides that a storage is local, so it is used like an object
+// store
+type remoteStorage struct {
+	storage.Storage
+}
+
+func TestDownloadMediaRemoteStorage(t *testing.T) {
+	d := newTestDownloader(t, map[string][]byte{"media.example/photo.png": []byte("png data")})
+	bucket := t.TempDir()
+	d.Storage = remoteStorage{storage.NewLocal(bucket)}
+
+	// A file already stored under the same key is not replaced
+	if err := os.MkdirAll(filepath.Join(bucket, "pics"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bucket, "pics", "11_photo.png"), []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := d.DownloadMedia(context.Background(), "https://media.example/photo.png", testPost(11))
+	if err != nil {
+		t.Fatalf("DownloadMedia() error = %v", err)
+	}
+
+	key, err := storage.Key(d.BaseDir, media.FilePath)
+	if err != nil {
+		t.Fatalf("FilePath %s is not under the base directory: %v", media.FilePath, err)
+	}
+	if want := "pics/11_photo_" + media.MediaHash[:8] + ".png"; key != want {
+		t.Errorf("key = %s, want %s", key, want)
+	}
+	if content, err := os.ReadFile(filepath.Join(bucket, filepath.FromSlash(key))); err != nil || string(content) != "png data" {
+		t.Errorf("stored content = %q, %v", content, err)
+	}
+	if _, err := os.Stat(media.FilePath); err == nil {
+		t.Errorf("file was written to the local base directory")
+	}
+}
+
+func TestDownloadMediaNearDuplicates(t *testing.T) {
+	// The same picture as a PNG and as JPEGs of two qualities
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(x * 4)
+			if (x/16+y/12)%2 == 0 {
+				v = 255 - v
+			}
+			img.Set(x, y, color.NRGBA{v, v, uint8(y * 5), 255})
+		}
+	}
+	files := map[string][]byte{}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	files["media.example/a.png"] = append([]byte(nil), buf.Bytes()...)
+	for _, quality := range []int{90, 50} {
+		buf.Reset()
+		jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		files[fmt.Sprintf("media.example/q%d.jpg", quality)] = append([]byte(nil), buf.Bytes()...)
+	}
+
+	d := newTestDownloader(t, files)
+	detector, err := phash.NewDetector(d.DB)
+	if err != nil {
+		t.Fatalf("NewDetector() error = %v", err)
+	}
+	d.NearDuplicates = detector
+	d.NearDuplicateDistance = 8
+	download := func(name string, postID int64) *models.ScrapedMedia {
+		t.Helper()
+		media, err := d.DownloadMedia(context.Background(), "https://media.example/"+name, testPost(postID))
+		if err != nil {
+			t.Fatalf("DownloadMedia(%s) error = %v", name, err)
+		}
+		return media
+	}
+
+	// Linked near-duplicates are stored and recorded
+	first := download("a.png", 20)
+	second := download("q90.jpg", 21)
+	if first.ID == second.ID {
+		t.Fatalf("near-duplicate was not stored separately")
+	}
+	groups, err := d.DB.GetDuplicateGroups()
+	if err != nil {
+		t.Fatalf("GetDuplicateGroups() error = %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Media) != 2 {
+		t.Fatalf("GetDuplicateGroups() = %+v, want one group of 2", groups)
+	}
+
+	// Skipped near-duplicates link the post to the closest archived media
+	d.SkipNearDuplicates = true
+	third := download("q50.jpg", 22)
+	if third.ID != first.ID && third.ID != second.ID {
+		t.Errorf("skipped near-duplicate returned media %d, want an archived one", third.ID)
+	}
+	linked, err := d.DB.GetMediaPosts(third.ID)
+	if err != nil {
+		t.Fatalf("GetMediaPosts() error = %v", err)
+	}
+	if last := linked[len(linked)-1]; last.PostID != 22 || last.DetectedBy != database.LinkPHash {
+		t.Errorf("last linked post = %+v, want post 22 detected by phash", last)
+	}
+}
+
+func TestDownloadMediaStripsMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	clean := buf.Bytes()
+
+	// An EXIF segment with a GPS position, inserted after SOI
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00GPS-51.5007N-0.1246W")
+	content := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+	content = append(content, clean[2:]...)
+
+	d := newTestDownloader(t, map[string][]byte{
+		"media.example/0.jpg": content,
+		"media.example/1.jpg": content,
+	})
+	d.StripMetadata = true
+
+	media, err := d.DownloadMedia(context.Background(), "https://media.example/0.jpg", testPost(30))
+	if err != nil {
+		t.Fatalf("DownloadMedia() error = %v", err)
+	}
+	stored, err := os.ReadFile(media.FilePath)
+	if err != nil {
+		t.Fatalf("failed to read stored file: %v", err)
+	}
+	if bytes.Contains(stored, []byte("GPS-")) {
+		t.Error("stored file still contains the GPS position")
+	}
+
+	originalHash, _ := database.HashContent(bytes.NewReader(content))
+	storedHash, _ := database.HashContent(bytes.NewReader(stored))
+	if media.MediaHash != originalHash {
+		t.Errorf("MediaHash = %s, want the hash of the download %s", media.MediaHash, originalHash)
+	}
+	if media.SanitizedHash != storedHash {
+		t.Errorf("SanitizedHash = %s, want the hash of the stored file %s", media.SanitizedHash, storedHash)
+	}
+	if media.FileSize != int64(len(stored)) {
+		t.Errorf("FileSize = %d, want %d", media.FileSize, len(stored))
+	}
+
+	// Another download of the same file is still recognised by its hash
+	again, err := d.DownloadMedia(context.Background(), "https://media.example/1.jpg", testPost(31))
+	if err != nil {
+		t.Fatalf("second DownloadMedia() error = %v", err)
+	}
+	if again.ID != media.ID {
+		t.Errorf("second download stored media %d, want existing media %d", again.ID, media.ID)
+	}
+}
+
+func TestDownloadMediaWritesSidecars(t *testing.T) {
+	d := newTestDownloader(t, map[string][]byte{"media.example/clip.mp4": []byte("mp4 data")})
+	d.SidecarJSON = true
+	d.SidecarNFO = true
+
+	pv := testPost(40)
+	pv.Post.ApID = "https://lemmy.example/post/40"
+	pv.Counts.Comments = 12
+	media, err := d.DownloadMedia(context.Background(), "https://media.example/clip.mp4", pv)
+	if err != nil {
+		t.Fatalf("DownloadMedia() error = %v", err)
+	}
+
+	content, err := os.ReadFile(sidecar.JSONPath(media.FilePath))
+	if err != nil {
+		t.Fatalf("failed to read JSON sidecar: %v", err)
+	}
+	for _, want := range []string{`"title": "Post 40"`, `"ap_id": "https://lemmy.example/post/40"`, `"comment_count": 12`} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("JSON sidecar = %s, want %s", content, want)
+		}
+	}
+	if content, err := os.ReadFile(sidecar.NFOPath(media.FilePath)); err != nil || !strings.Contains(string(content), "<title>Post 40</title>") {
+		t.Errorf("NFO sidecar = %s, %v", content, err)
+	}
+}
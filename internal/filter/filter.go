@@ -0,0 +1,201 @@
+package filter
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+// Skip reasons reported when a post is rejected
+const (
+	ReasonCreatorBlocked = "creator_blocked"
+	ReasonBot            = "bot_account"
+	ReasonAuthor         = "author"
+	ReasonNSFW           = "nsfw"
+	ReasonLanguage       = "language"
+	ReasonTitle          = "title"
+	ReasonBody           = "body"
+	ReasonScore          = "score"
+)
+
+// Result describes the outcome of evaluating a post against the filter rules
+type Result struct {
+	Allowed bool
+	Reason  string // One of the Reason* constants when not allowed
+	Detail  string // Human readable explanation for logs
+}
+
+// Filter evaluates posts against a compiled set of rules
+type Filter struct {
+	minScore       *int
+	nsfw           string
+	titleInclude   []*regexp.Regexp
+	titleExclude   []*regexp.Regexp
+	bodyInclude    []*regexp.Regexp
+	bodyExclude    []*regexp.Regexp
+	authorAllow    map[string]bool
+	authorDeny     map[string]bool
+	excludeBots    bool
+	languages      map[int]bool
+	excludeBlocked bool
+}
+
+// New compiles the filter rules from the given configuration
+func New(cfg config.FilterConfig) (*Filter, error) {
+	f := &Filter{
+		minScore:       cfg.MinScore,
+		nsfw:           cfg.NSFW,
+		authorAllow:    toSet(cfg.AuthorAllow),
+		authorDeny:     toSet(cfg.AuthorDeny),
+		excludeBots:    cfg.ExcludeBots != nil && *cfg.ExcludeBots,
+		excludeBlocked: cfg.ExcludeBlockedCreators != nil && *cfg.ExcludeBlockedCreators,
+	}
+
+	var err error
+	if f.titleInclude, err = compileAll(cfg.TitleInclude); err != nil {
+		return nil, err
+	}
+	if f.titleExclude, err = compileAll(cfg.TitleExclude); err != nil {
+		return nil, err
+	}
+	if f.bodyInclude, err = compileAll(cfg.BodyInclude); err != nil {
+		return nil, err
+	}
+	if f.bodyExclude, err = compileAll(cfg.BodyExclude); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Languages) > 0 {
+		f.languages = make(map[int]bool, len(cfg.Languages))
+		for _, id := range cfg.Languages {
+			f.languages[id] = true
+		}
+	}
+
+	return f, nil
+}
+
+// Evaluate checks a post against the rules. The score rule is checked last so
+// that a rejection with ReasonScore means every other rule passed.
+// A nil Filter allows everything.
+func (f *Filter) Evaluate(postView models.PostView) Result {
+	if f == nil {
+		return Result{Allowed: true}
+	}
+
+	if f.excludeBlocked && postView.CreatorBlocked {
+		return reject(ReasonCreatorBlocked, "creator is blocked")
+	}
+
+	if f.excludeBots && postView.Creator.BotAccount {
+		return reject(ReasonBot, fmt.Sprintf("author %s is a bot account", postView.Creator.Name))
+	}
+
+	author := authorNames(postView.Creator)
+	if len(f.authorDeny) > 0 && matchesAny(f.authorDeny, author) {
+		return reject(ReasonAuthor, fmt.Sprintf("author %s is denied", postView.Creator.Name))
+	}
+	if len(f.authorAllow) > 0 && !matchesAny(f.authorAllow, author) {
+		return reject(ReasonAuthor, fmt.Sprintf("author %s is not allowed", postView.Creator.Name))
+	}
+
+	switch f.nsfw {
+	case "exclude":
+		if postView.Post.NSFW {
+			return reject(ReasonNSFW, "post is NSFW")
+		}
+	case "only":
+		if !postView.Post.NSFW {
+			return reject(ReasonNSFW, "post is not NSFW")
+		}
+	}
+
+	if f.languages != nil && !f.languages[postView.Post.LanguageID] {
+		return reject(ReasonLanguage, fmt.Sprintf("language %d is not allowed", postView.Post.LanguageID))
+	}
+
+	if re := firstMatch(f.titleExclude, postView.Post.Name); re != nil {
+		return reject(ReasonTitle, fmt.Sprintf("title matches excluded pattern %q", re.String()))
+	}
+	if len(f.titleInclude) > 0 && firstMatch(f.titleInclude, postView.Post.Name) == nil {
+		return reject(ReasonTitle, "title matches no included pattern")
+	}
+
+	if re := firstMatch(f.bodyExclude, postView.Post.Body); re != nil {
+		return reject(ReasonBody, fmt.Sprintf("body matches excluded pattern %q", re.String()))
+	}
+	if len(f.bodyInclude) > 0 && firstMatch(f.bodyInclude, postView.Post.Body) == nil {
+		return reject(ReasonBody, "body matches no included pattern")
+	}
+
+	if f.minScore != nil && postView.Counts.Score < *f.minScore {
+		return reject(ReasonScore, fmt.Sprintf("score %d is below minimum %d", postView.Counts.Score, *f.minScore))
+	}
+
+	return Result{Allowed: true}
+}
+
+// reject builds a rejected Result
+func reject(reason, detail string) Result {
+	return Result{Allowed: false, Reason: reason, Detail: detail}
+}
+
+// compileAll compiles a list of regular expressions
+func compileAll(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// firstMatch returns the first expression matching s, or nil
+func firstMatch(patterns []*regexp.Regexp, s string) *regexp.Regexp {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return re
+		}
+	}
+	return nil
+}
+
+// toSet builds a lowercase lookup set from a list of author names
+func toSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[strings.ToLower(strings.TrimPrefix(name, "@"))] = true
+	}
+	return set
+}
+
+// authorNames returns the forms an author can be referred to by:
+// the bare name and name@instance when the actor ID is known
+func authorNames(person models.Person) []string {
+	name := strings.ToLower(person.Name)
+	names := []string{name}
+	if parsed, err := url.Parse(person.ActorID); err == nil && parsed.Hostname() != "" {
+		names = append(names, name+"@"+strings.ToLower(parsed.Hostname()))
+	}
+	return names
+}
+
+// matchesAny reports whether any of the names is in the set
+func matchesAny(set map[string]bool, names []string) bool {
+	for _, name := range names {
+		if set[name] {
+			return true
+		}
+	}
+	return false
+}
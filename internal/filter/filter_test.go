@@ -0,0 +1,117 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func intPtr(i int) *int    { return &i }
+func boolPtr(b bool) *bool { return &b }
+
+func TestEvaluate(t *testing.T) {
+	post := models.PostView{
+		Post: models.Post{
+			Name:       "Sunset over the lake",
+			Body:       "Taken with my phone",
+			NSFW:       false,
+			LanguageID: 37,
+		},
+		Creator: models.Person{
+			Name:    "alice",
+			ActorID: "https://lemmy.world/u/alice",
+		},
+		Counts: models.PostAggregates{Score: 42},
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config.FilterConfig
+		modify     func(*models.PostView)
+		wantAllow  bool
+		wantReason string
+	}{
+		{name: "empty rules allow everything", cfg: config.FilterConfig{}, wantAllow: true},
+		{name: "score above minimum", cfg: config.FilterConfig{MinScore: intPtr(10)}, wantAllow: true},
+		{name: "score below minimum", cfg: config.FilterConfig{MinScore: intPtr(100)}, wantReason: ReasonScore},
+		{
+			name:       "nsfw excluded",
+			cfg:        config.FilterConfig{NSFW: "exclude"},
+			modify:     func(pv *models.PostView) { pv.Post.NSFW = true },
+			wantReason: ReasonNSFW,
+		},
+		{name: "nsfw only rejects sfw", cfg: config.FilterConfig{NSFW: "only"}, wantReason: ReasonNSFW},
+		{name: "title exclude", cfg: config.FilterConfig{TitleExclude: []string{"(?i)sunset"}}, wantReason: ReasonTitle},
+		{name: "title include match", cfg: config.FilterConfig{TitleInclude: []string{"lake"}}, wantAllow: true},
+		{name: "title include no match", cfg: config.FilterConfig{TitleInclude: []string{"mountain"}}, wantReason: ReasonTitle},
+		{name: "body exclude", cfg: config.FilterConfig{BodyExclude: []string{"phone"}}, wantReason: ReasonBody},
+		{name: "body include no match", cfg: config.FilterConfig{BodyInclude: []string{"camera"}}, wantReason: ReasonBody},
+		{name: "author denied by name", cfg: config.FilterConfig{AuthorDeny: []string{"Alice"}}, wantReason: ReasonAuthor},
+		{name: "author denied by name@instance", cfg: config.FilterConfig{AuthorDeny: []string{"alice@lemmy.world"}}, wantReason: ReasonAuthor},
+		{name: "author deny other instance", cfg: config.FilterConfig{AuthorDeny: []string{"alice@lemmy.ml"}}, wantAllow: true},
+		{name: "author allowed", cfg: config.FilterConfig{AuthorAllow: []string{"alice"}}, wantAllow: true},
+		{name: "author not in allow list", cfg: config.FilterConfig{AuthorAllow: []string{"bob"}}, wantReason: ReasonAuthor},
+		{
+			name:       "bot excluded",
+			cfg:        config.FilterConfig{ExcludeBots: boolPtr(true)},
+			modify:     func(pv *models.PostView) { pv.Creator.BotAccount = true },
+			wantReason: ReasonBot,
+		},
+		{
+			name:      "bot allowed when not excluded",
+			cfg:       config.FilterConfig{ExcludeBots: boolPtr(false)},
+			modify:    func(pv *models.PostView) { pv.Creator.BotAccount = true },
+			wantAllow: true,
+		},
+		{name: "language allowed", cfg: config.FilterConfig{Languages: []int{37}}, wantAllow: true},
+		{name: "language not allowed", cfg: config.FilterConfig{Languages: []int{0}}, wantReason: ReasonLanguage},
+		{
+			name:       "blocked creator excluded",
+			cfg:        config.FilterConfig{ExcludeBlockedCreators: boolPtr(true)},
+			modify:     func(pv *models.PostView) { pv.CreatorBlocked = true },
+			wantReason: ReasonCreatorBlocked,
+		},
+		{
+			name:       "score checked after other rules",
+			cfg:        config.FilterConfig{MinScore: intPtr(100), TitleExclude: []string{"lake"}},
+			wantReason: ReasonTitle,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.cfg)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			pv := post
+			if tt.modify != nil {
+				tt.modify(&pv)
+			}
+
+			result := f.Evaluate(pv)
+			if result.Allowed != tt.wantAllow {
+				t.Errorf("Allowed = %v, want %v (reason %q: %s)", result.Allowed, tt.wantAllow, result.Reason, result.Detail)
+			}
+			if !tt.wantAllow && result.Reason != tt.wantReason {
+				t.Errorf("Reason = %q, want %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewInvalidPattern(t *testing.T) {
+	_, err := New(config.FilterConfig{TitleExclude: []string{"("}})
+	if err == nil {
+		t.Error("New() with invalid pattern should return error")
+	}
+}
+
+func TestNilFilterAllowsEverything(t *testing.T) {
+	var f *Filter
+	if result := f.Evaluate(models.PostView{}); !result.Allowed {
+		t.Errorf("nil Filter rejected post: %s", result.Reason)
+	}
+}
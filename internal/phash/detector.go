@@ -0,0 +1,187 @@
+package phash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Detector hashes media and records near-duplicates in the database, keeping
+// an in-memory index of every stored hash
+type Detector struct {
+	DB         *database.DB
+	Index      *Index
+	FFmpegPath string
+}
+
+// NewDetector creates a detector and loads the stored hashes into its index
+func NewDetector(db *database.DB) (*Detector, error) {
+	hashes, err := db.GetPerceptualHashes()
+	if err != nil {
+		return nil, err
+	}
+	index := NewIndex()
+	for _, h := range hashes {
+		index.Add(h.MediaID, h.Hash)
+	}
+
+	ffmpegPath, _ := exec.LookPath("ffmpeg")
+	return &Detector{DB: db, Index: index, FFmpegPath: ffmpegPath}, nil
+}
+
+// HashContent hashes downloaded content of the given media type ("image" or
+// "video"). Videos are written to a temporary file with extension ext for
+// ffmpeg.
+func (d *Detector) HashContent(ctx context.Context, content []byte, mediaType, ext string) (uint64, error) {
+	switch mediaType {
+	case "image":
+		return FromImage(bytes.NewReader(content))
+	case "video":
+		tmp, err := os.CreateTemp("", "phash-*"+ext)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		_, err = tmp.Write(content)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write temporary file: %w", err)
+		}
+		return FromVideo(ctx, d.FFmpegPath, tmp.Name())
+	default:
+		return 0, fmt.Errorf("unsupported media type for perceptual hashing: %s", mediaType)
+	}
+}
+
+// Find returns the archived media within maxDistance of hash, closest first
+func (d *Detector) Find(hash uint64, maxDistance int) []Match {
+	return d.Index.Within(hash, maxDistance)
+}
+
+// Record stores the hash of a media item, records the archived media within
+// maxDistance as its near-duplicates and adds it to the index. A nil hash
+// records that the media could not be hashed, so it is not retried.
+func (d *Detector) Record(mediaID int64, hash *uint64, maxDistance int) error {
+	if err := d.DB.SavePerceptualHash(mediaID, hash); err != nil {
+		return err
+	}
+	if hash == nil {
+		return nil
+	}
+	for _, m := range d.Find(*hash, maxDistance) {
+		if m.MediaID == mediaID {
+			continue
+		}
+		if err := d.DB.SaveDuplicate(m.MediaID, mediaID, m.Distance); err != nil {
+			return err
+		}
+	}
+	d.Index.Add(mediaID, *hash)
+	return nil
+}
+
+// Remove drops a media item from the index
+func (d *Detector) Remove(mediaID int64) {
+	d.Index.Remove(mediaID)
+}
+
+// Backfill hashes the images and videos that were downloaded before
+// detection was enabled, reading their files from files. Errors on
+// individual items are logged but do not stop the backfill. Cancelling ctx
+// stops it before the next item.
+func Backfill(ctx context.Context, d *Detector, files storage.Storage, baseDir string, maxDistance int) {
+	if d == nil {
+		return
+	}
+
+	media, err := d.DB.GetMediaWithoutPerceptualHash()
+	if err != nil {
+		log.Errorf("Failed to query media without perceptual hash: %v", err)
+		return
+	}
+	if len(media) == 0 {
+		log.Debug("No media items need perceptual hashing")
+		return
+	}
+
+	log.Infof("Computing perceptual hashes for %d media items", len(media))
+
+	hashed := 0
+	skipped := 0
+	failed := 0
+	for _, item := range media {
+		if ctx.Err() != nil {
+			log.Infof("Perceptual hash backfill stopped: %d hashed, %d remaining", hashed, len(media)-hashed-skipped-failed)
+			return
+		}
+
+		hash, err := hashStored(ctx, d, files, baseDir, item.FilePath, item.MediaType)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrNoFFmpeg) {
+				// The file may come back, e.g. from a restored backup, and
+				// ffmpeg may be installed later
+				log.Debugf("Skipping media %d: %v", item.ID, err)
+				skipped++
+				continue
+			}
+			log.Debugf("Failed to hash media %d: %v", item.ID, err)
+			failed++
+			if err := d.Record(item.ID, nil, maxDistance); err != nil {
+				log.Errorf("Failed to record perceptual hash for media %d: %v", item.ID, err)
+			}
+			continue
+		}
+
+		if err := d.Record(item.ID, &hash, maxDistance); err != nil {
+			log.Errorf("Failed to record perceptual hash for media %d: %v", item.ID, err)
+			failed++
+			continue
+		}
+		hashed++
+		if hashed%100 == 0 {
+			log.Infof("Perceptual hash backfill progress: %d/%d hashed", hashed, len(media))
+		}
+	}
+
+	log.Infof("Perceptual hash backfill complete: %d hashed, %d skipped, %d failed (out of %d)",
+		hashed, skipped, failed, len(media))
+}
+
+// hashStored hashes a stored media file
+func hashStored(ctx context.Context, d *Detector, files storage.Storage, baseDir, filePath, mediaType string) (uint64, error) {
+	if mediaType != "image" && d.FFmpegPath == "" {
+		return 0, ErrNoFFmpeg
+	}
+	key, err := storage.Key(baseDir, filePath)
+	if err != nil {
+		return 0, err
+	}
+	if mediaType == "image" {
+		r, err := files.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		return FromImage(r)
+	}
+
+	localPath, cleanup, err := storage.LocalCopy(ctx, files, key)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	return FromVideo(ctx, d.FFmpegPath, localPath)
+}
@@ -0,0 +1,258 @@
+package phash
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Match is an indexed media item near a searched hash
+type Match struct {
+	MediaID  int64 `json:"media_id"`
+	Distance int   `json:"distance"`
+}
+
+// The index splits each 64-bit hash into chunks of 16 bits. Two hashes that
+// differ in d bits differ in at most d/chunks bits in at least one chunk, so
+// a search within d bits only looks up the chunk values within d/chunks bits
+// of the query's.
+const (
+	chunks    = 4
+	chunkBits = 64 / chunks
+
+	// maxChunkRadius is the largest per-chunk radius searched through the
+	// tables, covering searches within 15 bits. A search at radius 3 looks up
+	// 697 chunk values per table; beyond it the lookups cost more than
+	// checking every hash.
+	maxChunkRadius = 3
+)
+
+// chunkMasks lists the 16-bit masks with each number of set bits up to
+// maxChunkRadius
+var chunkMasks = func() [maxChunkRadius + 1][]uint16 {
+	var masks [maxChunkRadius + 1][]uint16
+	for m := 0; m < 1<<chunkBits; m++ {
+		if n := bits.OnesCount16(uint16(m)); n <= maxChunkRadius {
+			masks[n] = append(masks[n], uint16(m))
+		}
+	}
+	return masks
+}()
+
+// Index holds the perceptual hashes of archived media. Searches use
+// multi-index hashing: one table per chunk maps chunk values to media, so a
+// search within a few bits checks a small share of the hashes. It is safe
+// for concurrent use.
+type Index struct {
+	mu     sync.RWMutex
+	ids    []int64
+	hashes []uint64
+	pos    map[int64]int32   // Position of each media item in ids and hashes
+	tables [chunks][][]entry // Entries by chunk value, indexed directly
+	scans  atomic.Int64      // Searches too wide for the tables, which checked every hash
+}
+
+// entry is an indexed hash in a table. The hash is copied into the table so
+// that candidates are checked without looking them up.
+type entry struct {
+	hash uint64
+	pos  int32
+}
+
+// NewIndex creates an empty index
+func NewIndex() *Index {
+	i := &Index{pos: make(map[int64]int32)}
+	for c := range i.tables {
+		i.tables[c] = make([][]entry, 1<<chunkBits)
+	}
+	return i
+}
+
+// chunk returns chunk c of a hash
+func chunk(hash uint64, c int) uint16 {
+	return uint16(hash >> (uint(c) * chunkBits))
+}
+
+// Add indexes the hash of a media item, replacing its previous hash
+func (i *Index) Add(mediaID int64, hash uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if p, ok := i.pos[mediaID]; ok {
+		if i.hashes[p] == hash {
+			return
+		}
+		i.remove(mediaID)
+	}
+	p := int32(len(i.ids))
+	i.ids = append(i.ids, mediaID)
+	i.hashes = append(i.hashes, hash)
+	i.pos[mediaID] = p
+	for c := range i.tables {
+		key := chunk(hash, c)
+		i.tables[c][key] = append(i.tables[c][key], entry{hash: hash, pos: p})
+	}
+}
+
+// Remove drops a media item from the index
+func (i *Index) Remove(mediaID int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.pos[mediaID]; ok {
+		i.remove(mediaID)
+	}
+}
+
+// remove drops an indexed media item, moving the last item into its place.
+// The caller must hold the write lock.
+func (i *Index) remove(mediaID int64) {
+	p := i.pos[mediaID]
+	last := int32(len(i.ids) - 1)
+	for c := range i.tables {
+		i.replace(c, chunk(i.hashes[p], c), p, -1)
+		if p != last {
+			i.replace(c, chunk(i.hashes[last], c), last, p)
+		}
+	}
+	if p != last {
+		i.ids[p] = i.ids[last]
+		i.hashes[p] = i.hashes[last]
+		i.pos[i.ids[p]] = p
+	}
+	i.ids = i.ids[:last]
+	i.hashes = i.hashes[:last]
+	delete(i.pos, mediaID)
+}
+
+// replace changes position from to position to in a bucket of table c, or
+// drops it when to is negative
+func (i *Index) replace(c int, key uint16, from, to int32) {
+	bucket := i.tables[c][key]
+	for j, e := range bucket {
+		if e.pos != from {
+			continue
+		}
+		if to >= 0 {
+			bucket[j].pos = to
+			return
+		}
+		i.tables[c][key] = append(bucket[:j], bucket[j+1:]...)
+		return
+	}
+}
+
+// Len returns the number of indexed media items
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.ids)
+}
+
+// Within returns the media whose hashes differ from hash in at most
+// maxDistance bits, closest first
+func (i *Index) Within(hash uint64, maxDistance int) []Match {
+	i.mu.RLock()
+	var matches []Match
+	if maxDistance/chunks > maxChunkRadius {
+		matches = i.scan(hash, maxDistance)
+	} else {
+		for r := 0; r <= maxDistance/chunks; r++ {
+			matches = i.lookup(hash, r, maxDistance, matches)
+		}
+	}
+	i.mu.RUnlock()
+
+	sortMatches(matches)
+	return matches
+}
+
+// Nearest returns up to limit media whose hashes differ from hash in at
+// most maxDistance bits, closest first. It widens the per-chunk radius until
+// limit matches are found that no unsearched hash can beat.
+func (i *Index) Nearest(hash uint64, limit, maxDistance int) []Match {
+	if limit <= 0 {
+		return nil
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var matches []Match
+	for r := 0; r <= maxDistance/chunks; r++ {
+		if r > maxChunkRadius {
+			matches = i.scan(hash, maxDistance)
+			break
+		}
+		matches = i.lookup(hash, r, maxDistance, matches)
+
+		// Every hash within chunks*(r+1)-1 bits has been found
+		sortMatches(matches)
+		if len(matches) >= limit && matches[limit-1].Distance < chunks*(r+1) {
+			break
+		}
+	}
+
+	sortMatches(matches)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// lookup appends the media within maxDistance of hash that have a chunk
+// exactly r bits away from the query's and were not found at a smaller r.
+// The caller must hold the lock.
+func (i *Index) lookup(hash uint64, r, maxDistance int, matches []Match) []Match {
+	for c := range i.tables {
+		query := chunk(hash, c)
+		for _, mask := range chunkMasks[r] {
+			for _, e := range i.tables[c][query^mask] {
+				if !firstFound(hash, e.hash, c, r) {
+					continue
+				}
+				if d := Distance(hash, e.hash); d <= maxDistance {
+					matches = append(matches, Match{MediaID: i.ids[e.pos], Distance: d})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// firstFound reports whether a hash found through chunk c at chunk radius r
+// is found there for the first time. Searches go through the radii in
+// increasing order and through the chunks in order, so it was found before
+// if another chunk is closer or an earlier chunk is as close.
+func firstFound(query, hash uint64, c, r int) bool {
+	for other := 0; other < chunks; other++ {
+		d := bits.OnesCount16(chunk(query, other) ^ chunk(hash, other))
+		if d < r || (d == r && other < c) {
+			return false
+		}
+	}
+	return true
+}
+
+// scan checks every hash. The caller must hold the lock.
+func (i *Index) scan(hash uint64, maxDistance int) []Match {
+	i.scans.Add(1)
+	var matches []Match
+	for p, h := range i.hashes {
+		if d := Distance(hash, h); d <= maxDistance {
+			matches = append(matches, Match{MediaID: i.ids[p], Distance: d})
+		}
+	}
+	return matches
+}
+
+// sortMatches orders matches by distance, then by media id
+func sortMatches(matches []Match) {
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].Distance != matches[b].Distance {
+			return matches[a].Distance < matches[b].Distance
+		}
+		return matches[a].MediaID < matches[b].MediaID
+	})
+}
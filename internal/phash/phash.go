@@ -0,0 +1,97 @@
+// Package phash computes perceptual hashes of images and videos and finds
+// archived media that look the same, such as re-encoded, resized or
+// re-compressed copies.
+package phash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os/exec"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp"
+)
+
+// Hash returns the difference hash (dHash) of an image: the image is shrunk
+// to 9x8 grey pixels and each bit tells whether a pixel is darker than its
+// right neighbour. Resizing and re-compressing an image barely changes it.
+func Hash(img image.Image) uint64 {
+	small := imaging.Resize(img, 9, 8, imaging.Box)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luma(small, x, y) < luma(small, x+1, y) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// luma returns the brightness of a pixel
+func luma(img *image.NRGBA, x, y int) int {
+	c := img.NRGBAAt(x, y)
+	return 299*int(c.R) + 587*int(c.G) + 114*int(c.B)
+}
+
+// Distance returns the number of bits in which two hashes differ
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FromImage decodes a JPEG, PNG, GIF or WebP image and returns its hash.
+// Animated images are hashed by their first frame.
+func FromImage(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return Hash(img), nil
+}
+
+// ErrNoFFmpeg is returned when a video cannot be hashed because ffmpeg is
+// not installed
+var ErrNoFFmpeg = errors.New("ffmpeg not found, cannot hash video")
+
+// FromVideo hashes a keyframe of a video, taken one second in or at the
+// start of shorter videos, using ffmpeg
+func FromVideo(ctx context.Context, ffmpegPath, videoPath string) (uint64, error) {
+	if ffmpegPath == "" {
+		return 0, ErrNoFFmpeg
+	}
+
+	var lastErr error
+	for _, seek := range []string{"1", "0"} {
+		cmd := exec.CommandContext(ctx, ffmpegPath,
+			"-v", "error",
+			"-ss", seek,
+			"-i", videoPath,
+			"-frames:v", "1",
+			"-f", "image2pipe",
+			"-vcodec", "png",
+			"pipe:1",
+		)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		frame, err := cmd.Output()
+		if err != nil {
+			lastErr = fmt.Errorf("ffmpeg failed: %w, output: %s", err, stderr.String())
+			continue
+		}
+		if len(frame) == 0 {
+			lastErr = fmt.Errorf("ffmpeg returned no frame")
+			continue
+		}
+		return FromImage(bytes.NewReader(frame))
+	}
+	return 0, lastErr
+}
@@ -0,0 +1,233 @@
+package phash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// testImage draws a picture with enough structure for a meaningful hash
+func testImage(width, height int, invert bool) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8((x*255/width + (y*y*255)/(height*height)) / 2)
+			if (x*8/width+y*4/height)%3 == 0 {
+				v = 255 - v
+			}
+			if invert {
+				v = 255 - v
+			}
+			img.Set(x, y, color.NRGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func TestHashSimilarCopies(t *testing.T) {
+	original := testImage(640, 480, false)
+	hash := Hash(original)
+
+	// A resized copy re-compressed as JPEG
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Resize(original, 320, 240, imaging.Lanczos), &jpeg.Options{Quality: 60}); err != nil {
+		t.Fatal(err)
+	}
+	copyHash, err := FromImage(&buf)
+	if err != nil {
+		t.Fatalf("FromImage() error = %v", err)
+	}
+	if d := Distance(hash, copyHash); d > 8 {
+		t.Errorf("distance to a resized JPEG copy = %d, want at most 8", d)
+	}
+
+	// A PNG of the same image hashes identically
+	buf.Reset()
+	if err := png.Encode(&buf, original); err != nil {
+		t.Fatal(err)
+	}
+	if pngHash, _ := FromImage(&buf); pngHash != hash {
+		t.Errorf("PNG hash = %016x, want %016x", pngHash, hash)
+	}
+
+	// A different image is far away
+	if d := Distance(hash, Hash(testImage(640, 480, true))); d < 20 {
+		t.Errorf("distance to a different image = %d, want at least 20", d)
+	}
+}
+
+func TestFromImageInvalid(t *testing.T) {
+	if _, err := FromImage(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Error("FromImage() of invalid data succeeded")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, ^uint64(0), 64},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIndexWithin(t *testing.T) {
+	index := NewIndex()
+	index.Add(1, 0)
+	index.Add(2, 0x7)  // 3 bits from 0
+	index.Add(3, 0x3)  // 2 bits from 0
+	index.Add(4, 0xff) // 8 bits from 0
+
+	matches := index.Within(0, 3)
+	want := []Match{{1, 0}, {3, 2}, {2, 3}}
+	if len(matches) != len(want) {
+		t.Fatalf("Within() = %v, want %v", matches, want)
+	}
+	for i := range want {
+		if matches[i] != want[i] {
+			t.Errorf("Within()[%d] = %v, want %v", i, matches[i], want[i])
+		}
+	}
+
+	index.Remove(1)
+	if index.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", index.Len())
+	}
+	if matches := index.Within(0, 0); len(matches) != 0 {
+		t.Errorf("Within() after Remove() = %v, want none", matches)
+	}
+}
+
+// TestIndexMatchesLinearScan compares searches of an index of random
+// hashes, some of them shared, with checking every hash
+func TestIndexMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	index := NewIndex()
+	hashes := make(map[int64]uint64)
+	for id := int64(1); id <= 5000; id++ {
+		hash := rng.Uint64()
+		if id%10 == 0 {
+			// Near and exact copies of an earlier hash
+			hash = hashes[id-1] ^ (1 << uint(rng.Intn(64)))
+			if id%20 == 0 {
+				hash = hashes[id-1]
+			}
+		}
+		hashes[id] = hash
+		index.Add(id, hash)
+	}
+	// Replaced and removed hashes must not be found
+	for id := int64(1); id <= 100; id++ {
+		if id%2 == 0 {
+			index.Remove(id)
+			delete(hashes, id)
+		} else {
+			hashes[id] = rng.Uint64()
+			index.Add(id, hashes[id])
+		}
+	}
+	if index.Len() != len(hashes) {
+		t.Fatalf("Len() = %d, want %d", index.Len(), len(hashes))
+	}
+
+	linear := func(query uint64, maxDistance int) []Match {
+		var matches []Match
+		for id, h := range hashes {
+			if d := Distance(query, h); d <= maxDistance {
+				matches = append(matches, Match{MediaID: id, Distance: d})
+			}
+		}
+		sortMatches(matches)
+		return matches
+	}
+	equal := func(a, b []Match) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for q := 0; q < 200; q++ {
+		query := rng.Uint64()
+		if q%2 == 0 {
+			query = hashes[int64(rng.Intn(4900)+101)] ^ (1 << uint(rng.Intn(64)))
+		}
+		for _, maxDistance := range []int{0, 4, 8, 12, 24} {
+			want := linear(query, maxDistance)
+			if got := index.Within(query, maxDistance); !equal(got, want) {
+				t.Fatalf("Within(%x, %d) = %v, want %v", query, maxDistance, got, want)
+			}
+			if len(want) > 5 {
+				want = want[:5]
+			}
+			if got := index.Nearest(query, 5, maxDistance); !equal(got, want) {
+				t.Fatalf("Nearest(%x, 5, %d) = %v, want %v", query, maxDistance, got, want)
+			}
+		}
+	}
+}
+
+// TestIndexSearchesLargeIndexThroughTables checks that searches within the
+// default image search distance use the tables of a large index rather than
+// checking every hash
+func TestIndexSearchesLargeIndexThroughTables(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	index := NewIndex()
+	hashes := make([]uint64, 100000)
+	for p := range hashes {
+		hashes[p] = rng.Uint64()
+		index.Add(int64(p+1), hashes[p])
+	}
+
+	for q := 0; q < 20; q++ {
+		// A copy of an indexed hash with up to 12 bits changed
+		query := hashes[rng.Intn(len(hashes))]
+		for b := rng.Intn(13); b > 0; b-- {
+			query ^= 1 << uint(rng.Intn(64))
+		}
+
+		var want []Match
+		for p, h := range hashes {
+			if d := Distance(query, h); d <= 12 {
+				want = append(want, Match{MediaID: int64(p + 1), Distance: d})
+			}
+		}
+		sortMatches(want)
+
+		got := index.Within(query, 12)
+		if len(got) != len(want) || len(got) == 0 || got[0] != want[0] {
+			t.Fatalf("Within(%x, 12) = %v, want %v", query, got, want)
+		}
+		if nearest := index.Nearest(query, 20, 12); len(nearest) == 0 || nearest[0] != want[0] {
+			t.Fatalf("Nearest(%x, 20, 12) = %v, want %v first", query, nearest, want[0])
+		}
+	}
+	if scans := index.scans.Load(); scans != 0 {
+		t.Errorf("%d searches within 12 bits checked every hash, want none", scans)
+	}
+
+	// Wider searches still find every match by checking every hash
+	index.Within(hashes[0], 24)
+	if scans := index.scans.Load(); scans != 1 {
+		t.Errorf("search within 24 bits made %d scans, want 1", scans)
+	}
+}
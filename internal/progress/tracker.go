@@ -10,9 +10,18 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Run states reported in Status.State
+const (
+	StateIdle       = "idle"
+	StateRunning    = "running"
+	StatePaused     = "paused"
+	StateCancelling = "cancelling"
+)
+
 // Status represents the current scraper status
 type Status struct {
 	IsRunning        bool      `json:"is_running"`
+	State            string    `json:"state"`
 	CurrentCommunity string    `json:"current_community"`
 	PostsProcessed   int       `json:"posts_processed"`
 	MediaDownloaded  int       `json:"media_downloaded"`
@@ -31,16 +40,21 @@ type Tracker struct {
 	broadcast chan Status
 	register  chan *websocket.Conn
 	unregister chan *websocket.Conn
+	done      chan struct{} // Closed by Close
+	stopped   chan struct{} // Closed when run has returned
+	closeOnce sync.Once
 }
 
 // NewTracker creates a new progress tracker
 func NewTracker() *Tracker {
 	tracker := &Tracker{
-		status:     Status{IsRunning: false},
+		status:     Status{IsRunning: false, State: StateIdle},
 		clients:    make(map[*websocket.Conn]bool),
 		broadcast:  make(chan Status, 100),
 		register:   make(chan *websocket.Conn),
 		unregister: make(chan *websocket.Conn),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 
 	go tracker.run()
@@ -52,9 +66,22 @@ func NewTracker() *Tracker {
 func (t *Tracker) run() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	defer close(t.stopped)
 
 	for {
 		select {
+		case <-t.done:
+			t.mu.Lock()
+			for client := range t.clients {
+				client.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+					time.Now().Add(time.Second))
+				client.Close()
+				delete(t.clients, client)
+			}
+			t.mu.Unlock()
+			return
+
 		case client := <-t.register:
 			t.mu.Lock()
 			t.clients[client] = true
@@ -107,14 +134,29 @@ func (t *Tracker) sendToClient(client *websocket.Conn, status Status) {
 	}
 }
 
-// RegisterClient registers a new WebSocket client
+// RegisterClient registers a new WebSocket client. The client is closed
+// straight away if the tracker has been closed.
 func (t *Tracker) RegisterClient(client *websocket.Conn) {
-	t.register <- client
+	select {
+	case t.register <- client:
+	case <-t.done:
+		client.Close()
+	}
 }
 
 // UnregisterClient unregisters a WebSocket client
 func (t *Tracker) UnregisterClient(client *websocket.Conn) {
-	t.unregister <- client
+	select {
+	case t.unregister <- client:
+	case <-t.done:
+	}
+}
+
+// Close disconnects all WebSocket clients and stops the tracker. Status
+// updates are still recorded but no longer broadcast.
+func (t *Tracker) Close() {
+	t.closeOnce.Do(func() { close(t.done) })
+	<-t.stopped
 }
 
 // Start marks the beginning of a scrape operation
@@ -122,6 +164,7 @@ func (t *Tracker) Start() {
 	t.mu.Lock()
 	t.status = Status{
 		IsRunning:      true,
+		State:          StateRunning,
 		StartedAt:      time.Now(),
 		PostsProcessed: 0,
 		MediaDownloaded: 0,
@@ -137,8 +180,26 @@ func (t *Tracker) Start() {
 func (t *Tracker) Stop() {
 	t.mu.Lock()
 	t.status.IsRunning = false
-	t.status.CurrentOperation = "Completed"
-	t.status.Progress = 100
+	if t.status.State == StateCancelling {
+		t.status.CurrentOperation = "Cancelled"
+	} else {
+		t.status.CurrentOperation = "Completed"
+		t.status.Progress = 100
+	}
+	t.status.State = StateIdle
+	t.mu.Unlock()
+
+	t.broadcastStatus()
+}
+
+// SetState updates the run state while a scrape is running
+func (t *Tracker) SetState(state string) {
+	t.mu.Lock()
+	if !t.status.IsRunning {
+		t.mu.Unlock()
+		return
+	}
+	t.status.State = state
 	t.mu.Unlock()
 
 	t.broadcastStatus()
@@ -181,6 +242,17 @@ func (t *Tracker) IncrementErrors() {
 	t.broadcastStatus()
 }
 
+// UpdateCounts replaces the posts, media and error counters at once
+func (t *Tracker) UpdateCounts(posts, media, errors int) {
+	t.mu.Lock()
+	t.status.PostsProcessed = posts
+	t.status.MediaDownloaded = media
+	t.status.ErrorsCount = errors
+	t.mu.Unlock()
+
+	t.broadcastStatus()
+}
+
 // UpdateOperation updates the current operation description
 func (t *Tracker) UpdateOperation(operation string) {
 	t.mu.Lock()
@@ -0,0 +1,98 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// JPEG markers
+const (
+	markerTEM   = 0x01
+	markerRST0  = 0xD0
+	markerRST7  = 0xD7
+	markerEOI   = 0xD9
+	markerSOS   = 0xDA
+	markerAPP1  = 0xE1 // EXIF and XMP
+	markerAPP13 = 0xED // Photoshop resources, including IPTC
+)
+
+var (
+	jpegStart  = []byte{0xFF, 0xD8}
+	exifHeader = []byte("Exif\x00\x00")
+
+	errTruncatedJPEG = errors.New("truncated JPEG")
+)
+
+// stripJPEG drops the APP1 (EXIF and XMP) and APP13 (IPTC) segments before
+// the image data. The image data and everything after it is copied as is.
+func stripJPEG(content []byte) ([]byte, bool, error) {
+	out := make([]byte, 0, len(content))
+	out = append(out, jpegStart...)
+	stripped := false
+	wroteEXIF := false
+
+	pos := len(jpegStart)
+	for {
+		if pos+1 >= len(content) {
+			return nil, false, errTruncatedJPEG
+		}
+		if content[pos] != 0xFF {
+			return nil, false, errors.New("invalid JPEG marker")
+		}
+		// Markers may be preceded by any number of fill bytes
+		if content[pos+1] == 0xFF {
+			pos++
+			continue
+		}
+
+		marker := content[pos+1]
+		if marker == markerSOS || marker == markerEOI {
+			out = append(out, content[pos:]...)
+			break
+		}
+		if marker == markerTEM || (marker >= markerRST0 && marker <= markerRST7) {
+			out = append(out, content[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(content) {
+			return nil, false, errTruncatedJPEG
+		}
+		length := int(binary.BigEndian.Uint16(content[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(content) {
+			return nil, false, errTruncatedJPEG
+		}
+		data := content[pos+4 : end]
+
+		switch marker {
+		case markerAPP1:
+			stripped = true
+			if bytes.HasPrefix(data, exifHeader) && !wroteEXIF {
+				if tiff := keptOrientation(data[len(exifHeader):]); tiff != nil {
+					out = appendJPEGSegment(out, markerAPP1, append(append([]byte{}, exifHeader...), tiff...))
+					wroteEXIF = true
+				}
+			}
+		case markerAPP13:
+			stripped = true
+		default:
+			out = append(out, content[pos:end]...)
+		}
+		pos = end
+	}
+
+	if !stripped {
+		return content, false, nil
+	}
+	return out, true, nil
+}
+
+// appendJPEGSegment appends a segment with the given marker and data
+func appendJPEGSegment(out []byte, marker byte, data []byte) []byte {
+	out = append(out, 0xFF, marker)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(data)+2))
+	return append(out, data...)
+}
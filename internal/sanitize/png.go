@@ -0,0 +1,69 @@
+package sanitize
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadata lists the chunks that carry metadata: EXIF, and text chunks,
+// which hold XMP and arbitrary key-value pairs
+var pngMetadata = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+var errTruncatedPNG = errors.New("truncated PNG")
+
+// stripPNG drops the metadata chunks of a PNG image
+func stripPNG(content []byte) ([]byte, bool, error) {
+	out := make([]byte, 0, len(content))
+	out = append(out, pngSignature...)
+	stripped := false
+
+	pos := len(pngSignature)
+	for pos < len(content) {
+		if pos+8 > len(content) {
+			return nil, false, errTruncatedPNG
+		}
+		length := int(binary.BigEndian.Uint32(content[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(content) || end < pos {
+			return nil, false, errTruncatedPNG
+		}
+		kind := string(content[pos+4 : pos+8])
+
+		if pngMetadata[kind] {
+			stripped = true
+			if kind == "eXIf" {
+				if tiff := keptOrientation(content[pos+8 : pos+8+length]); tiff != nil {
+					out = appendPNGChunk(out, kind, tiff)
+				}
+			}
+		} else {
+			out = append(out, content[pos:end]...)
+		}
+		pos = end
+		if kind == "IEND" {
+			break
+		}
+	}
+
+	if !stripped {
+		return content, false, nil
+	}
+	return out, true, nil
+}
+
+// appendPNGChunk appends a chunk with its length and checksum
+func appendPNGChunk(out []byte, kind string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, kind...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
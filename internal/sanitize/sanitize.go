@@ -0,0 +1,98 @@
+// Package sanitize strips EXIF, XMP and GPS metadata from downloaded images
+// without re-encoding them. The EXIF orientation is kept, so stripped images
+// are still displayed the right way up.
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// orientationTag is the EXIF tag telling how an image is rotated or flipped
+const orientationTag = 0x0112
+
+// Strip removes EXIF, XMP and GPS metadata from a JPEG, PNG or WebP image.
+// It reports whether anything was removed; content in other formats, and
+// images without such metadata, are returned unchanged. An orientation other
+// than the default is written back as the only EXIF tag.
+func Strip(content []byte) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(content, jpegStart):
+		return stripJPEG(content)
+	case bytes.HasPrefix(content, pngSignature):
+		return stripPNG(content)
+	case len(content) >= 12 && string(content[0:4]) == "RIFF" && string(content[8:12]) == "WEBP":
+		return stripWebP(content)
+	default:
+		return content, false, nil
+	}
+}
+
+// orientation returns the orientation (1-8) in EXIF data, given as a TIFF
+// structure, or 0 if it has none
+func orientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) != orientationTag {
+			continue
+		}
+		// A single SHORT, stored in the first bytes of the value field
+		if order.Uint16(tiff[entry+2:entry+4]) != 3 {
+			return 0
+		}
+		if o := int(order.Uint16(tiff[entry+8 : entry+10])); o >= 1 && o <= 8 {
+			return o
+		}
+		return 0
+	}
+	return 0
+}
+
+// orientationEXIF returns EXIF data, as a TIFF structure, holding only the
+// given orientation
+func orientationEXIF(o int) []byte {
+	tiff := make([]byte, 26)
+	copy(tiff, "II")
+	binary.LittleEndian.PutUint16(tiff[2:], 42)
+	binary.LittleEndian.PutUint32(tiff[4:], 8) // IFD0 follows the header
+	binary.LittleEndian.PutUint16(tiff[8:], 1) // One entry
+	binary.LittleEndian.PutUint16(tiff[10:], orientationTag)
+	binary.LittleEndian.PutUint16(tiff[12:], 3) // SHORT
+	binary.LittleEndian.PutUint32(tiff[14:], 1) // One value
+	binary.LittleEndian.PutUint16(tiff[18:], uint16(o))
+	// The next IFD offset is left 0: there is no IFD1
+	return tiff
+}
+
+// keptOrientation returns the EXIF data to write back for the orientation in
+// tiff, or nil when the image needs no rotation
+func keptOrientation(tiff []byte) []byte {
+	if o := orientation(tiff); o > 1 {
+		return orientationEXIF(o)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testEXIF builds big-endian EXIF data with an orientation and a GPS IFD
+// holding a recognisable marker
+func testEXIF(o int) []byte {
+	var tiff []byte
+	tiff = append(tiff, "MM"...)
+	tiff = binary.BigEndian.AppendUint16(tiff, 42)
+	tiff = binary.BigEndian.AppendUint32(tiff, 8)
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	// Orientation, SHORT
+	tiff = binary.BigEndian.AppendUint16(tiff, orientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(o))
+	tiff = binary.BigEndian.AppendUint16(tiff, 0)
+	// GPS IFD pointer, LONG
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x8825)
+	tiff = binary.BigEndian.AppendUint16(tiff, 4)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint32(tiff, 38)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+	return append(tiff, "GPS-51.5007N-0.1246W"...)
+}
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 16), uint8(y * 32), 128, 255})
+		}
+	}
+	return img
+}
+
+func TestOrientation(t *testing.T) {
+	if got := orientation(testEXIF(6)); got != 6 {
+		t.Errorf("orientation() of big-endian EXIF = %d, want 6", got)
+	}
+	if got := orientation(orientationEXIF(8)); got != 8 {
+		t.Errorf("orientation() of written EXIF = %d, want 8", got)
+	}
+	if got := orientation([]byte("not exif")); got != 0 {
+		t.Errorf("orientation() of invalid data = %d, want 0", got)
+	}
+	if keptOrientation(testEXIF(1)) != nil {
+		t.Error("keptOrientation() kept the default orientation")
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	clean := encoded.Bytes()
+
+	// Metadata segments go right after SOI
+	var content []byte
+	content = append(content, clean[:2]...)
+	content = appendJPEGSegment(content, markerAPP1, append([]byte("Exif\x00\x00"), testEXIF(6)...))
+	content = appendJPEGSegment(content, markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>Camera</x:xmpmeta>"))
+	content = appendJPEGSegment(content, markerAPP13, []byte("Photoshop 3.0\x00IPTC"))
+	content = append(content, clean[2:]...)
+
+	out, stripped, err := Strip(content)
+	if err != nil {
+		t.Fatalf("Strip() error = %v", err)
+	}
+	if !stripped {
+		t.Fatal("Strip() did not strip anything")
+	}
+	for _, s := range []string{"GPS-", "xmpmeta", "IPTC"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("stripped JPEG still contains %q", s)
+		}
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+
+	// The orientation is written back as the only EXIF
+	i := bytes.Index(out, exifHeader)
+	if i < 0 {
+		t.Fatal("stripped JPEG has no EXIF orientation")
+	}
+	if got := orientation(out[i+len(exifHeader):]); got != 6 {
+		t.Errorf("orientation of stripped JPEG = %d, want 6", got)
+	}
+
+	// Images without metadata are returned unchanged
+	if out, stripped, err := Strip(clean); err != nil || stripped || !bytes.Equal(out, clean) {
+		t.Errorf("Strip() of a clean JPEG = stripped %v, error %v", stripped, err)
+	}
+	if _, _, err := Strip(content[:40]); err == nil {
+		t.Error("Strip() of a truncated JPEG succeeded")
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	clean := encoded.Bytes()
+
+	// Metadata chunks go after IHDR, which is 25 bytes long
+	ihdrEnd := len(pngSignature) + 25
+	var content []byte
+	content = append(content, clean[:ihdrEnd]...)
+	content = appendPNGChunk(content, "eXIf", testEXIF(3))
+	content = appendPNGChunk(content, "tEXt", []byte("Comment\x00GPS-secret"))
+	content = appendPNGChunk(content, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	content = append(content, clean[ihdrEnd:]...)
+
+	out, stripped, err := Strip(content)
+	if err != nil {
+		t.Fatalf("Strip() error = %v", err)
+	}
+	if !stripped {
+		t.Fatal("Strip() did not strip anything")
+	}
+	for _, s := range []string{"GPS-", "xmpmeta", "tEXt", "iTXt"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("stripped PNG still contains %q", s)
+		}
+	}
+	// Decoding checks the checksum of every chunk
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+	i := bytes.Index(out, []byte("eXIf"))
+	if i < 0 {
+		t.Fatal("stripped PNG has no EXIF orientation")
+	}
+	if got := orientation(out[i+4:]); got != 3 {
+		t.Errorf("orientation of stripped PNG = %d, want 3", got)
+	}
+
+	if out, stripped, err := Strip(clean); err != nil || stripped || !bytes.Equal(out, clean) {
+		t.Errorf("Strip() of a clean PNG = stripped %v, error %v", stripped, err)
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	webp := func(chunks ...[]byte) []byte {
+		content := []byte("RIFF\x00\x00\x00\x00WEBP")
+		for _, c := range chunks {
+			content = append(content, c...)
+		}
+		binary.LittleEndian.PutUint32(content[4:8], uint32(len(content)-8))
+		return content
+	}
+	chunk := func(kind string, data []byte) []byte {
+		return appendWebPChunk(nil, kind, data)
+	}
+	vp8x := chunk("VP8X", []byte{webpFlagEXIF | webpFlagXMP, 0, 0, 0, 15, 0, 0, 7, 0, 0})
+	bitstream := chunk("VP8L", []byte("image data"))
+
+	tests := []struct {
+		name     string
+		exif     []byte
+		wantEXIF bool
+	}{
+		{"rotated", testEXIF(6), true},
+		{"upright", testEXIF(1), false},
+		{"exif header", append([]byte("Exif\x00\x00"), testEXIF(5)...), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := webp(vp8x, bitstream, chunk("EXIF", tt.exif), chunk("XMP ", []byte("<x:xmpmeta/>")))
+
+			out, stripped, err := Strip(content)
+			if err != nil {
+				t.Fatalf("Strip() error = %v", err)
+			}
+			if !stripped {
+				t.Fatal("Strip() did not strip anything")
+			}
+			if bytes.Contains(out, []byte("GPS-")) || bytes.Contains(out, []byte("xmpmeta")) {
+				t.Error("stripped WebP still contains metadata")
+			}
+			if got := binary.LittleEndian.Uint32(out[4:8]); int(got) != len(out)-8 {
+				t.Errorf("RIFF size = %d, want %d", got, len(out)-8)
+			}
+			if !bytes.Contains(out, bitstream) {
+				t.Error("stripped WebP lost its image data")
+			}
+
+			flags := out[20]
+			if flags&webpFlagXMP != 0 {
+				t.Error("XMP flag still set")
+			}
+			i := bytes.Index(out, []byte("EXIF"))
+			if hasEXIF := flags&webpFlagEXIF != 0; hasEXIF != tt.wantEXIF || (i >= 0) != tt.wantEXIF {
+				t.Fatalf("EXIF flag = %v, chunk found = %v, want %v", hasEXIF, i >= 0, tt.wantEXIF)
+			}
+			if tt.wantEXIF && orientation(out[i+8:]) != orientation(bytes.TrimPrefix(tt.exif, exifHeader)) {
+				t.Errorf("orientation of stripped WebP = %d", orientation(out[i+8:]))
+			}
+		})
+	}
+
+	// Simple images cannot carry metadata
+	simple := webp(bitstream)
+	if out, stripped, err := Strip(simple); err != nil || stripped || !bytes.Equal(out, simple) {
+		t.Errorf("Strip() of a simple WebP = stripped %v, error %v", stripped, err)
+	}
+}
+
+func TestStripOtherFormats(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	if out, stripped, err := Strip(gif); err != nil || stripped || !bytes.Equal(out, gif) {
+		t.Errorf("Strip() of a GIF = stripped %v, error %v", stripped, err)
+	}
+}
@@ -0,0 +1,89 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Flags in the VP8X chunk of an extended WebP image
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+var errTruncatedWebP = errors.New("truncated WebP")
+
+// stripWebP drops the EXIF and XMP chunks of a WebP image and clears their
+// flags. Only extended (VP8X) images can carry them.
+func stripWebP(content []byte) ([]byte, bool, error) {
+	out := make([]byte, 12, len(content))
+	copy(out, content[:12])
+	stripped := false
+	vp8x := -1 // Offset of the VP8X chunk data in out
+
+	// Anything after the RIFF container is not part of the image
+	riff := content
+	if size := int(binary.LittleEndian.Uint32(content[4:8])); size >= 4 && size+8 < len(content) {
+		riff = content[:size+8]
+	}
+
+	pos := 12
+	for pos < len(riff) {
+		if pos+8 > len(riff) {
+			return nil, false, errTruncatedWebP
+		}
+		kind := string(riff[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(riff[pos+4 : pos+8]))
+		end := pos + 8 + size + size%2 // Chunks are padded to an even size
+		if end == len(riff)+1 {
+			// Some encoders leave out the padding of the last chunk
+			end = len(riff)
+		}
+		if end > len(riff) || end < pos {
+			return nil, false, errTruncatedWebP
+		}
+
+		switch kind {
+		case "EXIF":
+			stripped = true
+			data := bytes.TrimPrefix(riff[pos+8:pos+8+size], exifHeader)
+			if tiff := keptOrientation(data); tiff != nil {
+				out = appendWebPChunk(out, kind, tiff)
+			} else if vp8x >= 0 {
+				out[vp8x] &^= webpFlagEXIF
+			}
+		case "XMP ":
+			stripped = true
+			if vp8x >= 0 {
+				out[vp8x] &^= webpFlagXMP
+			}
+		case "VP8X":
+			if size < 1 {
+				return nil, false, errTruncatedWebP
+			}
+			vp8x = len(out) + 8
+			out = append(out, riff[pos:end]...)
+		default:
+			out = append(out, riff[pos:end]...)
+		}
+		pos = end
+	}
+
+	if !stripped {
+		return content, false, nil
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, true, nil
+}
+
+// appendWebPChunk appends a chunk with its size and padding
+func appendWebPChunk(out []byte, kind string, data []byte) []byte {
+	out = append(out, kind...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
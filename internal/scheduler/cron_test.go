@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"abc * * * *",
+	}
+
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := ParseCron(expr); err == nil {
+				t.Errorf("ParseCron(%q) error = nil, want error", expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-03-15 is a Friday
+	from := time.Date(2024, 3, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{name: "every minute", expr: "* * * * *", want: time.Date(2024, 3, 15, 10, 8, 0, 0, time.UTC)},
+		{name: "every 15 minutes", expr: "*/15 * * * *", want: time.Date(2024, 3, 15, 10, 15, 0, 0, time.UTC)},
+		{name: "hourly shorthand", expr: "@hourly", want: time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{name: "daily at 03:30", expr: "30 3 * * *", want: time.Date(2024, 3, 16, 3, 30, 0, 0, time.UTC)},
+		{name: "list of hours", expr: "0 6,12,18 * * *", want: time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)},
+		{name: "weekdays by name", expr: "0 9 * * mon-fri", want: time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)},
+		{name: "sunday as 7", expr: "0 0 * * 7", want: time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{name: "first of month", expr: "@monthly", want: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "leap day", expr: "0 0 29 2 *", want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month or day of week", expr: "0 0 20 * sat", want: time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{name: "step from offset", expr: "5/20 * * * *", want: time.Date(2024, 3, 15, 10, 25, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error = %v", tt.expr, err)
+			}
+			if got := c.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	c, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("ParseCron() error = %v", err)
+	}
+	if got := c.Next(time.Now()); !got.IsZero() {
+		t.Errorf("Next() = %s, want zero time", got)
+	}
+}
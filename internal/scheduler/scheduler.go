@@ -0,0 +1,323 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuietHours is a daily window, in local time, during which no runs start.
+// The window may wrap around midnight (e.g. 23:00-07:00).
+type QuietHours struct {
+	start int // Minutes since midnight
+	end   int
+}
+
+// ParseQuietHours parses a window given as "HH:MM" start and end times.
+// Returns nil when both are empty.
+func ParseQuietHours(start, end string) (*QuietHours, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	if start == "" || end == "" {
+		return nil, fmt.Errorf("quiet hours need both a start and an end")
+	}
+
+	q := &QuietHours{}
+	var err error
+	if q.start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if q.end, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("quiet hours start and end must differ")
+	}
+	return q, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls inside the quiet window
+func (q *QuietHours) Contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// End returns the end of the quiet window that contains t
+func (q *QuietHours) End(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// String renders the window as "HH:MM-HH:MM"
+func (q *QuietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.start/60, q.start%60, q.end/60, q.end%60)
+}
+
+// JobStatus describes a scheduled job for display
+type JobStatus struct {
+	Name        string     `json:"name"`
+	Schedule    string     `json:"schedule"`
+	NextRun     time.Time  `json:"next_run"`
+	Running     bool       `json:"running"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	SkippedRuns int        `json:"skipped_runs"`
+}
+
+// job is a scheduled function and its state
+type job struct {
+	name     string
+	spec     string
+	schedule Schedule
+	run      func(ctx context.Context) error
+
+	next    time.Time
+	running bool
+	lastRun time.Time
+	lastErr string
+	skipped int
+}
+
+// Scheduler starts jobs on their schedules, postponing runs that fall in quiet
+// hours, adding random jitter, and skipping a job's run while its previous run
+// is still in progress
+type Scheduler struct {
+	mu     sync.Mutex
+	jobs   []*job
+	quiet  *QuietHours
+	jitter time.Duration
+	wake   chan struct{}
+	wg     sync.WaitGroup
+	ctx    context.Context // Passed to jobs, set by Run
+
+	// retired holds jobs removed by Reset until they are added again
+	retired map[string]*job
+}
+
+// New creates a scheduler. quiet may be nil.
+func New(quiet *QuietHours, jitter time.Duration) *Scheduler {
+	return &Scheduler{
+		quiet:  quiet,
+		jitter: jitter,
+		wake:   make(chan struct{}, 1),
+		ctx:    context.Background(),
+	}
+}
+
+// Add registers a job. spec is a human readable description of the schedule.
+// A job removed by Reset and added again keeps its state, and keeps its next
+// run time if its spec is unchanged.
+func (s *Scheduler) Add(name, spec string, schedule Schedule, run func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.retired[name]
+	if ok {
+		delete(s.retired, name)
+	} else {
+		j = &job{name: name}
+	}
+	unchanged := ok && j.spec == spec && !j.next.IsZero() && !s.quiet.Contains(j.next)
+	j.spec = spec
+	j.schedule = schedule
+	j.run = run
+	if !unchanged {
+		j.next = s.plan(j, time.Now())
+	}
+	s.jobs = append(s.jobs, j)
+	s.notify()
+}
+
+// Reset removes all jobs and replaces the quiet hours and jitter, so the
+// schedule can be rebuilt after a configuration change. Running jobs are not
+// interrupted. quiet may be nil.
+func (s *Scheduler) Reset(quiet *QuietHours, jitter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retired = make(map[string]*job, len(s.jobs))
+	for _, j := range s.jobs {
+		s.retired[j.name] = j
+	}
+	s.jobs = nil
+	s.quiet = quiet
+	s.jitter = jitter
+	s.notify()
+}
+
+// RunNow schedules the named job to start immediately. Returns false if there
+// is no such job.
+func (s *Scheduler) RunNow(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.name == name {
+			j.next = time.Now()
+			s.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// Jobs returns the status of all jobs ordered by their next run
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		status := JobStatus{
+			Name:        j.name,
+			Schedule:    j.spec,
+			NextRun:     j.next,
+			Running:     j.running,
+			LastError:   j.lastErr,
+			SkippedRuns: j.skipped,
+		}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			status.LastRun = &lastRun
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(a, b int) bool {
+		return statuses[a].NextRun.Before(statuses[b].NextRun)
+	})
+	return statuses
+}
+
+// QuietHours returns the configured quiet window, or nil
+func (s *Scheduler) QuietHours() *QuietHours {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quiet
+}
+
+// Run starts due jobs until stop is closed, then waits for running jobs to
+// finish. Jobs receive ctx, so cancelling it aborts them.
+func (s *Scheduler) Run(ctx context.Context, stop <-chan struct{}) {
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		wait := time.Hour
+		for _, j := range s.jobs {
+			if !j.next.IsZero() {
+				wait = min(wait, time.Until(j.next))
+			}
+		}
+		s.mu.Unlock()
+
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-timer.C:
+			s.runDue(time.Now())
+		case <-s.wake:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			s.wg.Wait()
+			return
+		}
+	}
+}
+
+// runDue starts every job whose next run is due and plans its following run
+func (s *Scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.next.IsZero() || j.next.After(now) {
+			continue
+		}
+		j.next = s.plan(j, now)
+
+		if j.running {
+			j.skipped++
+			log.Warnf("Skipping scheduled run of %s: previous run still in progress", j.name)
+			continue
+		}
+
+		j.running = true
+		s.wg.Add(1)
+		go s.execute(s.ctx, j)
+	}
+}
+
+// execute runs a job and records the outcome
+func (s *Scheduler) execute(ctx context.Context, j *job) {
+	defer s.wg.Done()
+
+	log.Infof("Starting scheduled run: %s", j.name)
+	err := j.run(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.running = false
+	j.lastRun = time.Now()
+	j.lastErr = ""
+	if err != nil {
+		j.lastErr = err.Error()
+		log.Errorf("Scheduled run %s failed: %v", j.name, err)
+	}
+	if !j.next.IsZero() {
+		log.Debugf("Next run of %s at %s", j.name, j.next.Format(time.RFC3339))
+	}
+}
+
+// plan returns the next run time of a job after the given time, with jitter
+// applied and moved out of quiet hours. Jitter is applied first, so that it
+// cannot push a run into quiet hours. Returns the zero time if the schedule
+// never fires again.
+func (s *Scheduler) plan(j *job, after time.Time) time.Time {
+	next := j.schedule.Next(after)
+	// Bounded so that a schedule that only fires inside quiet hours cannot loop forever
+	for i := 0; i < 1000 && !next.IsZero(); i++ {
+		run := next
+		if s.jitter > 0 {
+			run = run.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+		}
+		if !s.quiet.Contains(run) {
+			return run
+		}
+		next = j.schedule.Next(s.quiet.End(run).Add(-time.Nanosecond))
+	}
+	return time.Time{}
+}
+
+// notify wakes the run loop so it picks up changed run times
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
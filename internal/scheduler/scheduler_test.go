@@ -0,0 +1,277 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	day := func(h, m int) time.Time { return time.Date(2024, 3, 15, h, m, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name       string
+		start, end string
+		at         time.Time
+		want       bool
+	}{
+		{name: "inside daytime window", start: "09:00", end: "17:00", at: day(12, 0), want: true},
+		{name: "at end of window", start: "09:00", end: "17:00", at: day(17, 0), want: false},
+		{name: "inside overnight window before midnight", start: "23:00", end: "07:00", at: day(23, 30), want: true},
+		{name: "inside overnight window after midnight", start: "23:00", end: "07:00", at: day(3, 0), want: true},
+		{name: "outside overnight window", start: "23:00", end: "07:00", at: day(12, 0), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := ParseQuietHours(tt.start, tt.end)
+			if err != nil {
+				t.Fatalf("ParseQuietHours() error = %v", err)
+			}
+			if got := q.Contains(tt.at); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.at.Format("15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuietHoursInvalid(t *testing.T) {
+	tests := []struct{ start, end string }{
+		{"23:00", ""},
+		{"25:00", "07:00"},
+		{"08:00", "08:00"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseQuietHours(tt.start, tt.end); err == nil {
+			t.Errorf("ParseQuietHours(%q, %q) error = nil, want error", tt.start, tt.end)
+		}
+	}
+
+	q, err := ParseQuietHours("", "")
+	if err != nil || q != nil {
+		t.Errorf("ParseQuietHours(\"\", \"\") = %v, %v, want nil, nil", q, err)
+	}
+}
+
+func TestPlanSkipsQuietHours(t *testing.T) {
+	quiet, err := ParseQuietHours("23:00", "07:00")
+	if err != nil {
+		t.Fatalf("ParseQuietHours() error = %v", err)
+	}
+	cron, err := ParseCron("*/30 * * * *")
+	if err != nil {
+		t.Fatalf("ParseCron() error = %v", err)
+	}
+
+	s := New(quiet, 0)
+	j := &job{name: "test", schedule: cron}
+	from := time.Date(2024, 3, 15, 22, 45, 0, 0, time.UTC)
+
+	want := time.Date(2024, 3, 16, 7, 0, 0, 0, time.UTC)
+	if got := s.plan(j, from); !got.Equal(want) {
+		t.Errorf("plan() = %s, want %s", got, want)
+	}
+}
+
+func TestPlanAddsJitter(t *testing.T) {
+	s := New(nil, time.Minute)
+	j := &job{name: "test", schedule: Every(time.Hour)}
+	from := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 20; i++ {
+		got := s.plan(j, from)
+		if got.Before(from.Add(time.Hour)) || !got.Before(from.Add(time.Hour+time.Minute)) {
+			t.Fatalf("plan() = %s, want within a minute after %s", got, from.Add(time.Hour))
+		}
+	}
+}
+
+func TestPlanKeepsJitterOutOfQuietHours(t *testing.T) {
+	quiet, err := ParseQuietHours("22:00", "07:00")
+	if err != nil {
+		t.Fatalf("ParseQuietHours() error = %v", err)
+	}
+	cron, err := ParseCron("55 21 * * *")
+	if err != nil {
+		t.Fatalf("ParseCron() error = %v", err)
+	}
+
+	// Up to 10 minutes of jitter can push the 21:55 run past 22:00
+	s := New(quiet, 10*time.Minute)
+	j := &job{name: "test", schedule: cron}
+	from := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	quietStart := time.Date(2024, 3, 15, 22, 0, 0, 0, time.UTC)
+	nextDay := time.Date(2024, 3, 16, 21, 55, 0, 0, time.UTC)
+
+	for i := 0; i < 100; i++ {
+		got := s.plan(j, from)
+		if quiet.Contains(got) {
+			t.Fatalf("plan() = %s, inside quiet hours", got)
+		}
+		if !got.Before(quietStart) && got.Before(nextDay) {
+			t.Fatalf("plan() = %s, want before %s or the next day's run", got, quietStart)
+		}
+	}
+}
+
+func TestRunDueSkipsRunningJob(t *testing.T) {
+	s := New(nil, 0)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	s.Add("slow", "every 1h", Every(time.Hour), func(ctx context.Context) error {
+		calls.Add(1)
+		<-release
+		return nil
+	})
+
+	now := time.Now()
+	s.jobs[0].next = now
+	s.runDue(now)
+
+	// The first run is still going when the job is due again
+	s.mu.Lock()
+	s.jobs[0].next = now
+	s.mu.Unlock()
+	s.runDue(now)
+
+	close(release)
+	s.wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("job ran %d times, want 1", got)
+	}
+	status := s.Jobs()[0]
+	if status.SkippedRuns != 1 {
+		t.Errorf("SkippedRuns = %d, want 1", status.SkippedRuns)
+	}
+	if status.Running || status.LastRun == nil {
+		t.Errorf("status after run = %+v, want finished with a last run time", status)
+	}
+}
+
+func TestRunStopsAndRunsNow(t *testing.T) {
+	s := New(nil, 0)
+
+	ran := make(chan struct{}, 1)
+	s.Add("job", "every 1h", Every(time.Hour), func(ctx context.Context) error {
+		ran <- struct{}{}
+		return nil
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(context.Background(), stop)
+		close(done)
+	}()
+
+	if !s.RunNow("job") {
+		t.Fatal("RunNow() = false for an existing job")
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not run after RunNow()")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after stop")
+	}
+
+	if s.RunNow("missing") {
+		t.Error("RunNow() = true for an unknown job")
+	}
+}
+
+func TestRunWaitsForJobsUntilCancelled(t *testing.T) {
+	s := New(nil, 0)
+
+	started := make(chan struct{})
+	s.Add("job", "every 1h", Every(time.Hour), func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	s.RunNow("job")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, stop)
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not start")
+	}
+
+	// Stopping waits for the running job
+	close(stop)
+	select {
+	case <-done:
+		t.Fatal("Run() returned while a job was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Cancelling the context aborts it
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the context was cancelled")
+	}
+	if status := s.Jobs()[0]; status.LastError != context.Canceled.Error() {
+		t.Errorf("LastError = %q, want %q", status.LastError, context.Canceled.Error())
+	}
+}
+
+func TestResetKeepsUnchangedJobs(t *testing.T) {
+	s := New(nil, 0)
+	noop := func(ctx context.Context) error { return nil }
+	s.Add("kept", "every 1h", Every(time.Hour), noop)
+	s.Add("changed", "every 1h", Every(time.Hour), noop)
+	s.Add("removed", "every 1h", Every(time.Hour), noop)
+
+	next := time.Now().Add(30 * time.Minute)
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		j.next = next
+		j.skipped = 2
+	}
+	s.mu.Unlock()
+
+	s.Reset(nil, 0)
+	s.Add("kept", "every 1h", Every(time.Hour), noop)
+	s.Add("changed", "every 2h", Every(2*time.Hour), noop)
+
+	jobs := s.Jobs()
+	if len(jobs) != 2 {
+		t.Fatalf("Jobs() returned %d jobs, want 2", len(jobs))
+	}
+	for _, status := range jobs {
+		if status.SkippedRuns != 2 {
+			t.Errorf("%s SkippedRuns = %d, want 2", status.Name, status.SkippedRuns)
+		}
+		switch status.Name {
+		case "kept":
+			if !status.NextRun.Equal(next) {
+				t.Errorf("kept NextRun = %s, want %s", status.NextRun, next)
+			}
+		case "changed":
+			if status.NextRun.Before(time.Now().Add(time.Hour + 59*time.Minute)) {
+				t.Errorf("changed NextRun = %s, want replanned two hours out", status.NextRun)
+			}
+		default:
+			t.Errorf("unexpected job %q after Reset", status.Name)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/api"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// backfillRetries is how many times a failed page request is retried before
+// the backfill gives up (it can be resumed later)
+const backfillRetries = 3
+
+// BackfillOptions configures a historical backfill of a community
+type BackfillOptions struct {
+	Community string        // Community to backfill
+	Since     time.Time     // Oldest publish time to archive
+	SortType  string        // "New" (default) or "TopAll"
+	Delay     time.Duration // Pause between page requests
+	Restart   bool          // Ignore saved progress and start from the first page
+}
+
+// Backfill archives a community's history back to opts.Since. Unlike Run it
+// ignores max_posts_per_run and the seen-post stop rules, skipping already
+// scraped posts instead. Progress is saved after every page so an interrupted
+// backfill resumes where it left off.
+func (s *Scraper) Backfill(ctx context.Context, opts BackfillOptions) error {
+	if opts.Community == "" {
+		return fmt.Errorf("backfill requires a community")
+	}
+	if opts.Since.IsZero() {
+		return fmt.Errorf("backfill requires a since date")
+	}
+	if opts.SortType == "" {
+		opts.SortType = "New"
+	}
+	if opts.SortType != "New" && opts.SortType != "TopAll" {
+		return fmt.Errorf("backfill sort must be New or TopAll, got %s", opts.SortType)
+	}
+
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	ctx, err := s.beginControl(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.endControl()
+	s.applyPendingConfig()
+
+	target, err := s.targetFor(opts.Community)
+	if err != nil {
+		return err
+	}
+	target.params.Sort = opts.SortType
+	target.settings.SortType = opts.SortType
+	target.settings.StopAtSeenPosts = false
+	target.settings.SkipSeenPosts = true
+	target.since = opts.Since
+	community := target.name
+
+	job, err := s.DB.GetBackfillJob(community, opts.SortType, opts.Since)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.CompletedAt != nil || opts.Restart {
+		job = &database.BackfillJob{
+			Source:    community,
+			SortType:  opts.SortType,
+			Since:     opts.Since,
+			NextPage:  1,
+			StartedAt: time.Now(),
+		}
+		log.Infof("Starting backfill of %s (%s) back to %s", community, opts.SortType, opts.Since.Format("2006-01-02"))
+	} else {
+		log.Infof("Resuming backfill of %s (%s) from page %d", community, opts.SortType, job.NextPage)
+	}
+
+	stats := newRunStats()
+	runID, err := s.DB.StartScraperRun()
+	if err != nil {
+		log.Errorf("Failed to record scraper run: %v", err)
+	}
+
+	if s.Progress != nil {
+		s.Progress.Start()
+		s.Progress.UpdateCommunity(community)
+		defer s.Progress.Stop()
+	}
+	startedAt := time.Now()
+
+	for {
+		params := target.params
+		params.Page = job.NextPage
+		params.Limit = 50
+
+		pageStats, postsReturned, stop := s.backfillPage(ctx, params, target, opts.Delay)
+		stats.add(pageStats)
+		stats.Processed += postsReturned
+
+		if stop == stopCancelled {
+			s.finishRun(runID, stats, "cancelled")
+			return fmt.Errorf("backfill of %s cancelled at page %d, run it again to resume: %w", community, job.NextPage, ctx.Err())
+		}
+		if stop == stopError {
+			s.finishRun(runID, stats, "failed")
+			return fmt.Errorf("backfill of %s stopped at page %d, run it again to resume", community, job.NextPage)
+		}
+
+		job.NextPage++
+		job.PostsProcessed += postsReturned
+		job.MediaDownloaded += pageStats.Downloaded
+
+		done := stop == stopDateBound || postsReturned < params.Limit
+		if done {
+			now := time.Now()
+			job.CompletedAt = &now
+		}
+		if err := s.DB.SaveBackfillJob(job); err != nil {
+			log.Errorf("Failed to save backfill progress for %s: %v", community, err)
+		}
+
+		s.reportBackfillProgress(target, job, stats, startedAt)
+		if done {
+			break
+		}
+
+		if !sleepContext(ctx, opts.Delay) {
+			s.finishRun(runID, stats, "cancelled")
+			return fmt.Errorf("backfill of %s cancelled at page %d, run it again to resume: %w", community, job.NextPage, ctx.Err())
+		}
+	}
+
+	log.Infof("Backfill complete for %s: %d pages, %d posts, %d media downloaded",
+		community, job.NextPage-1, job.PostsProcessed, job.MediaDownloaded)
+	s.finishRun(runID, stats, "completed")
+	return nil
+}
+
+// backfillPage scrapes one page, retrying with an increasing delay if the request fails
+func (s *Scraper) backfillPage(ctx context.Context, params api.GetPostsParams, target *scrapeTarget, delay time.Duration) (runStats, int, stopReason) {
+	wait := delay
+	for attempt := 0; ; attempt++ {
+		pageStats, postsReturned, _, stop := s.scrapePosts(ctx, params, target, 0)
+		if stop != stopError || attempt == backfillRetries {
+			return pageStats, postsReturned, stop
+		}
+
+		wait *= 2
+		if wait < time.Second {
+			wait = time.Second
+		}
+		log.Warnf("Failed to fetch page %d of %s, retrying in %s", params.Page, target.name, wait)
+		if !sleepContext(ctx, wait) {
+			return pageStats, postsReturned, stopCancelled
+		}
+	}
+}
+
+// reportBackfillProgress logs backfill progress and publishes it to the progress tracker.
+// Completion is only estimated for New-sorted backfills, which walk back in time.
+func (s *Scraper) reportBackfillProgress(target *scrapeTarget, job *database.BackfillJob, stats *runStats, startedAt time.Time) {
+	reached := "-"
+	percent := 0.0
+	if !target.oldest.IsZero() {
+		reached = target.oldest.Format("2006-01-02")
+		if job.SortType == "New" && startedAt.After(job.Since) {
+			percent = 100 * float64(startedAt.Sub(target.oldest)) / float64(startedAt.Sub(job.Since))
+			if percent > 100 {
+				percent = 100
+			}
+		}
+	}
+
+	log.Infof("Backfill %s: page %d, reached %s, %d posts, %d media downloaded",
+		target.name, job.NextPage-1, reached, job.PostsProcessed, job.MediaDownloaded)
+
+	if s.Progress == nil {
+		return
+	}
+	s.Progress.UpdateOperation(fmt.Sprintf("Backfilling %s: page %d, reached %s", target.name, job.NextPage-1, reached))
+	s.Progress.UpdateCounts(stats.Processed, stats.Downloaded, stats.Errors)
+	if percent > 0 {
+		s.Progress.UpdateProgress(percent)
+	}
+}
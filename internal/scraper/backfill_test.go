@@ -0,0 +1,125 @@
+package scraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+// datedPost builds a post published the given number of days after 2024-01-01
+func datedPost(id int64, day int) models.PostView {
+	pv := testPost(id)
+	pv.Post.Published = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).AddDate(0, 0, day)
+	return pv
+}
+
+// fullPage builds a page of 50 posts, newest first, all on the given day
+func fullPage(firstID int64, day int) []models.PostView {
+	page := make([]models.PostView, 0, 50)
+	for i := int64(0); i < 50; i++ {
+		page = append(page, datedPost(firstID-i, day))
+	}
+	return page
+}
+
+func TestBackfillStopsAtDateBound(t *testing.T) {
+	since := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	pages := [][]models.PostView{
+		fullPage(200, 20),
+		append(fullPage(150, 12)[:48], datedPost(101, 5), datedPost(100, 4)),
+		fullPage(99, 3),
+	}
+	s := setupTestScraper(t, pages)
+
+	// Already-seen posts must not stop a backfill
+	for _, pv := range pages[0][:5] {
+		if err := s.DB.MarkPostAsScraped(s.Config.Lemmy.Instance, &pv, 0); err != nil {
+			t.Fatalf("MarkPostAsScraped() error = %v", err)
+		}
+	}
+
+	if err := s.Backfill(context.Background(), BackfillOptions{Community: "pics", Since: since}); err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+
+	for id, want := range map[int64]bool{200: true, 151: true, 103: true, 101: false, 99: false} {
+		exists, err := s.DB.PostExists(s.Config.Lemmy.Instance, id)
+		if err != nil {
+			t.Fatalf("PostExists() error = %v", err)
+		}
+		if exists != want {
+			t.Errorf("post %d processed = %v, want %v", id, exists, want)
+		}
+	}
+
+	job, err := s.DB.GetBackfillJob("pics", "New", since)
+	if err != nil {
+		t.Fatalf("GetBackfillJob() error = %v", err)
+	}
+	if job == nil || job.CompletedAt == nil {
+		t.Fatalf("backfill job = %+v, want completed", job)
+	}
+	if job.NextPage != 3 {
+		t.Errorf("NextPage = %d, want 3", job.NextPage)
+	}
+}
+
+func TestBackfillResumes(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pages := [][]models.PostView{
+		fullPage(200, 20),
+		{datedPost(150, 15), datedPost(149, 14)},
+	}
+	s := setupTestScraper(t, pages)
+
+	// An earlier backfill was interrupted after the first page
+	err := s.DB.SaveBackfillJob(&database.BackfillJob{
+		Source:    "pics",
+		SortType:  "New",
+		Since:     since,
+		NextPage:  2,
+		StartedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("SaveBackfillJob() error = %v", err)
+	}
+
+	if err := s.Backfill(context.Background(), BackfillOptions{Community: "pics", Since: since}); err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+
+	for id, want := range map[int64]bool{200: false, 150: true, 149: true} {
+		exists, err := s.DB.PostExists(s.Config.Lemmy.Instance, id)
+		if err != nil {
+			t.Fatalf("PostExists() error = %v", err)
+		}
+		if exists != want {
+			t.Errorf("post %d processed = %v, want %v", id, exists, want)
+		}
+	}
+}
+
+func TestBackfillInvalidOptions(t *testing.T) {
+	s := setupTestScraper(t, nil)
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		opts BackfillOptions
+	}{
+		{name: "missing community", opts: BackfillOptions{Since: since}},
+		{name: "missing since", opts: BackfillOptions{Community: "pics"}},
+		{name: "unsupported sort", opts: BackfillOptions{Community: "pics", Since: since, SortType: "Hot"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Backfill(context.Background(), tt.opts); err == nil {
+				t.Error("Backfill() error = nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrRunInProgress is returned by StartRun when another run is active
+var ErrRunInProgress = errors.New("a scrape run is already in progress")
+
+// ErrShuttingDown is returned for runs requested after Shutdown
+var ErrShuttingDown = errors.New("scraper is shutting down")
+
+// StartRun starts a run in the background. source selects what to scrape: an
+// empty source runs all configured communities, hotSource the hot page and
+// anything else the named community. Returns ErrRunInProgress if a run,
+// scheduled or otherwise, is already active.
+func (s *Scraper) StartRun(source string) error {
+	return s.startRun(source, false)
+}
+
+// StartDryRun starts a dry run in the background, like StartRun. Its report
+// is available from LastDryRun.
+func (s *Scraper) StartDryRun(source string) error {
+	return s.startRun(source, true)
+}
+
+// startRun starts a run or dry run of source in the background
+func (s *Scraper) startRun(source string, dryRun bool) error {
+	if !s.runMu.TryLock() {
+		return ErrRunInProgress
+	}
+
+	// Register the run before returning so it can be cancelled right away
+	ctx, err := s.beginControl(context.Background())
+	if err != nil {
+		s.runMu.Unlock()
+		return err
+	}
+
+	s.applyPendingConfig()
+	var communities []config.CommunityConfig
+	switch source {
+	case "":
+		communities = s.Config.Lemmy.Communities
+	case hotSource:
+	default:
+		communities = []config.CommunityConfig{s.communityConfig(source)}
+	}
+
+	if dryRun {
+		s.beginDryRun()
+	}
+
+	go func() {
+		defer s.runMu.Unlock()
+		defer s.endControl()
+		if dryRun {
+			defer s.endDryRun()
+		}
+		if err := s.runLocked(ctx, communities); err != nil && ctx.Err() == nil {
+			log.Errorf("Scrape run failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Cancel cancels the active run. Returns false if no run is active.
+func (s *Scraper) Cancel() bool {
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+
+	if s.cancel == nil {
+		return false
+	}
+	log.Info("Cancelling scrape run")
+	s.cancel()
+	s.releasePause()
+	s.setState(progress.StateCancelling)
+	return true
+}
+
+// Pause pauses the active run before its next post. Returns false if no run
+// is active or it is already paused.
+func (s *Scraper) Pause() bool {
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+
+	if s.cancel == nil || s.resume != nil {
+		return false
+	}
+	s.resume = make(chan struct{})
+	s.setState(progress.StatePaused)
+	return true
+}
+
+// Resume resumes a paused run. Returns false if no run is paused.
+func (s *Scraper) Resume() bool {
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+
+	if s.resume == nil {
+		return false
+	}
+	s.releasePause()
+	s.setState(progress.StateRunning)
+	return true
+}
+
+// Shutdown stops the scraper from starting new runs and waits for the active
+// run to finish. If ctx expires first the run is cancelled, and Shutdown
+// returns ctx's error once it has stopped.
+func (s *Scraper) Shutdown(ctx context.Context) error {
+	s.ctrlMu.Lock()
+	s.closed = true
+	s.ctrlMu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		s.runMu.Lock()
+		s.runMu.Unlock()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Warn("Scrape run did not finish in time, cancelling it")
+	s.Cancel()
+	<-idle
+	return ctx.Err()
+}
+
+// beginControl registers a new active run and returns its cancellable
+// context. Returns ErrShuttingDown once Shutdown has been called.
+func (s *Scraper) beginControl(parent context.Context) (context.Context, error) {
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+
+	if s.closed {
+		return nil, ErrShuttingDown
+	}
+	ctx, cancel := context.WithCancel(parent)
+	s.cancel = cancel
+	s.resume = nil
+	return ctx, nil
+}
+
+// endControl clears the control state once the active run has finished
+func (s *Scraper) endControl() {
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.releasePause()
+}
+
+// releasePause wakes a paused run. The caller must hold ctrlMu.
+func (s *Scraper) releasePause() {
+	if s.resume != nil {
+		close(s.resume)
+		s.resume = nil
+	}
+}
+
+// setState publishes the run state to the progress tracker
+func (s *Scraper) setState(state string) {
+	if s.Progress != nil {
+		s.Progress.SetState(state)
+	}
+}
+
+// waitIfPaused blocks while the run is paused. Returns the context's error
+// if the run has been cancelled.
+func (s *Scraper) waitIfPaused(ctx context.Context) error {
+	s.ctrlMu.Lock()
+	resume := s.resume
+	s.ctrlMu.Unlock()
+
+	if resume != nil {
+		log.Info("Scrape run paused")
+		select {
+		case <-resume:
+			if ctx.Err() == nil {
+				log.Info("Scrape run resumed")
+			}
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err()
+}
+
+// sleepContext waits for the given duration. Returns false if the context was
+// cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func TestRunControl(t *testing.T) {
+	s := setupTestScraper(t, nil)
+
+	if s.Cancel() || s.Pause() || s.Resume() {
+		t.Fatal("control actions succeeded without an active run")
+	}
+
+	ctx, err := s.beginControl(context.Background())
+	if err != nil {
+		t.Fatalf("beginControl() error = %v", err)
+	}
+	defer s.endControl()
+
+	if !s.Pause() {
+		t.Fatal("Pause() = false, want true")
+	}
+	if s.Pause() {
+		t.Error("second Pause() = true, want false")
+	}
+
+	// A paused run blocks until it is resumed
+	waited := make(chan error, 1)
+	go func() { waited <- s.waitIfPaused(ctx) }()
+	select {
+	case <-waited:
+		t.Fatal("waitIfPaused() returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !s.Resume() {
+		t.Fatal("Resume() = false, want true")
+	}
+	if err := <-waited; err != nil {
+		t.Errorf("waitIfPaused() after resume = %v, want nil", err)
+	}
+
+	// Cancelling releases a paused run
+	s.Pause()
+	go func() { waited <- s.waitIfPaused(ctx) }()
+	if !s.Cancel() {
+		t.Fatal("Cancel() = false, want true")
+	}
+	if err := <-waited; !errors.Is(err, context.Canceled) {
+		t.Errorf("waitIfPaused() after cancel = %v, want context.Canceled", err)
+	}
+}
+
+func TestStartRunRejectsConcurrentRun(t *testing.T) {
+	s := setupTestScraper(t, nil)
+
+	s.runMu.Lock()
+	if err := s.StartRun(""); !errors.Is(err, ErrRunInProgress) {
+		t.Errorf("StartRun() error = %v, want ErrRunInProgress", err)
+	}
+	s.runMu.Unlock()
+}
+
+func TestCancelledRunLeavesNoTrace(t *testing.T) {
+	s := setupTestScraper(t, [][]models.PostView{{testPost(2), testPost(1)}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run() error = %v, want context.Canceled", err)
+	}
+
+	checkpoint, err := s.DB.GetCheckpoint(hotSource)
+	if err != nil {
+		t.Fatalf("GetCheckpoint() error = %v", err)
+	}
+	if checkpoint != nil {
+		t.Errorf("checkpoint = %+v, want none after a cancelled run", checkpoint)
+	}
+	exists, err := s.DB.PostExists(s.Config.Lemmy.Instance, 2)
+	if err != nil {
+		t.Fatalf("PostExists() error = %v", err)
+	}
+	if exists {
+		t.Error("post was marked as scraped by a cancelled run")
+	}
+
+	// The scraper is usable again afterwards
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, 2); !exists {
+		t.Error("post was not scraped by the following run")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := setupTestScraper(t, nil)
+
+	// Simulate an active run that only stops when cancelled
+	s.runMu.Lock()
+	runCtx, err := s.beginControl(context.Background())
+	if err != nil {
+		t.Fatalf("beginControl() error = %v", err)
+	}
+	go func() {
+		<-runCtx.Done()
+		s.endControl()
+		s.runMu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want context.DeadlineExceeded", err)
+	}
+	if runCtx.Err() == nil {
+		t.Error("active run was not cancelled")
+	}
+
+	// No new runs start afterwards
+	if err := s.Run(context.Background()); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Run() error = %v, want ErrShuttingDown", err)
+	}
+	if err := s.StartRun(""); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("StartRun() error = %v, want ErrShuttingDown", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown() error = %v, want nil", err)
+	}
+}
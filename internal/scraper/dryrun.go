@@ -0,0 +1,227 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Decisions recorded for posts and media in a dry run
+const (
+	DecisionDownload     = "download"      // The media would be downloaded
+	DecisionNoMedia      = "no_media"      // The post has no media URLs
+	DecisionFiltered     = "filtered"      // A filter rule rejected the post
+	DecisionDeferred     = "deferred"      // The post would wait in the score queue
+	DecisionSeen         = "seen"          // The post was scraped by an earlier run
+	DecisionSkipped      = "skipped"       // The post is skipped by a scraper setting
+	DecisionTypeDisabled = "type_disabled" // Downloads of this media type are disabled
+	DecisionDuplicate    = "duplicate"     // Media from this URL is already stored
+	DecisionTooLarge     = "too_large"     // The media exceeds the maximum file size
+	DecisionProbeFailed  = "probe_failed"  // The server did not describe the media
+)
+
+// DryRunReport lists what a dry run would have done with each post
+type DryRunReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Posts      []PostReport `json:"posts"`
+}
+
+// PostReport is the dry run decision for a single post
+type PostReport struct {
+	PostID   int64         `json:"post_id"`
+	Title    string        `json:"title"`
+	Source   string        `json:"source"`
+	Decision string        `json:"decision"`
+	Reason   string        `json:"reason,omitempty"`
+	Media    []MediaReport `json:"media,omitempty"`
+}
+
+// MediaReport is the dry run decision for a media URL found in a post
+type MediaReport struct {
+	URL      string                  `json:"url"`
+	Resolver string                  `json:"resolver"`
+	Decision string                  `json:"decision"`
+	Reason   string                  `json:"reason,omitempty"`
+	Probe    *downloader.ProbeResult `json:"probe,omitempty"`
+}
+
+// dryRun collects the report of an active dry run. It is read by the API
+// while the run is still adding to it.
+type dryRun struct {
+	mu     sync.Mutex
+	report DryRunReport
+}
+
+// newDryRun starts an empty report
+func newDryRun() *dryRun {
+	return &dryRun{report: DryRunReport{StartedAt: time.Now(), Posts: []PostReport{}}}
+}
+
+// add records a post decision and logs it
+func (d *dryRun) add(post PostReport) {
+	d.mu.Lock()
+	d.report.Posts = append(d.report.Posts, post)
+	d.mu.Unlock()
+
+	if post.Reason != "" {
+		log.Infof("Dry run: post %d in %s: %s (%s)", post.PostID, post.Source, post.Decision, post.Reason)
+	} else {
+		log.Infof("Dry run: post %d in %s: %s", post.PostID, post.Source, post.Decision)
+	}
+	for _, media := range post.Media {
+		log.Infof("Dry run:   %s [%s] %s", media.URL, media.Resolver, media.Decision)
+	}
+}
+
+// finish records the end of the run
+func (d *dryRun) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.report.FinishedAt = &now
+}
+
+// snapshot returns a copy of the report so far
+func (d *dryRun) snapshot() *DryRunReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	report := d.report
+	report.Posts = append([]PostReport(nil), d.report.Posts...)
+	return &report
+}
+
+// DryRun runs the named communities, or all configured communities when names
+// is nil, without downloading or recording anything. Posts are fetched,
+// filtered and checked against earlier runs as usual, and media URLs are
+// probed for their type and size.
+func (s *Scraper) DryRun(ctx context.Context, names []string) (*DryRunReport, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	ctx, err := s.beginControl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.endControl()
+
+	s.applyPendingConfig()
+	run := s.beginDryRun()
+	err = s.runLocked(ctx, s.communitiesFor(names))
+	s.endDryRun()
+	return run.snapshot(), err
+}
+
+// LastDryRun returns the report of the active or most recent dry run, or nil
+// if there has not been one
+func (s *Scraper) LastDryRun() *DryRunReport {
+	s.ctrlMu.Lock()
+	run := s.lastDryRun
+	s.ctrlMu.Unlock()
+
+	if run == nil {
+		return nil
+	}
+	return run.snapshot()
+}
+
+// beginDryRun makes the run being started a dry run. The caller must hold
+// runMu.
+func (s *Scraper) beginDryRun() *dryRun {
+	run := newDryRun()
+	s.dryRun = run
+
+	s.ctrlMu.Lock()
+	s.lastDryRun = run
+	s.ctrlMu.Unlock()
+	return run
+}
+
+// endDryRun finishes the active dry run. The caller must hold runMu.
+func (s *Scraper) endDryRun() {
+	s.dryRun.finish()
+	s.dryRun = nil
+}
+
+// reportPost records a decision for a post that is not processed further.
+// It does nothing outside dry runs.
+func (s *Scraper) reportPost(postView models.PostView, target *scrapeTarget, decision, reason string) {
+	if s.dryRun == nil {
+		return
+	}
+	s.dryRun.add(PostReport{
+		PostID:   postView.Post.ID,
+		Title:    postView.Post.Name,
+		Source:   target.name,
+		Decision: decision,
+		Reason:   reason,
+	})
+}
+
+// dryRunPost records what processPost would do with a post: which media URLs
+// it would download, and why any would be skipped
+func (s *Scraper) dryRunPost(ctx context.Context, postView models.PostView, target *scrapeTarget, stats *runStats) {
+	sc := target.settings
+	post := PostReport{
+		PostID:   postView.Post.ID,
+		Title:    postView.Post.Name,
+		Source:   target.name,
+		Decision: DecisionNoMedia,
+	}
+
+	for _, candidate := range s.extractMedia(postView) {
+		media := MediaReport{URL: candidate.url, Resolver: candidate.resolver}
+
+		switch {
+		case !downloader.ShouldDownload(candidate.url, sc.IncludeImages, sc.IncludeVideos, sc.IncludeOtherMedia):
+			media.Decision = DecisionTypeDisabled
+			stats.Skipped++
+		case s.mediaURLExists(candidate.url):
+			media.Decision = DecisionDuplicate
+			stats.Skipped++
+		default:
+			probe, err := s.Downloader.Probe(ctx, candidate.url)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				media.Decision = DecisionProbeFailed
+				media.Reason = err.Error()
+				stats.Errors++
+				break
+			}
+			media.Probe = probe
+			if probe.Size > downloader.MaxFileSize {
+				media.Decision = DecisionTooLarge
+				media.Reason = fmt.Sprintf("%d bytes", probe.Size)
+				stats.Errors++
+				break
+			}
+			media.Decision = DecisionDownload
+			post.Decision = DecisionDownload
+			stats.Downloaded++
+		}
+		post.Media = append(post.Media, media)
+	}
+
+	if post.Decision == DecisionNoMedia && len(post.Media) > 0 {
+		post.Decision = DecisionSkipped
+		post.Reason = "no media would be downloaded"
+	}
+	s.dryRun.add(post)
+}
+
+// mediaURLExists reports whether media has already been downloaded from url
+func (s *Scraper) mediaURLExists(url string) bool {
+	exists, err := s.DB.MediaURLExists(url)
+	if err != nil {
+		log.Errorf("Failed to check if media exists: %v", err)
+		return false
+	}
+	return exists
+}
@@ -0,0 +1,136 @@
+package scraper
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+// roundTripFunc serves HTTP requests without a network
+type roundTripFunc func(*http.Request) *http.Response
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r), nil
+}
+
+func TestDryRunLeavesArchivedPostsUnchanged(t *testing.T) {
+	post := testPost(1)
+	post.Post.ApID = "https://lemmy.example/post/1"
+	s := setupTestScraper(t, [][]models.PostView{{post}})
+
+	// A post archived before ActivityPub ids were stored
+	legacy := testPost(1)
+	if err := s.DB.MarkPostAsScraped(s.Config.Lemmy.Instance, &legacy, 0); err != nil {
+		t.Fatalf("MarkPostAsScraped() error = %v", err)
+	}
+
+	if _, err := s.DryRun(context.Background(), nil); err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	var apID *string
+	if err := s.DB.Get(&apID, `SELECT ap_id FROM scraped_posts WHERE post_id = 1`); err != nil || apID != nil {
+		t.Errorf("ap_id after a dry run = %v, %v; want NULL", apID, err)
+	}
+
+	// A real run records it
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if err := s.DB.Get(&apID, `SELECT ap_id FROM scraped_posts WHERE post_id = 1`); err != nil || apID == nil || *apID != post.Post.ApID {
+		t.Errorf("ap_id after a run = %v, %v; want %s", apID, err, post.Post.ApID)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	withURL := func(pv models.PostView, url string) models.PostView {
+		pv.Post.URL = url
+		return pv
+	}
+	filtered := testPost(4)
+	filtered.Post.Name = "Spoiler inside"
+
+	s := setupTestScraper(t, [][]models.PostView{{
+		withURL(testPost(5), "https://media.example/photo.png"),
+		filtered,
+		withURL(testPost(3), "https://media.example/clip.mp4"),
+		withURL(testPost(2), "http://localhost/photo.jpg"),
+		testPost(1),
+	}})
+	s.Config.Scraper.IncludeVideos = false
+	s.Config.Filters = config.FilterConfig{TitleExclude: []string{"(?i)spoiler"}}
+
+	var probes []string
+	s.Downloader.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		probes = append(probes, r.Method+" "+r.URL.String())
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"image/png"}},
+			ContentLength: 1234,
+			Body:          io.NopCloser(strings.NewReader("")),
+			Request:       r,
+		}
+	})}
+
+	report, err := s.DryRun(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if report.FinishedAt == nil {
+		t.Error("report is not finished")
+	}
+
+	want := map[int64]string{
+		5: DecisionDownload,
+		4: DecisionFiltered,
+		3: DecisionSkipped,
+		2: DecisionSkipped,
+		1: DecisionNoMedia,
+	}
+	if len(report.Posts) != len(want) {
+		t.Fatalf("report has %d posts, want %d: %+v", len(report.Posts), len(want), report.Posts)
+	}
+	for _, post := range report.Posts {
+		if post.Decision != want[post.PostID] {
+			t.Errorf("post %d decision = %q, want %q", post.PostID, post.Decision, want[post.PostID])
+		}
+		switch post.PostID {
+		case 5:
+			media := post.Media[0]
+			if media.Resolver != resolverPostURL || media.Probe == nil || media.Probe.MediaType != "image" || media.Probe.Size != 1234 {
+				t.Errorf("post 5 media = %+v, want a probed image of 1234 bytes from post_url", media)
+			}
+		case 3:
+			if post.Media[0].Decision != DecisionTypeDisabled {
+				t.Errorf("post 3 media decision = %q, want %q", post.Media[0].Decision, DecisionTypeDisabled)
+			}
+		case 2:
+			if post.Media[0].Decision != DecisionProbeFailed {
+				t.Errorf("post 2 media decision = %q, want %q", post.Media[0].Decision, DecisionProbeFailed)
+			}
+		}
+	}
+	if len(probes) != 1 || probes[0] != "HEAD https://media.example/photo.png" {
+		t.Errorf("probes = %v, want a single HEAD of the image", probes)
+	}
+
+	// Nothing was recorded
+	for id := range want {
+		if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, id); exists {
+			t.Errorf("post %d was marked as scraped by a dry run", id)
+		}
+	}
+	if checkpoint, _ := s.DB.GetCheckpoint(hotSource); checkpoint != nil {
+		t.Errorf("checkpoint = %+v, want none after a dry run", checkpoint)
+	}
+	if runs, _ := s.DB.GetRecentScraperRuns(10); len(runs) != 0 {
+		t.Errorf("dry run recorded %d scraper runs, want 0", len(runs))
+	}
+	if last := s.LastDryRun(); last == nil || len(last.Posts) != len(want) {
+		t.Error("LastDryRun() does not return the report")
+	}
+}
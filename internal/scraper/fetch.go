@@ -0,0 +1,151 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidPostRef is returned by FetchPost for references that are neither
+// a post ID nor a URL
+var ErrInvalidPostRef = errors.New("expected a post ID, post URL or ActivityPub id")
+
+// ErrPostNotFound is returned by FetchPost when a reference does not resolve
+// to a post
+var ErrPostNotFound = errors.New("reference does not resolve to a post")
+
+// FetchResult describes a post archived by FetchPost
+type FetchResult struct {
+	PostID     int64   `json:"post_id"`
+	Title      string  `json:"title"`
+	Community  string  `json:"community"`
+	MediaIDs   []int64 `json:"media_ids"`
+	Downloaded int     `json:"downloaded"`
+	Skipped    int     `json:"skipped"`
+	Errors     int     `json:"errors"`
+}
+
+// FetchPost archives a single post, given its local ID, its URL on the
+// configured instance, or its URL or ActivityPub id on any instance, which is
+// resolved through the configured instance. The post's media, thumbnails and
+// comments are stored as in a run, regardless of filters and of whether the
+// post was seen before. Returns ErrRunInProgress if a run is active.
+func (s *Scraper) FetchPost(ctx context.Context, ref string) (*FetchResult, error) {
+	if !s.runMu.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer s.runMu.Unlock()
+
+	ctx, err := s.beginControl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.endControl()
+
+	s.applyPendingConfig()
+	postView, err := s.resolvePost(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := s.fetchTarget(postView.Community)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Fetching post %d: %s", postView.Post.ID, postView.Post.Name)
+	stats := newRunStats()
+	media := s.processPost(ctx, *postView, target, stats)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &FetchResult{
+		PostID:     postView.Post.ID,
+		Title:      postView.Post.Name,
+		Community:  postView.Community.Name,
+		MediaIDs:   make([]int64, 0, len(media)),
+		Downloaded: stats.Downloaded,
+		Skipped:    stats.Skipped,
+		Errors:     stats.Errors,
+	}
+	for _, m := range media {
+		result.MediaIDs = append(result.MediaIDs, m.ID)
+	}
+	return result, nil
+}
+
+// fetchTarget returns the scrape target for a post's community, so its
+// media type settings apply. Remote communities configured as name@instance
+// are matched by their instance.
+func (s *Scraper) fetchTarget(community models.Community) (*scrapeTarget, error) {
+	name := community.Name
+	if u, err := url.Parse(community.ActorID); err == nil && u.Hostname() != "" && !community.Local {
+		qualified := name + "@" + u.Hostname()
+		for _, configured := range s.Config.Lemmy.Communities {
+			if strings.EqualFold(configured.Name, qualified) {
+				name = configured.Name
+				break
+			}
+		}
+	}
+	return s.targetFor(name)
+}
+
+// resolvePost fetches the post a reference points to. Local IDs and local
+// post URLs are read directly, anything else is resolved as a federated object.
+func (s *Scraper) resolvePost(ctx context.Context, ref string) (*models.PostView, error) {
+	postID, query, err := parsePostRef(ref, s.Config.Lemmy.Instance)
+	if err != nil {
+		return nil, err
+	}
+
+	if postID > 0 {
+		resp, err := s.API.GetPost(ctx, postID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get post %d: %w", postID, err)
+		}
+		return &resp.PostView, nil
+	}
+
+	resp, err := s.API.ResolveObject(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", query, err)
+	}
+	if resp.Post == nil {
+		return nil, ErrPostNotFound
+	}
+	return resp.Post, nil
+}
+
+// parsePostRef splits a post reference into a local post ID, or a query to
+// resolve when the post lives on another instance
+func parsePostRef(ref, instance string) (int64, string, error) {
+	ref = strings.TrimSpace(ref)
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		if id <= 0 {
+			return 0, "", ErrInvalidPostRef
+		}
+		return id, "", nil
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, "", ErrInvalidPostRef
+	}
+
+	if strings.EqualFold(u.Host, instance) {
+		if rest, ok := strings.CutPrefix(u.Path, "/post/"); ok {
+			if id, err := strconv.ParseInt(strings.TrimSuffix(rest, "/"), 10, 64); err == nil && id > 0 {
+				return id, "", nil
+			}
+		}
+	}
+	return 0, ref, nil
+}
@@ -0,0 +1,81 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func TestParsePostRef(t *testing.T) {
+	tests := []struct {
+		ref       string
+		wantID    int64
+		wantQuery string
+		wantErr   bool
+	}{
+		{ref: "42", wantID: 42},
+		{ref: " 42 ", wantID: 42},
+		{ref: "https://lemmy.test/post/42", wantID: 42},
+		{ref: "https://LEMMY.test/post/42/", wantID: 42},
+		{ref: "https://lemmy.world/post/42", wantQuery: "https://lemmy.world/post/42"},
+		{ref: "https://lemmy.test/c/pics", wantQuery: "https://lemmy.test/c/pics"},
+		{ref: "0", wantErr: true},
+		{ref: "pics", wantErr: true},
+		{ref: "ftp://lemmy.test/post/42", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		id, query, err := parsePostRef(tt.ref, "lemmy.test")
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidPostRef) {
+				t.Errorf("parsePostRef(%q) error = %v, want ErrInvalidPostRef", tt.ref, err)
+			}
+			continue
+		}
+		if err != nil || id != tt.wantID || query != tt.wantQuery {
+			t.Errorf("parsePostRef(%q) = %d, %q, %v; want %d, %q", tt.ref, id, query, err, tt.wantID, tt.wantQuery)
+		}
+	}
+}
+
+func TestFetchPost(t *testing.T) {
+	pv := testPost(7)
+	pv.Post.URL = "https://media.example/photo.png"
+	pv.Post.Name = "Spoiler"
+	s := setupTestScraper(t, [][]models.PostView{{pv}})
+	// Fetching a post bypasses the filters
+	s.Config.Filters.TitleExclude = []string{"(?i)spoiler"}
+	s.Downloader.HTTPClient = serveMedia(t, map[string][]byte{"/photo.png": []byte("png data")})
+
+	result, err := s.FetchPost(context.Background(), "7")
+	if err != nil {
+		t.Fatalf("FetchPost() error = %v", err)
+	}
+	if result.PostID != 7 || result.Downloaded != 1 || len(result.MediaIDs) != 1 {
+		t.Fatalf("FetchPost() = %+v, want post 7 with one downloaded media", result)
+	}
+	media, err := s.DB.GetMediaByID(result.MediaIDs[0])
+	if err != nil || media.PostID != 7 {
+		t.Errorf("GetMediaByID() = %+v, %v; want media of post 7", media, err)
+	}
+	if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, 7); !exists {
+		t.Error("fetched post was not marked as scraped")
+	}
+
+	// Fetching it again returns the stored media
+	again, err := s.FetchPost(context.Background(), "7")
+	if err != nil {
+		t.Fatalf("second FetchPost() error = %v", err)
+	}
+	if len(again.MediaIDs) != 1 || again.MediaIDs[0] != result.MediaIDs[0] {
+		t.Errorf("second FetchPost() media = %v, want %v", again.MediaIDs, result.MediaIDs)
+	}
+
+	s.runMu.Lock()
+	if _, err := s.FetchPost(context.Background(), "7"); !errors.Is(err, ErrRunInProgress) {
+		t.Errorf("FetchPost() during a run error = %v, want ErrRunInProgress", err)
+	}
+	s.runMu.Unlock()
+}
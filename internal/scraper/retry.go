@@ -0,0 +1,265 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/api"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrFailureNotFound is returned by RetryDownload for unknown failure IDs
+var ErrFailureNotFound = errors.New("download failure not found")
+
+// RetryResult describes a download retried by RetryDownload
+type RetryResult struct {
+	MediaID int64                     `json:"media_id,omitempty"` // Set when the download succeeded
+	Failure *database.DownloadFailure `json:"failure,omitempty"`  // Set when it failed again
+}
+
+// retryDelay returns how long to wait after a download failed for the given
+// number of attempts: the initial delay, doubled after each further attempt
+// up to the maximum delay
+func retryDelay(attempts int, initial, max time.Duration) time.Duration {
+	delay := initial
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// recordDownloadFailure records a failed download so a later run retries it.
+// Downloads that cannot succeed, or that used up their attempts, fail
+// permanently and are only retried on request.
+func (s *Scraper) recordDownloadFailure(postView models.PostView, mediaURL string, downloadErr error) *database.DownloadFailure {
+	if s.dryRun != nil {
+		return nil
+	}
+	failure, err := s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, postView.Post.ID, mediaURL)
+	if err != nil {
+		log.Errorf("Failed to record download failure of %s: %v", mediaURL, err)
+		return nil
+	}
+	if failure == nil {
+		failure = &database.DownloadFailure{
+			Instance:      s.Config.Lemmy.Instance,
+			PostID:        postView.Post.ID,
+			MediaURL:      mediaURL,
+			FirstFailedAt: time.Now(),
+		}
+	}
+	failure.ApID = postView.Post.ApID
+	failure.PostTitle = postView.Post.Name
+	failure.CommunityName = postView.Community.Name
+	return s.failDownload(failure, downloadErr)
+}
+
+// failDownload counts a failed attempt at a recorded download and schedules
+// its next retry, or fails it permanently when the media or its post is gone
+// or it used up its attempts
+func (s *Scraper) failDownload(failure *database.DownloadFailure, downloadErr error) *database.DownloadFailure {
+	now := time.Now()
+	failure.Attempts++
+	failure.LastError = downloadErr.Error()
+	failure.LastAttemptAt = now
+
+	retries := s.Config.Scraper.Retries
+	if downloader.Permanent(downloadErr) || errors.Is(downloadErr, api.ErrNotFound) || errors.Is(downloadErr, ErrPostNotFound) ||
+		failure.Attempts >= retries.MaxAttempts {
+		failure.Status = database.FailurePermanent
+		failure.NextRetryAt = nil
+	} else {
+		next := now.Add(retryDelay(failure.Attempts, retries.InitialDelay, retries.MaxDelay))
+		failure.Status = database.FailurePending
+		failure.NextRetryAt = &next
+	}
+
+	if err := s.DB.SaveDownloadFailure(failure); err != nil {
+		log.Errorf("Failed to record download failure of %s: %v", failure.MediaURL, err)
+		return nil
+	}
+	if failure.Status == database.FailurePermanent {
+		log.Warnf("Giving up on %s after %d attempts: %s", failure.MediaURL, failure.Attempts, failure.LastError)
+	} else {
+		log.Debugf("Retrying %s after %s", failure.MediaURL, failure.NextRetryAt.Format(time.RFC3339))
+	}
+	return failure
+}
+
+// clearDownloadFailure removes the recorded failure of a media URL in a post
+// scraped from an instance, if any, once it was downloaded
+func (s *Scraper) clearDownloadFailure(instance string, postID int64, mediaURL string) {
+	if err := s.DB.RemoveDownloadFailure(instance, postID, mediaURL); err != nil {
+		log.Errorf("Failed to remove download failure of %s: %v", mediaURL, err)
+	}
+}
+
+// processDownloadFailures retries the failed downloads that are due. Their
+// posts were marked as scraped when the download failed, so this is the only
+// way their media is downloaded.
+func (s *Scraper) processDownloadFailures(ctx context.Context, stats *runStats) {
+	failures, err := s.DB.GetDueDownloadFailures(time.Now())
+	if err != nil {
+		log.Errorf("Failed to load download failures: %v", err)
+		return
+	}
+	if len(failures) == 0 {
+		return
+	}
+
+	log.Infof("Retrying %d failed downloads", len(failures))
+	posts := make(map[database.ArchivedPost]*models.PostView)
+	downloaded := 0
+
+	for i := range failures {
+		if s.waitIfPaused(ctx) != nil {
+			return
+		}
+		media, _, err := s.retryDownload(ctx, &failures[i], posts, stats)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Leave the failure as it is and try again on the next run
+			log.Errorf("Failed to retry %s: %v", failures[i].MediaURL, err)
+			stats.Errors++
+			continue
+		}
+		if media != nil {
+			downloaded++
+		}
+	}
+
+	log.Infof("Download retries: %d of %d downloaded", downloaded, len(failures))
+}
+
+// retryDownload downloads the media of a failed download again, fetching its
+// post through the API unless it is in posts. It returns the media when the
+// download succeeded and the updated failure when it, or fetching its post,
+// failed again. Errors are only returned when the failure could not be
+// updated or ctx was cancelled.
+func (s *Scraper) retryDownload(ctx context.Context, failure *database.DownloadFailure, posts map[database.ArchivedPost]*models.PostView, stats *runStats) (*models.ScrapedMedia, *database.DownloadFailure, error) {
+	key := database.ArchivedPost{Instance: failure.Instance, PostID: failure.PostID}
+	postView, ok := posts[key]
+	if !ok {
+		var err error
+		postView, err = s.refetchPost(ctx, failure.Instance, failure.PostID, failure.ApID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			stats.Errors++
+			return nil, s.failDownload(failure, err), nil
+		}
+		posts[key] = postView
+	}
+
+	if postView.Post.Deleted || postView.Post.Removed {
+		failure.Status = database.FailurePermanent
+		failure.LastError = "post was deleted or removed"
+		failure.LastAttemptAt = time.Now()
+		failure.NextRetryAt = nil
+		if err := s.DB.SaveDownloadFailure(failure); err != nil {
+			return nil, nil, err
+		}
+		return nil, failure, nil
+	}
+
+	media, err := s.Downloader.DownloadMedia(ctx, failure.MediaURL, *postView)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		stats.Errors++
+		return nil, s.failDownload(failure, err), nil
+	}
+
+	log.Infof("Downloaded %s on attempt %d", failure.MediaURL, failure.Attempts+1)
+	s.clearDownloadFailure(failure.Instance, failure.PostID, failure.MediaURL)
+	s.countRetriedMedia(*postView)
+	s.generateThumbnail(ctx, media)
+	s.transcode(ctx, media)
+	stats.Downloaded++
+
+	// Comments are only fetched for posts with media
+	s.scrapeComments(ctx, postView.Post.ID)
+	return media, nil, nil
+}
+
+// countRetriedMedia adds a retried download to the media count of its
+// archived post, which was marked as scraped when the download failed
+func (s *Scraper) countRetriedMedia(postView models.PostView) {
+	archived, err := s.DB.FindPost(s.Config.Lemmy.Instance, postView.Post.ID, postView.Post.ApID)
+	if err != nil {
+		log.Errorf("Failed to find archived post %d: %v", postView.Post.ID, err)
+		return
+	}
+	if archived == nil {
+		log.Warnf("Post %d of a retried download is not archived", postView.Post.ID)
+		return
+	}
+	if err := s.DB.AddPostMedia(archived.Instance, archived.PostID, 1); err != nil {
+		log.Errorf("Failed to count media of post %d: %v", postView.Post.ID, err)
+	}
+}
+
+// refetchPost fetches a post recorded earlier, such as the post of a failed
+// download or a queued post. Its local ID is only valid on the instance it
+// was seen on; on any other instance the post is resolved by its ActivityPub
+// id, as FetchPost does.
+func (s *Scraper) refetchPost(ctx context.Context, instance string, postID int64, apID string) (*models.PostView, error) {
+	if instance == s.Config.Lemmy.Instance {
+		resp, err := s.API.GetPost(ctx, postID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get post %d: %w", postID, err)
+		}
+		return &resp.PostView, nil
+	}
+	if apID == "" {
+		return nil, fmt.Errorf("post %d of %s has no ActivityPub id: %w", postID, instance, ErrPostNotFound)
+	}
+	return s.resolvePost(ctx, apID)
+}
+
+// RetryDownload retries a failed download right away, whether or not its
+// retry is due or it failed permanently. Returns ErrRunInProgress if a run is
+// active and ErrFailureNotFound for unknown IDs.
+func (s *Scraper) RetryDownload(ctx context.Context, id int64) (*RetryResult, error) {
+	if !s.runMu.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer s.runMu.Unlock()
+
+	ctx, err := s.beginControl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.endControl()
+
+	s.applyPendingConfig()
+	failure, err := s.DB.GetDownloadFailure(id)
+	if err != nil {
+		return nil, err
+	}
+	if failure == nil {
+		return nil, ErrFailureNotFound
+	}
+
+	media, failure, err := s.retryDownload(ctx, failure, make(map[database.ArchivedPost]*models.PostView), newRunStats())
+	if err != nil {
+		return nil, err
+	}
+	result := &RetryResult{Failure: failure}
+	if media != nil {
+		result.MediaID = media.ID
+	}
+	return result, nil
+}
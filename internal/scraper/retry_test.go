@@ -0,0 +1,242 @@
+package scraper
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Minute},
+		{2, 20 * time.Minute},
+		{3, 40 * time.Minute},
+		{10, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts, 10*time.Minute, time.Hour); got != tt.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// mediaServer answers media downloads with the status in *status
+func mediaServer(status *int) *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: *status,
+			Header:     http.Header{"Content-Type": []string{"image/png"}},
+			Body:       io.NopCloser(strings.NewReader("png data " + r.URL.Path)),
+			Request:    r,
+		}
+	})}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	flaky, gone := testPost(1), testPost(2)
+	flaky.Post.URL = "https://media.example/flaky.png"
+	gone.Post.URL = "https://media.example/gone.png"
+	s := setupTestScraper(t, [][]models.PostView{{flaky, gone}})
+	s.Config.Scraper.Retries = config.RetryConfig{MaxAttempts: 3, InitialDelay: time.Hour, MaxDelay: 4 * time.Hour}
+
+	status := http.StatusServiceUnavailable
+	s.Downloader.HTTPClient = mediaServer(&status)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, 1); !exists {
+		t.Fatal("post with a failed download was not marked as scraped")
+	}
+
+	failure, err := s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, flaky.Post.URL)
+	if err != nil || failure == nil {
+		t.Fatalf("FindDownloadFailure() = %+v, %v", failure, err)
+	}
+	if failure.Status != database.FailurePending || failure.Attempts != 1 || failure.NextRetryAt == nil ||
+		!strings.Contains(failure.LastError, "503") {
+		t.Errorf("failure after the first attempt = %+v", failure)
+	}
+	if due, _ := s.DB.GetDueDownloadFailures(time.Now()); len(due) != 0 {
+		t.Errorf("%d failures are due before their delay, want 0", len(due))
+	}
+
+	// A second failure doubles the delay
+	ageFailures(t, s)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	failure, _ = s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, flaky.Post.URL)
+	if failure.Attempts != 2 || failure.NextRetryAt.Sub(failure.LastAttemptAt) < 2*time.Hour-time.Second {
+		t.Errorf("failure after the second attempt = %+v, want a 2h delay", failure)
+	}
+
+	// A client error fails permanently
+	status = http.StatusNotFound
+	ageFailures(t, s)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	failures, total, err := s.DB.ListDownloadFailures(database.FailurePermanent, 10, 0)
+	if err != nil || total != 2 {
+		t.Fatalf("ListDownloadFailures() = %d permanent failures, %v; want 2", total, err)
+	}
+	if failures[0].NextRetryAt != nil {
+		t.Errorf("permanent failure has a next retry: %+v", failures[0])
+	}
+
+	// Permanent failures are only retried on request
+	status = http.StatusOK
+	ageFailures(t, s)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if _, total, _ := s.DB.ListDownloadFailures(database.FailurePermanent, 10, 0); total != 2 {
+		t.Errorf("%d permanent failures left after a run, want 2", total)
+	}
+
+	failure, _ = s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, flaky.Post.URL)
+	result, err := s.RetryDownload(context.Background(), failure.ID)
+	if err != nil {
+		t.Fatalf("RetryDownload() error = %v", err)
+	}
+	if result.MediaID == 0 || result.Failure != nil {
+		t.Errorf("RetryDownload() = %+v, want downloaded media", result)
+	}
+	if media, err := s.DB.GetMediaByID(result.MediaID); err != nil || media.MediaURL != flaky.Post.URL {
+		t.Errorf("GetMediaByID() = %+v, %v", media, err)
+	}
+	if f, _ := s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, flaky.Post.URL); f != nil {
+		t.Errorf("failure still recorded after the download succeeded: %+v", f)
+	}
+	var counts struct {
+		MediaCount int  `db:"media_count"`
+		HadMedia   bool `db:"had_media"`
+	}
+	if err := s.DB.Get(&counts, `SELECT media_count, had_media FROM scraped_posts WHERE post_id = 1`); err != nil ||
+		counts.MediaCount != 1 || !counts.HadMedia {
+		t.Errorf("post after the retry = %+v, %v; want 1 media", counts, err)
+	}
+
+	if _, err := s.RetryDownload(context.Background(), 999); err != ErrFailureNotFound {
+		t.Errorf("RetryDownload() of an unknown failure error = %v, want ErrFailureNotFound", err)
+	}
+}
+
+func TestDownloadRetriesRunOut(t *testing.T) {
+	post := testPost(1)
+	post.Post.URL = "https://media.example/flaky.png"
+	s := setupTestScraper(t, [][]models.PostView{{post}})
+	s.Config.Scraper.Retries = config.RetryConfig{MaxAttempts: 2, InitialDelay: time.Minute, MaxDelay: time.Hour}
+
+	status := http.StatusBadGateway
+	s.Downloader.HTTPClient = mediaServer(&status)
+	for i := 0; i < 2; i++ {
+		if err := s.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		ageFailures(t, s)
+	}
+
+	failure, _ := s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, post.Post.URL)
+	if failure == nil || failure.Status != database.FailurePermanent || failure.Attempts != 2 {
+		t.Errorf("failure after using up its attempts = %+v, want permanent after 2", failure)
+	}
+}
+
+func TestDownloadRetriesCountPostLookups(t *testing.T) {
+	post := testPost(1)
+	post.Post.URL = "https://media.example/flaky.png"
+	pages := [][]models.PostView{{post}}
+	s := setupTestScraper(t, pages)
+	s.Config.Scraper.Retries = config.RetryConfig{MaxAttempts: 5, InitialDelay: time.Hour, MaxDelay: 4 * time.Hour}
+
+	status := http.StatusServiceUnavailable
+	s.Downloader.HTTPClient = mediaServer(&status)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// An instance that does not answer counts as an attempt, with backoff
+	apiClient := s.API.HTTPClient
+	s.API.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader("")), Request: r}
+	})}
+	ageFailures(t, s)
+	s.processDownloadFailures(context.Background(), newRunStats())
+	failure, _ := s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, post.Post.URL)
+	if failure == nil || failure.Status != database.FailurePending || failure.Attempts != 2 ||
+		failure.NextRetryAt.Sub(failure.LastAttemptAt) < 2*time.Hour-time.Second {
+		t.Fatalf("failure after the post lookup failed = %+v, want pending with a 2h delay", failure)
+	}
+
+	// A post that is gone fails permanently
+	s.API.HTTPClient = apiClient
+	pages[0] = nil
+	ageFailures(t, s)
+	s.processDownloadFailures(context.Background(), newRunStats())
+	failure, _ = s.DB.FindDownloadFailure(s.Config.Lemmy.Instance, 1, post.Post.URL)
+	if failure == nil || failure.Status != database.FailurePermanent || failure.Attempts != 3 || failure.NextRetryAt != nil {
+		t.Errorf("failure after its post was not found = %+v, want permanent", failure)
+	}
+}
+
+func TestDownloadRetriesAfterInstanceChange(t *testing.T) {
+	post := testPost(1)
+	post.Post.ApID = "https://old.example/post/1"
+	post.Post.URL = "https://media.example/flaky.png"
+	pages := [][]models.PostView{{post}}
+	s := setupTestScraper(t, pages)
+	s.Config.Lemmy.Instance = "old.example"
+	s.Config.Scraper.Retries = config.RetryConfig{MaxAttempts: 5, InitialDelay: time.Hour, MaxDelay: 4 * time.Hour}
+
+	status := http.StatusServiceUnavailable
+	s.Downloader.HTTPClient = mediaServer(&status)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	failure, _ := s.DB.FindDownloadFailure("old.example", 1, post.Post.URL)
+	if failure == nil || failure.Instance != "old.example" || failure.ApID != post.Post.ApID {
+		t.Fatalf("failure = %+v, want the instance and ActivityPub id of its post", failure)
+	}
+
+	// On the new instance the post has another local ID, and ID 1 is another post
+	moved, other := post, testPost(1)
+	moved.Post.ID = 7
+	other.Post.ApID = "https://new.example/post/1"
+	pages[0] = []models.PostView{moved, other}
+	s.Config.Lemmy.Instance = "new.example"
+
+	status = http.StatusOK
+	ageFailures(t, s)
+	s.processDownloadFailures(context.Background(), newRunStats())
+	if f, _ := s.DB.FindDownloadFailure("old.example", 1, post.Post.URL); f != nil {
+		t.Fatalf("failure still recorded after the retry: %+v", f)
+	}
+	var postID int64
+	if err := s.DB.Get(&postID, `SELECT post_id FROM scraped_media WHERE media_url = ?`, post.Post.URL); err != nil || postID != 7 {
+		t.Errorf("retried media stored for post %d, %v; want the resolved post 7", postID, err)
+	}
+	var mediaCount int
+	if err := s.DB.Get(&mediaCount, `SELECT media_count FROM scraped_posts WHERE instance = 'old.example' AND post_id = 1`); err != nil || mediaCount != 1 {
+		t.Errorf("media count of the archived post = %d, %v; want 1", mediaCount, err)
+	}
+}
+
+// ageFailures makes every pending failure due
+func ageFailures(t *testing.T, s *Scraper) {
+	t.Helper()
+	past := time.Now().Add(-time.Minute).UTC()
+	if _, err := s.DB.Exec(`UPDATE download_failures SET next_retry_at = ? WHERE status = ?`, past, database.FailurePending); err != nil {
+		t.Fatalf("failed to age download failures: %v", err)
+	}
+}
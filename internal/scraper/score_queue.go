@@ -0,0 +1,172 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/api"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/filter"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// deferForScore queues a post that failed only the minimum score rule so it
+// can be re-checked once its score has had time to mature. Returns false if
+// the score queue is disabled or the post is already past the deadline, in
+// which case the post should be filtered as usual.
+func (s *Scraper) deferForScore(postView models.PostView, target *scrapeTarget) bool {
+	sq := target.settings.ScoreQueue
+	if !sq.Enabled {
+		return false
+	}
+
+	now := time.Now()
+	published := postView.Post.Published
+	expiresAt := published.Add(sq.Deadline)
+	if !now.Before(expiresAt) {
+		return false
+	}
+
+	checkAfter := published.Add(sq.Maturation)
+	if checkAfter.Before(now) {
+		checkAfter = now.Add(sq.RecheckInterval)
+	}
+	if s.dryRun != nil {
+		return true
+	}
+
+	added, err := s.DB.EnqueueScoreCheck(&database.ScoreQueueEntry{
+		Instance:      s.Config.Lemmy.Instance,
+		PostID:        postView.Post.ID,
+		ApID:          postView.Post.ApID,
+		Source:        target.name,
+		PostTitle:     postView.Post.Name,
+		CommunityName: postView.Community.Name,
+		PostCreated:   published,
+		CheckAfter:    checkAfter,
+		ExpiresAt:     expiresAt,
+		LastScore:     postView.Counts.Score,
+	})
+	if err != nil {
+		log.Errorf("Failed to queue post %d for a score re-check: %v", postView.Post.ID, err)
+		return false
+	}
+	if added {
+		log.Debugf("Queued post %d for a score re-check after %s", postView.Post.ID, checkAfter.Format(time.RFC3339))
+	}
+	return true
+}
+
+// processScoreQueue re-checks queued posts that are due. Posts that now pass
+// the filters are downloaded, posts still below the minimum score are
+// rescheduled until their deadline, and everything else is dropped.
+func (s *Scraper) processScoreQueue(ctx context.Context, stats *runStats) {
+	now := time.Now()
+	entries, err := s.DB.GetDueScoreChecks(now)
+	if err != nil {
+		log.Errorf("Failed to load score queue: %v", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	log.Infof("Re-checking %d queued posts", len(entries))
+	targets := make(map[string]*scrapeTarget)
+	promoted := 0
+
+	for _, entry := range entries {
+		if s.waitIfPaused(ctx) != nil {
+			return
+		}
+
+		target, ok := targets[entry.Source]
+		if !ok {
+			target, err = s.targetFor(entry.Source)
+			if err != nil {
+				log.Errorf("Failed to build filters for %s: %v", entry.Source, err)
+				continue
+			}
+			targets[entry.Source] = target
+		}
+
+		// The post may have been picked up by a regular run in the meantime,
+		// here or from another instance
+		archived, err := s.DB.FindPost(entry.Instance, entry.PostID, entry.ApID)
+		if err != nil {
+			log.Errorf("Failed to check if post exists: %v", err)
+			continue
+		}
+		if archived != nil {
+			s.removeFromScoreQueue(entry)
+			continue
+		}
+
+		fetched, err := s.refetchPost(ctx, entry.Instance, entry.PostID, entry.ApID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, api.ErrNotFound) || errors.Is(err, ErrPostNotFound) {
+				log.Debugf("Dropping queued post %d: %v", entry.PostID, err)
+				s.removeFromScoreQueue(entry)
+				continue
+			}
+			// Leave the entry queued and try again on the next run
+			log.Errorf("Failed to re-check post %d: %v", entry.PostID, err)
+			stats.Errors++
+			continue
+		}
+		postView := *fetched
+
+		if postView.Post.Deleted || postView.Post.Removed {
+			log.Debugf("Dropping queued post %d: post was deleted or removed", entry.PostID)
+			s.dropFromScoreQueue(entry, postView, stats, "")
+			continue
+		}
+
+		result := target.filter.Evaluate(postView)
+		switch {
+		case result.Allowed:
+			log.Debugf("Queued post %d now qualifies with score %d", entry.PostID, postView.Counts.Score)
+			s.removeFromScoreQueue(entry)
+			stats.Processed++
+			promoted++
+			s.processPost(ctx, postView, target, stats)
+
+		case result.Reason == filter.ReasonScore && now.Before(entry.ExpiresAt):
+			nextCheck := now.Add(target.settings.ScoreQueue.RecheckInterval)
+			if nextCheck.After(entry.ExpiresAt) {
+				nextCheck = entry.ExpiresAt
+			}
+			if err := s.DB.RescheduleScoreCheck(entry.Instance, entry.PostID, postView.Counts.Score, nextCheck); err != nil {
+				log.Errorf("Failed to reschedule post %d: %v", entry.PostID, err)
+			}
+
+		default:
+			log.Debugf("Dropping queued post %d (%s): %s", entry.PostID, result.Reason, result.Detail)
+			s.dropFromScoreQueue(entry, postView, stats, result.Reason)
+		}
+	}
+
+	log.Infof("Score queue: %d of %d re-checked posts now qualify", promoted, len(entries))
+}
+
+// dropFromScoreQueue removes a post from the queue and marks it as scraped so
+// it is not queued again. A non-empty reason is counted as a filtered post.
+func (s *Scraper) dropFromScoreQueue(entry database.ScoreQueueEntry, postView models.PostView, stats *runStats, reason string) {
+	s.removeFromScoreQueue(entry)
+	if reason != "" {
+		stats.recordFiltered(reason)
+	}
+	s.markPostScraped(postView, 0)
+}
+
+// removeFromScoreQueue removes a post from the queue, logging failures
+func (s *Scraper) removeFromScoreQueue(entry database.ScoreQueueEntry) {
+	if err := s.DB.RemoveScoreCheck(entry.Instance, entry.PostID); err != nil {
+		log.Errorf("Failed to remove post %d from score queue: %v", entry.PostID, err)
+	}
+}
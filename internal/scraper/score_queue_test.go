@@ -0,0 +1,128 @@
+package scraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func TestScoreQueue(t *testing.T) {
+	rising, stale := testPost(2), testPost(1)
+	rising.Counts.Score, stale.Counts.Score = 2, 2
+	pages := [][]models.PostView{{rising, stale}}
+
+	s := setupTestScraper(t, pages)
+	minScore := 10
+	s.Config.Filters.MinScore = &minScore
+	s.Config.Scraper.ScoreQueue = config.ScoreQueueConfig{
+		Enabled:         true,
+		Maturation:      time.Hour,
+		RecheckInterval: time.Hour,
+		Deadline:        24 * time.Hour,
+	}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for _, id := range []int64{1, 2} {
+		if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, id); exists {
+			t.Errorf("young post %d was filtered instead of queued", id)
+		}
+	}
+	if due, _ := s.DB.GetDueScoreChecks(time.Now().Add(2 * time.Hour)); len(due) != 2 {
+		t.Fatalf("score queue has %d due entries after maturation, want 2", len(due))
+	}
+
+	// One post collects votes, the other runs out of time
+	pages[0][0].Counts.Score = 25
+	past := time.Now().Add(-time.Minute).UTC()
+	if _, err := s.DB.Exec(`UPDATE score_queue SET check_after = ?`, past); err != nil {
+		t.Fatalf("failed to age queue: %v", err)
+	}
+	if _, err := s.DB.Exec(`UPDATE score_queue SET expires_at = ? WHERE post_id = 1`, past); err != nil {
+		t.Fatalf("failed to expire entry: %v", err)
+	}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for _, id := range []int64{1, 2} {
+		if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, id); !exists {
+			t.Errorf("queued post %d was not resolved", id)
+		}
+	}
+	if due, _ := s.DB.GetDueScoreChecks(time.Now().Add(48 * time.Hour)); len(due) != 0 {
+		t.Errorf("score queue has %d entries left, want 0", len(due))
+	}
+}
+
+func TestScoreQueueIgnoresOldPosts(t *testing.T) {
+	old := testPost(1)
+	old.Post.Published = time.Now().Add(-48 * time.Hour)
+
+	s := setupTestScraper(t, [][]models.PostView{{old}})
+	minScore := 10
+	s.Config.Filters.MinScore = &minScore
+	s.Config.Scraper.ScoreQueue = config.ScoreQueueConfig{Enabled: true, Maturation: time.Hour, Deadline: 24 * time.Hour}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, 1); !exists {
+		t.Error("post past the deadline was not filtered")
+	}
+	if due, _ := s.DB.GetDueScoreChecks(time.Now().Add(48 * time.Hour)); len(due) != 0 {
+		t.Errorf("post past the deadline was queued")
+	}
+}
+
+func TestScoreQueueAfterInstanceChange(t *testing.T) {
+	queued := testPost(1)
+	queued.Post.ApID = "https://old.example/post/1"
+	queued.Counts.Score = 2
+	pages := [][]models.PostView{{queued}}
+
+	s := setupTestScraper(t, pages)
+	s.Config.Lemmy.Instance = "old.example"
+	minScore := 10
+	s.Config.Filters.MinScore = &minScore
+	s.Config.Scraper.ScoreQueue = config.ScoreQueueConfig{Enabled: true, Maturation: time.Hour, RecheckInterval: time.Hour, Deadline: 24 * time.Hour}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	due, _ := s.DB.GetDueScoreChecks(time.Now().Add(2 * time.Hour))
+	if len(due) != 1 || due[0].Instance != "old.example" || due[0].ApID != queued.Post.ApID {
+		t.Fatalf("score queue = %+v, want the post with its instance and ActivityPub id", due)
+	}
+
+	// On the new instance the post has another local ID, and ID 1 is another post
+	moved, other := queued, testPost(1)
+	moved.Post.ID = 7
+	moved.Counts.Score = 25
+	other.Post.ApID = "https://new.example/post/1"
+	other.Counts.Score = 25
+	pages[0] = []models.PostView{moved, other}
+	s.Config.Lemmy.Instance = "new.example"
+
+	if _, err := s.DB.Exec(`UPDATE score_queue SET check_after = ?`, time.Now().Add(-time.Minute).UTC()); err != nil {
+		t.Fatalf("failed to age queue: %v", err)
+	}
+	s.processScoreQueue(context.Background(), newRunStats())
+
+	if exists, _ := s.DB.PostExists("new.example", 7); !exists {
+		t.Error("queued post was not resolved by its ActivityPub id")
+	}
+	if exists, _ := s.DB.PostExists("new.example", 1); exists {
+		t.Error("unrelated post with the queued post's local ID was processed")
+	}
+	if due, _ := s.DB.GetDueScoreChecks(time.Now().Add(48 * time.Hour)); len(due) != 0 {
+		t.Errorf("score queue has %d entries left, want 0", len(due))
+	}
+}
@@ -1,13 +1,20 @@
 package scraper
 
 import (
+	"context"
+	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ST2Projects/lemmy-media-scraper/internal/api"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/filter"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/thumbnails"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/transcode"
 	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 	log "github.com/sirupsen/logrus"
 )
@@ -19,91 +26,446 @@ type Scraper struct {
 	DB           *database.DB
 	Downloader   *downloader.Downloader
 	ThumbnailGen *thumbnails.Generator
+	Progress     *progress.Tracker
+
+	// Transcoder converts downloaded videos and animated GIFs when set
+	Transcoder *transcode.Transcoder
+
+	// lastScraped records when each community was last scraped so that
+	// per-community intervals can be honoured across runs
+	lastScraped map[string]time.Time
+
+	// runMu serializes runs, which share the database and lastScraped
+	runMu sync.Mutex
+	// dryRun collects the report while a dry run is active; guarded by runMu
+	dryRun *dryRun
+
+	// ctrlMu guards the control state of the active run
+	ctrlMu sync.Mutex
+	// cancel cancels the active run; nil when no run is active
+	cancel context.CancelFunc
+	// resume is closed to resume a paused run; nil when not paused
+	resume chan struct{}
+	// closed is set by Shutdown to refuse new runs
+	closed bool
+	// pendingConfig is set by UpdateConfig and applied when the next run starts
+	pendingConfig *config.Config
+	// lastDryRun is the active or most recent dry run
+	lastDryRun *dryRun
 }
 
 // New creates a new Scraper instance
-func New(cfg *config.Config, apiClient *api.Client, db *database.DB, dl *downloader.Downloader, thumbnailGen *thumbnails.Generator) *Scraper {
+func New(cfg *config.Config, apiClient *api.Client, db *database.DB, dl *downloader.Downloader, thumbnailGen *thumbnails.Generator, progressTracker *progress.Tracker) *Scraper {
 	return &Scraper{
 		Config:       cfg,
 		API:          apiClient,
 		DB:           db,
 		Downloader:   dl,
 		ThumbnailGen: thumbnailGen,
+		Progress:     progressTracker,
+		lastScraped:  make(map[string]time.Time),
 	}
 }
 
-// Run executes the scraping process
-func (s *Scraper) Run() error {
-	log.Info("Starting scrape run")
+// UpdateConfig replaces the configuration used by the scraper. It takes
+// effect when the next run starts, so an active run is not affected.
+func (s *Scraper) UpdateConfig(cfg *config.Config) {
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+	s.pendingConfig = cfg
+}
+
+// applyPendingConfig switches to the configuration set by UpdateConfig, if
+// any. The caller must hold runMu.
+func (s *Scraper) applyPendingConfig() {
+	s.ctrlMu.Lock()
+	cfg := s.pendingConfig
+	s.pendingConfig = nil
+	s.ctrlMu.Unlock()
+
+	if cfg == nil {
+		return
+	}
+	if cfg.Thumbnails != s.Config.Thumbnails {
+		s.ThumbnailGen = thumbnails.NewFromConfig(cfg.Thumbnails)
+		if s.ThumbnailGen != nil {
+			s.ThumbnailGen.Storage = s.Downloader.Storage
+			s.ThumbnailGen.MediaDir = s.Downloader.BaseDir
+		}
+	}
+	if cfg.Transcode != s.Config.Transcode {
+		s.Transcoder = transcode.NewFromConfig(cfg.Transcode)
+		if s.Transcoder != nil {
+			s.Transcoder.Storage = s.Downloader.Storage
+			s.Transcoder.MediaDir = s.Downloader.BaseDir
+		}
+	}
+	if cfg.Storage.PathTemplate != "" {
+		s.Downloader.PathTemplate = cfg.Storage.PathTemplate
+	}
+	if cfg.Storage.Mode != "" {
+		s.Downloader.Mode = cfg.Storage.Mode
+		s.Downloader.LinkType = cfg.Storage.LinkType
+	}
+	s.Downloader.StripMetadata = cfg.Storage.StripMetadata
+	s.Downloader.SidecarJSON = cfg.Storage.SidecarJSON
+	s.Downloader.SidecarNFO = cfg.Storage.SidecarNFO
+	if cfg.NearDuplicates.MaxDistance != 0 {
+		s.Downloader.NearDuplicateDistance = cfg.NearDuplicates.MaxDistance
+		s.Downloader.SkipNearDuplicates = cfg.NearDuplicates.Action == config.NearDuplicateSkip
+	}
+	s.Config = cfg
+	log.Info("Applied updated configuration")
+}
+
+// Run executes the scraping process for all configured communities, or the
+// hot page when none are configured
+func (s *Scraper) Run(ctx context.Context) error {
+	return s.run(ctx, nil)
+}
+
+// RunCommunities scrapes only the named communities. Names that are not in
+// the config are scraped with the global settings.
+func (s *Scraper) RunCommunities(ctx context.Context, names []string) error {
+	if names == nil {
+		// An empty list scrapes the hot page, nil would mean all communities
+		names = []string{}
+	}
+	return s.run(ctx, names)
+}
+
+// run scrapes the named communities, or all configured communities when names
+// is nil. Concurrent calls wait for the previous run to finish.
+func (s *Scraper) run(ctx context.Context, names []string) error {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	ctx, err := s.beginControl(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.endControl()
+
+	s.applyPendingConfig()
+	return s.runLocked(ctx, s.communitiesFor(names))
+}
+
+// communitiesFor resolves community names to their configured entries, or
+// returns all configured communities when names is nil. The caller must hold
+// runMu so the configuration cannot change underneath it.
+func (s *Scraper) communitiesFor(names []string) []config.CommunityConfig {
+	if names == nil {
+		return s.Config.Lemmy.Communities
+	}
+	communities := make([]config.CommunityConfig, 0, len(names))
+	for _, name := range names {
+		communities = append(communities, s.communityConfig(name))
+	}
+	return communities
+}
+
+// runLocked performs a run. The caller must hold runMu and have registered
+// the run with beginControl.
+func (s *Scraper) runLocked(ctx context.Context, communities []config.CommunityConfig) error {
+	stats := newRunStats()
+	var runID int64
+	if s.dryRun != nil {
+		log.Info("Starting dry run, nothing will be downloaded or recorded")
+	} else {
+		log.Info("Starting scrape run")
+		var err error
+		runID, err = s.DB.StartScraperRun()
+		if err != nil {
+			log.Errorf("Failed to record scraper run: %v", err)
+		}
+	}
+
+	if s.Progress != nil {
+		s.Progress.Start()
+		defer s.Progress.Stop()
+	}
+
+	// Download deferred posts whose score has matured since an earlier run
+	if s.dryRun == nil {
+		s.processScoreQueue(ctx, stats)
+	}
+
+	// Retry downloads that failed in earlier runs
+	if s.dryRun == nil {
+		s.processDownloadFailures(ctx, stats)
+	}
 
-	if len(s.Config.Lemmy.Communities) == 0 {
+	if len(communities) == 0 {
 		// Scrape from hot page
 		log.Info("No communities specified, scraping from hot page")
-		return s.scrapeHotPage()
+		s.reportSource(hotSource, stats)
+		if err := s.scrapeHotPage(ctx, stats); err != nil && ctx.Err() == nil {
+			s.finishRun(runID, stats, "failed")
+			return err
+		}
+		return s.endRun(ctx, runID, stats)
 	}
 
 	// Scrape specific communities
-	for _, community := range s.Config.Lemmy.Communities {
-		log.Infof("Scraping community: %s", community)
-		if err := s.scrapeCommunity(community); err != nil {
-			log.Errorf("Failed to scrape community %s: %v", community, err)
+	for _, community := range communities {
+		if ctx.Err() != nil {
+			break
+		}
+		if !s.isDue(community, time.Now()) {
+			log.Debugf("Skipping community %s, interval %s has not elapsed", community.Name, community.Interval)
+			continue
+		}
+
+		log.Infof("Scraping community: %s", community.Name)
+		s.reportSource(community.Name, stats)
+		if err := s.scrapeCommunity(ctx, community, stats); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Errorf("Failed to scrape community %s: %v", community.Name, err)
+			stats.Errors++
 			continue
 		}
+		if s.dryRun == nil {
+			s.lastScraped[community.Name] = time.Now()
+		}
 	}
 
+	return s.endRun(ctx, runID, stats)
+}
+
+// endRun finishes a run as completed, or as cancelled if its context was
+// cancelled. Returns the cancellation error, if any.
+func (s *Scraper) endRun(ctx context.Context, runID int64, stats *runStats) error {
+	if err := ctx.Err(); err != nil {
+		log.Infof("Scrape run cancelled after %d posts", stats.Processed)
+		s.finishRun(runID, stats, "cancelled")
+		return err
+	}
+	s.finishRun(runID, stats, "completed")
 	return nil
 }
 
+// reportSource publishes the source being scraped and the run totals so far
+// to the progress tracker
+func (s *Scraper) reportSource(source string, stats *runStats) {
+	if s.Progress == nil {
+		return
+	}
+	s.Progress.UpdateCommunity(source)
+	s.Progress.UpdateCounts(stats.Processed, stats.Downloaded, stats.Errors)
+}
+
+// finishRun stores the run totals and marks the run as finished
+func (s *Scraper) finishRun(runID int64, stats *runStats, status string) {
+	if stats.Filtered > 0 {
+		log.Infof("Filtered %d posts: %s", stats.Filtered, stats.formatSkipReasons())
+	}
+	if stats.Deferred > 0 {
+		log.Infof("Deferred %d young posts until their score matures", stats.Deferred)
+	}
+
+	if runID == 0 {
+		return
+	}
+	if err := s.DB.UpdateScraperRun(runID, stats.Processed, stats.Downloaded, stats.Errors); err != nil {
+		log.Errorf("Failed to update scraper run: %v", err)
+	}
+	if err := s.DB.UpdateScraperRunFilters(runID, stats.Filtered, stats.SkipReasons); err != nil {
+		log.Errorf("Failed to update scraper run filters: %v", err)
+	}
+	if err := s.DB.CompleteScraperRun(runID, status); err != nil {
+		log.Errorf("Failed to complete scraper run: %v", err)
+	}
+}
+
+// isDue reports whether a community should be scraped at the given time,
+// based on its own interval and when it was last scraped
+func (s *Scraper) isDue(community config.CommunityConfig, now time.Time) bool {
+	if community.Interval <= 0 {
+		return true
+	}
+	last, ok := s.lastScraped[community.Name]
+	if !ok {
+		return true
+	}
+	return now.Sub(last) >= community.Interval
+}
+
+// scrapeTarget bundles the settings used to scrape a single source
+type scrapeTarget struct {
+	name     string
+	params   api.GetPostsParams
+	settings config.ScraperConfig
+	filter   *filter.Filter
+
+	// checkpoint is the newest post processed by a previous New-sorted run;
+	// when set, pagination continues exactly until posts are older than it
+	checkpoint *database.Checkpoint
+	// newest tracks the newest non-featured post seen during this run
+	newest *database.Checkpoint
+
+	// since is the lower bound on post publish time for backfills. Older
+	// posts end a New-sorted listing and are skipped in other sorts.
+	since time.Time
+	// oldest tracks the oldest non-featured post seen during this run
+	oldest time.Time
+}
+
+// checkpointSort is the only sort order where posts arrive newest first,
+// which is what checkpoint-based stopping relies on
+const checkpointSort = "New"
+
+// stopReason explains why scrapePosts ended pagination
+type stopReason int
+
+const (
+	stopNone       stopReason = iota // Keep paginating
+	stopSeenPosts                    // Seen-post threshold reached
+	stopCheckpoint                   // Passed the source checkpoint
+	stopDateBound                    // Passed the backfill date bound
+	stopError                        // Fetching the page failed
+	stopCancelled                    // The run was cancelled
+)
+
+// trackNewest records a post as the newest seen if it is newer than the current one
+func (t *scrapeTarget) trackNewest(postView models.PostView) {
+	if t.newest != nil && t.newest.IsBefore(postView.Post.Published, postView.Post.ID) {
+		return
+	}
+	t.newest = &database.Checkpoint{
+		Source:        t.name,
+		LastPublished: postView.Post.Published,
+		LastPostID:    postView.Post.ID,
+	}
+}
+
+// hotSource is the source name used for the instance's hot page
+const hotSource = "hot"
+
+// targetFor builds the scrape target for a source (a community name or
+// hotSource) using its effective settings and filters
+func (s *Scraper) targetFor(source string) (*scrapeTarget, error) {
+	if source == hotSource {
+		f, err := filter.New(s.Config.Filters)
+		if err != nil {
+			return nil, err
+		}
+		sc := s.Config.Scraper
+		return &scrapeTarget{
+			name: hotSource,
+			params: api.GetPostsParams{
+				Sort: sc.SortType,
+			},
+			settings: sc,
+			filter:   f,
+		}, nil
+	}
+
+	community := s.communityConfig(source)
+	f, err := filter.New(s.Config.FiltersFor(community))
+	if err != nil {
+		return nil, err
+	}
+	sc := s.Config.ScraperFor(community)
+	return &scrapeTarget{
+		name: community.Name,
+		params: api.GetPostsParams{
+			Sort:          sc.SortType,
+			CommunityName: community.Name,
+		},
+		settings: sc,
+		filter:   f,
+	}, nil
+}
+
+// communityConfig returns the configured entry for a community, or a plain
+// entry using the global settings if it is not in the config
+func (s *Scraper) communityConfig(name string) config.CommunityConfig {
+	for _, community := range s.Config.Lemmy.Communities {
+		if community.Name == name {
+			return community
+		}
+	}
+	return config.CommunityConfig{Name: name}
+}
+
 // scrapeHotPage scrapes posts from the instance's hot page
-func (s *Scraper) scrapeHotPage() error {
-	return s.scrapeWithPagination("hot", api.GetPostsParams{
-		Sort: s.Config.Scraper.SortType,
-	})
+func (s *Scraper) scrapeHotPage(ctx context.Context, stats *runStats) error {
+	target, err := s.targetFor(hotSource)
+	if err != nil {
+		return err
+	}
+	return s.scrapeWithPagination(ctx, target, stats)
 }
 
-// scrapeCommunity scrapes posts from a specific community
-func (s *Scraper) scrapeCommunity(communityName string) error {
-	return s.scrapeWithPagination(communityName, api.GetPostsParams{
-		Sort:          s.Config.Scraper.SortType,
-		CommunityName: communityName,
-	})
+// scrapeCommunity scrapes posts from a specific community using its effective settings
+func (s *Scraper) scrapeCommunity(ctx context.Context, community config.CommunityConfig, stats *runStats) error {
+	target, err := s.targetFor(community.Name)
+	if err != nil {
+		return err
+	}
+	return s.scrapeWithPagination(ctx, target, stats)
 }
 
 // scrapeWithPagination handles paginated scraping to get more than 50 posts
-func (s *Scraper) scrapeWithPagination(source string, baseParams api.GetPostsParams) error {
-	totalDownloaded := 0
-	totalSkipped := 0
-	totalErrors := 0
-	totalProcessed := 0
+func (s *Scraper) scrapeWithPagination(ctx context.Context, target *scrapeTarget, stats *runStats) error {
+	sc := target.settings
+	total := newRunStats()
 	consecutiveSeenPosts := 0
 	page := 1
 
+	useCheckpoint := target.params.Sort == checkpointSort
+	if useCheckpoint {
+		checkpoint, err := s.DB.GetCheckpoint(target.name)
+		if err != nil {
+			return err
+		}
+		target.checkpoint = checkpoint
+		if checkpoint != nil {
+			log.Debugf("Scraping %s until checkpoint %s (post %d)", target.name,
+				checkpoint.LastPublished.Format(time.RFC3339), checkpoint.LastPostID)
+		}
+	}
+
+	reachedEnd := false
 	for {
-		// Calculate how many more posts we can fetch
-		remainingPosts := s.Config.Scraper.MaxPostsPerRun - totalProcessed
-		if remainingPosts <= 0 {
-			log.Infof("Reached maximum posts limit (%d)", s.Config.Scraper.MaxPostsPerRun)
-			break
+		// Calculate how many more posts we can fetch. With a checkpoint the run
+		// is bounded by the checkpoint instead of the per-run limit.
+		limit := 50 // API max is 50 per request
+		if target.checkpoint == nil {
+			remainingPosts := sc.MaxPostsPerRun - total.Processed
+			if remainingPosts <= 0 {
+				log.Infof("Reached maximum posts limit (%d)", sc.MaxPostsPerRun)
+				break
+			}
+			limit = min(limit, remainingPosts)
 		}
 
 		// Set page and limit for this request
-		params := baseParams
+		params := target.params
 		params.Page = page
-		params.Limit = min(50, remainingPosts) // API max is 50 per request
+		params.Limit = limit
 
 		log.Debugf("Fetching page %d with limit %d", page, params.Limit)
 
-		downloaded, skipped, errors, postsReturned, seenInRow, shouldStop := s.scrapePosts(params, source, consecutiveSeenPosts)
+		pageStats, postsReturned, seenInRow, stop := s.scrapePosts(ctx, params, target, consecutiveSeenPosts)
 
-		totalDownloaded += downloaded
-		totalSkipped += skipped
-		totalErrors += errors
-		totalProcessed += postsReturned
+		total.add(pageStats)
+		total.Processed += postsReturned
 
 		consecutiveSeenPosts = seenInRow
 
 		// Check if we should stop
-		if shouldStop {
+		if stop == stopError || stop == stopCancelled {
+			break
+		}
+		if stop == stopCheckpoint {
+			log.Infof("Reached checkpoint for %s, stopping pagination", target.name)
+			reachedEnd = true
+			break
+		}
+		if stop == stopSeenPosts {
 			log.Infof("Stopping pagination due to idempotency rules")
 			break
 		}
@@ -111,11 +473,12 @@ func (s *Scraper) scrapeWithPagination(source string, baseParams api.GetPostsPar
 		// If we got fewer posts than requested, we've reached the end
 		if postsReturned < params.Limit {
 			log.Debugf("Received fewer posts than requested (%d < %d), reached end of available posts", postsReturned, params.Limit)
+			reachedEnd = true
 			break
 		}
 
 		// Only continue to next page if pagination is enabled
-		if !s.Config.Scraper.EnablePagination {
+		if !sc.EnablePagination && target.checkpoint == nil {
 			log.Debug("Pagination disabled, stopping after first page")
 			break
 		}
@@ -123,9 +486,19 @@ func (s *Scraper) scrapeWithPagination(source string, baseParams api.GetPostsPar
 		page++
 	}
 
-	log.Infof("Scrape complete for %s: %d downloaded, %d skipped, %d errors (total %d posts processed)",
-		source, totalDownloaded, totalSkipped, totalErrors, totalProcessed)
-	return nil
+	// Advance the checkpoint once everything newer than it has been processed.
+	// The first run has nothing to catch up on, so it always records one.
+	// A cancelled run or dry run leaves the checkpoint untouched.
+	if useCheckpoint && target.newest != nil && ctx.Err() == nil && s.dryRun == nil && (reachedEnd || target.checkpoint == nil) {
+		if err := s.DB.SaveCheckpoint(target.name, target.newest.LastPublished, target.newest.LastPostID); err != nil {
+			log.Errorf("Failed to save checkpoint for %s: %v", target.name, err)
+		}
+	}
+
+	log.Infof("Scrape complete for %s: %d downloaded, %d skipped, %d filtered, %d errors (total %d posts processed)",
+		target.name, total.Downloaded, total.Skipped, total.Filtered, total.Errors, total.Processed)
+	stats.add(*total)
+	return ctx.Err()
 }
 
 // min returns the minimum of two integers
@@ -137,46 +510,120 @@ func min(a, b int) int {
 }
 
 // scrapePosts fetches and processes posts based on the given parameters
-// Returns: downloaded, skipped, errors, postsReturned, consecutiveSeenPosts, shouldStop
-func (s *Scraper) scrapePosts(params api.GetPostsParams, source string, currentConsecutiveSeen int) (int, int, int, int, int, bool) {
-	postsResp, err := s.API.GetPosts(params)
+// Returns: page stats, postsReturned, consecutiveSeenPosts, stop reason
+func (s *Scraper) scrapePosts(ctx context.Context, params api.GetPostsParams, target *scrapeTarget, currentConsecutiveSeen int) (runStats, int, int, stopReason) {
+	sc := target.settings
+	stats := newRunStats()
+
+	if s.waitIfPaused(ctx) != nil {
+		return *stats, 0, currentConsecutiveSeen, stopCancelled
+	}
+
+	postsResp, err := s.API.GetPosts(ctx, params)
 	if err != nil {
+		if ctx.Err() != nil {
+			return *stats, 0, currentConsecutiveSeen, stopCancelled
+		}
 		log.Errorf("Failed to get posts: %v", err)
-		return 0, 0, 1, 0, currentConsecutiveSeen, true
+		stats.Errors++
+		return *stats, 0, currentConsecutiveSeen, stopError
 	}
 
 	postsReturned := len(postsResp.Posts)
-	log.Debugf("Retrieved %d posts from %s (page %d)", postsReturned, source, params.Page)
+	log.Debugf("Retrieved %d posts from %s (page %d)", postsReturned, target.name, params.Page)
 
-	downloaded := 0
-	skipped := 0
-	errors := 0
 	consecutiveSeenPosts := currentConsecutiveSeen
 
 	for _, postView := range postsResp.Posts {
-		// Check if we've already scraped this post
-		exists, err := s.DB.PostExists(postView.Post.ID)
+		if s.waitIfPaused(ctx) != nil {
+			return *stats, postsReturned, consecutiveSeenPosts, stopCancelled
+		}
+
+		// Featured (pinned) posts sit at the top of every listing regardless of
+		// age, so they never count towards or reset the seen-post threshold
+		// and are ignored for checkpoints
+		featured := postView.Post.FeaturedCommunity || postView.Post.FeaturedLocal
+
+		if !featured && target.checkpoint != nil {
+			if target.checkpoint.IsBefore(postView.Post.Published, postView.Post.ID) {
+				return *stats, postsReturned, consecutiveSeenPosts, stopCheckpoint
+			}
+		}
+		if !featured && params.Sort == checkpointSort {
+			target.trackNewest(postView)
+		}
+
+		if !target.since.IsZero() && postView.Post.Published.Before(target.since) {
+			if !featured && params.Sort == checkpointSort {
+				return *stats, postsReturned, consecutiveSeenPosts, stopDateBound
+			}
+			log.Debugf("Skipping post %d published before %s", postView.Post.ID, target.since.Format("2006-01-02"))
+			s.reportPost(postView, target, DecisionSkipped, "published before "+target.since.Format("2006-01-02"))
+			stats.Skipped++
+			continue
+		}
+		if !featured && (target.oldest.IsZero() || postView.Post.Published.Before(target.oldest)) {
+			target.oldest = postView.Post.Published
+		}
+
+		// Check if we've already scraped this post, here or from another instance
+		archived, err := s.DB.FindPost(s.Config.Lemmy.Instance, postView.Post.ID, postView.Post.ApID)
 		if err != nil {
 			log.Errorf("Failed to check if post exists: %v", err)
 			continue
 		}
 
-		if exists {
+		// A federated post already archived from another instance or under
+		// another local id is only recorded as an alias, so that it is
+		// archived once
+		exists := archived != nil
+		elsewhere := exists && (archived.Instance != s.Config.Lemmy.Instance || archived.PostID != postView.Post.ID)
+		if elsewhere {
+			s.savePostAlias(postView)
+		} else if exists {
+			s.recordPostApID(postView)
+		}
+
+		if featured {
+			if exists && (elsewhere || sc.SkipSeenPosts || sc.StopAtSeenPosts) {
+				log.Debugf("Skipping previously seen featured post (ID: %d)", postView.Post.ID)
+				s.reportPost(postView, target, DecisionSeen, "featured")
+				stats.Skipped++
+				continue
+			}
+			if sc.SkipFeaturedPosts {
+				log.Debugf("Skipping featured post (ID: %d)", postView.Post.ID)
+				s.reportPost(postView, target, DecisionSkipped, "featured")
+				stats.Skipped++
+				s.markPostScraped(postView, 0)
+				continue
+			}
+		} else if exists {
 			consecutiveSeenPosts++
 
-			// Check if we should stop based on threshold
-			if s.Config.Scraper.StopAtSeenPosts {
-				if consecutiveSeenPosts >= s.Config.Scraper.SeenPostsThreshold {
+			// Check if we should stop based on threshold. With a checkpoint
+			// the checkpoint decides when to stop instead.
+			if sc.StopAtSeenPosts && target.checkpoint == nil {
+				if consecutiveSeenPosts >= sc.SeenPostsThreshold {
 					log.Infof("Encountered %d previously seen posts in a row (threshold: %d), stopping",
-						consecutiveSeenPosts, s.Config.Scraper.SeenPostsThreshold)
-					return downloaded, skipped, errors, postsReturned, consecutiveSeenPosts, true
+						consecutiveSeenPosts, sc.SeenPostsThreshold)
+					s.reportPost(postView, target, DecisionSeen, "seen-post threshold reached, stopping")
+					return *stats, postsReturned, consecutiveSeenPosts, stopSeenPosts
 				}
 			}
 
+			if elsewhere {
+				log.Debugf("Skipping post %d, already archived as post %d on %s", postView.Post.ID, archived.PostID, archived.Instance)
+				s.reportPost(postView, target, DecisionSeen, fmt.Sprintf("archived as post %d on %s", archived.PostID, archived.Instance))
+				stats.Skipped++
+				continue
+			}
+
 			// Skip this post if configured to do so
-			if s.Config.Scraper.SkipSeenPosts || s.Config.Scraper.StopAtSeenPosts {
+			if sc.SkipSeenPosts || sc.StopAtSeenPosts {
 				log.Debugf("Skipping previously seen post (ID: %d)", postView.Post.ID)
-				skipped++
+				s.reportPost(postView, target, DecisionSeen, "")
+				stats.Skipped++
 				continue
 			}
 		} else {
@@ -184,63 +631,159 @@ func (s *Scraper) scrapePosts(params api.GetPostsParams, source string, currentC
 			consecutiveSeenPosts = 0
 		}
 
-		// Extract media URLs from the post
-		mediaURLs := s.extractMediaURLs(postView)
-		mediaDownloaded := 0
+		// Apply content filters before looking for media. Filtered posts are
+		// still marked as scraped so they count towards the seen-post logic.
+		if result := target.filter.Evaluate(postView); !result.Allowed {
+			if result.Reason == filter.ReasonScore && s.deferForScore(postView, target) {
+				log.Debugf("Deferred post %d until its score matures: %s", postView.Post.ID, result.Detail)
+				s.reportPost(postView, target, DecisionDeferred, result.Detail)
+				stats.Deferred++
+				continue
+			}
+			log.Debugf("Filtered post %d (%s): %s", postView.Post.ID, result.Reason, result.Detail)
+			s.reportPost(postView, target, DecisionFiltered, result.Reason+": "+result.Detail)
+			stats.recordFiltered(result.Reason)
+			s.markPostScraped(postView, 0)
+			continue
+		}
 
-		if len(mediaURLs) == 0 {
-			log.Debugf("No media found in post: %s (ID: %d)", postView.Post.Name, postView.Post.ID)
-		} else {
-			// Download each media URL
-			for _, mediaURL := range mediaURLs {
-				// Check if we should download this type of media
-				if !downloader.ShouldDownload(
-					mediaURL,
-					s.Config.Scraper.IncludeImages,
-					s.Config.Scraper.IncludeVideos,
-					s.Config.Scraper.IncludeOtherMedia,
-				) {
-					log.Debugf("Skipping media (type not enabled): %s", mediaURL)
-					skipped++
-					continue
-				}
+		if s.dryRun != nil {
+			s.dryRunPost(ctx, postView, target, stats)
+			continue
+		}
+		s.processPost(ctx, postView, target, stats)
+	}
 
-				media, err := s.Downloader.DownloadMedia(mediaURL, postView)
-				if err != nil {
-					if strings.Contains(err.Error(), "already exists") {
-						log.Debugf("Media already exists: %s", mediaURL)
-						skipped++
-					} else {
-						log.Errorf("Failed to download media from %s: %v", mediaURL, err)
-						errors++
-					}
-					continue
-				}
+	return *stats, postsReturned, consecutiveSeenPosts, stopNone
+}
 
-				// Generate thumbnail if enabled
-				s.generateThumbnail(media)
+// processPost downloads the media of a post that passed all checks, marks it
+// as scraped and fetches its comments. Returns the stored media, including
+// media that was already stored by an earlier download.
+func (s *Scraper) processPost(ctx context.Context, postView models.PostView, target *scrapeTarget, stats *runStats) []*models.ScrapedMedia {
+	sc := target.settings
+
+	// Extract media URLs from the post
+	mediaURLs := s.extractMediaURLs(postView)
+	mediaDownloaded := 0
+	var stored []*models.ScrapedMedia
+
+	if len(mediaURLs) == 0 {
+		log.Debugf("No media found in post: %s (ID: %d)", postView.Post.Name, postView.Post.ID)
+	} else {
+		// Download each media URL
+		for _, mediaURL := range mediaURLs {
+			// Check if we should download this type of media
+			if !downloader.ShouldDownload(
+				mediaURL,
+				sc.IncludeImages,
+				sc.IncludeVideos,
+				sc.IncludeOtherMedia,
+			) {
+				log.Debugf("Skipping media (type not enabled): %s", mediaURL)
+				stats.Skipped++
+				continue
+			}
 
-				downloaded++
-				mediaDownloaded++
+			media, err := s.Downloader.DownloadMedia(ctx, mediaURL, postView)
+			if err != nil {
+				if ctx.Err() != nil {
+					// Leave the post unmarked so the next run downloads it
+					return stored
+				}
+				if strings.Contains(err.Error(), "already exists") {
+					log.Debugf("Media already exists: %s", mediaURL)
+					stats.Skipped++
+				} else {
+					log.Errorf("Failed to download media from %s: %v", mediaURL, err)
+					stats.Errors++
+					// The post is still marked as scraped; the failure is retried instead
+					s.recordDownloadFailure(postView, mediaURL, err)
+				}
+				continue
 			}
-		}
+			s.clearDownloadFailure(s.Config.Lemmy.Instance, postView.Post.ID, mediaURL)
 
-		// Mark this post as scraped (even if it had no media)
-		if err := s.DB.MarkPostAsScraped(&postView, mediaDownloaded); err != nil {
-			log.Errorf("Failed to mark post %d as scraped: %v", postView.Post.ID, err)
+			// Generate thumbnail if enabled
+			s.generateThumbnail(ctx, media)
+			s.transcode(ctx, media)
+
+			stats.Downloaded++
+			mediaDownloaded++
+			stored = append(stored, media)
 		}
+	}
+
+	// Mark this post as scraped (even if it had no media)
+	s.markPostScraped(postView, mediaDownloaded)
 
-		// Fetch and store comments if the post had media
-		if mediaDownloaded > 0 {
-			s.scrapeComments(postView.Post.ID)
+	// Fetch and store comments if the post had media
+	if mediaDownloaded > 0 {
+		s.linkCrossPosts(ctx, postView, stored)
+		s.scrapeComments(ctx, postView.Post.ID)
+	}
+	return stored
+}
+
+// linkCrossPosts records the crossposts of a post as further appearances of
+// its media, so a media item lists every community it was posted to
+func (s *Scraper) linkCrossPosts(ctx context.Context, postView models.PostView, media []*models.ScrapedMedia) {
+	postResp, err := s.API.GetPost(ctx, postView.Post.ID)
+	if err != nil {
+		log.Errorf("Failed to fetch crossposts of post %d: %v", postView.Post.ID, err)
+		return
+	}
+
+	for i := range postResp.CrossPosts {
+		crossPost := &postResp.CrossPosts[i]
+		for _, m := range media {
+			if err := s.DB.LinkMediaPost(m.ID, s.Config.Lemmy.Instance, crossPost, database.LinkCrossPost); err != nil {
+				log.Errorf("Failed to link crosspost %d to media %d: %v", crossPost.Post.ID, m.ID, err)
+			}
 		}
 	}
+	if len(postResp.CrossPosts) > 0 {
+		log.Debugf("Linked %d crossposts of post %d", len(postResp.CrossPosts), postView.Post.ID)
+	}
+}
+
+// markPostScraped records a post as scraped so later runs treat it as seen.
+// Dry runs record nothing.
+func (s *Scraper) markPostScraped(postView models.PostView, mediaCount int) {
+	if s.dryRun != nil {
+		return
+	}
+	if err := s.DB.MarkPostAsScraped(s.Config.Lemmy.Instance, &postView, mediaCount); err != nil {
+		log.Errorf("Failed to mark post %d as scraped: %v", postView.Post.ID, err)
+	}
+	s.savePostAlias(postView)
+}
 
-	return downloaded, skipped, errors, postsReturned, consecutiveSeenPosts, false
+// recordPostApID records the ActivityPub id of a seen post archived before
+// ActivityPub ids were stored, so that it is found from other instances. Dry
+// runs record nothing.
+func (s *Scraper) recordPostApID(postView models.PostView) {
+	if s.dryRun != nil || postView.Post.ApID == "" {
+		return
+	}
+	if err := s.DB.SetPostApID(s.Config.Lemmy.Instance, postView.Post.ID, postView.Post.ApID); err != nil {
+		log.Errorf("Failed to record ap_id of post %d: %v", postView.Post.ID, err)
+	}
+}
+
+// savePostAlias records the post's local id on the configured instance
+// against its ActivityPub id. Dry runs record nothing.
+func (s *Scraper) savePostAlias(postView models.PostView) {
+	if s.dryRun != nil || postView.Post.ApID == "" {
+		return
+	}
+	if err := s.DB.SavePostAlias(s.Config.Lemmy.Instance, postView.Post.ID, postView.Post.ApID); err != nil {
+		log.Errorf("Failed to record alias of post %d: %v", postView.Post.ID, err)
+	}
 }
 
 // scrapeComments fetches and stores comments for a post
-func (s *Scraper) scrapeComments(postID int64) {
+func (s *Scraper) scrapeComments(ctx context.Context, postID int64) {
 	// Check if we already have comments for this post
 	exists, err := s.DB.CommentsExistForPost(postID)
 	if err != nil {
@@ -253,7 +796,7 @@ func (s *Scraper) scrapeComments(postID int64) {
 	}
 
 	// Fetch comments from API (max_depth=10, limit=500 to get most comments)
-	commentsResp, err := s.API.GetComments(postID, 10, 500)
+	commentsResp, err := s.API.GetComments(ctx, postID, 10, 500)
 	if err != nil {
 		log.Errorf("Failed to fetch comments for post %d: %v", postID, err)
 		return
@@ -283,7 +826,7 @@ func (s *Scraper) scrapeComments(postID int64) {
 }
 
 // generateThumbnail creates a thumbnail for a downloaded media item
-func (s *Scraper) generateThumbnail(media *models.ScrapedMedia) {
+func (s *Scraper) generateThumbnail(ctx context.Context, media *models.ScrapedMedia) {
 	if s.ThumbnailGen == nil {
 		return
 	}
@@ -301,7 +844,7 @@ func (s *Scraper) generateThumbnail(media *models.ScrapedMedia) {
 		return
 	}
 
-	thumbnailPath, width, height, err := s.ThumbnailGen.GenerateThumbnail(media.FilePath, mimeType)
+	thumbnailPath, width, height, err := s.ThumbnailGen.GenerateThumbnail(ctx, media.FilePath, mimeType)
 	if err != nil {
 		log.Errorf("Failed to generate thumbnail for media %d: %v", media.ID, err)
 		return
@@ -315,36 +858,77 @@ func (s *Scraper) generateThumbnail(media *models.ScrapedMedia) {
 	log.Debugf("Generated thumbnail for media %d: %s (%dx%d)", media.ID, thumbnailPath, width, height)
 }
 
+// transcode converts a downloaded video or animated GIF if enabled
+func (s *Scraper) transcode(ctx context.Context, media *models.ScrapedMedia) {
+	derivative, err := transcode.ForMedia(ctx, s.Transcoder, s.DB, media)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("Failed to transcode media %d: %v", media.ID, err)
+		}
+		return
+	}
+	if derivative == nil {
+		return
+	}
+	if derivative.Error != "" {
+		log.Debugf("Did not transcode media %d: %s", media.ID, derivative.Error)
+		return
+	}
+	log.Debugf("Transcoded media %d to %s (%d bytes)", media.ID, derivative.Format, derivative.FileSize)
+}
+
+// Resolvers name the post field a media URL was taken from
+const (
+	resolverPostURL    = "post_url"
+	resolverEmbedVideo = "embed_video"
+	resolverThumbnail  = "thumbnail"
+)
+
+// mediaCandidate is a media URL found in a post and the field it came from
+type mediaCandidate struct {
+	url      string
+	resolver string
+}
+
 // extractMediaURLs extracts all media URLs from a post
 // Only returns the highest quality version available
 func (s *Scraper) extractMediaURLs(postView models.PostView) []string {
 	var urls []string
+	for _, candidate := range s.extractMedia(postView) {
+		urls = append(urls, candidate.url)
+	}
+	return urls
+}
+
+// extractMedia returns the media URLs of a post along with their resolvers
+func (s *Scraper) extractMedia(postView models.PostView) []mediaCandidate {
+	var candidates []mediaCandidate
 
 	// Priority 1: Main post URL (highest quality, direct link to media)
 	if postView.Post.URL != "" && isMediaURL(postView.Post.URL) {
-		urls = append(urls, postView.Post.URL)
+		candidates = append(candidates, mediaCandidate{postView.Post.URL, resolverPostURL})
 		// If we have a main URL, skip the thumbnail as it's lower quality
 
 		// However, still check for embedded video as it might be different content
 		if postView.Post.EmbedVideoURL != "" && isMediaURL(postView.Post.EmbedVideoURL) {
-			urls = append(urls, postView.Post.EmbedVideoURL)
+			candidates = append(candidates, mediaCandidate{postView.Post.EmbedVideoURL, resolverEmbedVideo})
 		}
 
-		return urls
+		return candidates
 	}
 
 	// Priority 2: Embedded video URL (if no main URL)
 	if postView.Post.EmbedVideoURL != "" && isMediaURL(postView.Post.EmbedVideoURL) {
-		urls = append(urls, postView.Post.EmbedVideoURL)
-		return urls
+		candidates = append(candidates, mediaCandidate{postView.Post.EmbedVideoURL, resolverEmbedVideo})
+		return candidates
 	}
 
 	// Priority 3: Thumbnail URL (fallback, only if no other media found)
 	if postView.Post.ThumbnailURL != "" && isMediaURL(postView.Post.ThumbnailURL) {
-		urls = append(urls, postView.Post.ThumbnailURL)
+		candidates = append(candidates, mediaCandidate{postView.Post.ThumbnailURL, resolverThumbnail})
 	}
 
-	return urls
+	return candidates
 }
 
 // isMediaURL checks if a URL points to a media file
@@ -1,11 +1,119 @@
 package scraper
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ST2Projects/lemmy-media-scraper/internal/api"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
 	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 )
 
+// setupTestScraper creates a Scraper backed by a temp database and a fake
+// Lemmy API that serves the given pages of posts from /post/list and /post.
+func setupTestScraper(t *testing.T, pages [][]models.PostView) *Scraper {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	db, err := database.New(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/post/list", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		resp := models.GetPostsResponse{Posts: []models.PostView{}}
+		if page >= 1 && page <= len(pages) {
+			resp.Posts = pages[page-1]
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/api/v3/post", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		for _, page := range pages {
+			for _, pv := range page {
+				if pv.Post.ID == id {
+					json.NewEncoder(w).Encode(models.GetPostResponse{PostView: pv})
+					return
+				}
+			}
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/api/v3/resolve_object", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		for _, page := range pages {
+			for _, pv := range page {
+				if pv.Post.ApID != "" && pv.Post.ApID == q {
+					json.NewEncoder(w).Encode(models.ResolveObjectResponse{Post: &pv})
+					return
+				}
+			}
+		}
+		http.Error(w, `{"error":"couldnt_find_object"}`, http.StatusBadRequest)
+	})
+	mux.HandleFunc("/api/v3/comment/list", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(models.GetCommentsResponse{})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{
+		Scraper: config.ScraperConfig{
+			MaxPostsPerRun:     50,
+			SeenPostsThreshold: 2,
+			StopAtSeenPosts:    true,
+			SortType:           "New",
+			IncludeImages:      true,
+			IncludeVideos:      true,
+			IncludeOtherMedia:  true,
+		},
+	}
+
+	apiClient := &api.Client{BaseURL: srv.URL + "/api/v3", HTTPClient: srv.Client()}
+	dl := downloader.New(db, filepath.Join(tmpDir, "media"))
+
+	return New(cfg, apiClient, db, dl, nil, nil)
+}
+
+// testPost builds a text-only post view with the given ID
+func testPost(id int64) models.PostView {
+	return models.PostView{
+		Post: models.Post{
+			ID:        id,
+			Name:      "Post " + strconv.FormatInt(id, 10),
+			Published: time.Now(),
+		},
+		Community: models.Community{ID: 1, Name: "pics"},
+		Creator:   models.Person{ID: 1, Name: "alice"},
+	}
+}
+
+// serveMedia answers media downloads with files by URL path, or 404 Not Found
+func serveMedia(t *testing.T, files map[string][]byte) *http.Client {
+	t.Helper()
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("")), Request: r}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(content)), Request: r}
+	})}
+}
+
 func TestIsMediaURL(t *testing.T) {
 	tests := []struct {
 		name string
@@ -181,3 +289,299 @@ func TestExtractMediaURLs(t *testing.T) {
 		})
 	}
 }
+
+func TestIsDue(t *testing.T) {
+	now := time.Now()
+	s := &Scraper{
+		lastScraped: map[string]time.Time{
+			"recent": now.Add(-30 * time.Minute),
+			"stale":  now.Add(-3 * time.Hour),
+		},
+	}
+
+	tests := []struct {
+		name      string
+		community config.CommunityConfig
+		want      bool
+	}{
+		{name: "no interval always due", community: config.CommunityConfig{Name: "recent"}, want: true},
+		{name: "never scraped", community: config.CommunityConfig{Name: "new", Interval: time.Hour}, want: true},
+		{name: "interval not elapsed", community: config.CommunityConfig{Name: "recent", Interval: time.Hour}, want: false},
+		{name: "interval elapsed", community: config.CommunityConfig{Name: "stale", Interval: time.Hour}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.isDue(tt.community, now); got != tt.want {
+				t.Errorf("isDue(%s) = %v, want %v", tt.community.Name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapePostsFeaturedDoNotTriggerStop(t *testing.T) {
+	var pinned []models.PostView
+	for i := int64(1); i <= 3; i++ {
+		pv := testPost(i)
+		pv.Post.FeaturedCommunity = true
+		pinned = append(pinned, pv)
+	}
+	page := append(append([]models.PostView{}, pinned...), testPost(10), testPost(11))
+
+	s := setupTestScraper(t, [][]models.PostView{page})
+
+	// The pinned posts were archived on an earlier run
+	for i := range pinned {
+		if err := s.DB.MarkPostAsScraped(s.Config.Lemmy.Instance, &pinned[i], 0); err != nil {
+			t.Fatalf("MarkPostAsScraped() error = %v", err)
+		}
+	}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for _, id := range []int64{10, 11} {
+		exists, err := s.DB.PostExists(s.Config.Lemmy.Instance, id)
+		if err != nil {
+			t.Fatalf("PostExists() error = %v", err)
+		}
+		if !exists {
+			t.Errorf("post %d below the pinned posts was not processed", id)
+		}
+	}
+}
+
+func TestScrapePostsSkipFeatured(t *testing.T) {
+	pinned := testPost(1)
+	pinned.Post.FeaturedLocal = true
+
+	s := setupTestScraper(t, [][]models.PostView{{pinned, testPost(2)}})
+	s.Config.Scraper.SkipFeaturedPosts = true
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	var featured bool
+	if err := s.DB.Get(&featured, `SELECT featured FROM scraped_posts WHERE post_id = ?`, 1); err != nil {
+		t.Fatalf("failed to read featured flag: %v", err)
+	}
+	if !featured {
+		t.Error("featured flag not recorded for pinned post")
+	}
+
+	if err := s.DB.Get(&featured, `SELECT featured FROM scraped_posts WHERE post_id = ?`, 2); err != nil {
+		t.Fatalf("failed to read featured flag: %v", err)
+	}
+	if featured {
+		t.Error("featured flag recorded for regular post")
+	}
+}
+
+func TestScrapeStopsAtCheckpoint(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	post := func(id int64) models.PostView {
+		pv := testPost(id)
+		pv.Post.Published = base.Add(time.Duration(id) * time.Minute)
+		return pv
+	}
+
+	pages := [][]models.PostView{{post(3), post(2), post(1)}}
+	s := setupTestScraper(t, pages)
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	checkpoint, err := s.DB.GetCheckpoint("hot")
+	if err != nil {
+		t.Fatalf("GetCheckpoint() error = %v", err)
+	}
+	if checkpoint == nil || checkpoint.LastPostID != 3 {
+		t.Fatalf("checkpoint after first run = %+v, want post 3", checkpoint)
+	}
+
+	// Posts 4 and 5 are new; post 6 is older than the checkpoint but was
+	// never scraped, so the run must stop before reaching it
+	old := post(6)
+	old.Post.Published = base
+	pages[0] = []models.PostView{post(5), post(4), post(3), old}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for id, want := range map[int64]bool{4: true, 5: true, 6: false} {
+		exists, err := s.DB.PostExists(s.Config.Lemmy.Instance, id)
+		if err != nil {
+			t.Fatalf("PostExists() error = %v", err)
+		}
+		if exists != want {
+			t.Errorf("post %d processed = %v, want %v", id, exists, want)
+		}
+	}
+
+	checkpoint, err = s.DB.GetCheckpoint("hot")
+	if err != nil {
+		t.Fatalf("GetCheckpoint() error = %v", err)
+	}
+	if checkpoint == nil || checkpoint.LastPostID != 5 {
+		t.Errorf("checkpoint after second run = %+v, want post 5", checkpoint)
+	}
+}
+
+func TestScrapeSkipsPostsArchivedFromAnotherInstance(t *testing.T) {
+	federated := testPost(20)
+	federated.Post.ApID = "https://lemmy.world/post/5"
+	federated.Post.URL = "https://media.example/photo.png"
+	local := testPost(21)
+	local.Post.ApID = "https://lemmy.test/post/21"
+
+	s := setupTestScraper(t, [][]models.PostView{{federated, local}})
+	s.Config.Lemmy.Instance = "lemmy.test"
+	s.Config.Scraper.StopAtSeenPosts = false
+
+	// The same post was archived earlier from lemmy.world, where its id is 5
+	archived := federated
+	archived.Post.ID = 5
+	if err := s.DB.MarkPostAsScraped("lemmy.world", &archived, 1); err != nil {
+		t.Fatalf("MarkPostAsScraped() error = %v", err)
+	}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, 20); exists {
+		t.Error("federated post was archived a second time under its local id")
+	}
+	if exists, _ := s.DB.PostExists(s.Config.Lemmy.Instance, 21); !exists {
+		t.Error("local post was not scraped")
+	}
+	aliases, err := s.DB.GetPostAliases(federated.Post.ApID)
+	if err != nil {
+		t.Fatalf("GetPostAliases() error = %v", err)
+	}
+	if len(aliases) != 1 || aliases[0].Instance != "lemmy.test" || aliases[0].PostID != 20 {
+		t.Errorf("aliases = %+v, want post 20 on lemmy.test", aliases)
+	}
+}
+
+func TestMediaIsLinkedToEveryPost(t *testing.T) {
+	original := testPost(30)
+	original.Post.URL = "https://media.example/photo.png"
+	crossPost := testPost(31)
+	crossPost.Community = models.Community{ID: 2, Name: "art"}
+	reupload := testPost(32)
+	reupload.Post.URL = "https://media.example/copy.png"
+	repost := testPost(33)
+	repost.Post.URL = original.Post.URL
+	repost.Community = models.Community{ID: 3, Name: "memes"}
+
+	s := setupTestScraper(t, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/post", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		for _, pv := range []models.PostView{original, reupload, repost} {
+			if pv.Post.ID == id {
+				resp := models.GetPostResponse{PostView: pv}
+				if id == original.Post.ID {
+					resp.CrossPosts = []models.PostView{crossPost}
+				}
+				json.NewEncoder(w).Encode(resp)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/api/v3/comment/list", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(models.GetCommentsResponse{})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s.API = &api.Client{BaseURL: srv.URL + "/api/v3", HTTPClient: srv.Client()}
+
+	downloads := 0
+	s.Downloader.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		downloads++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"image/png"}},
+			Body:       io.NopCloser(strings.NewReader("png data")),
+			Request:    r,
+		}
+	})}
+
+	var mediaID int64
+	for _, id := range []string{"30", "32", "33"} {
+		result, err := s.FetchPost(context.Background(), id)
+		if err != nil {
+			t.Fatalf("FetchPost(%s) error = %v", id, err)
+		}
+		if len(result.MediaIDs) != 1 {
+			t.Fatalf("FetchPost(%s) media = %v, want one", id, result.MediaIDs)
+		}
+		if mediaID == 0 {
+			mediaID = result.MediaIDs[0]
+		} else if result.MediaIDs[0] != mediaID {
+			t.Errorf("FetchPost(%s) media = %d, want %d", id, result.MediaIDs[0], mediaID)
+		}
+	}
+	if downloads != 2 {
+		t.Errorf("downloads = %d, want 2 (the repost URL is not fetched again)", downloads)
+	}
+
+	posts, err := s.DB.GetMediaPosts(mediaID)
+	if err != nil {
+		t.Fatalf("GetMediaPosts() error = %v", err)
+	}
+	want := map[int64]string{
+		30: database.LinkOriginal,
+		31: database.LinkCrossPost,
+		32: database.LinkHash,
+		33: database.LinkURL,
+	}
+	if len(posts) != len(want) {
+		t.Fatalf("GetMediaPosts() = %+v, want %d posts", posts, len(want))
+	}
+	for _, p := range posts {
+		if want[p.PostID] != p.DetectedBy {
+			t.Errorf("post %d detected by %q, want %q", p.PostID, p.DetectedBy, want[p.PostID])
+		}
+		if p.PostID == crossPost.Post.ID && p.CommunityName != "art" {
+			t.Errorf("crosspost community = %q, want art", p.CommunityName)
+		}
+	}
+}
+
+func TestScrapeArchivesPostsSharingLocalIDs(t *testing.T) {
+	post := testPost(5)
+	post.Post.ApID = "https://lemmy.test/post/5"
+	post.Post.URL = "https://media.example/photo.png"
+
+	s := setupTestScraper(t, [][]models.PostView{{post}})
+	s.Config.Lemmy.Instance = "lemmy.test"
+	s.Config.Scraper.StopAtSeenPosts = false
+	s.Downloader.HTTPClient = serveMedia(t, map[string][]byte{"/photo.png": []byte("png data")})
+
+	// A different post archived earlier from lemmy.world had the same local id
+	other := testPost(5)
+	other.Post.ApID = "https://lemmy.world/post/5"
+	if err := s.DB.MarkPostAsScraped("lemmy.world", &other, 0); err != nil {
+		t.Fatalf("MarkPostAsScraped() error = %v", err)
+	}
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for _, instance := range []string{"lemmy.world", "lemmy.test"} {
+		if exists, _ := s.DB.PostExists(instance, 5); !exists {
+			t.Errorf("post 5 on %s is not archived", instance)
+		}
+	}
+	if media, err := s.DB.GetAllMedia(); err != nil || len(media) != 1 {
+		t.Errorf("GetAllMedia() = %d media, %v; want the media of the new post", len(media), err)
+	}
+}
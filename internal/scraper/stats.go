@@ -0,0 +1,57 @@
+package scraper
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// runStats accumulates counters for a scrape run or a part of one
+type runStats struct {
+	Downloaded  int
+	Skipped     int
+	Errors      int
+	Processed   int
+	Filtered    int
+	Deferred    int            // Young posts queued until their score matures
+	SkipReasons map[string]int // Filter skip reason -> count
+}
+
+// newRunStats creates an empty runStats
+func newRunStats() *runStats {
+	return &runStats{SkipReasons: make(map[string]int)}
+}
+
+// add merges another set of counters into this one
+func (r *runStats) add(other runStats) {
+	r.Downloaded += other.Downloaded
+	r.Skipped += other.Skipped
+	r.Errors += other.Errors
+	r.Processed += other.Processed
+	r.Filtered += other.Filtered
+	r.Deferred += other.Deferred
+	for reason, count := range other.SkipReasons {
+		r.SkipReasons[reason] += count
+	}
+}
+
+// recordFiltered counts a post rejected by the content filters
+func (r *runStats) recordFiltered(reason string) {
+	r.Filtered++
+	r.SkipReasons[reason]++
+}
+
+// formatSkipReasons renders the skip reasons as "reason=count" pairs in a stable order
+func (r *runStats) formatSkipReasons() string {
+	reasons := make([]string, 0, len(r.SkipReasons))
+	for reason := range r.SkipReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%s=%d", reason, r.SkipReasons[reason])
+	}
+	return strings.Join(parts, ", ")
+}
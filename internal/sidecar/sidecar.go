@@ -0,0 +1,264 @@
+// Package sidecar writes metadata files next to stored media, so that files
+// copied out of the archive still say where they came from: a <file>.json
+// sidecar for every file and a Kodi-style <name>.nfo sidecar for videos.
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Metadata describes the post a media file was downloaded from
+type Metadata struct {
+	Title        string    `json:"title"`
+	URL          string    `json:"url"`
+	ApID         string    `json:"ap_id,omitempty"` // ActivityPub id of the post
+	Community    string    `json:"community"`
+	Instance     string    `json:"instance,omitempty"`
+	Author       string    `json:"author"`
+	Score        int       `json:"score"`
+	CommentCount int       `json:"comment_count"`
+	Created      time.Time `json:"created"`
+	Tags         []string  `json:"tags"`
+	MediaHash    string    `json:"media_hash"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// New returns the metadata of a media item. The ActivityPub id and the
+// comment count come from the post, which is not stored with the media.
+func New(media *models.ScrapedMedia, apID string, commentCount int, tags []string) *Metadata {
+	if tags == nil {
+		tags = []string{}
+	}
+	return &Metadata{
+		Title:        media.PostTitle,
+		URL:          media.PostURL,
+		ApID:         apID,
+		Community:    media.CommunityName,
+		Instance:     media.Instance,
+		Author:       media.AuthorName,
+		Score:        media.PostScore,
+		CommentCount: commentCount,
+		Created:      media.PostCreated,
+		Tags:         tags,
+		MediaHash:    media.MediaHash,
+		DownloadedAt: media.DownloadedAt,
+	}
+}
+
+// JSON returns the content of the .json sidecar
+func (m *Metadata) JSON() ([]byte, error) {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
+
+// nfo is the movie format of .nfo files read by Kodi, Jellyfin and Plex
+type nfo struct {
+	XMLName   xml.Name `xml:"movie"`
+	Title     string   `xml:"title"`
+	Premiered string   `xml:"premiered"`
+	Studio    string   `xml:"studio"`
+	Credits   string   `xml:"credits"`
+	UniqueID  *uniqueID
+	Tags      []string `xml:"tag"`
+	DateAdded string   `xml:"dateadded"`
+}
+
+type uniqueID struct {
+	XMLName xml.Name `xml:"uniqueid"`
+	Type    string   `xml:"type,attr"`
+	Default bool     `xml:"default,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+// NFO returns the content of the .nfo sidecar
+func (m *Metadata) NFO() ([]byte, error) {
+	n := nfo{
+		Title:     m.Title,
+		Premiered: m.Created.Format("2006-01-02"),
+		Studio:    m.Community,
+		Credits:   m.Author,
+		Tags:      m.Tags,
+		DateAdded: m.DownloadedAt.Format("2006-01-02 15:04:05"),
+	}
+	if m.Instance != "" {
+		n.Studio += "@" + m.Instance
+	}
+	if m.ApID != "" {
+		n.UniqueID = &uniqueID{Type: "lemmy", Default: true, Value: m.ApID}
+	}
+	content, err := xml.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	buf.Write(content)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Path returns the path of the file a media item's sidecars go next to: its
+// link in content mode, or the file itself
+func Path(media *models.ScrapedMedia) string {
+	if media.LinkPath != "" {
+		return media.LinkPath
+	}
+	return media.FilePath
+}
+
+// JSONPath returns the path of the .json sidecar of a file, e.g.
+// 123_cat.jpg.json for 123_cat.jpg
+func JSONPath(filePath string) string {
+	return filePath + ".json"
+}
+
+// NFOPath returns the path of the .nfo sidecar of a file, which replaces its
+// extension, e.g. 123_clip.nfo for 123_clip.mp4
+func NFOPath(filePath string) string {
+	return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".nfo"
+}
+
+// Writer writes the sidecars of media files into a storage, under their keys
+// relative to BaseDir. Each sidecar is written whole or not at all: local
+// files are renamed into place and objects are uploaded in one request.
+type Writer struct {
+	Storage storage.Storage
+	BaseDir string
+	JSON    bool // Write .json sidecars
+	NFO     bool // Write .nfo sidecars for videos
+}
+
+// Enabled reports whether the writer writes any sidecars
+func (w *Writer) Enabled() bool {
+	return w != nil && (w.JSON || w.NFO)
+}
+
+// Write writes the sidecars of a media item, replacing existing ones
+func (w *Writer) Write(ctx context.Context, media *models.ScrapedMedia, m *Metadata) error {
+	if !w.Enabled() {
+		return nil
+	}
+	filePath := Path(media)
+	if w.JSON {
+		content, err := m.JSON()
+		if err != nil {
+			return fmt.Errorf("failed to encode sidecar: %w", err)
+		}
+		if err := w.put(ctx, JSONPath(filePath), content, "application/json"); err != nil {
+			return err
+		}
+	}
+	if w.NFO && media.MediaType == "video" {
+		content, err := m.NFO()
+		if err != nil {
+			return fmt.Errorf("failed to encode sidecar: %w", err)
+		}
+		if err := w.put(ctx, NFOPath(filePath), content, "text/xml"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put stores the content of a sidecar
+func (w *Writer) put(ctx context.Context, path string, content []byte, contentType string) error {
+	key, err := storage.Key(w.BaseDir, path)
+	if err != nil {
+		return err
+	}
+	if err := w.Storage.Put(ctx, key, bytes.NewReader(content), int64(len(content)), contentType); err != nil {
+		return fmt.Errorf("failed to write sidecar %s: %w", key, err)
+	}
+	return nil
+}
+
+// Remove removes the sidecars of a file, if there are any
+func (w *Writer) Remove(ctx context.Context, filePath string) error {
+	for _, path := range []string{JSONPath(filePath), NFOPath(filePath)} {
+		key, err := storage.Key(w.BaseDir, path)
+		if err != nil {
+			return err
+		}
+		if err := w.Storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove sidecar %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ForRecord returns the metadata of an archived media item, with the details
+// of its post and its tags
+func ForRecord(db *database.DB, media *models.ScrapedMedia) (*Metadata, error) {
+	post, err := db.GetPostDetails(media)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := db.GetMediaTags(media.ID)
+	if err != nil {
+		return nil, err
+	}
+	return New(media, post.ApID, post.CommentCount, tags), nil
+}
+
+// Regenerate writes the sidecars of every archived media item, replacing
+// existing ones. Media whose file is missing is skipped. It returns the
+// number of media items written and skipped; errors on individual items are
+// logged. Cancelling ctx stops it before the next item.
+func Regenerate(ctx context.Context, w *Writer, db *database.DB) (int, int, error) {
+	media, err := db.GetAllMedia()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	written := 0
+	skipped := 0
+	for i := range media {
+		item := &media[i]
+		if err := ctx.Err(); err != nil {
+			return written, skipped, err
+		}
+
+		key, err := storage.Key(w.BaseDir, Path(item))
+		if err == nil {
+			_, err = w.Storage.Stat(ctx, key)
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Debugf("File of media %d is missing: %s", item.ID, Path(item))
+			} else {
+				log.Warnf("Failed to check the file of media %d: %v", item.ID, err)
+			}
+			skipped++
+			continue
+		}
+
+		m, err := ForRecord(db, item)
+		if err == nil {
+			err = w.Write(ctx, item, m)
+		}
+		if err != nil {
+			log.Warnf("Failed to write sidecars of media %d: %v", item.ID, err)
+			skipped++
+			continue
+		}
+		written++
+	}
+	return written, skipped, nil
+}
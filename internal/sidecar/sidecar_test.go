@@ -0,0 +1,154 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func TestPaths(t *testing.T) {
+	if got := JSONPath("/media/pics/123_cat.jpg"); got != "/media/pics/123_cat.jpg.json" {
+		t.Errorf("JSONPath() = %s", got)
+	}
+	if got := NFOPath("/media/pics/123_clip.mp4"); got != "/media/pics/123_clip.nfo" {
+		t.Errorf("NFOPath() = %s", got)
+	}
+	linked := &models.ScrapedMedia{FilePath: "/media/objects/ab/abc.mp4", LinkPath: "/media/pics/1_clip.mp4"}
+	if got := Path(linked); got != linked.LinkPath {
+		t.Errorf("Path() = %s, want the link", got)
+	}
+}
+
+func TestNFO(t *testing.T) {
+	m := &Metadata{
+		Title:        "Cats & dogs",
+		ApID:         "https://lemmy.example/post/1",
+		Community:    "pics",
+		Instance:     "lemmy.example",
+		Author:       "alice",
+		Created:      time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC),
+		Tags:         []string{"cat", "dog"},
+		DownloadedAt: time.Date(2024, 3, 3, 8, 30, 0, 0, time.UTC),
+	}
+	content, err := m.NFO()
+	if err != nil {
+		t.Fatalf("NFO() error = %v", err)
+	}
+	for _, want := range []string{
+		"<title>Cats &amp; dogs</title>",
+		"<premiered>2024-03-02</premiered>",
+		"<studio>pics@lemmy.example</studio>",
+		`<uniqueid type="lemmy" default="true">https://lemmy.example/post/1</uniqueid>`,
+		"<tag>cat</tag>",
+		"<tag>dog</tag>",
+		"<dateadded>2024-03-03 08:30:00</dateadded>",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("NFO() = %s, want %s", content, want)
+		}
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	baseDir := t.TempDir()
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+	defer db.Close()
+
+	save := func(postID int64, name, mediaType string, write bool) *models.ScrapedMedia {
+		t.Helper()
+		filePath := filepath.Join(baseDir, "pics", name)
+		if write {
+			if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filePath, []byte(name), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pv := &models.PostView{
+			Post:      models.Post{ID: postID, Name: name, ApID: "https://lemmy.example/post/" + name, Published: time.Now()},
+			Community: models.Community{ID: 1, Name: "pics"},
+			Creator:   models.Person{ID: 1, Name: "alice"},
+			Counts:    models.PostAggregates{Comments: 5},
+		}
+		if err := db.MarkPostAsScraped("lemmy.example", pv, 1); err != nil {
+			t.Fatalf("MarkPostAsScraped() error = %v", err)
+		}
+		media := &models.ScrapedMedia{
+			PostID: postID, PostTitle: name, CommunityName: "pics", CommunityID: 1,
+			AuthorName: "alice", AuthorID: 1, MediaURL: "https://example.com/" + name,
+			MediaHash: name, FileName: name, FilePath: filePath, MediaType: mediaType,
+			PostURL: "https://example.com/" + name, PostCreated: time.Now(), DownloadedAt: time.Now(),
+		}
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
+			t.Fatalf("SaveMedia() error = %v", err)
+		}
+		return media
+	}
+	photo := save(1, "photo.jpg", "image", true)
+	clip := save(2, "clip.mp4", "video", true)
+	save(3, "missing.png", "image", false)
+
+	if _, err := db.Exec(`INSERT INTO media_tags (name) VALUES ('cat')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO media_tag_assignments (media_id, tag_id) VALUES (?, 1)`, photo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Writer{Storage: storage.NewLocal(baseDir), BaseDir: baseDir, JSON: true, NFO: true}
+	written, skipped, err := Regenerate(context.Background(), w, db)
+	if err != nil {
+		t.Fatalf("Regenerate() error = %v", err)
+	}
+	if written != 2 || skipped != 1 {
+		t.Errorf("Regenerate() = %d written, %d skipped, want 2 and 1", written, skipped)
+	}
+
+	content, err := os.ReadFile(JSONPath(photo.FilePath))
+	if err != nil {
+		t.Fatalf("failed to read JSON sidecar: %v", err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(content, &m); err != nil {
+		t.Fatalf("JSON sidecar does not decode: %v", err)
+	}
+	if m.Title != "photo.jpg" || m.ApID != "https://lemmy.example/post/photo.jpg" || m.CommentCount != 5 ||
+		len(m.Tags) != 1 || m.Tags[0] != "cat" {
+		t.Errorf("JSON sidecar = %+v", m)
+	}
+
+	// Only videos get an .nfo sidecar
+	if _, err := os.Stat(NFOPath(photo.FilePath)); !os.IsNotExist(err) {
+		t.Errorf("image has an NFO sidecar: %v", err)
+	}
+	if _, err := os.Stat(NFOPath(clip.FilePath)); err != nil {
+		t.Errorf("video has no NFO sidecar: %v", err)
+	}
+
+	// Sidecars are written by renaming, so no temporary files are left
+	entries, _ := os.ReadDir(filepath.Join(baseDir, "pics"))
+	if len(entries) != 5 {
+		t.Errorf("pics holds %d files, want 2 media and 3 sidecars", len(entries))
+	}
+
+	if err := w.Remove(context.Background(), clip.FilePath); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	for _, path := range []string{JSONPath(clip.FilePath), NFOPath(clip.FilePath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after Remove()", path)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// Storage stores files under keys, which are slash-separated paths relative
+// to the storage root, e.g. "pics/123_image.jpg". Keys are the same for every
+// backend, so a record's key is its path relative to storage.base_directory.
+// Get and Stat return an error matching fs.ErrNotExist for missing keys.
+type Storage interface {
+	// Put stores size bytes from r at key, replacing any existing file
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the file at key for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat describes the file at key
+	Stat(ctx context.Context, key string) (FileInfo, error)
+	// Delete removes the file at key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// List describes the files whose keys start with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]FileInfo, error)
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Key returns the key of a file recorded at filePath under baseDir
+func Key(baseDir, filePath string) (string, error) {
+	rel, err := filepath.Rel(baseDir, filePath)
+	if err != nil {
+		return "", err
+	}
+	key := filepath.ToSlash(rel)
+	if err := checkKey(key); err != nil {
+		return "", fmt.Errorf("%s is outside %s", filePath, baseDir)
+	}
+	return key, nil
+}
+
+// checkKey rejects keys that are absolute or leave the storage root
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	for _, element := range strings.Split(key, "/") {
+		if element == "" || element == "." || element == ".." {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+// Local stores files in a directory on the local filesystem
+type Local struct {
+	Dir string
+}
+
+// NewLocal creates a Local storage rooted at dir
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+// Path returns the filesystem path of key
+func (l *Local) Path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the file to a temporary file and renames it into place, so
+// readers never see a partial file
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".download-*.part")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return nil
+}
+
+// Get opens the file at key
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Stat describes the file at key
+func (l *Local) Stat(ctx context.Context, key string) (FileInfo, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() {
+		return FileInfo{}, fmt.Errorf("%s is a directory: %w", key, fs.ErrNotExist)
+	}
+	return FileInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the file at key and any directories it leaves empty
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	removeEmptyDirs(filepath.Dir(p), l.Dir)
+	return nil
+}
+
+// List walks the directory holding prefix and returns the files under it.
+// Temporary files of unfinished writes are left out.
+func (l *Local) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	root := l.Dir
+	if dir := path.Dir(prefix); strings.Contains(prefix, "/") && dir != "." {
+		if err := checkKey(dir); err != nil {
+			return nil, err
+		}
+		root = filepath.Join(l.Dir, filepath.FromSlash(dir))
+	}
+
+	var files []FileInfo
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".download-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files, nil
+}
+
+// PutNew stores content at key, or at the first alternative from
+// AlternativePath that is not taken, and returns the key used. Unlike
+// WriteNew it checks and writes in separate steps, so it relies on a single
+// writer per key.
+func PutNew(ctx context.Context, s Storage, key, hash string, content []byte, contentType string) (string, error) {
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		candidate := AlternativePath(key, hash, attempt)
+		_, err := s.Stat(ctx, candidate)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err := s.Put(ctx, candidate, bytes.NewReader(content), int64(len(content)), contentType); err != nil {
+			return "", err
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("failed to store file: %s and %d alternatives already exist", key, maxNameAttempts-1)
+}
+
+// LocalCopy returns a path on the local filesystem holding the file at key,
+// for tools such as ffmpeg that need one. Files of a Local storage are used
+// in place; others are downloaded to a temporary file, which the returned
+// function removes.
+func LocalCopy(ctx context.Context, s Storage, key string) (string, func(), error) {
+	if local, ok := s.(*Local); ok {
+		p, err := local.Path(key)
+		return p, func() {}, err
+	}
+
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "media-*"+path.Ext(key))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to copy %s: %w", key, err)
+	}
+	return tmp.Name(), cleanup, nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Storage modes
+const (
+	ModePath    = "path"    // Files are stored at the path template
+	ModeContent = "content" // Files are stored by hash under objects/ and linked from the path template
+)
+
+// Link types for the path template tree in content mode
+const (
+	LinkHard     = "hardlink"
+	LinkSymbolic = "symlink"
+	LinkNone     = "none"
+)
+
+// ObjectsDir is the directory under the base directory holding files stored
+// by hash
+const ObjectsDir = "objects"
+
+var objectPattern = regexp.MustCompile(`^objects/[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{64}(\.[^/.]+)?$`)
+
+// ObjectPath returns where content with the given hash is stored in content
+// mode: objects/ab/cd/<hash>.<ext>
+func ObjectPath(baseDir, hash, ext string) string {
+	name := hash
+	if ext = SanitizeName(strings.TrimPrefix(ext, ".")); ext != "" {
+		name += "." + ext
+	}
+	if len(hash) < 4 {
+		return filepath.Join(baseDir, ObjectsDir, name)
+	}
+	return filepath.Join(baseDir, ObjectsDir, hash[0:2], hash[2:4], name)
+}
+
+// IsObjectPath reports whether a slash-separated path relative to the base
+// directory names a stored object. Objects never change, so they can be
+// cached indefinitely.
+func IsObjectPath(rel string) bool {
+	return objectPattern.MatchString(rel)
+}
+
+// WriteObject stores content at an object path unless it already exists,
+// which for an object means the same content is stored. It reports whether
+// the object was created.
+func WriteObject(path string, content []byte) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*.part")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to write object: %w", err)
+	}
+
+	err = os.Link(tmp.Name(), path)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		// Filesystems without hard links
+		err = writeExclusive(path, content)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to write object: %w", err)
+	}
+	return true, nil
+}
+
+// LinkNew links path, or the first free alternative from AlternativePath, to
+// target and returns the path linked. A path that already links to target is
+// reused.
+func LinkNew(target, path, hash, linkType string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create link directory: %w", err)
+	}
+
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		candidate := AlternativePath(path, hash, attempt)
+		err := makeLink(target, candidate, linkType)
+		if err == nil || (errors.Is(err, fs.ErrExist) && sameFile(target, candidate)) {
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("failed to link %s: %w", candidate, err)
+		}
+	}
+	return "", fmt.Errorf("failed to link %s: it and %d alternatives already exist", path, maxNameAttempts-1)
+}
+
+// makeLink creates a hard link or a relative symbolic link at path
+func makeLink(target, path, linkType string) error {
+	switch linkType {
+	case LinkHard:
+		return os.Link(target, path)
+	case LinkSymbolic:
+		rel, err := filepath.Rel(filepath.Dir(path), target)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(rel, path)
+	default:
+		return fmt.Errorf("unknown link type %q", linkType)
+	}
+}
+
+// sameFile reports whether two paths resolve to the same file
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
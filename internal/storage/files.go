@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxNameAttempts bounds how many alternative names WriteNew tries
+const maxNameAttempts = 100
+
+// AlternativePath returns the name to try for a file after attempt names
+// were taken. The first alternative adds a fragment of the content hash, later
+// ones a counter as well, keeping the extension and MaxNameLength.
+func AlternativePath(path, hash string, attempt int) string {
+	if attempt == 0 {
+		return path
+	}
+
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	suffix := "_" + truncate(hash, 8)
+	if attempt > 1 {
+		suffix += "_" + strconv.Itoa(attempt)
+	}
+	if len(ext)+len(suffix) >= MaxNameLength {
+		ext = ""
+	}
+	base := truncate(strings.TrimSuffix(name, ext), MaxNameLength-len(ext)-len(suffix))
+	return dir + base + suffix + ext
+}
+
+// WriteNew writes content to path, or to the first free alternative from
+// AlternativePath if path is taken. It never replaces an existing file and
+// returns the path written. The content is written to a temporary file and
+// linked into place, so an interrupted write never leaves a truncated file.
+func WriteNew(path, hash string, content []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*.part")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		candidate := AlternativePath(path, hash, attempt)
+
+		err := os.Link(tmp.Name(), candidate)
+		if err == nil {
+			return candidate, nil
+		}
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+
+		// Filesystems without hard links: claim the name by creating it exclusively
+		err = writeExclusive(candidate, content)
+		if err == nil {
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("failed to write file: %w", err)
+		}
+	}
+	return "", fmt.Errorf("failed to write file: %s and %d alternatives already exist", path, maxNameAttempts-1)
+}
+
+// writeExclusive creates a file that must not exist yet and writes content
+// to it, removing it again if the write fails
+func writeExclusive(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
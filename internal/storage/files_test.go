@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAlternativePath(t *testing.T) {
+	path := filepath.Join("pics", "1_image.jpg")
+	tests := []struct {
+		attempt int
+		want    string
+	}{
+		{0, filepath.Join("pics", "1_image.jpg")},
+		{1, filepath.Join("pics", "1_image_abcdef01.jpg")},
+		{2, filepath.Join("pics", "1_image_abcdef01_2.jpg")},
+	}
+	for _, tt := range tests {
+		if got := AlternativePath(path, "abcdef0123456789", tt.attempt); got != tt.want {
+			t.Errorf("AlternativePath(attempt %d) = %q, want %q", tt.attempt, got, tt.want)
+		}
+	}
+
+	long := strings.Repeat("x", MaxNameLength-4) + ".jpg"
+	got := filepath.Base(AlternativePath(long, "abcdef0123456789", 3))
+	if len(got) > MaxNameLength || !strings.HasSuffix(got, "_abcdef01_3.jpg") {
+		t.Errorf("AlternativePath() of a long name = %q, want at most %d bytes ending in the suffix", got, MaxNameLength)
+	}
+}
+
+func TestWriteNew(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1_image.jpg")
+
+	first, err := WriteNew(path, "aaaaaaaa00", []byte("first"))
+	if err != nil {
+		t.Fatalf("WriteNew() error = %v", err)
+	}
+	if first != path {
+		t.Errorf("WriteNew() = %q, want %q", first, path)
+	}
+
+	second, err := WriteNew(path, "bbbbbbbb00", []byte("second"))
+	if err != nil {
+		t.Fatalf("second WriteNew() error = %v", err)
+	}
+	if want := filepath.Join(dir, "1_image_bbbbbbbb.jpg"); second != want {
+		t.Errorf("second WriteNew() = %q, want %q", second, want)
+	}
+
+	third, err := WriteNew(path, "bbbbbbbb00", []byte("third"))
+	if err != nil {
+		t.Fatalf("third WriteNew() error = %v", err)
+	}
+	if want := filepath.Join(dir, "1_image_bbbbbbbb_2.jpg"); third != want {
+		t.Errorf("third WriteNew() = %q, want %q", third, want)
+	}
+
+	for path, want := range map[string]string{first: "first", second: "second", third: "third"} {
+		content, err := os.ReadFile(path)
+		if err != nil || string(content) != want {
+			t.Errorf("%s holds %q, %v; want %q", path, content, err, want)
+		}
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("directory has %d entries, want 3", len(entries))
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	hash := "ab" + "cd" + strings.Repeat("0", 60)
+	got := ObjectPath("media", hash, ".png")
+	if want := filepath.Join("media", "objects", "ab", "cd", hash+".png"); got != want {
+		t.Errorf("ObjectPath() = %q, want %q", got, want)
+	}
+	if !IsObjectPath("objects/ab/cd/" + hash + ".png") {
+		t.Error("IsObjectPath() = false for an object path")
+	}
+	for _, rel := range []string{"pics/1_image.png", "objects/ab/cd/" + hash + ".png/x", "objects/ab/" + hash} {
+		if IsObjectPath(rel) {
+			t.Errorf("IsObjectPath(%q) = true, want false", rel)
+		}
+	}
+}
+
+func TestWriteObjectAndLinkNew(t *testing.T) {
+	dir := t.TempDir()
+	hash := strings.Repeat("e", 64)
+	object := ObjectPath(dir, hash, "jpg")
+
+	created, err := WriteObject(object, []byte("data"))
+	if err != nil || !created {
+		t.Fatalf("WriteObject() = %v, %v; want created", created, err)
+	}
+	// Storing the same content again keeps the object
+	created, err = WriteObject(object, []byte("data"))
+	if err != nil || created {
+		t.Fatalf("second WriteObject() = %v, %v; want the existing object", created, err)
+	}
+
+	link := filepath.Join(dir, "pics", "1_image.jpg")
+	got, err := LinkNew(object, link, hash, LinkSymbolic)
+	if err != nil || got != link {
+		t.Fatalf("LinkNew() = %q, %v; want %q", got, err, link)
+	}
+	// Linking again reuses the link
+	if got, err := LinkNew(object, link, hash, LinkSymbolic); err != nil || got != link {
+		t.Errorf("second LinkNew() = %q, %v; want %q", got, err, link)
+	}
+	content, err := os.ReadFile(link)
+	if err != nil || string(content) != "data" {
+		t.Errorf("link reads %q, %v; want the object's content", content, err)
+	}
+
+	// A different file at the link path is kept
+	other := filepath.Join(dir, "pics", "2_image.jpg")
+	if err := os.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = LinkNew(object, other, hash, LinkHard)
+	if err != nil || got != filepath.Join(dir, "pics", "2_image_eeeeeeee.jpg") {
+		t.Errorf("LinkNew() over another file = %q, %v; want an alternative name", got, err)
+	}
+}
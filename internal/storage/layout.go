@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+// DefaultPathTemplate is the layout used when storage.path_template is not set
+const DefaultPathTemplate = "{community}/{post_id}_{filename}"
+
+const (
+	// MaxNameLength is the longest file or directory name a template renders,
+	// in bytes, which is the limit of most filesystems
+	MaxNameLength = 255
+	// maxSlugLength limits {title_slug} so long titles leave room for the
+	// rest of the name
+	maxSlugLength = 80
+)
+
+// PathVars are the values substituted into a path template
+type PathVars struct {
+	Instance  string
+	Community string
+	Author    string
+	PostID    int64
+	Title     string
+	Hash      string
+	Ext       string // Without the leading dot
+	Filename  string // Name of the file in the media URL
+	MediaType string
+	Published time.Time
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+// placeholders maps each template placeholder to its value
+var placeholders = map[string]func(v PathVars) string{
+	"instance":   func(v PathVars) string { return v.Instance },
+	"community":  func(v PathVars) string { return v.Community },
+	"author":     func(v PathVars) string { return v.Author },
+	"post_id":    func(v PathVars) string { return strconv.FormatInt(v.PostID, 10) },
+	"title_slug": func(v PathVars) string { return slugify(v.Title) },
+	"hash":       func(v PathVars) string { return v.Hash },
+	"hash8":      func(v PathVars) string { return truncate(v.Hash, 8) },
+	"ext":        func(v PathVars) string { return v.Ext },
+	"filename":   func(v PathVars) string { return v.Filename },
+	"media_type": func(v PathVars) string { return v.MediaType },
+	"yyyy":       func(v PathVars) string { return v.Published.Format("2006") },
+	"mm":         func(v PathVars) string { return v.Published.Format("01") },
+	"dd":         func(v PathVars) string { return v.Published.Format("02") },
+}
+
+// uniqueNamePlaceholders tell apart files of different posts or content.
+// The file name of a template must use one of them.
+var uniqueNamePlaceholders = []string{"post_id", "hash", "hash8", "filename"}
+
+// ValidateTemplate checks that a path template is relative, only uses known
+// placeholders and names files uniquely enough to avoid most collisions
+func ValidateTemplate(tmpl string) error {
+	if tmpl == "" {
+		return fmt.Errorf("template is empty")
+	}
+	if strings.HasPrefix(tmpl, "/") || filepath.IsAbs(tmpl) || strings.Contains(tmpl, "\\") {
+		return fmt.Errorf("template must be a relative path using / as separator")
+	}
+
+	segments := strings.Split(tmpl, "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("template contains an empty, . or .. path element")
+		}
+	}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := placeholders[match[1]]; !ok {
+			return fmt.Errorf("unknown placeholder {%s}", match[1])
+		}
+	}
+
+	name := segments[len(segments)-1]
+	for _, placeholder := range uniqueNamePlaceholders {
+		if strings.Contains(name, "{"+placeholder+"}") {
+			return nil
+		}
+	}
+	return fmt.Errorf("file name must include {post_id}, {hash}, {hash8} or {filename}")
+}
+
+// Render expands a path template into a relative file path. Every path
+// element is sanitised and limited to MaxNameLength bytes, keeping the
+// extension of the file name.
+func Render(tmpl string, v PathVars) (string, error) {
+	if err := ValidateTemplate(tmpl); err != nil {
+		return "", fmt.Errorf("invalid path template %q: %w", tmpl, err)
+	}
+
+	segments := strings.Split(tmpl, "/")
+	for i, segment := range segments {
+		rendered := placeholderPattern.ReplaceAllStringFunc(segment, func(m string) string {
+			return SanitizeName(placeholders[m[1:len(m)-1]](v))
+		})
+		rendered = strings.TrimSpace(SanitizeName(rendered))
+		if rendered == "" || rendered == "." || rendered == ".." {
+			rendered = "_"
+		}
+		if i == len(segments)-1 {
+			ext := path.Ext(rendered)
+			if len(ext) >= MaxNameLength {
+				ext = ""
+			}
+			rendered = truncate(strings.TrimSuffix(rendered, ext), MaxNameLength-len(ext)) + ext
+		} else {
+			rendered = truncate(rendered, MaxNameLength)
+		}
+		segments[i] = rendered
+	}
+	return filepath.Join(segments...), nil
+}
+
+// MediaVars returns the template values for a media record. ext is the file
+// extension with or without its dot.
+func MediaVars(media *models.ScrapedMedia, ext string) PathVars {
+	ext = strings.TrimPrefix(ext, ".")
+
+	filename := ""
+	if u, err := url.Parse(media.MediaURL); err == nil {
+		filename = path.Base(u.Path)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "media"
+	}
+	if path.Ext(filename) == "" && ext != "" {
+		filename += "." + ext
+	}
+
+	return PathVars{
+		Instance:  media.Instance,
+		Community: media.CommunityName,
+		Author:    media.AuthorName,
+		PostID:    media.PostID,
+		Title:     media.PostTitle,
+		Hash:      media.MediaHash,
+		Ext:       ext,
+		Filename:  filename,
+		MediaType: media.MediaType,
+		Published: media.PostCreated,
+	}
+}
+
+// SanitizeName replaces characters that are invalid in file names on common
+// filesystems with underscores
+func SanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune("/\\:*?\"<>|", r), unicode.IsControl(r):
+			return '_'
+		default:
+			return r
+		}
+	}, name)
+}
+
+// slugify lowercases a title and joins its words with hyphens
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+		} else {
+			hyphen = true
+		}
+	}
+
+	slug := strings.TrimRight(truncate(b.String(), maxSlugLength), "-")
+	if slug == "" {
+		return "untitled"
+	}
+	return slug
+}
+
+// truncate shortens s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
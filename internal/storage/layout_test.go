@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		wantErr bool
+	}{
+		{name: "default", tmpl: DefaultPathTemplate},
+		{name: "dated", tmpl: "{instance}/{community}/{yyyy}/{mm}/{post_id}_{hash8}.{ext}"},
+		{name: "literal directory", tmpl: "media/{hash}.{ext}"},
+		{name: "empty", tmpl: "", wantErr: true},
+		{name: "absolute", tmpl: "/srv/{post_id}", wantErr: true},
+		{name: "parent directory", tmpl: "../{post_id}", wantErr: true},
+		{name: "empty element", tmpl: "{community}//{post_id}", wantErr: true},
+		{name: "trailing slash", tmpl: "{community}/{post_id}/", wantErr: true},
+		{name: "backslash", tmpl: "{community}\\{post_id}", wantErr: true},
+		{name: "unknown placeholder", tmpl: "{community}/{post_id}_{color}", wantErr: true},
+		{name: "ambiguous file name", tmpl: "{post_id}/{title_slug}.{ext}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTemplate(tt.tmpl)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTemplate(%q) error = %v, wantErr %v", tt.tmpl, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	vars := PathVars{
+		Instance:  "lemmy.world",
+		Community: "pics",
+		Author:    "alice",
+		PostID:    42,
+		Title:     "Sunset over the Bay: Part 2!",
+		Hash:      "0123456789abcdef",
+		Ext:       "jpg",
+		Filename:  "sunset.jpg",
+		MediaType: "image",
+		Published: time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{
+			name: "default",
+			tmpl: DefaultPathTemplate,
+			want: "pics/42_sunset.jpg",
+		},
+		{
+			name: "dated",
+			tmpl: "{instance}/{community}/{yyyy}/{mm}/{dd}/{post_id}_{hash8}.{ext}",
+			want: "lemmy.world/pics/2024/03/09/42_01234567.jpg",
+		},
+		{
+			name: "title slug",
+			tmpl: "{author}/{title_slug}_{post_id}.{ext}",
+			want: "alice/sunset-over-the-bay-part-2_42.jpg",
+		},
+		{
+			name: "media type",
+			tmpl: "{media_type}/{hash}.{ext}",
+			want: "image/0123456789abcdef.jpg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(tt.tmpl, vars)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderSanitisesValues(t *testing.T) {
+	vars := PathVars{
+		Community: "../etc",
+		Author:    "..",
+		PostID:    1,
+		Filename:  "a/b?.png",
+	}
+
+	got, err := Render("{community}/{author}/{post_id}_{filename}", vars)
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if want := filepath.Join(".._etc", "_", "1_a_b_.png"); got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+
+	if _, err := Render("/{post_id}", vars); err == nil {
+		t.Error("Render() with an absolute template should fail")
+	}
+}
+
+func TestRenderLimitsLength(t *testing.T) {
+	vars := PathVars{
+		Community: strings.Repeat("c", 300),
+		PostID:    1,
+		Title:     strings.Repeat("word ", 100),
+		Filename:  strings.Repeat("é", 200) + ".png",
+	}
+
+	got, err := Render("{community}/{title_slug}/{post_id}_{filename}", vars)
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	parts := strings.Split(got, string(filepath.Separator))
+	if len(parts) != 3 {
+		t.Fatalf("Render() = %q, want 3 path elements", got)
+	}
+	for _, part := range parts {
+		if len(part) > MaxNameLength {
+			t.Errorf("path element of %d bytes exceeds %d", len(part), MaxNameLength)
+		}
+	}
+	if len(parts[1]) > maxSlugLength || strings.HasSuffix(parts[1], "-") {
+		t.Errorf("title slug = %q, want at most %d bytes without a trailing hyphen", parts[1], maxSlugLength)
+	}
+	if !strings.HasSuffix(parts[2], ".png") || !strings.HasPrefix(parts[2], "1_é") {
+		t.Errorf("file name = %q, want the extension kept", parts[2])
+	}
+}
+
+func TestMediaVars(t *testing.T) {
+	media := &models.ScrapedMedia{
+		PostID:        7,
+		CommunityName: "pics",
+		MediaURL:      "https://lemmy.world/pictrs/image/abc123?format=webp",
+		MediaHash:     "ffff0000",
+	}
+
+	vars := MediaVars(media, ".webp")
+	if vars.Filename != "abc123.webp" {
+		t.Errorf("Filename = %q, want abc123.webp", vars.Filename)
+	}
+	if vars.Ext != "webp" {
+		t.Errorf("Ext = %q, want webp", vars.Ext)
+	}
+
+	media.MediaURL = "https://example.com/photo.png?size=large"
+	if vars := MediaVars(media, ".png"); vars.Filename != "photo.png" {
+		t.Errorf("Filename = %q, want photo.png", vars.Filename)
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "clean path",
+			input:    "technology",
+			expected: "technology",
+		},
+		{
+			name:     "path with slash",
+			input:    "tech/programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "path with backslash",
+			input:    "tech\\programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "path with colon",
+			input:    "tech:programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "path with asterisk",
+			input:    "tech*programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "path with question mark",
+			input:    "tech?programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "path with quotes",
+			input:    "tech\"programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "path with angle brackets",
+			input:    "tech<programming>",
+			expected: "tech_programming_",
+		},
+		{
+			name:     "path with pipe",
+			input:    "tech|programming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "multiple invalid characters",
+			input:    "tech/prog:ram*ming?",
+			expected: "tech_prog_ram_ming_",
+		},
+		{
+			name:     "path with @ symbol (valid)",
+			input:    "technology@lemmy.ml",
+			expected: "technology@lemmy.ml",
+		},
+		{
+			name:     "control character",
+			input:    "tech\nprogramming",
+			expected: "tech_programming",
+		},
+		{
+			name:     "empty string",
+			input:    "",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := SanitizeName(tt.input)
+			if result != tt.expected {
+				t.Errorf("SanitizeName(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Layout describes where media files are stored
+type Layout struct {
+	BaseDir  string
+	Template string
+	Mode     string // ModePath or ModeContent
+	LinkType string // How Template links to objects in ModeContent
+	Instance string // Stands in for media recorded before the instance was stored
+}
+
+// Move is a media file that a relayout moves to a new path, and in content
+// mode the link to it that replaces its old link
+type Move struct {
+	MediaID int64
+	From    string
+	To      string
+	OldLink string
+	Link    string
+}
+
+// RelayoutPlan lists the moves that store media in a layout
+type RelayoutPlan struct {
+	Layout    Layout
+	Moves     []Move
+	Unchanged int
+	Missing   []int64 // Media whose files do not exist; they are left as they are
+}
+
+// PlanRelayout works out where each media file and its link belong in a
+// layout. Files that would share a path, or replace a file already on disk,
+// get an alternative name from AlternativePath. It fails if two records share
+// a file.
+func PlanRelayout(media []models.ScrapedMedia, layout Layout) (*RelayoutPlan, error) {
+	if err := ValidateTemplate(layout.Template); err != nil {
+		return nil, fmt.Errorf("invalid path template %q: %w", layout.Template, err)
+	}
+
+	plan := &RelayoutPlan{Layout: layout}
+	sources := make(map[string]int64, len(media))
+	claimed := make(map[string]bool, len(media))
+	var present []models.ScrapedMedia
+	for _, m := range media {
+		from := filepath.Clean(m.FilePath)
+		if other, ok := sources[from]; ok {
+			return nil, fmt.Errorf("media %d and %d share the file %s, run the check command", other, m.ID, from)
+		}
+		sources[from] = m.ID
+
+		// Paths of missing files stay reserved for their records
+		if _, err := os.Stat(from); err != nil {
+			plan.Missing = append(plan.Missing, m.ID)
+			claimed[from] = true
+			if m.LinkPath != "" {
+				claimed[filepath.Clean(m.LinkPath)] = true
+			}
+			continue
+		}
+		present = append(present, m)
+	}
+
+	for i := range present {
+		m := present[i]
+		move := Move{MediaID: m.ID, From: filepath.Clean(m.FilePath)}
+		if m.LinkPath != "" {
+			move.OldLink = filepath.Clean(m.LinkPath)
+		}
+		own := []string{move.From, move.OldLink}
+
+		if m.Instance == "" {
+			m.Instance = layout.Instance
+		}
+		ext := filepath.Ext(m.FilePath)
+		rel, err := Render(layout.Template, MediaVars(&m, ext))
+		if err != nil {
+			return nil, err
+		}
+		templatePath := filepath.Join(layout.BaseDir, rel)
+
+		if layout.Mode == ModeContent {
+			move.To = ObjectPath(layout.BaseDir, m.MediaHash, ext)
+			if claimed[move.To] {
+				return nil, fmt.Errorf("media %d would be stored at %s, which is taken", m.ID, move.To)
+			}
+			if layout.LinkType != LinkNone {
+				if move.Link, err = freePath(templatePath, own, m.MediaHash, claimed); err != nil {
+					return nil, fmt.Errorf("failed to place media %d: %w", m.ID, err)
+				}
+				claimed[move.Link] = true
+			}
+		} else {
+			if move.To, err = freePath(templatePath, own, m.MediaHash, claimed); err != nil {
+				return nil, fmt.Errorf("failed to place media %d: %w", m.ID, err)
+			}
+		}
+		claimed[move.To] = true
+
+		if move.To == move.From && move.Link == move.OldLink {
+			plan.Unchanged++
+			continue
+		}
+		if !isOwn(move.To, own) {
+			if _, err := os.Lstat(move.To); err == nil {
+				return nil, fmt.Errorf("moving media %d to %s would replace an existing file", m.ID, move.To)
+			}
+		}
+		plan.Moves = append(plan.Moves, move)
+	}
+	return plan, nil
+}
+
+// freePath returns path, or the first alternative to it, that is either one
+// of the media's own current paths or neither claimed by another file nor on
+// disk
+func freePath(path string, own []string, hash string, claimed map[string]bool) (string, error) {
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		candidate := AlternativePath(path, hash, attempt)
+		if claimed[candidate] {
+			continue
+		}
+		if isOwn(candidate, own) {
+			return candidate, nil
+		}
+		if _, err := os.Lstat(candidate); err == nil {
+			continue
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("%s and %d alternatives are taken", path, maxNameAttempts-1)
+}
+
+// isOwn reports whether path is one of own
+func isOwn(path string, own []string) bool {
+	for _, p := range own {
+		if p != "" && p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyRelayout removes old links, moves the planned files, creates new links
+// and records the new paths in one transaction. If any step fails, the steps
+// already taken are undone. Directories left empty are removed.
+func ApplyRelayout(db *database.DB, plan *RelayoutPlan) error {
+	var undo []func()
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	// Old links go first, as a file may move to its own link's path
+	for _, mv := range plan.Moves {
+		if mv.OldLink == "" || mv.OldLink == mv.Link {
+			continue
+		}
+		linkType := LinkHard
+		if info, err := os.Lstat(mv.OldLink); err != nil {
+			continue
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			linkType = LinkSymbolic
+		}
+		if err := os.Remove(mv.OldLink); err != nil {
+			rollback()
+			return fmt.Errorf("failed to remove link of media %d: %w", mv.MediaID, err)
+		}
+		undo = append(undo, func() {
+			if err := makeLink(mv.From, mv.OldLink, linkType); err != nil {
+				log.Errorf("Failed to restore link %s: %v", mv.OldLink, err)
+			}
+		})
+	}
+
+	for _, mv := range plan.Moves {
+		if mv.To == mv.From {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(mv.To), 0700); err != nil {
+			rollback()
+			return fmt.Errorf("failed to create directory for media %d: %w", mv.MediaID, err)
+		}
+		if err := os.Rename(mv.From, mv.To); err != nil {
+			rollback()
+			return fmt.Errorf("failed to move media %d: %w", mv.MediaID, err)
+		}
+		undo = append(undo, func() {
+			if err := os.Rename(mv.To, mv.From); err != nil {
+				log.Errorf("Failed to move %s back to %s: %v", mv.To, mv.From, err)
+			}
+		})
+	}
+
+	for _, mv := range plan.Moves {
+		if mv.Link == "" || mv.Link == mv.OldLink {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(mv.Link), 0700); err != nil {
+			rollback()
+			return fmt.Errorf("failed to create directory for media %d: %w", mv.MediaID, err)
+		}
+		if err := makeLink(mv.To, mv.Link, plan.Layout.LinkType); err != nil {
+			rollback()
+			return fmt.Errorf("failed to link media %d: %w", mv.MediaID, err)
+		}
+		undo = append(undo, func() { os.Remove(mv.Link) })
+	}
+
+	updates := make([]database.MediaPathUpdate, 0, len(plan.Moves))
+	for _, mv := range plan.Moves {
+		name := filepath.Base(mv.To)
+		if mv.Link != "" {
+			name = filepath.Base(mv.Link)
+		}
+		updates = append(updates, database.MediaPathUpdate{
+			MediaID:  mv.MediaID,
+			FileName: name,
+			FilePath: mv.To,
+			LinkPath: mv.Link,
+		})
+	}
+	if err := db.UpdateMediaPaths(updates); err != nil {
+		rollback()
+		return err
+	}
+
+	for _, mv := range plan.Moves {
+		removeEmptyDirs(filepath.Dir(mv.From), plan.Layout.BaseDir)
+		if mv.OldLink != "" {
+			removeEmptyDirs(filepath.Dir(mv.OldLink), plan.Layout.BaseDir)
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including,
+// baseDir for as long as they are empty
+func removeEmptyDirs(dir, baseDir string) {
+	baseDir = filepath.Clean(baseDir)
+	for dir != baseDir {
+		rel, err := filepath.Rel(baseDir, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+// setupRelayout stores media for the given post IDs in the default layout
+func setupRelayout(t *testing.T, postIDs ...int64) (*database.DB, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	baseDir := filepath.Join(tmpDir, "media")
+
+	db, err := database.New(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, postID := range postIDs {
+		media := &models.ScrapedMedia{
+			PostID:        postID,
+			PostTitle:     fmt.Sprintf("Post %d", postID),
+			CommunityName: "pics",
+			CommunityID:   1,
+			AuthorName:    "alice",
+			MediaURL:      fmt.Sprintf("https://example.com/%d.jpg", postID),
+			MediaHash:     fmt.Sprintf("%064d", postID),
+			FileSize:      4,
+			MediaType:     "image",
+			PostCreated:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			DownloadedAt:  time.Now(),
+		}
+		rel, err := Render(DefaultPathTemplate, MediaVars(media, ".jpg"))
+		if err != nil {
+			t.Fatalf("Render() error = %v", err)
+		}
+		media.FilePath = filepath.Join(baseDir, rel)
+		media.FileName = filepath.Base(media.FilePath)
+		if err := os.MkdirAll(filepath.Dir(media.FilePath), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(media.FilePath, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
+			t.Fatalf("SaveMedia() error = %v", err)
+		}
+	}
+	return db, baseDir
+}
+
+// pathLayout is a path mode layout using tmpl
+func pathLayout(baseDir, tmpl, instance string) Layout {
+	return Layout{BaseDir: baseDir, Template: tmpl, Mode: ModePath, Instance: instance}
+}
+
+func TestRelayout(t *testing.T) {
+	db, baseDir := setupRelayout(t, 1, 2)
+	media, err := db.GetAllMedia()
+	if err != nil {
+		t.Fatalf("GetAllMedia() error = %v", err)
+	}
+
+	// The current layout needs no moves
+	plan, err := PlanRelayout(media, pathLayout(baseDir, DefaultPathTemplate, "lemmy.test"))
+	if err != nil {
+		t.Fatalf("PlanRelayout() error = %v", err)
+	}
+	if len(plan.Moves) != 0 || plan.Unchanged != 2 {
+		t.Fatalf("plan for current layout = %+v, want 2 unchanged", plan)
+	}
+
+	tmpl := "{instance}/{community}/{yyyy}/{post_id}_{hash8}.{ext}"
+	plan, err = PlanRelayout(media, pathLayout(baseDir, tmpl, "lemmy.test"))
+	if err != nil {
+		t.Fatalf("PlanRelayout() error = %v", err)
+	}
+	if len(plan.Moves) != 2 {
+		t.Fatalf("plan = %+v, want 2 moves", plan)
+	}
+	if err := ApplyRelayout(db, plan); err != nil {
+		t.Fatalf("ApplyRelayout() error = %v", err)
+	}
+
+	moved, err := db.GetMediaByID(media[0].ID)
+	if err != nil {
+		t.Fatalf("GetMediaByID() error = %v", err)
+	}
+	want := filepath.Join(baseDir, "lemmy.test", "pics", "2024", "1_00000000.jpg")
+	if moved.FilePath != want || moved.FileName != "1_00000000.jpg" {
+		t.Errorf("media path = %s (%s), want %s", moved.FilePath, moved.FileName, want)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("moved file is missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "pics")); !os.IsNotExist(err) {
+		t.Errorf("emptied directory was not removed: %v", err)
+	}
+	if _, err := os.Stat(baseDir); err != nil {
+		t.Errorf("base directory was removed: %v", err)
+	}
+}
+
+func TestRelayoutAvoidsCollisions(t *testing.T) {
+	db, baseDir := setupRelayout(t, 1, 2)
+	media, err := db.GetAllMedia()
+	if err != nil {
+		t.Fatalf("GetAllMedia() error = %v", err)
+	}
+
+	// A file outside the database already occupies the first target
+	occupied := filepath.Join(baseDir, "all", "1.jpg")
+	if err := os.MkdirAll(filepath.Dir(occupied), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(occupied, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both files are named after the media URL's file name only
+	media[1].MediaURL = media[0].MediaURL
+	plan, err := PlanRelayout(media, pathLayout(baseDir, "all/{filename}", ""))
+	if err != nil {
+		t.Fatalf("PlanRelayout() error = %v", err)
+	}
+	want := []string{
+		filepath.Join(baseDir, "all", "1_00000000.jpg"),
+		filepath.Join(baseDir, "all", "1_00000000_2.jpg"),
+	}
+	if len(plan.Moves) != 2 || plan.Moves[0].To != want[0] || plan.Moves[1].To != want[1] {
+		t.Errorf("plan = %+v, want moves to %v", plan.Moves, want)
+	}
+}
+
+func TestRelayoutRejectsSharedFiles(t *testing.T) {
+	db, baseDir := setupRelayout(t, 1, 2)
+	media, err := db.GetAllMedia()
+	if err != nil {
+		t.Fatalf("GetAllMedia() error = %v", err)
+	}
+
+	media[1].FilePath = media[0].FilePath
+	if _, err := PlanRelayout(media, pathLayout(baseDir, "{post_id}.{ext}", "")); err == nil {
+		t.Error("PlanRelayout() with records sharing a file should fail")
+	}
+}
+
+func TestRelayoutSkipsMissingFiles(t *testing.T) {
+	db, baseDir := setupRelayout(t, 1)
+	media, err := db.GetAllMedia()
+	if err != nil {
+		t.Fatalf("GetAllMedia() error = %v", err)
+	}
+	if err := os.Remove(media[0].FilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanRelayout(media, pathLayout(baseDir, "{post_id}.{ext}", ""))
+	if err != nil {
+		t.Fatalf("PlanRelayout() error = %v", err)
+	}
+	if len(plan.Moves) != 0 || len(plan.Missing) != 1 {
+		t.Errorf("plan = %+v, want the missing file left alone", plan)
+	}
+}
+
+func TestRelayoutContentMode(t *testing.T) {
+	for _, linkType := range []string{LinkHard, LinkSymbolic} {
+		t.Run(linkType, func(t *testing.T) {
+			db, baseDir := setupRelayout(t, 1)
+			media, err := db.GetAllMedia()
+			if err != nil {
+				t.Fatalf("GetAllMedia() error = %v", err)
+			}
+			oldPath := media[0].FilePath
+
+			layout := Layout{BaseDir: baseDir, Template: DefaultPathTemplate, Mode: ModeContent, LinkType: linkType}
+			plan, err := PlanRelayout(media, layout)
+			if err != nil {
+				t.Fatalf("PlanRelayout() error = %v", err)
+			}
+			if err := ApplyRelayout(db, plan); err != nil {
+				t.Fatalf("ApplyRelayout() error = %v", err)
+			}
+
+			stored, err := db.GetMediaByID(media[0].ID)
+			if err != nil {
+				t.Fatalf("GetMediaByID() error = %v", err)
+			}
+			object := ObjectPath(baseDir, media[0].MediaHash, ".jpg")
+			if stored.FilePath != object || stored.LinkPath != oldPath {
+				t.Errorf("paths = %s, link %s; want %s, link %s", stored.FilePath, stored.LinkPath, object, oldPath)
+			}
+			if !sameFile(object, oldPath) {
+				t.Error("the template path does not link to the object")
+			}
+			if info, err := os.Lstat(oldPath); err != nil || (info.Mode()&os.ModeSymlink != 0) != (linkType == LinkSymbolic) {
+				t.Errorf("link at %s has mode %v, %v; want a %s", oldPath, info.Mode(), err, linkType)
+			}
+
+			// Switching back to path mode moves the object to the template path
+			media, _ = db.GetAllMedia()
+			plan, err = PlanRelayout(media, pathLayout(baseDir, DefaultPathTemplate, ""))
+			if err != nil {
+				t.Fatalf("PlanRelayout() back to path mode error = %v", err)
+			}
+			if err := ApplyRelayout(db, plan); err != nil {
+				t.Fatalf("ApplyRelayout() back to path mode error = %v", err)
+			}
+			stored, _ = db.GetMediaByID(media[0].ID)
+			if stored.FilePath != oldPath || stored.LinkPath != "" {
+				t.Errorf("paths = %s, link %q; want %s without a link", stored.FilePath, stored.LinkPath, oldPath)
+			}
+			if info, err := os.Lstat(oldPath); err != nil || !info.Mode().IsRegular() {
+				t.Errorf("%s is not a regular file: %v", oldPath, err)
+			}
+			if _, err := os.Stat(filepath.Join(baseDir, ObjectsDir)); !os.IsNotExist(err) {
+				t.Errorf("emptied objects directory was not removed: %v", err)
+			}
+		})
+	}
+}
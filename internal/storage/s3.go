@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is sent in place of a body hash, which S3 accepts so that
+// bodies can be streamed without reading them twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3 stores files in a bucket of an S3-compatible object store such as AWS
+// S3 or MinIO. Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	Endpoint   string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region     string
+	Bucket     string
+	AccessKey  string
+	SecretKey  string
+	Prefix     string // Prepended to every key, e.g. "archive/"
+	PathStyle  bool   // Address the bucket in the URL path instead of the host name, as MinIO expects
+	HTTPClient *http.Client
+
+	// now returns the signing time; replaced in tests
+	now func() time.Time
+}
+
+// NewS3 creates an S3 storage for a bucket
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) *S3 {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
+		now: time.Now,
+	}
+}
+
+// Put uploads the file at key
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), r)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads the file at key
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+// Stat describes the file at key
+func (s *S3) Stat(ctx context.Context, key string) (FileInfo, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// Delete removes the file at key
+func (s *S3) Delete(ctx context.Context, key string) error {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.do(req)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// listResult is the response of ListObjectsV2
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the files whose keys start with prefix, following
+// continuation tokens until the listing is complete
+func (s *S3) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	token := ""
+	for {
+		u := s.bucketURL()
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.Prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse listing of %s: %w", prefix, err)
+		}
+
+		for _, c := range result.Contents {
+			files = append(files, FileInfo{
+				Key:     strings.TrimPrefix(c.Key, s.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files, nil
+}
+
+// PresignGet returns a URL that downloads the file at key without
+// credentials until it expires
+func (s *S3) PresignGet(key string, expires time.Duration) (string, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+
+	t := s.now().UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(t))
+	query.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(t, canonicalRequest))
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), nil
+}
+
+// do signs and sends a request. Responses other than 2xx are returned as
+// errors, matching fs.ErrNotExist for 404.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req)
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+	return nil, &s3Error{status: resp.StatusCode, code: body.Code, message: body.Message}
+}
+
+// s3Error is an error response from the object store
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	if e.code == "" {
+		return fmt.Sprintf("request failed with status %d", e.status)
+	}
+	return fmt.Sprintf("request failed with status %d: %s: %s", e.status, e.code, e.message)
+}
+
+// Is makes 404 responses match fs.ErrNotExist
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.status == http.StatusNotFound
+}
+
+// sign adds the Signature Version 4 headers to a request
+func (s *S3) sign(req *http.Request) {
+	t := s.now().UTC()
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": unsignedPayload,
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		strings.Join(signed, ";"),
+		unsignedPayload,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, s.scope(t), strings.Join(signed, ";"), s.signature(t, canonicalRequest)))
+}
+
+// scope is the credential scope of requests signed at t
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with a key derived from the secret key
+func (s *S3) signature(t time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// bucketURL returns the URL of the bucket
+func (s *S3) bucketURL() *url.URL {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		u = &url.URL{Scheme: "https", Host: s.Endpoint}
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/"
+		u.RawPath = ""
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return u
+}
+
+// objectURL returns the URL of the file at key
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	u := s.bucketURL()
+	objectKey := s.Prefix + key
+	u.Path += objectKey
+	if s.PathStyle {
+		u.RawPath = "/" + uriEscape(s.Bucket) + "/" + escapeKey(objectKey)
+	} else {
+		u.RawPath = "/" + escapeKey(objectKey)
+	}
+	return u, nil
+}
+
+// escapeKey escapes each element of a key for a URL path
+func escapeKey(key string) string {
+	elements := strings.Split(key, "/")
+	for i, element := range elements {
+		elements[i] = uriEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// canonicalQuery encodes query parameters sorted by name, as signing expects
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEscape(name)+"="+uriEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEscape percent-encodes everything but unreserved characters, as
+// Signature Version 4 requires
+func uriEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -1,8 +1,8 @@
 package thumbnails
 
 import (
+	"context"
 	"fmt"
-	"os"
 
 	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
 	log "github.com/sirupsen/logrus"
@@ -10,8 +10,9 @@ import (
 
 // BackfillThumbnails generates thumbnails for all media items that don't have them yet.
 // It queries the database for media without thumbnails and generates them one by one.
-// Errors on individual items are logged but do not stop the backfill.
-func BackfillThumbnails(gen *Generator, db *database.DB) {
+// Errors on individual items are logged but do not stop the backfill. Cancelling
+// ctx stops it before the next item.
+func BackfillThumbnails(ctx context.Context, gen *Generator, db *database.DB) {
 	if gen == nil {
 		return
 	}
@@ -34,8 +35,13 @@ func BackfillThumbnails(gen *Generator, db *database.DB) {
 	errors := 0
 
 	for _, item := range media {
+		if ctx.Err() != nil {
+			log.Infof("Thumbnail backfill stopped: %d generated, %d remaining", generated, len(media)-generated-skipped-errors)
+			return
+		}
+
 		// Verify the source file exists before attempting thumbnail generation
-		if _, err := os.Stat(item.FilePath); os.IsNotExist(err) {
+		if !gen.SourceExists(ctx, item.FilePath) {
 			log.Debugf("Source file missing for media %d: %s", item.ID, item.FilePath)
 			skipped++
 			continue
@@ -49,7 +55,7 @@ func BackfillThumbnails(gen *Generator, db *database.DB) {
 			continue
 		}
 
-		thumbnailPath, width, height, err := gen.GenerateThumbnail(item.FilePath, mediaType)
+		thumbnailPath, width, height, err := gen.GenerateThumbnail(ctx, item.FilePath, mediaType)
 		if err != nil {
 			log.Debugf("Failed to generate thumbnail for media %d: %v", item.ID, err)
 			errors++
@@ -87,7 +93,7 @@ func mapMediaType(mediaType string) string {
 
 // GenerateForMedia generates a thumbnail for a single media item and saves it to the database.
 // Returns the thumbnail path or an error. This is used by the scraper for newly downloaded media.
-func GenerateForMedia(gen *Generator, db *database.DB, mediaID int64, filePath string, mediaType string) error {
+func GenerateForMedia(ctx context.Context, gen *Generator, db *database.DB, mediaID int64, filePath string, mediaType string) error {
 	if gen == nil {
 		return nil
 	}
@@ -97,7 +103,7 @@ func GenerateForMedia(gen *Generator, db *database.DB, mediaID int64, filePath s
 		return fmt.Errorf("unsupported media type for thumbnails: %s", mediaType)
 	}
 
-	thumbnailPath, width, height, err := gen.GenerateThumbnail(filePath, mappedType)
+	thumbnailPath, width, height, err := gen.GenerateThumbnail(ctx, filePath, mappedType)
 	if err != nil {
 		return fmt.Errorf("failed to generate thumbnail: %w", err)
 	}
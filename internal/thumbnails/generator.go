@@ -1,6 +1,7 @@
 package thumbnails
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -10,6 +11,8 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
 	"github.com/disintegration/imaging"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,6 +25,12 @@ type Generator struct {
 	BaseDir      string
 	VideoMethod  string
 	FFmpegPath   string
+
+	// Storage holds the media files when they are not on the local
+	// filesystem. Media paths are then read from it by their key under
+	// MediaDir.
+	Storage  storage.Storage
+	MediaDir string
 }
 
 // NewGenerator creates a new thumbnail generator
@@ -39,8 +48,18 @@ func NewGenerator(maxWidth, maxHeight, quality int, baseDir string, videoMethod
 	}
 }
 
-// GenerateThumbnail creates a thumbnail for the given media file
-func (g *Generator) GenerateThumbnail(mediaPath string, mediaType string) (string, int, int, error) {
+// NewFromConfig creates a generator from the thumbnail settings, or returns nil
+// when thumbnails are disabled
+func NewFromConfig(tc config.ThumbnailConfig) *Generator {
+	if !tc.Enabled {
+		return nil
+	}
+	return NewGenerator(tc.MaxWidth, tc.MaxHeight, tc.Quality, tc.Directory, tc.VideoMethod)
+}
+
+// GenerateThumbnail creates a thumbnail for the given media file. Cancelling
+// ctx kills a running ffmpeg process.
+func (g *Generator) GenerateThumbnail(ctx context.Context, mediaPath string, mediaType string) (string, int, int, error) {
 	// Ensure thumbnail directory exists
 	if err := os.MkdirAll(g.BaseDir, 0755); err != nil {
 		return "", 0, 0, fmt.Errorf("failed to create thumbnail directory: %w", err)
@@ -62,14 +81,19 @@ func (g *Generator) GenerateThumbnail(mediaPath string, mediaType string) (strin
 		}
 	}
 
+	source, cleanup, err := g.localSource(ctx, mediaPath)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer cleanup()
+
 	var width, height int
-	var err error
 
 	// Generate based on media type
 	if strings.HasPrefix(mediaType, "video/") {
-		width, height, err = g.generateVideoThumbnail(mediaPath, thumbnailPath)
+		width, height, err = g.generateVideoThumbnail(ctx, source, thumbnailPath)
 	} else if strings.HasPrefix(mediaType, "image/") {
-		width, height, err = g.generateImageThumbnail(mediaPath, thumbnailPath)
+		width, height, err = g.generateImageThumbnail(source, thumbnailPath)
 	} else {
 		return "", 0, 0, fmt.Errorf("unsupported media type: %s", mediaType)
 	}
@@ -81,6 +105,46 @@ func (g *Generator) GenerateThumbnail(mediaPath string, mediaType string) (strin
 	return thumbnailPath, width, height, nil
 }
 
+// isRemote reports whether media files are read from Storage rather than
+// the local filesystem
+func (g *Generator) isRemote() bool {
+	_, local := g.Storage.(*storage.Local)
+	return g.Storage != nil && !local
+}
+
+// SourceExists reports whether the media file at mediaPath exists
+func (g *Generator) SourceExists(ctx context.Context, mediaPath string) bool {
+	if !g.isRemote() {
+		_, err := os.Stat(mediaPath)
+		return err == nil
+	}
+	key, err := storage.Key(g.MediaDir, mediaPath)
+	if err != nil {
+		return false
+	}
+	_, err = g.Storage.Stat(ctx, key)
+	return err == nil
+}
+
+// localSource returns a local file holding the media at mediaPath. Media in
+// remote storage is downloaded to a temporary file, which the returned
+// function removes.
+func (g *Generator) localSource(ctx context.Context, mediaPath string) (string, func(), error) {
+	if !g.isRemote() {
+		return mediaPath, func() {}, nil
+	}
+
+	key, err := storage.Key(g.MediaDir, mediaPath)
+	if err != nil {
+		return "", nil, err
+	}
+	source, cleanup, err := storage.LocalCopy(ctx, g.Storage, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read media: %w", err)
+	}
+	return source, cleanup, nil
+}
+
 // generateImageThumbnail creates a thumbnail from an image file
 func (g *Generator) generateImageThumbnail(imagePath string, thumbnailPath string) (int, int, error) {
 	// Open the image
@@ -114,7 +178,7 @@ func (g *Generator) generateImageThumbnail(imagePath string, thumbnailPath strin
 }
 
 // generateVideoThumbnail creates a thumbnail from a video file using ffmpeg
-func (g *Generator) generateVideoThumbnail(videoPath string, thumbnailPath string) (int, int, error) {
+func (g *Generator) generateVideoThumbnail(ctx context.Context, videoPath string, thumbnailPath string) (int, int, error) {
 	if g.FFmpegPath == "" {
 		return 0, 0, fmt.Errorf("ffmpeg not found, cannot generate video thumbnail")
 	}
@@ -124,7 +188,8 @@ func (g *Generator) generateVideoThumbnail(videoPath string, thumbnailPath strin
 	// -i input file
 	// -vframes 1 extracts one frame
 	// -vf scale applies filter to resize
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		g.FFmpegPath,
 		"-ss", "00:00:01", // Seek to 1 second
 		"-i", videoPath,
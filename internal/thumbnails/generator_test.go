@@ -1,6 +1,7 @@
 package thumbnails
 
 import (
+	"context"
 	"image"
 	"image/color"
 	"image/png"
@@ -73,7 +74,7 @@ func TestGenerateImageThumbnail(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			thumbPath, width, height, err := gen.GenerateThumbnail(tt.mediaPath, tt.mediaType)
+			thumbPath, width, height, err := gen.GenerateThumbnail(context.Background(), tt.mediaPath, tt.mediaType)
 
 			if tt.wantErr {
 				if err == nil {
@@ -119,7 +120,7 @@ func TestGenerateImageThumbnailSmallImage(t *testing.T) {
 	srcPath := filepath.Join(tmpDir, "small.png")
 	createTestImage(t, srcPath, 100, 50)
 
-	thumbPath, width, height, err := gen.GenerateThumbnail(srcPath, "image/png")
+	thumbPath, width, height, err := gen.GenerateThumbnail(context.Background(), srcPath, "image/png")
 	if err != nil {
 		t.Fatalf("GenerateThumbnail() error = %v", err)
 	}
@@ -229,7 +230,7 @@ func TestGenerateThumbnailUnsupportedType(t *testing.T) {
 	srcPath := filepath.Join(tmpDir, "file.txt")
 	os.WriteFile(srcPath, []byte("not media"), 0644)
 
-	_, _, _, err := gen.GenerateThumbnail(srcPath, "text/plain")
+	_, _, _, err := gen.GenerateThumbnail(context.Background(), srcPath, "text/plain")
 	if err == nil {
 		t.Error("expected error for unsupported media type, got nil")
 	}
@@ -247,7 +248,7 @@ func TestGenerateThumbnailDirCreation(t *testing.T) {
 	srcPath := filepath.Join(tmpDir, "source.png")
 	createTestImage(t, srcPath, 100, 100)
 
-	thumbPath, _, _, err := gen.GenerateThumbnail(srcPath, "image/png")
+	thumbPath, _, _, err := gen.GenerateThumbnail(context.Background(), srcPath, "image/png")
 	if err != nil {
 		t.Fatalf("GenerateThumbnail() error = %v", err)
 	}
@@ -272,13 +273,13 @@ func TestGenerateThumbnailCaching(t *testing.T) {
 	createTestImage(t, srcPath, 400, 300)
 
 	// First generation
-	path1, w1, h1, err := gen.GenerateThumbnail(srcPath, "image/png")
+	path1, w1, h1, err := gen.GenerateThumbnail(context.Background(), srcPath, "image/png")
 	if err != nil {
 		t.Fatalf("first GenerateThumbnail() error = %v", err)
 	}
 
 	// Second call should return cached result (same path)
-	path2, w2, h2, err := gen.GenerateThumbnail(srcPath, "image/png")
+	path2, w2, h2, err := gen.GenerateThumbnail(context.Background(), srcPath, "image/png")
 	if err != nil {
 		t.Fatalf("second GenerateThumbnail() error = %v", err)
 	}
@@ -0,0 +1,103 @@
+package transcode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// GIF block introducers
+const (
+	gifExtension = 0x21
+	gifImage     = 0x2C
+	gifTrailer   = 0x3B
+)
+
+// IsAnimatedGIF reports whether a GIF has more than one frame. It walks the
+// blocks of the file without decoding any image data.
+func IsAnimatedGIF(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+
+	// Header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return false, fmt.Errorf("failed to read GIF header: %w", err)
+	}
+	if string(header[:3]) != "GIF" {
+		return false, errors.New("not a GIF")
+	}
+	if err := skipColorTable(br, header[10]); err != nil {
+		return false, err
+	}
+
+	frames := 0
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			// Truncated files still play up to where they end
+			return frames > 1, nil
+		}
+		switch introducer {
+		case gifExtension:
+			if _, err := br.ReadByte(); err != nil {
+				return frames > 1, nil
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return frames > 1, nil
+			}
+		case gifImage:
+			frames++
+			if frames > 1 {
+				return true, nil
+			}
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return false, nil
+			}
+			if err := skipColorTable(br, descriptor[8]); err != nil {
+				return false, nil
+			}
+			// LZW minimum code size, then the image data
+			if _, err := br.ReadByte(); err != nil {
+				return false, nil
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return false, nil
+			}
+		case gifTrailer:
+			return frames > 1, nil
+		default:
+			return false, fmt.Errorf("invalid GIF block 0x%02x", introducer)
+		}
+	}
+}
+
+// skipColorTable skips the color table announced by the flags of a screen or
+// image descriptor
+func skipColorTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	size := 3 * (1 << (int(flags&0x07) + 1))
+	if _, err := br.Discard(size); err != nil {
+		return fmt.Errorf("failed to read GIF color table: %w", err)
+	}
+	return nil
+}
+
+// skipSubBlocks skips data sub-blocks up to the terminating empty block
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,362 @@
+// Package transcode converts downloaded videos and animated GIFs with ffmpeg
+// into formats that play in every browser. The converted files are stored as
+// derivatives of the original media, which are kept as they are.
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoFFmpeg is returned when ffmpeg is needed but not installed
+var ErrNoFFmpeg = errors.New("ffmpeg not found")
+
+// DerivativesDir is the directory under the base directory holding the
+// converted files
+const DerivativesDir = "derivatives"
+
+// maxOutput bounds how much of ffmpeg's output is kept in errors
+const maxOutput = 500
+
+// mimeTypes maps derivative formats to their content types
+var mimeTypes = map[string]string{
+	"mp4":  "video/mp4",
+	"webm": "video/webm",
+}
+
+// Transcoder converts media files with ffmpeg
+type Transcoder struct {
+	FFmpegPath string
+	GIFFormat  string // config.GIFToMP4, config.GIFToWebM or config.GIFKeep
+	Remux      bool   // Remux MKV and MOV videos to MP4
+	MaxHeight  int    // Scale converted videos down to this height, 0 for no limit
+	MaxBitrate string // Cap the video bitrate of converted videos, e.g. "2M"
+
+	// Storage holds the media files and the derivatives, under their keys
+	// relative to MediaDir
+	Storage  storage.Storage
+	MediaDir string
+}
+
+// NewFromConfig creates a transcoder from the transcode settings, or returns
+// nil when transcoding is disabled. The caller sets Storage and MediaDir.
+func NewFromConfig(tc config.TranscodeConfig) *Transcoder {
+	if !tc.Enabled {
+		return nil
+	}
+	ffmpegPath, _ := exec.LookPath("ffmpeg")
+	return &Transcoder{
+		FFmpegPath: ffmpegPath,
+		GIFFormat:  tc.GIFFormat,
+		Remux:      tc.Remux,
+		MaxHeight:  tc.MaxHeight,
+		MaxBitrate: tc.MaxBitrate,
+	}
+}
+
+// job is a planned conversion
+type job struct {
+	format string // Container of the derivative
+	remux  bool   // Copy the streams instead of re-encoding them, if possible
+}
+
+// plan returns the conversion for a media file, if it needs one
+func (t *Transcoder) plan(filePath string) (job, bool) {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".gif":
+		if t.GIFFormat == config.GIFToMP4 || t.GIFFormat == config.GIFToWebM {
+			return job{format: t.GIFFormat}, true
+		}
+	case ".mkv", ".mov":
+		if t.Remux {
+			return job{format: "mp4", remux: true}, true
+		}
+	}
+	return job{}, false
+}
+
+// Extensions returns the file extensions of the media that are converted
+func (t *Transcoder) Extensions() []string {
+	var extensions []string
+	if _, ok := t.plan("media.gif"); ok {
+		extensions = append(extensions, "gif")
+	}
+	if t.Remux {
+		extensions = append(extensions, "mkv", "mov")
+	}
+	return extensions
+}
+
+// capped reports whether converted videos are scaled or limited in bitrate,
+// which streams copied as they are would not be
+func (t *Transcoder) capped() bool {
+	return t.MaxHeight > 0 || t.MaxBitrate != ""
+}
+
+// args returns the ffmpeg arguments converting input to output. With
+// copyStreams the streams are put in the new container as they are.
+func (t *Transcoder) args(j job, input, output string, copyStreams bool) []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-i", input,
+		"-map", "0:v:0", "-map", "0:a?",
+	}
+	if copyStreams {
+		args = append(args, "-c", "copy")
+	} else {
+		// Keep the aspect ratio with even dimensions, which yuv420p needs
+		height := "ih"
+		if t.MaxHeight > 0 {
+			height = fmt.Sprintf("min(ih\\,%d)", t.MaxHeight)
+		}
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:trunc(%s/2)*2", height), "-pix_fmt", "yuv420p")
+
+		switch j.format {
+		case "webm":
+			// Constant quality, or constrained quality with a cap
+			bitrate := "0"
+			if t.MaxBitrate != "" {
+				bitrate = t.MaxBitrate
+			}
+			args = append(args, "-c:v", "libvpx-vp9", "-crf", "32", "-b:v", bitrate, "-c:a", "libopus")
+		default:
+			args = append(args, "-c:v", "libx264", "-preset", "medium", "-crf", "23")
+			if t.MaxBitrate != "" {
+				args = append(args, "-maxrate", t.MaxBitrate, "-bufsize", t.MaxBitrate)
+			}
+			args = append(args, "-c:a", "aac")
+		}
+	}
+	if j.format == "mp4" {
+		// Put the index first, so playback starts before the file is loaded
+		args = append(args, "-movflags", "+faststart")
+	}
+	return append(args, output)
+}
+
+// run converts input to output. A remux that fails, e.g. because a codec is
+// not allowed in the new container, is retried as a conversion.
+func (t *Transcoder) run(ctx context.Context, j job, input, output string) error {
+	if j.remux && !t.capped() {
+		err := t.ffmpeg(ctx, t.args(j, input, output, true))
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		log.Debugf("Remuxing %s failed, converting it instead: %v", input, err)
+	}
+	return t.ffmpeg(ctx, t.args(j, input, output, false))
+}
+
+// ffmpeg runs ffmpeg with the given arguments
+func (t *Transcoder) ffmpeg(ctx context.Context, args []string) error {
+	output, err := exec.CommandContext(ctx, t.FFmpegPath, args...).CombinedOutput()
+	if err != nil {
+		out := strings.TrimSpace(string(output))
+		if len(out) > maxOutput {
+			out = "..." + out[len(out)-maxOutput:]
+		}
+		return fmt.Errorf("ffmpeg failed: %w, output: %s", err, out)
+	}
+	return nil
+}
+
+// DerivativeKey returns the key of a derivative of the media with the given
+// hash: derivatives/ab/<hash>.<format>
+func DerivativeKey(hash, format string) string {
+	prefix := hash
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return path.Join(DerivativesDir, prefix, hash+"."+format)
+}
+
+// Transcode converts a media item if it needs it and stores the result. It
+// returns nil for media that is not converted. A conversion that fails is
+// returned as a derivative without a file, recording why; errors are only
+// returned when the media could not be tried, e.g. because its file is
+// missing.
+func (t *Transcoder) Transcode(ctx context.Context, media *models.ScrapedMedia) (*database.Derivative, error) {
+	j, ok := t.plan(media.FilePath)
+	if !ok {
+		return nil, nil
+	}
+	if t.FFmpegPath == "" {
+		return nil, ErrNoFFmpeg
+	}
+
+	key, err := storage.Key(t.MediaDir, media.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	source, cleanup, err := storage.LocalCopy(ctx, t.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	derivative := &database.Derivative{MediaID: media.ID, Format: j.format, CreatedAt: time.Now()}
+
+	// Still GIFs are shown as images
+	if strings.EqualFold(filepath.Ext(media.FilePath), ".gif") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		animated, err := IsAnimatedGIF(f)
+		f.Close()
+		if err != nil || !animated {
+			derivative.Error = "not an animated GIF"
+			return derivative, nil
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "transcode-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output."+j.format)
+
+	if err := t.run(ctx, j, source, output); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		derivative.Error = err.Error()
+		return derivative, nil
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open converted file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open converted file: %w", err)
+	}
+
+	derivativeKey := DerivativeKey(media.MediaHash, j.format)
+	mimeType := mimeTypes[j.format]
+	if err := t.Storage.Put(ctx, derivativeKey, f, info.Size(), mimeType); err != nil {
+		return nil, fmt.Errorf("failed to store converted file: %w", err)
+	}
+
+	derivative.FilePath = filepath.Join(t.MediaDir, filepath.FromSlash(derivativeKey))
+	derivative.MimeType = mimeType
+	derivative.FileSize = info.Size()
+	return derivative, nil
+}
+
+// ForMedia converts a newly downloaded media item if it needs it and records
+// the result. Media that already has a derivative recorded is left alone.
+func ForMedia(ctx context.Context, t *Transcoder, db *database.DB, media *models.ScrapedMedia) (*database.Derivative, error) {
+	if t == nil {
+		return nil, nil
+	}
+	if _, ok := t.plan(media.FilePath); !ok {
+		return nil, nil
+	}
+	recorded, err := db.HasDerivative(media.ID)
+	if err != nil || recorded {
+		return nil, err
+	}
+
+	derivative, err := t.Transcode(ctx, media)
+	if err != nil || derivative == nil {
+		return nil, err
+	}
+	if err := db.SaveDerivative(derivative); err != nil {
+		return nil, err
+	}
+	return derivative, nil
+}
+
+// Backfill converts the media downloaded before transcoding was enabled.
+// Errors on individual items are logged but do not stop the backfill.
+// Cancelling ctx stops it before the next item.
+func Backfill(ctx context.Context, t *Transcoder, db *database.DB) {
+	if t == nil {
+		return
+	}
+	extensions := t.Extensions()
+	if len(extensions) == 0 {
+		return
+	}
+	if t.FFmpegPath == "" {
+		log.Warn("ffmpeg not found, media will not be transcoded")
+		return
+	}
+
+	media, err := db.GetMediaWithoutDerivatives(extensions)
+	if err != nil {
+		log.Errorf("Failed to query media without derivatives: %v", err)
+		return
+	}
+	if len(media) == 0 {
+		log.Debug("No media items need transcoding")
+		return
+	}
+
+	log.Infof("Transcoding %d media items", len(media))
+
+	converted := 0
+	skipped := 0
+	failed := 0
+	for i := range media {
+		item := &media[i]
+		if ctx.Err() != nil {
+			log.Infof("Transcode backfill stopped: %d converted, %d remaining", converted, len(media)-converted-skipped-failed)
+			return
+		}
+
+		derivative, err := t.Transcode(ctx, item)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Debugf("Source file missing for media %d: %s", item.ID, item.FilePath)
+			} else {
+				log.Warnf("Failed to transcode media %d: %v", item.ID, err)
+			}
+			skipped++
+			continue
+		}
+		if derivative == nil {
+			skipped++
+			continue
+		}
+		if err := db.SaveDerivative(derivative); err != nil {
+			log.Errorf("Failed to record derivative of media %d: %v", item.ID, err)
+			failed++
+			continue
+		}
+		if derivative.Error != "" {
+			log.Debugf("Not transcoding media %d: %s", item.ID, derivative.Error)
+			failed++
+			continue
+		}
+
+		converted++
+		if converted%100 == 0 {
+			log.Infof("Transcode backfill progress: %d/%d converted", converted, len(media))
+		}
+	}
+
+	log.Infof("Transcode backfill complete: %d converted, %d skipped, %d not converted (out of %d)",
+		converted, skipped, failed, len(media))
+}
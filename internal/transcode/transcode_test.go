@@ -0,0 +1,280 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+)
+
+// testGIF encodes a GIF with the given number of frames
+func testGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		frame.SetColorIndex(i%4, 0, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+		wantErr bool
+	}{
+		{name: "still", content: testGIF(t, 1)},
+		{name: "animated", content: testGIF(t, 3), want: true},
+		{name: "not a gif", content: []byte("\x89PNG\r\n\x1a\n0000000"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IsAnimatedGIF(bytes.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IsAnimatedGIF() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IsAnimatedGIF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	tr := &Transcoder{GIFFormat: config.GIFToWebM, Remux: true}
+	tests := []struct {
+		path   string
+		want   job
+		wantOK bool
+	}{
+		{"/media/a.gif", job{format: "webm"}, true},
+		{"/media/b.MKV", job{format: "mp4", remux: true}, true},
+		{"/media/c.mov", job{format: "mp4", remux: true}, true},
+		{"/media/d.mp4", job{}, false},
+		{"/media/e.jpg", job{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := tr.plan(tt.path)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("plan(%q) = %+v, %v, want %+v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	keep := &Transcoder{GIFFormat: config.GIFKeep}
+	if _, ok := keep.plan("/media/a.gif"); ok {
+		t.Error("plan() converts GIFs with gif_format none")
+	}
+	if got := keep.Extensions(); len(got) != 0 {
+		t.Errorf("Extensions() = %v, want none", got)
+	}
+	if got := strings.Join(tr.Extensions(), ","); got != "gif,mkv,mov" {
+		t.Errorf("Extensions() = %s, want gif,mkv,mov", got)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		tr          Transcoder
+		job         job
+		copyStreams bool
+		want        []string
+		notWant     []string
+	}{
+		{
+			name:        "remux",
+			job:         job{format: "mp4", remux: true},
+			copyStreams: true,
+			want:        []string{"-i in.mkv", "-c copy", "-movflags +faststart out.mp4"},
+			notWant:     []string{"-vf", "libx264"},
+		},
+		{
+			name:    "gif to mp4",
+			job:     job{format: "mp4"},
+			want:    []string{"-vf scale=-2:trunc(ih/2)*2", "-pix_fmt yuv420p", "-c:v libx264", "-movflags +faststart"},
+			notWant: []string{"-maxrate", "-c copy"},
+		},
+		{
+			name: "capped mp4",
+			tr:   Transcoder{MaxHeight: 720, MaxBitrate: "2M"},
+			job:  job{format: "mp4", remux: true},
+			want: []string{"-vf scale=-2:trunc(min(ih\\,720)/2)*2", "-maxrate 2M -bufsize 2M"},
+		},
+		{
+			name:    "capped webm",
+			tr:      Transcoder{MaxBitrate: "1M"},
+			job:     job{format: "webm"},
+			want:    []string{"-c:v libvpx-vp9", "-b:v 1M", "-c:a libopus"},
+			notWant: []string{"faststart"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := "out." + tt.job.format
+			args := strings.Join(tt.tr.args(tt.job, "in.mkv", output, tt.copyStreams), " ")
+			for _, want := range tt.want {
+				if !strings.Contains(args, want) {
+					t.Errorf("args() = %s, want %q", args, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(args, notWant) {
+					t.Errorf("args() = %s, must not contain %q", args, notWant)
+				}
+			}
+		})
+	}
+}
+
+// fakeFFmpeg installs a script standing in for ffmpeg. It logs its
+// arguments, fails to copy streams and writes "converted" to its output.
+func fakeFFmpeg(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "calls.log")
+	script := `#!/bin/sh
+echo "$@" >> ` + logPath + `
+for a; do out="$a"; done
+case "$*" in *"-c copy"*) echo "codec not supported in mp4" >&2; exit 1;; esac
+printf converted > "$out"
+`
+	ffmpegPath := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpegPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return ffmpegPath, logPath
+}
+
+func TestTranscodeForMedia(t *testing.T) {
+	ffmpegPath, logPath := fakeFFmpeg(t)
+	mediaDir := t.TempDir()
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+	defer db.Close()
+
+	tr := &Transcoder{
+		FFmpegPath: ffmpegPath,
+		GIFFormat:  config.GIFToMP4,
+		Remux:      true,
+		Storage:    storage.NewLocal(mediaDir),
+		MediaDir:   mediaDir,
+	}
+
+	save := func(name string, content []byte, mediaType string) *models.ScrapedMedia {
+		t.Helper()
+		filePath := filepath.Join(mediaDir, "pics", name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		hash, _ := database.HashContent(bytes.NewReader(content))
+		media := &models.ScrapedMedia{
+			PostID: 1, PostTitle: name, CommunityName: "pics", CommunityID: 1,
+			AuthorName: "a", AuthorID: 1, MediaURL: "https://example.com/" + name,
+			MediaHash: hash, FileName: name, FilePath: filePath, FileSize: int64(len(content)),
+			MediaType: mediaType, PostURL: "https://example.com/" + name,
+			PostCreated: time.Now(), DownloadedAt: time.Now(),
+		}
+		if err := db.SaveMedia("lemmy.example", media); err != nil {
+			t.Fatalf("SaveMedia() error = %v", err)
+		}
+		return media
+	}
+	animated := save("anim.gif", testGIF(t, 2), "image")
+	still := save("still.gif", testGIF(t, 1), "image")
+	video := save("clip.mkv", []byte("matroska"), "video")
+	photo := save("photo.jpg", []byte("jpeg"), "image")
+
+	pending, err := db.GetMediaWithoutDerivatives(tr.Extensions())
+	if err != nil {
+		t.Fatalf("GetMediaWithoutDerivatives() error = %v", err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("GetMediaWithoutDerivatives() = %d media, want 3", len(pending))
+	}
+
+	// Animated GIFs are converted and stored by hash
+	derivative, err := ForMedia(context.Background(), tr, db, animated)
+	if err != nil {
+		t.Fatalf("ForMedia() error = %v", err)
+	}
+	if derivative == nil || derivative.Error != "" {
+		t.Fatalf("ForMedia() = %+v, want a derivative", derivative)
+	}
+	wantPath := filepath.Join(mediaDir, filepath.FromSlash(DerivativeKey(animated.MediaHash, "mp4")))
+	if derivative.FilePath != wantPath || derivative.MimeType != "video/mp4" || derivative.FileSize != int64(len("converted")) {
+		t.Errorf("derivative = %+v, want video/mp4 at %s", derivative, wantPath)
+	}
+	if content, err := os.ReadFile(wantPath); err != nil || string(content) != "converted" {
+		t.Errorf("stored derivative = %q, %v", content, err)
+	}
+	recorded, err := db.GetDerivative(animated.ID)
+	if err != nil || recorded == nil || recorded.FilePath != wantPath {
+		t.Errorf("GetDerivative() = %+v, %v", recorded, err)
+	}
+
+	// Still GIFs are recorded without a file, so they are not tried again
+	derivative, err = ForMedia(context.Background(), tr, db, still)
+	if err != nil {
+		t.Fatalf("ForMedia() error = %v", err)
+	}
+	if derivative == nil || derivative.Error == "" || derivative.FilePath != "" {
+		t.Errorf("ForMedia() of a still GIF = %+v, want a recorded error", derivative)
+	}
+	if recorded, _ := db.GetDerivative(still.ID); recorded != nil {
+		t.Errorf("GetDerivative() of a still GIF = %+v, want nil", recorded)
+	}
+
+	// A remux that fails is retried as a conversion
+	derivative, err = ForMedia(context.Background(), tr, db, video)
+	if err != nil || derivative == nil || derivative.Error != "" {
+		t.Fatalf("ForMedia() of a video = %+v, %v", derivative, err)
+	}
+	calls, _ := os.ReadFile(logPath)
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "-c copy") || !strings.Contains(lines[2], "libx264") {
+		t.Errorf("ffmpeg calls = %q, want the GIF, a remux and a conversion", lines)
+	}
+
+	// Media without a conversion, or with one recorded, is left alone
+	if derivative, err := ForMedia(context.Background(), tr, db, photo); derivative != nil || err != nil {
+		t.Errorf("ForMedia() of a JPEG = %+v, %v", derivative, err)
+	}
+	if derivative, err := ForMedia(context.Background(), tr, db, animated); derivative != nil || err != nil {
+		t.Errorf("ForMedia() of converted media = %+v, %v", derivative, err)
+	}
+	if pending, _ := db.GetMediaWithoutDerivatives(tr.Extensions()); len(pending) != 0 {
+		t.Errorf("GetMediaWithoutDerivatives() = %d media after converting, want 0", len(pending))
+	}
+
+	// Without ffmpeg nothing is recorded
+	tr.FFmpegPath = ""
+	other := save("other.gif", testGIF(t, 4), "image")
+	if _, err := ForMedia(context.Background(), tr, db, other); err != ErrNoFFmpeg {
+		t.Errorf("ForMedia() without ffmpeg error = %v, want ErrNoFFmpeg", err)
+	}
+}
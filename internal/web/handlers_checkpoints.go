@@ -0,0 +1,88 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleListCheckpoints returns the checkpoints of all sources
+func (s *Server) handleListCheckpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	checkpoints, err := s.DB.ListCheckpoints()
+	if err != nil {
+		log.Errorf("Failed to list checkpoints: %v", err)
+		http.Error(w, "Failed to list checkpoints", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"checkpoints": checkpoints,
+	})
+}
+
+// handleCheckpoint resets (DELETE) or rewinds (PUT) the checkpoint of one source
+func (s *Server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	source := strings.TrimPrefix(r.URL.Path, "/api/checkpoints/")
+	if source == "" || strings.Contains(source, "/") {
+		http.Error(w, "Invalid source", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		deleted, err := s.DB.DeleteCheckpoint(source)
+		if err != nil {
+			log.Errorf("Failed to reset checkpoint: %v", err)
+			http.Error(w, "Failed to reset checkpoint", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Checkpoint not found", http.StatusNotFound)
+			return
+		}
+		log.Infof("Checkpoint for %s reset via API", source)
+		respondJSON(w, map[string]interface{}{
+			"success": true,
+		})
+
+	case http.MethodPut:
+		var req struct {
+			LastPublished time.Time `json:"last_published"`
+			LastPostID    int64     `json:"last_post_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.LastPublished.IsZero() {
+			http.Error(w, "last_published is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.DB.SaveCheckpoint(source, req.LastPublished, req.LastPostID); err != nil {
+			log.Errorf("Failed to rewind checkpoint: %v", err)
+			http.Error(w, "Failed to save checkpoint", http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Checkpoint for %s set to %s via API", source, req.LastPublished.Format(time.RFC3339))
+
+		checkpoint, err := s.DB.GetCheckpoint(source)
+		if err != nil {
+			log.Errorf("Failed to get checkpoint: %v", err)
+			http.Error(w, "Failed to get checkpoint", http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, checkpoint)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/sidecar"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleGetDuplicates returns groups of near-duplicate media for review
+func (s *Server) handleGetDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 20
+	if l := query.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+	offset := 0
+	if o := query.Get("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	groups, err := s.DB.GetDuplicateGroups()
+	if err != nil {
+		log.Errorf("Failed to get duplicate groups: %v", err)
+		http.Error(w, "Failed to get duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	total := len(groups)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	var pageMedia []models.ScrapedMedia
+	for _, group := range groups[offset:end] {
+		pageMedia = append(pageMedia, group.Media...)
+	}
+	derivatives := s.mediaDerivatives(pageMedia)
+
+	page := make([]map[string]interface{}, 0, end-offset)
+	for _, group := range groups[offset:end] {
+		media := make([]map[string]interface{}, len(group.Media))
+		for i := range group.Media {
+			media[i] = s.mediaMap(&group.Media[i], derivatives)
+		}
+		page = append(page, map[string]interface{}{
+			"media": media,
+			"pairs": group.Pairs,
+		})
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"groups": page,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// handleMergeDuplicates merges near-duplicates into the media item to keep:
+// their posts are linked to it, and their records and files are removed
+func (s *Server) handleMergeDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Keep  int64   `json:"keep"`
+		Merge []int64 `json:"merge"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Keep == 0 || len(req.Merge) == 0 {
+		http.Error(w, "keep and merge are required", http.StatusBadRequest)
+		return
+	}
+	seen := map[int64]bool{req.Keep: true}
+	for _, id := range req.Merge {
+		if seen[id] {
+			http.Error(w, "merge must list distinct media other than keep", http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+
+	merged, err := s.DB.MergeMedia(req.Keep, req.Merge)
+	if err != nil {
+		if errors.Is(err, database.ErrMediaNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		log.Errorf("Failed to merge media: %v", err)
+		http.Error(w, "Failed to merge media", http.StatusInternalServerError)
+		return
+	}
+
+	baseDir := s.Configs.Get().Storage.BaseDirectory
+	for _, m := range merged {
+		if s.NearDuplicates != nil {
+			s.NearDuplicates.Remove(m.Media.ID)
+		}
+		sidecars := &sidecar.Writer{Storage: s.Storage, BaseDir: baseDir}
+		if m.Media.LinkPath != "" {
+			s.deleteStored(r.Context(), baseDir, m.Media.LinkPath)
+			if err := sidecars.Remove(r.Context(), m.Media.LinkPath); err != nil {
+				log.Warnf("Failed to remove sidecars of media %d: %v", m.Media.ID, err)
+			}
+		}
+		for _, derivative := range m.DerivativePaths {
+			s.deleteStored(r.Context(), baseDir, derivative)
+		}
+		// A file shared with another record, e.g. a content-addressed
+		// object, is kept along with its thumbnail
+		if m.FileShared {
+			continue
+		}
+		s.deleteStored(r.Context(), baseDir, m.Media.FilePath)
+		if err := sidecars.Remove(r.Context(), m.Media.FilePath); err != nil {
+			log.Warnf("Failed to remove sidecars of media %d: %v", m.Media.ID, err)
+		}
+		if m.ThumbnailPath != "" {
+			if err := os.Remove(m.ThumbnailPath); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove thumbnail %s: %v", m.ThumbnailPath, err)
+			}
+		}
+	}
+	log.Infof("Merged %d near-duplicates into media %d via API", len(merged), req.Keep)
+
+	respondJSON(w, map[string]interface{}{
+		"success": true,
+		"kept":    req.Keep,
+		"merged":  len(merged),
+	})
+}
+
+// deleteStored removes a media file recorded at filePath from storage
+func (s *Server) deleteStored(ctx context.Context, baseDir, filePath string) {
+	key, err := storage.Key(baseDir, filePath)
+	if err != nil {
+		log.Warnf("Not removing %s: %v", filePath, err)
+		return
+	}
+	if err := s.Storage.Delete(ctx, key); err != nil {
+		log.Warnf("Failed to remove %s: %v", filePath, err)
+	}
+}
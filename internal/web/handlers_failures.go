@@ -0,0 +1,101 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleGetFailures lists failed downloads, optionally only those with the
+// given status ("pending" or "permanent")
+func (s *Server) handleGetFailures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != database.FailurePending && status != database.FailurePermanent {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if l := query.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 200 {
+			limit = parsed
+		}
+	}
+	offset := 0
+	if o := query.Get("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	failures, total, err := s.DB.ListDownloadFailures(status, limit, offset)
+	if err != nil {
+		log.Errorf("Failed to get download failures: %v", err)
+		http.Error(w, "Failed to get download failures", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"failures": failures,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+	})
+}
+
+// handleRetryFailure retries a failed download right away:
+// POST /api/failures/{id}/retry
+func (s *Server) handleRetryFailure(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/failures/")
+	idStr, action, found := strings.Cut(path, "/")
+	if !found || action != "retry" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid failure ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Scraper == nil {
+		http.Error(w, "Scraper not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	result, err := s.Scraper.RetryDownload(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, scraper.ErrFailureNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, scraper.ErrRunInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, scraper.ErrShuttingDown):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			log.Errorf("Failed to retry download failure %d: %v", id, err)
+			http.Error(w, "Failed to retry download", http.StatusBadGateway)
+		}
+		return
+	}
+	if result.MediaID != 0 {
+		log.Infof("Retried download failure %d via API: downloaded as media %d", id, result.MediaID)
+	} else {
+		log.Infof("Retried download failure %d via API: failed again", id)
+	}
+
+	respondJSON(w, result)
+}
@@ -0,0 +1,157 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSearchUpload is the largest file accepted by the reverse image search
+const maxSearchUpload = 50 << 20
+
+// handleImageSearch finds the archived media that look closest to an image,
+// given either as an "image" file in a multipart form or as a URL, in a form
+// field or a JSON body {"url": "..."}
+func (s *Server) handleImageSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.NearDuplicates == nil {
+		http.Error(w, "Reverse image search requires near_duplicates.enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 20
+	if l := query.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+	maxDistance := 12
+	if d := query.Get("max_distance"); d != "" {
+		parsed, err := strconv.Atoi(d)
+		if err != nil || parsed < 0 || parsed > 64 {
+			http.Error(w, "max_distance must be between 0 and 64", http.StatusBadRequest)
+			return
+		}
+		maxDistance = parsed
+	}
+
+	content, contentType, status, err := s.searchImageContent(w, r)
+	if err != nil {
+		if status == http.StatusBadGateway {
+			log.Warnf("Reverse image search failed: %v", err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// The content decides the type; servers often send a generic one
+	sniffed := http.DetectContentType(content)
+	if sniffed == "application/octet-stream" && contentType != "" {
+		sniffed = contentType
+	}
+	var mediaType string
+	switch {
+	case strings.HasPrefix(sniffed, "image/"):
+		mediaType = "image"
+	case strings.HasPrefix(sniffed, "video/"):
+		mediaType = "video"
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported file type %s", sniffed), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := s.NearDuplicates.HashContent(r.Context(), content, mediaType, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to hash %s: %v", mediaType, err), http.StatusBadRequest)
+		return
+	}
+
+	matches := s.NearDuplicates.Index.Nearest(hash, limit, maxDistance)
+	found := make([]models.ScrapedMedia, 0, len(matches))
+	distances := make([]int, 0, len(matches))
+	for _, m := range matches {
+		media, err := s.DB.GetMediaByID(m.MediaID)
+		if err != nil {
+			// Merged away since it was indexed
+			log.Debugf("Skipping search match %d: %v", m.MediaID, err)
+			continue
+		}
+		found = append(found, *media)
+		distances = append(distances, m.Distance)
+	}
+
+	derivatives := s.mediaDerivatives(found)
+	results := make([]map[string]interface{}, len(found))
+	for i := range found {
+		results[i] = s.mediaMap(&found[i], derivatives)
+		results[i]["distance"] = distances[i]
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"hash":         fmt.Sprintf("%016x", hash),
+		"max_distance": maxDistance,
+		"matches":      results,
+		"total":        len(results),
+	})
+}
+
+// searchImageContent reads the searched file from an upload or downloads it
+// from a URL. On failure it returns the HTTP status to respond with.
+func (s *Server) searchImageContent(w http.ResponseWriter, r *http.Request) ([]byte, string, int, error) {
+	var mediaURL string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSearchUpload)
+		if err := r.ParseMultipartForm(8 << 20); err != nil {
+			return nil, "", http.StatusBadRequest, fmt.Errorf("invalid upload: %v", err)
+		}
+		file, header, err := r.FormFile("image")
+		if err == nil {
+			defer file.Close()
+			content, err := io.ReadAll(file)
+			if err != nil {
+				return nil, "", http.StatusBadRequest, fmt.Errorf("failed to read upload: %v", err)
+			}
+			return content, header.Header.Get("Content-Type"), http.StatusOK, nil
+		}
+		if err != http.ErrMissingFile {
+			return nil, "", http.StatusBadRequest, fmt.Errorf("invalid upload: %v", err)
+		}
+		mediaURL = r.FormValue("url")
+	} else {
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			return nil, "", http.StatusBadRequest, errors.New("invalid request body")
+		}
+		mediaURL = req.URL
+	}
+
+	mediaURL = strings.TrimSpace(mediaURL)
+	if mediaURL == "" {
+		return nil, "", http.StatusBadRequest, errors.New("an image file or url is required")
+	}
+	if s.Scraper == nil {
+		return nil, "", http.StatusServiceUnavailable, errors.New("scraper not available")
+	}
+	content, contentType, err := s.Scraper.Downloader.Fetch(r.Context(), mediaURL)
+	if err != nil {
+		if errors.Is(err, downloader.ErrInvalidURL) {
+			return nil, "", http.StatusBadRequest, err
+		}
+		return nil, "", http.StatusBadGateway, fmt.Errorf("failed to download %s: %v", mediaURL, err)
+	}
+	return content, contentType, http.StatusOK, nil
+}
@@ -188,7 +188,7 @@ func (s *Server) handleServeThumbnail(w http.ResponseWriter, r *http.Request) {
 
 	// Prevent path traversal - clean and validate the thumbnail path
 	cleanedPath := filepath.Clean(thumbnailPath)
-	baseDir := filepath.Clean(s.Config.Thumbnails.Directory)
+	baseDir := filepath.Clean(s.Configs.Get().Thumbnails.Directory)
 
 	// Resolve symlinks to prevent symlink-based bypasses
 	resolvedPath, err := filepath.EvalSymlinks(cleanedPath)
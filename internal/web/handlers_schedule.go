@@ -0,0 +1,31 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scheduler"
+)
+
+// handleGetSchedule returns the scheduled jobs and their next run times
+func (s *Server) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg := s.Configs.Get()
+	response := map[string]interface{}{
+		"mode":        cfg.RunMode.Mode,
+		"quiet_hours": "",
+		"jitter":      cfg.RunMode.Jitter.String(),
+		"jobs":        []scheduler.JobStatus{},
+	}
+	if s.Scheduler != nil {
+		if quiet := s.Scheduler.QuietHours(); quiet != nil {
+			response["quiet_hours"] = quiet.String()
+		}
+		response["jobs"] = s.Scheduler.Jobs()
+	}
+
+	respondJSON(w, response)
+}
@@ -0,0 +1,182 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleScrape starts a scrape run (POST) or returns the current run status (GET).
+// The POST body may scope the run to one community or to the "hot" source, and
+// may ask for a dry run whose report is served by handleDryRunReport.
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		respondJSON(w, s.scrapeStatus())
+
+	case http.MethodPost:
+		if s.Scraper == nil {
+			http.Error(w, "Scraper not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			Community string `json:"community"`
+			Source    string `json:"source"`
+			DryRun    bool   `json:"dry_run"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Community = strings.TrimSpace(req.Community)
+		req.Source = strings.TrimSpace(req.Source)
+		if req.Community != "" && req.Source != "" {
+			http.Error(w, "Specify either community or source, not both", http.StatusBadRequest)
+			return
+		}
+		source := req.Community
+		if req.Source != "" {
+			source = req.Source
+		}
+
+		start := s.Scraper.StartRun
+		kind := "Scrape run"
+		if req.DryRun {
+			start = s.Scraper.StartDryRun
+			kind = "Dry run"
+		}
+		if err := start(source); err != nil {
+			switch {
+			case errors.Is(err, scraper.ErrRunInProgress):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, scraper.ErrShuttingDown):
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			default:
+				log.Errorf("Failed to start %s: %v", strings.ToLower(kind), err)
+				http.Error(w, "Failed to start "+strings.ToLower(kind), http.StatusInternalServerError)
+			}
+			return
+		}
+		if source == "" {
+			log.Infof("%s started via API", kind)
+		} else {
+			log.Infof("%s of %s started via API", kind, source)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"source":  source,
+			"dry_run": req.DryRun,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDryRunReport returns the report of the active or most recent dry run
+func (s *Server) handleDryRunReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Scraper == nil {
+		http.Error(w, "Scraper not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	report := s.Scraper.LastDryRun()
+	if report == nil {
+		http.Error(w, "No dry run has been started", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, report)
+}
+
+// handleFetch archives a single post given its ID, URL or ActivityPub id and
+// returns the IDs of its stored media
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Scraper == nil {
+		http.Error(w, "Scraper not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.URL) == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.Scraper.FetchPost(r.Context(), req.URL)
+	if err != nil {
+		switch {
+		case errors.Is(err, scraper.ErrInvalidPostRef):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, scraper.ErrPostNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, scraper.ErrRunInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, scraper.ErrShuttingDown):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			log.Errorf("Failed to fetch %s: %v", req.URL, err)
+			http.Error(w, "Failed to fetch post", http.StatusBadGateway)
+		}
+		return
+	}
+	log.Infof("Fetched post %d via API (%d media)", result.PostID, len(result.MediaIDs))
+
+	respondJSON(w, result)
+}
+
+// handleScrapeControl returns a handler that applies a control action (cancel,
+// pause or resume) to the active run. The action reports false when it does
+// not apply, e.g. cancelling while no run is active.
+func (s *Server) handleScrapeControl(name string, action func(*scraper.Scraper) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.Scraper == nil {
+			http.Error(w, "Scraper not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !action(s.Scraper) {
+			http.Error(w, "Cannot "+name+": no matching scrape run", http.StatusConflict)
+			return
+		}
+		log.Infof("Scrape run %s requested via API", name)
+
+		respondJSON(w, s.scrapeStatus())
+	}
+}
+
+// scrapeStatus returns the current run status, or an idle status when
+// progress tracking is not available
+func (s *Server) scrapeStatus() progress.Status {
+	if s.ProgressTracker == nil {
+		return progress.Status{State: progress.StateIdle}
+	}
+	return s.ProgressTracker.GetStatus()
+}
@@ -1,10 +1,16 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -12,31 +18,41 @@ import (
 
 	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/phash"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scheduler"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/thumbnails"
+	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
 // Server represents the web server
 type Server struct {
-	Config            *config.Config
-	ConfigPath        string
+	Configs           *config.Store
 	DB                *database.DB
 	ProgressTracker   *progress.Tracker
 	ThumbnailGen      *thumbnails.Generator
+	Scheduler         *scheduler.Scheduler // Set in continuous mode
+	Scraper           *scraper.Scraper     // Enables triggering runs from the API
+	Storage           storage.Storage      // Holds the media files; a *storage.Local is served from disk
+	NearDuplicates    *phash.Detector      // Set when near-duplicate detection is enabled
 	handler           http.Handler
+	httpServer        *http.Server
 	websocketUpgrader websocket.Upgrader
 }
 
 // New creates a new web server
-func New(cfg *config.Config, configPath string, db *database.DB, progressTracker *progress.Tracker, thumbnailGen *thumbnails.Generator) *Server {
+func New(configs *config.Store, db *database.DB, progressTracker *progress.Tracker, thumbnailGen *thumbnails.Generator) *Server {
+	cfg := configs.Get()
 	s := &Server{
-		Config:          cfg,
-		ConfigPath:      configPath,
+		Configs:         configs,
 		DB:              db,
 		ProgressTracker: progressTracker,
 		ThumbnailGen:    thumbnailGen,
+		Storage:         storage.NewLocal(cfg.Storage.BaseDirectory),
 		websocketUpgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				// Allow all origins - WebSocket provides read-only progress data
@@ -46,6 +62,10 @@ func New(cfg *config.Config, configPath string, db *database.DB, progressTracker
 		},
 	}
 	s.setupRoutes()
+	s.httpServer = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", cfg.WebServer.Host, cfg.WebServer.Port),
+		Handler: s.handler,
+	}
 	return s
 }
 
@@ -123,12 +143,36 @@ func (s *Server) setupRoutes() {
 
 	// Search endpoints
 	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/search/image", s.handleImageSearch)
 
 	// Advanced statistics endpoints
 	mux.HandleFunc("/api/stats/timeline", s.handleStatsTimeline)
 	mux.HandleFunc("/api/stats/top-creators", s.handleStatsTopCreators)
 	mux.HandleFunc("/api/stats/storage", s.handleStatsStorage)
 
+	// Near-duplicate review
+	mux.HandleFunc("/api/duplicates", s.handleGetDuplicates)
+	mux.HandleFunc("/api/duplicates/merge", s.handleMergeDuplicates)
+
+	// Failed downloads
+	mux.HandleFunc("/api/failures", s.handleGetFailures)
+	mux.HandleFunc("/api/failures/", s.handleRetryFailure)
+
+	// Source checkpoints
+	mux.HandleFunc("/api/checkpoints", s.handleListCheckpoints)
+	mux.HandleFunc("/api/checkpoints/", s.handleCheckpoint)
+
+	// Scheduled runs
+	mux.HandleFunc("/api/schedule", s.handleGetSchedule)
+
+	// On-demand runs
+	mux.HandleFunc("/api/scrape", s.handleScrape)
+	mux.HandleFunc("/api/scrape/cancel", s.handleScrapeControl("cancel", (*scraper.Scraper).Cancel))
+	mux.HandleFunc("/api/scrape/pause", s.handleScrapeControl("pause", (*scraper.Scraper).Pause))
+	mux.HandleFunc("/api/scrape/resume", s.handleScrapeControl("resume", (*scraper.Scraper).Resume))
+	mux.HandleFunc("/api/scrape/dry-run", s.handleDryRunReport)
+	mux.HandleFunc("/api/fetch", s.handleFetch)
+
 	// WebSocket endpoint for real-time progress
 	mux.HandleFunc("/ws/progress", s.handleWebSocket)
 
@@ -142,9 +186,18 @@ func (s *Server) setupRoutes() {
 
 // Start starts the web server
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.Config.WebServer.Host, s.Config.WebServer.Port)
-	log.Infof("Starting API server on http://%s", addr)
-	return http.ListenAndServe(addr, s.handler)
+	log.Infof("Starting API server on http://%s", s.httpServer.Addr)
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish until ctx expires. WebSocket connections are not tracked by the HTTP
+// server and must be closed through the progress tracker.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
 
 // handleGetMedia returns a paginated list of media
@@ -195,30 +248,10 @@ func (s *Server) handleGetMedia(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Convert to map format for API response
+	derivatives := s.mediaDerivatives(mediaItems)
 	media := make([]map[string]interface{}, len(mediaItems))
-	for i, item := range mediaItems {
-		serveURL := fmt.Sprintf("/media/%s", filepath.Join(item.CommunityName, item.FileName))
-
-		media[i] = map[string]interface{}{
-			"id":             item.ID,
-			"post_id":        item.PostID,
-			"post_title":     item.PostTitle,
-			"community_name": item.CommunityName,
-			"community_id":   item.CommunityID,
-			"author_name":    item.AuthorName,
-			"author_id":      item.AuthorID,
-			"media_url":      item.MediaURL,
-			"media_hash":     item.MediaHash,
-			"file_name":      item.FileName,
-			"file_path":      item.FilePath,
-			"file_size":      item.FileSize,
-			"media_type":     item.MediaType,
-			"post_url":       item.PostURL,
-			"post_score":     item.PostScore,
-			"post_created":   item.PostCreated.Format(time.RFC3339),
-			"downloaded_at":  item.DownloadedAt.Format(time.RFC3339),
-			"serve_url":      serveURL,
-		}
+	for i := range mediaItems {
+		media[i] = s.mediaMap(&mediaItems[i], derivatives)
 	}
 
 	response := map[string]interface{}{
@@ -253,29 +286,16 @@ func (s *Server) handleGetMediaByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serveURL := fmt.Sprintf("/media/%s", filepath.Join(media.CommunityName, media.FileName))
-
-	response := map[string]interface{}{
-		"id":             media.ID,
-		"post_id":        media.PostID,
-		"post_title":     media.PostTitle,
-		"community_name": media.CommunityName,
-		"community_id":   media.CommunityID,
-		"author_name":    media.AuthorName,
-		"author_id":      media.AuthorID,
-		"media_url":      media.MediaURL,
-		"media_hash":     media.MediaHash,
-		"file_name":      media.FileName,
-		"file_path":      media.FilePath,
-		"file_size":      media.FileSize,
-		"media_type":     media.MediaType,
-		"post_url":       media.PostURL,
-		"post_score":     media.PostScore,
-		"post_created":   media.PostCreated.Format(time.RFC3339),
-		"downloaded_at":  media.DownloadedAt.Format(time.RFC3339),
-		"serve_url":      serveURL,
+	posts, err := s.DB.GetMediaPosts(id)
+	if err != nil {
+		log.Errorf("Failed to get posts of media %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
+	response := s.mediaMap(media, s.mediaDerivatives([]models.ScrapedMedia{*media}))
+	response["posts"] = posts
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -369,8 +389,9 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 // handleGetConfig returns the current configuration
 func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	// Return config without sensitive information (password)
-	safeCfg := *s.Config
+	safeCfg := *s.Configs.Get()
 	safeCfg.Lemmy.Password = "" // Don't expose password
+	safeCfg.Storage.S3.SecretAccessKey = ""
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(safeCfg)
@@ -386,7 +407,10 @@ func (s *Server) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 
 	// If password is empty (not changed), keep the existing one
 	if newConfig.Lemmy.Password == "" {
-		newConfig.Lemmy.Password = s.Config.Lemmy.Password
+		newConfig.Lemmy.Password = s.Configs.Get().Lemmy.Password
+	}
+	if newConfig.Storage.S3.SecretAccessKey == "" {
+		newConfig.Storage.S3.SecretAccessKey = s.Configs.Get().Storage.S3.SecretAccessKey
 	}
 
 	// Validate the new configuration
@@ -395,29 +419,100 @@ func (s *Server) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set defaults for any missing optional fields
-	newConfig.SetDefaults()
-
-	// Save to file
-	if err := config.SaveConfig(s.ConfigPath, &newConfig); err != nil {
+	// Save to file and apply; subscribers pick up the change at their next run
+	restartRequired, err := s.Configs.Update(&newConfig)
+	if err != nil {
 		log.Errorf("Failed to save config: %v", err)
 		http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
 		return
 	}
 
-	// Update the in-memory config
-	s.Config = &newConfig
-
 	log.Info("Configuration updated successfully")
+	message := "Configuration updated successfully. Changes take effect from the next run."
+	if len(restartRequired) > 0 {
+		log.Warnf("Restart required to apply: %s", strings.Join(restartRequired, ", "))
+		message += " Restart the application to apply: " + strings.Join(restartRequired, ", ") + "."
+	} else {
+		restartRequired = []string{}
+	}
 
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Configuration updated successfully. Restart the application for all changes to take effect.",
+		"success":          true,
+		"message":          message,
+		"restart_required": restartRequired,
 	})
 }
 
+// mediaDerivatives loads the derivatives of a page of media items in one
+// query. Derivatives are only served while transcoding is enabled.
+func (s *Server) mediaDerivatives(items []models.ScrapedMedia) map[int64]*database.Derivative {
+	if !s.Configs.Get().Transcode.Enabled || len(items) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(items))
+	for i := range items {
+		ids[i] = items[i].ID
+	}
+	derivatives, err := s.DB.GetDerivatives(ids)
+	if err != nil {
+		log.Warnf("Failed to get derivatives of %d media items: %v", len(ids), err)
+		return nil
+	}
+	return derivatives
+}
+
+// mediaMap converts a media record to its API representation. Media with a
+// derivative, such as an MP4 of an animated GIF, is served as the derivative;
+// original_url always points at the downloaded file. derivatives comes from
+// mediaDerivatives.
+func (s *Server) mediaMap(item *models.ScrapedMedia, derivatives map[int64]*database.Derivative) map[string]interface{} {
+	serveURL := s.mediaServeURL(item)
+	m := map[string]interface{}{
+		"id":             item.ID,
+		"post_id":        item.PostID,
+		"post_title":     item.PostTitle,
+		"community_name": item.CommunityName,
+		"community_id":   item.CommunityID,
+		"author_name":    item.AuthorName,
+		"author_id":      item.AuthorID,
+		"media_url":      item.MediaURL,
+		"media_hash":     item.MediaHash,
+		"sanitized_hash": item.SanitizedHash,
+		"file_name":      item.FileName,
+		"file_path":      item.FilePath,
+		"file_size":      item.FileSize,
+		"media_type":     item.MediaType,
+		"post_url":       item.PostURL,
+		"post_score":     item.PostScore,
+		"post_created":   item.PostCreated.Format(time.RFC3339),
+		"downloaded_at":  item.DownloadedAt.Format(time.RFC3339),
+		"serve_url":      serveURL,
+		"original_url":   serveURL,
+		"derivative":     nil,
+	}
+
+	if derivative := derivatives[item.ID]; derivative != nil {
+		baseDir := s.Configs.Get().Storage.BaseDirectory
+		if rel, err := filepath.Rel(baseDir, derivative.FilePath); err == nil && !strings.HasPrefix(rel, "..") {
+			m["serve_url"] = "/media/" + filepath.ToSlash(rel)
+			m["derivative"] = derivative
+		}
+	}
+	return m
+}
+
+// mediaServeURL returns the URL a media file is served from, which follows
+// its path under the storage directory
+func (s *Server) mediaServeURL(media *models.ScrapedMedia) string {
+	baseDir := s.Configs.Get().Storage.BaseDirectory
+	if rel, err := filepath.Rel(baseDir, media.FilePath); err == nil && !strings.HasPrefix(rel, "..") {
+		return "/media/" + filepath.ToSlash(rel)
+	}
+	return fmt.Sprintf("/media/%s", filepath.Join(media.CommunityName, media.FileName))
+}
+
 // handleServeMedia serves media files from the storage directory
 func (s *Server) handleServeMedia(w http.ResponseWriter, r *http.Request) {
 	// Extract path after /media/
@@ -434,8 +529,14 @@ func (s *Server) handleServeMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Media in remote storage is proxied or redirected to
+	if _, local := s.Storage.(*storage.Local); !local && s.Storage != nil {
+		s.serveStoredMedia(w, r, filepath.ToSlash(cleanedPath))
+		return
+	}
+
 	// 3. Construct full file path
-	baseDir := filepath.Clean(s.Config.Storage.BaseDirectory)
+	baseDir := filepath.Clean(s.Configs.Get().Storage.BaseDirectory)
 	fullPath := filepath.Join(baseDir, cleanedPath)
 
 	// 4. Ensure the resolved path is still within the base directory
@@ -464,6 +565,57 @@ func (s *Server) handleServeMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Objects are named by their content, so they never change
+	if storage.IsObjectPath(filepath.ToSlash(cleanedPath)) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
 	// Serve the file
 	http.ServeFile(w, r, resolvedPath)
 }
+
+// serveStoredMedia serves a media file from remote storage. With presigning
+// enabled the client is redirected to the object store, otherwise the file is
+// streamed through the server.
+func (s *Server) serveStoredMedia(w http.ResponseWriter, r *http.Request, key string) {
+	cfg := s.Configs.Get().Storage.S3
+	if presigner, ok := s.Storage.(*storage.S3); ok && cfg.Presign {
+		presigned, err := presigner.PresignGet(key, cfg.PresignExpiry)
+		if err != nil {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, presigned, http.StatusFound)
+		return
+	}
+
+	info, err := s.Storage.Stat(r.Context(), key)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Errorf("Failed to stat media %s: %v", key, err)
+		}
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	body, err := s.Storage.Get(r.Context(), key)
+	if err != nil {
+		log.Errorf("Failed to read media %s: %v", key, err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if storage.IsObjectPath(key) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Debugf("Failed to send media %s: %v", key, err)
+	}
+}
@@ -1,8 +1,14 @@
 package web
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -11,8 +17,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ST2Projects/lemmy-media-scraper/internal/api"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/config"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/database"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/downloader"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/phash"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/progress"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scheduler"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/scraper"
+	"github.com/ST2Projects/lemmy-media-scraper/internal/storage"
 	"github.com/ST2Projects/lemmy-media-scraper/internal/thumbnails"
 	"github.com/ST2Projects/lemmy-media-scraper/pkg/models"
 )
@@ -78,7 +91,7 @@ func setupTestServer(t *testing.T) *Server {
 
 	thumbGen := thumbnails.NewGenerator(400, 400, 85, thumbDir, "ffmpeg")
 
-	s := New(cfg, configPath, db, nil, thumbGen)
+	s := New(config.NewStore(configPath, cfg), db, nil, thumbGen)
 	return s
 }
 
@@ -104,7 +117,7 @@ func insertTestMedia(t *testing.T, db *database.DB, postID int64, community stri
 		DownloadedAt:  time.Now(),
 	}
 
-	if err := db.SaveMedia(media); err != nil {
+	if err := db.SaveMedia("lemmy.example", media); err != nil {
 		t.Fatalf("failed to insert test media: %v", err)
 	}
 	return media
@@ -242,6 +255,10 @@ func TestHandleGetMediaByID(t *testing.T) {
 				if resp["post_title"] != "Test Post 1" {
 					t.Errorf("post_title = %v, want 'Test Post 1'", resp["post_title"])
 				}
+				posts, ok := resp["posts"].([]interface{})
+				if !ok || len(posts) != 1 {
+					t.Errorf("posts = %v, want the original post", resp["posts"])
+				}
 			}
 		})
 	}
@@ -348,7 +365,7 @@ func TestHandleGetComments(t *testing.T) {
 		Community: models.Community{ID: 1, Name: "pics"},
 		Creator:   models.Person{ID: 1, Name: "testuser"},
 	}
-	if err := s.DB.MarkPostAsScraped(postView, 1); err != nil {
+	if err := s.DB.MarkPostAsScraped(s.Configs.Get().Lemmy.Instance, postView, 1); err != nil {
 		t.Fatalf("failed to mark post: %v", err)
 	}
 
@@ -454,7 +471,7 @@ func TestHandleConfig(t *testing.T) {
 	})
 
 	t.Run("PUT with valid config", func(t *testing.T) {
-		newCfg := *s.Config
+		newCfg := *s.Configs.Get()
 		newCfg.Lemmy.Password = "secret123" // needed for validation
 		body, _ := json.Marshal(newCfg)
 
@@ -468,6 +485,38 @@ func TestHandleConfig(t *testing.T) {
 		}
 	})
 
+	t.Run("PUT reports settings that need a restart", func(t *testing.T) {
+		newCfg := *s.Configs.Get()
+		newCfg.Lemmy.Password = ""
+		newCfg.WebServer.Port = 9090
+		newCfg.Scraper.MaxPostsPerRun = 5
+		body, _ := json.Marshal(newCfg)
+
+		req := httptest.NewRequest(http.MethodPut, "/api/config", strings.NewReader(string(body)))
+		rec := httptest.NewRecorder()
+
+		s.handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d; body: %s", rec.Code, http.StatusOK, rec.Body.String())
+		}
+		var resp struct {
+			RestartRequired []string `json:"restart_required"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(resp.RestartRequired) != 1 || resp.RestartRequired[0] != "web_server.port" {
+			t.Errorf("restart_required = %v, want [web_server.port]", resp.RestartRequired)
+		}
+		if got := s.Configs.Get().Scraper.MaxPostsPerRun; got != 5 {
+			t.Errorf("MaxPostsPerRun = %d, want 5", got)
+		}
+		if got := s.Configs.Get().Lemmy.Password; got != "secret123" {
+			t.Errorf("password = %q, want the existing password kept", got)
+		}
+	})
+
 	t.Run("unsupported method", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodDelete, "/api/config", nil)
 		rec := httptest.NewRecorder()
@@ -484,7 +533,7 @@ func TestHandleServeMedia(t *testing.T) {
 	s := setupTestServer(t)
 
 	// Create a test media file
-	communityDir := filepath.Join(s.Config.Storage.BaseDirectory, "pics")
+	communityDir := filepath.Join(s.Configs.Get().Storage.BaseDirectory, "pics")
 	if err := os.MkdirAll(communityDir, 0755); err != nil {
 		t.Fatalf("failed to create community dir: %v", err)
 	}
@@ -534,12 +583,103 @@ func TestHandleServeMedia(t *testing.T) {
 	}
 }
 
+func TestHandleServeMediaObject(t *testing.T) {
+	s := setupTestServer(t)
+	baseDir := s.Configs.Get().Storage.BaseDirectory
+
+	hash := strings.Repeat("ab", 32)
+	object := storage.ObjectPath(baseDir, hash, "jpg")
+	if _, err := storage.WriteObject(object, []byte("fake image data")); err != nil {
+		t.Fatalf("WriteObject() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, "plain.jpg"), []byte("fake image data"), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/media/objects/ab/ab/"+hash+".jpg", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("Cache-Control = %q, want immutable", cc)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/media/plain.jpg", nil)
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if cc := rec.Header().Get("Cache-Control"); strings.Contains(cc, "immutable") {
+		t.Errorf("Cache-Control of a template path = %q, want it not immutable", cc)
+	}
+}
+
+// remoteStorage hides that a storage is local, so it is served like an
+// object store
+type remoteStorage struct {
+	storage.Storage
+}
+
+func TestHandleServeMediaRemote(t *testing.T) {
+	s := setupTestServer(t)
+	files := storage.NewLocal(t.TempDir())
+	s.Storage = remoteStorage{files}
+
+	content := "fake image data"
+	if err := files.Put(context.Background(), "pics/1_image.jpg", strings.NewReader(content), int64(len(content)), ""); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/media/pics/1_image.jpg", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Body.String() != content {
+		t.Errorf("body = %q, want %q", rec.Body.String(), content)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Content-Type = %q, want image/jpeg", ct)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/media/pics/missing.jpg", nil)
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing file status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleServeMediaPresigned(t *testing.T) {
+	s := setupTestServer(t)
+	cfg := *s.Configs.Get()
+	cfg.Storage.S3 = config.S3Config{Endpoint: "http://s3.test", Bucket: "media", Presign: true, PresignExpiry: time.Hour}
+	if _, err := s.Configs.Update(&cfg); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	bucket := storage.NewS3("http://s3.test", "", "media", "access", "secret")
+	bucket.PathStyle = true
+	s.Storage = bucket
+
+	req := httptest.NewRequest(http.MethodGet, "/media/pics/1_image.jpg", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusFound)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, "http://s3.test/media/pics/1_image.jpg?") || !strings.Contains(location, "X-Amz-Signature=") {
+		t.Errorf("Location = %q, want a presigned URL of the object", location)
+	}
+}
+
 func TestHandleServeThumbnail(t *testing.T) {
 	s := setupTestServer(t)
 
 	// Insert media and its thumbnail record
 	media := insertTestMedia(t, s.DB, 1, "pics")
-	thumbPath := filepath.Join(s.Config.Thumbnails.Directory, "image_1.jpg")
+	thumbPath := filepath.Join(s.Configs.Get().Thumbnails.Directory, "image_1.jpg")
 	if err := os.WriteFile(thumbPath, []byte("fake thumb"), 0644); err != nil {
 		t.Fatalf("failed to write thumbnail file: %v", err)
 	}
@@ -626,6 +766,409 @@ func TestHandleSearch(t *testing.T) {
 	}
 }
 
+func TestHandleCheckpoints(t *testing.T) {
+	s := setupTestServer(t)
+
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.DB.SaveCheckpoint("pics", published, 42); err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{name: "list", method: http.MethodGet, path: "/api/checkpoints", wantStatus: http.StatusOK},
+		{name: "list wrong method", method: http.MethodPost, path: "/api/checkpoints", wantStatus: http.StatusMethodNotAllowed},
+		{name: "rewind", method: http.MethodPut, path: "/api/checkpoints/pics", body: `{"last_published":"2024-01-01T00:00:00Z"}`, wantStatus: http.StatusOK},
+		{name: "rewind without time", method: http.MethodPut, path: "/api/checkpoints/pics", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "rewind invalid body", method: http.MethodPut, path: "/api/checkpoints/pics", body: `not json`, wantStatus: http.StatusBadRequest},
+		{name: "reset", method: http.MethodDelete, path: "/api/checkpoints/pics", wantStatus: http.StatusOK},
+		{name: "reset missing", method: http.MethodDelete, path: "/api/checkpoints/pics", wantStatus: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodPost, path: "/api/checkpoints/pics", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+
+			s.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandleGetSchedule(t *testing.T) {
+	s := setupTestServer(t)
+
+	// Once mode has no scheduler
+	req := httptest.NewRequest(http.MethodGet, "/api/schedule", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	quiet, err := scheduler.ParseQuietHours("23:00", "07:00")
+	if err != nil {
+		t.Fatalf("ParseQuietHours() error = %v", err)
+	}
+	s.Scheduler = scheduler.New(quiet, 0)
+	s.Scheduler.Add("global", "every 1h", scheduler.Every(time.Hour), func(ctx context.Context) error { return nil })
+
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	var resp struct {
+		QuietHours string                `json:"quiet_hours"`
+		Jobs       []scheduler.JobStatus `json:"jobs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.QuietHours != "23:00-07:00" {
+		t.Errorf("quiet_hours = %q, want 23:00-07:00", resp.QuietHours)
+	}
+	if len(resp.Jobs) != 1 || resp.Jobs[0].Name != "global" || resp.Jobs[0].NextRun.IsZero() {
+		t.Errorf("jobs = %+v, want the global job with a next run", resp.Jobs)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/schedule", nil)
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleScrape(t *testing.T) {
+	s := setupTestServer(t)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without a scraper runs cannot be triggered
+	if rec := post("/api/scrape", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST without scraper status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// Fake Lemmy API whose post listing blocks until the request is cancelled
+	requested := make(chan struct{}, 1)
+	lemmy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(lemmy.Close)
+
+	apiClient := &api.Client{BaseURL: lemmy.URL + "/api/v3", HTTPClient: lemmy.Client()}
+	s.ProgressTracker = progress.NewTracker()
+	s.Scraper = scraper.New(s.Configs.Get(), apiClient, s.DB, downloader.New(s.DB, s.Configs.Get().Storage.BaseDirectory), nil, s.ProgressTracker)
+
+	if rec := post("/api/scrape", `{"community": "pics", "source": "hot"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with community and source status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := post("/api/scrape/cancel", ""); rec.Code != http.StatusConflict {
+		t.Errorf("cancel while idle status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	if rec := post("/api/scrape", `{"community": "pics"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not request posts")
+	}
+
+	if rec := post("/api/scrape", ""); rec.Code != http.StatusConflict {
+		t.Errorf("second POST status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantState  string
+	}{
+		{"/api/scrape/resume", http.StatusConflict, ""},
+		{"/api/scrape/pause", http.StatusOK, progress.StatePaused},
+		{"/api/scrape/pause", http.StatusConflict, ""},
+		{"/api/scrape/resume", http.StatusOK, progress.StateRunning},
+		{"/api/scrape/cancel", http.StatusOK, progress.StateCancelling},
+	}
+	for _, tt := range tests {
+		rec := post(tt.path, "")
+		if rec.Code != tt.wantStatus {
+			t.Fatalf("%s status = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+		}
+		if tt.wantState == "" {
+			continue
+		}
+		var status progress.Status
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if status.State != tt.wantState {
+			t.Errorf("%s state = %q, want %q", tt.path, status.State, tt.wantState)
+		}
+	}
+
+	// The cancelled run finishes and the status reflects it
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ProgressTracker.GetStatus().IsRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("run did not stop after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/scrape", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	var status progress.Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if status.State != progress.StateIdle || status.CurrentOperation != "Cancelled" {
+		t.Errorf("status = %q/%q, want idle/Cancelled", status.State, status.CurrentOperation)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/scrape/cancel", nil)
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET cancel status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	// Dry runs are started the same way and report on their own endpoint
+	getReport := func() (*httptest.ResponseRecorder, scraper.DryRunReport) {
+		req := httptest.NewRequest(http.MethodGet, "/api/scrape/dry-run", nil)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		var report scraper.DryRunReport
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("failed to decode report: %v", err)
+			}
+		}
+		return rec, report
+	}
+	if rec, _ := getReport(); rec.Code != http.StatusNotFound {
+		t.Errorf("GET dry-run before any status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec = post("/api/scrape", `{"community": "pics", "dry_run": true}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST dry run status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	var started struct {
+		DryRun bool `json:"dry_run"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&started); err != nil || !started.DryRun {
+		t.Errorf("POST dry run response dry_run = %v (%v), want true", started.DryRun, err)
+	}
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dry run did not request posts")
+	}
+	if rec, report := getReport(); rec.Code != http.StatusOK || report.FinishedAt != nil {
+		t.Errorf("GET dry-run while running = %d, finished %v; want 200, unfinished", rec.Code, report.FinishedAt)
+	}
+
+	post("/api/scrape/cancel", "")
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, report := getReport(); report.FinishedAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dry run did not finish after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// No runs start once the scraper is shutting down
+	if err := s.Scraper.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	for _, body := range []string{"", `{"dry_run": true}`} {
+		if rec := post("/api/scrape", body); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("POST %q after shutdown status = %d, want %d", body, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestHandleFetch(t *testing.T) {
+	s := setupTestServer(t)
+
+	fetch := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/fetch", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := fetch(http.MethodPost, `{"url": "7"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST without scraper status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// Fake Lemmy API serving a single text post
+	lemmy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/post":
+			json.NewEncoder(w).Encode(models.GetPostResponse{PostView: models.PostView{
+				Post:      models.Post{ID: 7, Name: "A text post"},
+				Community: models.Community{ID: 1, Name: "pics", Local: true},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(lemmy.Close)
+
+	apiClient := &api.Client{BaseURL: lemmy.URL + "/api/v3", HTTPClient: lemmy.Client()}
+	s.Scraper = scraper.New(s.Configs.Get(), apiClient, s.DB, downloader.New(s.DB, s.Configs.Get().Storage.BaseDirectory), nil, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+	}{
+		{"missing url", http.MethodPost, `{}`, http.StatusBadRequest},
+		{"invalid reference", http.MethodPost, `{"url": "pics"}`, http.StatusBadRequest},
+		{"resolve failure", http.MethodPost, `{"url": "https://lemmy.world/post/1"}`, http.StatusBadGateway},
+		{"unsupported method", http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := fetch(tt.method, tt.body); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	rec := fetch(http.MethodPost, `{"url": "7"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var result scraper.FetchResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.PostID != 7 || result.MediaIDs == nil || len(result.MediaIDs) != 0 {
+		t.Errorf("result = %+v, want post 7 with no media", result)
+	}
+	if exists, _ := s.DB.PostExists(s.Configs.Get().Lemmy.Instance, 7); !exists {
+		t.Error("fetched post was not marked as scraped")
+	}
+}
+
+func TestHandleFailures(t *testing.T) {
+	s := setupTestServer(t)
+
+	now := time.Now()
+	next := now.Add(time.Hour)
+	failures := []*database.DownloadFailure{
+		{PostID: 7, MediaURL: "https://media.example/a.png", Attempts: 1, LastError: "download failed with status 503",
+			Status: database.FailurePending, FirstFailedAt: now, LastAttemptAt: now, NextRetryAt: &next},
+		{PostID: 8, MediaURL: "https://media.example/b.png", Attempts: 1, LastError: "download failed with status 404",
+			Status: database.FailurePermanent, FirstFailedAt: now, LastAttemptAt: now},
+	}
+	for _, f := range failures {
+		if err := s.DB.SaveDownloadFailure(f); err != nil {
+			t.Fatalf("SaveDownloadFailure() error = %v", err)
+		}
+	}
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/api/failures?status=permanent")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var list struct {
+		Failures []database.DownloadFailure `json:"failures"`
+		Total    int                        `json:"total"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if list.Total != 1 || len(list.Failures) != 1 || list.Failures[0].PostID != 8 {
+		t.Errorf("permanent failures = %+v", list)
+	}
+
+	retryPath := fmt.Sprintf("/api/failures/%d/retry", failures[0].ID)
+	if rec := serve(http.MethodPost, retryPath); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("retry without scraper status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// Fake Lemmy API serving the post of the failure, since removed
+	lemmy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(models.GetPostResponse{PostView: models.PostView{
+			Post:      models.Post{ID: 7, Name: "A removed post", Removed: true},
+			Community: models.Community{ID: 1, Name: "pics", Local: true},
+		}})
+	}))
+	t.Cleanup(lemmy.Close)
+
+	apiClient := &api.Client{BaseURL: lemmy.URL + "/api/v3", HTTPClient: lemmy.Client()}
+	s.Scraper = scraper.New(s.Configs.Get(), apiClient, s.DB, downloader.New(s.DB, s.Configs.Get().Storage.BaseDirectory), nil, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"list all", http.MethodGet, "/api/failures", http.StatusOK},
+		{"list invalid status", http.MethodGet, "/api/failures?status=failed", http.StatusBadRequest},
+		{"list wrong method", http.MethodPost, "/api/failures", http.StatusMethodNotAllowed},
+		{"retry invalid ID", http.MethodPost, "/api/failures/abc/retry", http.StatusBadRequest},
+		{"retry missing", http.MethodPost, "/api/failures/999/retry", http.StatusNotFound},
+		{"retry wrong method", http.MethodGet, retryPath, http.StatusMethodNotAllowed},
+		{"unknown action", http.MethodPost, fmt.Sprintf("/api/failures/%d/skip", failures[0].ID), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(tt.method, tt.path); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	rec = serve(http.MethodPost, retryPath)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("retry status = %d, want %d; body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var result scraper.RetryResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.MediaID != 0 || result.Failure == nil || result.Failure.Status != database.FailurePermanent {
+		t.Errorf("retry of a removed post = %+v, want a permanent failure", result)
+	}
+}
+
 func TestCORSMiddleware(t *testing.T) {
 	s := setupTestServer(t)
 
@@ -716,3 +1259,260 @@ func TestSecurityHeaders(t *testing.T) {
 		t.Error("Permissions-Policy header is missing")
 	}
 }
+
+func TestHandleDuplicates(t *testing.T) {
+	s := setupTestServer(t)
+	baseDir := s.Configs.Get().Storage.BaseDirectory
+
+	var media []*models.ScrapedMedia
+	for i := int64(1); i <= 2; i++ {
+		m := insertTestMedia(t, s.DB, 700+i, "pics")
+		m.FilePath = filepath.Join(baseDir, "pics", m.FileName)
+		if _, err := s.DB.Exec(`UPDATE scraped_media SET file_path = ? WHERE id = ?`, m.FilePath, m.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(m.FilePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(m.FilePath, []byte("image"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		media = append(media, m)
+	}
+	if err := s.DB.SaveDuplicate(media[0].ID, media[1].ID, 4); err != nil {
+		t.Fatalf("SaveDuplicate() error = %v", err)
+	}
+	derivativePath := filepath.Join(baseDir, "derivatives", "ab", "merged.mp4")
+	if err := os.MkdirAll(filepath.Dir(derivativePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(derivativePath, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	derivative := &database.Derivative{MediaID: media[1].ID, Format: "mp4", FilePath: derivativePath, MimeType: "video/mp4", FileSize: 5, CreatedAt: time.Now()}
+	if err := s.DB.SaveDerivative(derivative); err != nil {
+		t.Fatalf("SaveDerivative() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/duplicates", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/duplicates status = %d, want 200", rec.Code)
+	}
+	var listed struct {
+		Groups []struct {
+			Media []map[string]interface{} `json:"media"`
+			Pairs []database.DuplicatePair `json:"pairs"`
+		} `json:"groups"`
+		Total int `json:"total"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if listed.Total != 1 || len(listed.Groups[0].Media) != 2 || listed.Groups[0].Pairs[0].Distance != 4 {
+		t.Fatalf("GET /api/duplicates = %+v, want one group of 2 at distance 4", listed)
+	}
+
+	merge := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/duplicates/merge", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := merge(fmt.Sprintf(`{"keep": %d, "merge": [%d]}`, media[0].ID, media[0].ID)); code != http.StatusBadRequest {
+		t.Errorf("merging media into itself status = %d, want 400", code)
+	}
+	if code := merge(fmt.Sprintf(`{"keep": %d, "merge": [999]}`, media[0].ID)); code != http.StatusNotFound {
+		t.Errorf("merging unknown media status = %d, want 404", code)
+	}
+	if code := merge(fmt.Sprintf(`{"keep": %d, "merge": [%d]}`, media[0].ID, media[1].ID)); code != http.StatusOK {
+		t.Fatalf("merge status = %d, want 200", code)
+	}
+
+	if _, err := os.Stat(media[1].FilePath); !os.IsNotExist(err) {
+		t.Errorf("merged file still exists: %v", err)
+	}
+	if _, err := os.Stat(media[0].FilePath); err != nil {
+		t.Errorf("kept file was removed: %v", err)
+	}
+	if _, err := os.Stat(derivativePath); !os.IsNotExist(err) {
+		t.Errorf("derivative of merged media still exists: %v", err)
+	}
+	posts, err := s.DB.GetMediaPosts(media[0].ID)
+	if err != nil || len(posts) != 2 {
+		t.Errorf("posts of kept media = %+v, %v; want 2", posts, err)
+	}
+}
+
+func TestMediaDerivative(t *testing.T) {
+	s := setupTestServer(t)
+	baseDir := s.Configs.Get().Storage.BaseDirectory
+	m := insertTestMedia(t, s.DB, 801, "gifs")
+	cfg := *s.Configs.Get()
+	cfg.Transcode.Enabled = true
+	if _, err := s.Configs.Update(&cfg); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	get := func() map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/media/%d", m.ID), nil)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /api/media/%d status = %d, want 200", m.ID, rec.Code)
+		}
+		var item map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&item); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return item
+	}
+
+	item := get()
+	if item["serve_url"] != item["original_url"] || item["derivative"] != nil {
+		t.Errorf("media without derivative = serve_url %v, original_url %v, derivative %v", item["serve_url"], item["original_url"], item["derivative"])
+	}
+
+	// A failed conversion is not served
+	if err := s.DB.SaveDerivative(&database.Derivative{MediaID: m.ID, Format: "webm", Error: "ffmpeg failed", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("SaveDerivative() error = %v", err)
+	}
+	if item := get(); item["derivative"] != nil {
+		t.Errorf("failed conversion served as derivative: %v", item["derivative"])
+	}
+
+	derivative := &database.Derivative{
+		MediaID:   m.ID,
+		Format:    "mp4",
+		FilePath:  filepath.Join(baseDir, "derivatives", "ab", "abc.mp4"),
+		MimeType:  "video/mp4",
+		FileSize:  1024,
+		CreatedAt: time.Now(),
+	}
+	if err := s.DB.SaveDerivative(derivative); err != nil {
+		t.Fatalf("SaveDerivative() error = %v", err)
+	}
+	item = get()
+	if item["serve_url"] != "/media/derivatives/ab/abc.mp4" {
+		t.Errorf("serve_url = %v, want the derivative", item["serve_url"])
+	}
+	if item["original_url"] == item["serve_url"] {
+		t.Errorf("original_url = %v, want the downloaded file", item["original_url"])
+	}
+	if d, ok := item["derivative"].(map[string]interface{}); !ok || d["mime_type"] != "video/mp4" {
+		t.Errorf("derivative = %v, want video/mp4", item["derivative"])
+	}
+
+	// The media list loads the derivatives of the whole page
+	other := insertTestMedia(t, s.DB, 802, "gifs")
+	req := httptest.NewRequest(http.MethodGet, "/api/media", nil)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	var list struct {
+		Media []map[string]interface{} `json:"media"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list.Media) != 2 {
+		t.Fatalf("GET /api/media returned %d items, want 2", len(list.Media))
+	}
+	for _, listed := range list.Media {
+		switch listed["id"] {
+		case float64(m.ID):
+			if listed["serve_url"] != "/media/derivatives/ab/abc.mp4" {
+				t.Errorf("listed serve_url = %v, want the derivative", listed["serve_url"])
+			}
+		case float64(other.ID):
+			if listed["derivative"] != nil {
+				t.Errorf("listed media %d has derivative %v, want none", other.ID, listed["derivative"])
+			}
+		}
+	}
+
+	// Derivatives are not served while transcoding is disabled
+	cfg.Transcode.Enabled = false
+	if _, err := s.Configs.Update(&cfg); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if item := get(); item["derivative"] != nil || item["serve_url"] != item["original_url"] {
+		t.Errorf("with transcoding disabled: serve_url %v, derivative %v, want the original", item["serve_url"], item["derivative"])
+	}
+}
+
+func TestHandleImageSearch(t *testing.T) {
+	s := setupTestServer(t)
+
+	search := func(content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("image", "query.png")
+		part.Write(content)
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/search/image?max_distance=10", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8((x*y + x*8) % 256)})
+		}
+	}
+	var query bytes.Buffer
+	png.Encode(&query, img)
+
+	if rec := search(query.Bytes()); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("search without detection status = %d, want 503", rec.Code)
+	}
+
+	detector, err := phash.NewDetector(s.DB)
+	if err != nil {
+		t.Fatalf("NewDetector() error = %v", err)
+	}
+	s.NearDuplicates = detector
+	hash := phash.Hash(img)
+	exact := insertTestMedia(t, s.DB, 801, "pics")
+	near := insertTestMedia(t, s.DB, 802, "pics")
+	far := insertTestMedia(t, s.DB, 803, "pics")
+	detector.Index.Add(exact.ID, hash)
+	detector.Index.Add(near.ID, hash^0x0101)
+	detector.Index.Add(far.ID, ^hash)
+
+	rec := search(query.Bytes())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("search status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var result struct {
+		Hash    string `json:"hash"`
+		Matches []struct {
+			ID       int64 `json:"id"`
+			Distance int   `json:"distance"`
+		} `json:"matches"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.Hash != fmt.Sprintf("%016x", hash) {
+		t.Errorf("hash = %s, want %016x", result.Hash, hash)
+	}
+	if len(result.Matches) != 2 || result.Matches[0].ID != exact.ID || result.Matches[1].ID != near.ID || result.Matches[1].Distance != 2 {
+		t.Errorf("matches = %+v, want media %d at 0 and %d at 2", result.Matches, exact.ID, near.ID)
+	}
+
+	if rec := search([]byte("plain text")); rec.Code != http.StatusBadRequest {
+		t.Errorf("search with a text file status = %d, want 400", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/search/image", strings.NewReader(`{}`))
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("search without an image or url status = %d, want 400", rec.Code)
+	}
+}
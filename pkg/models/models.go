@@ -9,12 +9,15 @@ type ScrapedMedia struct {
 	PostTitle     string    `db:"post_title"`
 	CommunityName string    `db:"community_name"`
 	CommunityID   int64     `db:"community_id"`
+	Instance      string    `db:"instance"` // Host of the community's instance
 	AuthorName    string    `db:"author_name"`
 	AuthorID      int64     `db:"author_id"`
 	MediaURL      string    `db:"media_url"`
 	MediaHash     string    `db:"media_hash"`
+	SanitizedHash string    `db:"sanitized_hash"` // Hash of the stored file when its metadata was stripped
 	FileName      string    `db:"file_name"`
 	FilePath      string    `db:"file_path"`
+	LinkPath      string    `db:"link_path"` // Link to the file in content storage mode
 	FileSize      int64     `db:"file_size"`
 	MediaType     string    `db:"media_type"`  // "image", "video", "other"
 	PostURL       string    `db:"post_url"`
@@ -44,6 +47,7 @@ type Post struct {
 	LanguageID         int       `json:"language_id"`
 	FeaturedCommunity  bool      `json:"featured_community"`
 	FeaturedLocal      bool      `json:"featured_local"`
+	ApID               string    `json:"ap_id"` // ActivityPub id, the same on every instance
 }
 
 // Community represents a Lemmy community
@@ -110,6 +114,18 @@ type GetPostsResponse struct {
 	Posts []PostView `json:"posts"`
 }
 
+// GetPostResponse represents the API response for getting a single post
+type GetPostResponse struct {
+	PostView   PostView   `json:"post_view"`
+	CrossPosts []PostView `json:"cross_posts"`
+}
+
+// ResolveObjectResponse represents the API response for resolving a
+// federated object. Only the field matching the object's type is set.
+type ResolveObjectResponse struct {
+	Post *PostView `json:"post,omitempty"`
+}
+
 // LoginRequest represents the login API request
 type LoginRequest struct {
 	UsernameOrEmail string `json:"username_or_email"`
@@ -12,6 +12,7 @@ export interface MediaItem {
 	author_id: number;
 	media_url: string;
 	media_hash: string;
+	sanitized_hash: string;
 	file_name: string;
 	file_path: string;
 	file_size: number;
@@ -20,7 +21,32 @@ export interface MediaItem {
 	post_score: number;
 	post_created: string;
 	downloaded_at: string;
+	// The derivative when there is one, otherwise the downloaded file
 	serve_url: string;
+	original_url: string;
+	derivative: Derivative | null;
+	// Only returned by getMediaById
+	posts?: MediaPost[];
+}
+
+export interface Derivative {
+	media_id: number;
+	format: string;
+	mime_type: string;
+	file_size: number;
+	created_at: string;
+}
+
+export interface MediaPost {
+	instance: string;
+	post_id: number;
+	post_title: string;
+	community_name: string;
+	community_id: number;
+	author_name: string;
+	post_created: string;
+	detected_by: 'original' | 'hash' | 'url' | 'cross_post' | 'phash';
+	linked_at: string;
 }
 
 export interface MediaResponse {
@@ -78,15 +104,54 @@ export interface StorageBreakdown {
 	by_type: { type: string; size: number; count: number }[];
 }
 
+export interface CommunityOverrides {
+	name: string;
+	sort_type?: string;
+	max_posts_per_run?: number;
+	include_images?: boolean;
+	include_videos?: boolean;
+	include_other_media?: boolean;
+	stop_at_seen_posts?: boolean;
+	interval?: number;
+	schedule?: string;
+}
+
+// Communities are plain names unless they carry per-community overrides
+export type CommunityEntry = string | CommunityOverrides;
+
+export function communityName(entry: CommunityEntry): string {
+	return typeof entry === 'string' ? entry : entry.name;
+}
+
+export interface S3Config {
+	endpoint: string;
+	region: string;
+	bucket: string;
+	access_key_id: string;
+	secret_access_key: string; // Empty in responses; leave empty to keep the current key
+	prefix: string;
+	path_style: boolean;
+	presign: boolean;
+	presign_expiry: number;
+}
+
 export interface AppConfig {
 	lemmy: {
 		instance: string;
 		username: string;
 		password: string;
-		communities: string[];
+		communities: CommunityEntry[];
 	};
 	storage: {
 		base_directory: string;
+		path_template: string;
+		mode: 'path' | 'content';
+		link_type: 'hardlink' | 'symlink' | 'none';
+		backend: 'local' | 's3';
+		strip_metadata: boolean;
+		sidecar_json: boolean;
+		sidecar_nfo: boolean;
+		s3: S3Config;
 	};
 	database: {
 		path: string;
@@ -101,10 +166,28 @@ export interface AppConfig {
 		include_images: boolean;
 		include_videos: boolean;
 		include_other_media: boolean;
+		skip_featured_posts: boolean;
+		score_queue: {
+			enabled: boolean;
+			maturation: number;
+			recheck_interval: number;
+			deadline: number;
+		};
+		retries: {
+			max_attempts: number;
+			initial_delay: number;
+			max_delay: number;
+		};
 	};
 	run_mode: {
 		mode: string;
 		interval: number;
+		schedule?: string;
+		jitter?: number;
+		quiet_hours: {
+			start?: string;
+			end?: string;
+		};
 	};
 	web_server: {
 		enabled: boolean;
@@ -122,6 +205,35 @@ export interface AppConfig {
 	search: {
 		rebuild_index: boolean;
 	};
+	near_duplicates: {
+		enabled: boolean;
+		max_distance: number;
+		action: 'link' | 'skip';
+	};
+	transcode: {
+		enabled: boolean;
+		gif_format: 'mp4' | 'webm' | 'none';
+		remux: boolean;
+		max_height: number;
+		max_bitrate: string;
+	};
+}
+
+export interface ScheduledJob {
+	name: string;
+	schedule: string;
+	next_run: string;
+	running: boolean;
+	last_run?: string;
+	last_error?: string;
+	skipped_runs: number;
+}
+
+export interface ScheduleResponse {
+	mode: string;
+	quiet_hours: string;
+	jitter: string;
+	jobs: ScheduledJob[];
 }
 
 export interface SearchResponse {
@@ -131,6 +243,64 @@ export interface SearchResponse {
 	offset: number;
 }
 
+export interface DuplicatePair {
+	media_id: number;
+	duplicate_id: number;
+	distance: number;
+	detected_at: string;
+}
+
+export interface DuplicateGroup {
+	media: MediaItem[];
+	pairs: DuplicatePair[];
+}
+
+export interface DuplicatesResponse {
+	groups: DuplicateGroup[];
+	total: number;
+	limit: number;
+	offset: number;
+}
+
+export interface DownloadFailure {
+	id: number;
+	post_id: number;
+	instance: string;
+	ap_id: string;
+	media_url: string;
+	post_title: string;
+	community_name: string;
+	attempts: number;
+	last_error: string;
+	status: 'pending' | 'permanent';
+	first_failed_at: string;
+	last_attempt_at: string;
+	next_retry_at: string | null;
+}
+
+export interface FailuresResponse {
+	failures: DownloadFailure[];
+	total: number;
+	limit: number;
+	offset: number;
+}
+
+export interface RetryResult {
+	media_id?: number;
+	failure?: DownloadFailure;
+}
+
+export interface ImageSearchMatch extends MediaItem {
+	distance: number;
+}
+
+export interface ImageSearchResponse {
+	hash: string;
+	max_distance: number;
+	matches: ImageSearchMatch[];
+	total: number;
+}
+
 export interface ProgressUpdate {
 	status: string;
 	community: string;
@@ -139,6 +309,7 @@ export interface ProgressUpdate {
 	errors: number;
 	eta_seconds: number;
 	is_running: boolean;
+	state: 'idle' | 'running' | 'paused' | 'cancelling';
 }
 
 export async function getMedia(
@@ -203,16 +374,23 @@ export async function getConfig(fetchFn: typeof fetch = fetch): Promise<AppConfi
 	return res.json();
 }
 
+export interface UpdateConfigResponse {
+	success: boolean;
+	message: string;
+	restart_required: string[];
+}
+
 export async function updateConfig(
 	config: AppConfig,
 	fetchFn: typeof fetch = fetch
-): Promise<void> {
+): Promise<UpdateConfigResponse> {
 	const res = await fetchFn(`/api/config`, {
 		method: 'PUT',
 		headers: { 'Content-Type': 'application/json' },
 		body: JSON.stringify(config)
 	});
 	if (!res.ok) throw new Error(`Failed to update config: ${res.statusText}`);
+	return res.json();
 }
 
 export async function searchMedia(
@@ -254,6 +432,154 @@ export async function getStorageBreakdown(
 	return res.json();
 }
 
+export async function getSchedule(fetchFn: typeof fetch = fetch): Promise<ScheduleResponse> {
+	const res = await fetchFn(`/api/schedule`);
+	if (!res.ok) throw new Error(`Failed to fetch schedule: ${res.statusText}`);
+	return res.json();
+}
+
+export async function startScrape(
+	scope: { community?: string; source?: string; dry_run?: boolean } = {},
+	fetchFn: typeof fetch = fetch
+): Promise<void> {
+	const res = await fetchFn(`/api/scrape`, {
+		method: 'POST',
+		headers: { 'Content-Type': 'application/json' },
+		body: JSON.stringify(scope)
+	});
+	if (!res.ok) throw new Error(`Failed to start scrape: ${await res.text()}`);
+}
+
+export interface DryRunMedia {
+	url: string;
+	resolver: 'post_url' | 'embed_video' | 'thumbnail';
+	decision: string;
+	reason?: string;
+	probe?: { content_type?: string; media_type: string; size: number };
+}
+
+export interface DryRunPost {
+	post_id: number;
+	title: string;
+	source: string;
+	decision: string;
+	reason?: string;
+	media?: DryRunMedia[];
+}
+
+export interface DryRunReport {
+	started_at: string;
+	finished_at?: string;
+	posts: DryRunPost[];
+}
+
+export async function getDryRunReport(fetchFn: typeof fetch = fetch): Promise<DryRunReport | null> {
+	const res = await fetchFn(`/api/scrape/dry-run`);
+	if (res.status === 404) return null;
+	if (!res.ok) throw new Error(`Failed to fetch dry run report: ${res.statusText}`);
+	return res.json();
+}
+
+export interface FetchResult {
+	post_id: number;
+	title: string;
+	community: string;
+	media_ids: number[];
+	downloaded: number;
+	skipped: number;
+	errors: number;
+}
+
+export async function fetchPost(url: string, fetchFn: typeof fetch = fetch): Promise<FetchResult> {
+	const res = await fetchFn(`/api/fetch`, {
+		method: 'POST',
+		headers: { 'Content-Type': 'application/json' },
+		body: JSON.stringify({ url })
+	});
+	if (!res.ok) throw new Error(`Failed to fetch post: ${await res.text()}`);
+	return res.json();
+}
+
+export async function controlScrape(
+	action: 'cancel' | 'pause' | 'resume',
+	fetchFn: typeof fetch = fetch
+): Promise<void> {
+	const res = await fetchFn(`/api/scrape/${action}`, { method: 'POST' });
+	if (!res.ok) throw new Error(`Failed to ${action} scrape: ${await res.text()}`);
+}
+
+export async function searchByImage(
+	image: File | string,
+	params?: { limit?: number; max_distance?: number },
+	fetchFn: typeof fetch = fetch
+): Promise<ImageSearchResponse> {
+	const searchParams = new URLSearchParams();
+	if (params?.limit) searchParams.set('limit', String(params.limit));
+	if (params?.max_distance !== undefined) searchParams.set('max_distance', String(params.max_distance));
+	const qs = searchParams.toString();
+	let init: RequestInit;
+	if (typeof image === 'string') {
+		init = {
+			method: 'POST',
+			headers: { 'Content-Type': 'application/json' },
+			body: JSON.stringify({ url: image })
+		};
+	} else {
+		const form = new FormData();
+		form.append('image', image);
+		init = { method: 'POST', body: form };
+	}
+	const res = await fetchFn(`/api/search/image${qs ? `?${qs}` : ''}`, init);
+	if (!res.ok) throw new Error(`Failed to search by image: ${await res.text()}`);
+	return res.json();
+}
+
+export async function getDuplicates(
+	params?: { limit?: number; offset?: number },
+	fetchFn: typeof fetch = fetch
+): Promise<DuplicatesResponse> {
+	const searchParams = new URLSearchParams();
+	if (params?.limit) searchParams.set('limit', String(params.limit));
+	if (params?.offset) searchParams.set('offset', String(params.offset));
+	const qs = searchParams.toString();
+	const res = await fetchFn(`/api/duplicates${qs ? `?${qs}` : ''}`);
+	if (!res.ok) throw new Error(`Failed to fetch duplicates: ${res.statusText}`);
+	return res.json();
+}
+
+export async function mergeDuplicates(
+	keep: number,
+	merge: number[],
+	fetchFn: typeof fetch = fetch
+): Promise<void> {
+	const res = await fetchFn(`/api/duplicates/merge`, {
+		method: 'POST',
+		headers: { 'Content-Type': 'application/json' },
+		body: JSON.stringify({ keep, merge })
+	});
+	if (!res.ok) throw new Error(`Failed to merge duplicates: ${await res.text()}`);
+}
+
+export async function getFailures(
+	params?: { status?: 'pending' | 'permanent'; limit?: number; offset?: number },
+	fetchFn: typeof fetch = fetch
+): Promise<FailuresResponse> {
+	const searchParams = new URLSearchParams();
+	if (params?.status) searchParams.set('status', params.status);
+	if (params?.limit) searchParams.set('limit', String(params.limit));
+	if (params?.offset) searchParams.set('offset', String(params.offset));
+	const qs = searchParams.toString();
+	const res = await fetchFn(`/api/failures${qs ? `?${qs}` : ''}`);
+	if (!res.ok) throw new Error(`Failed to fetch failures: ${res.statusText}`);
+	return res.json();
+}
+
+export async function retryFailure(id: number, fetchFn: typeof fetch = fetch): Promise<RetryResult> {
+	const res = await fetchFn(`/api/failures/${id}/retry`, { method: 'POST' });
+	if (!res.ok) throw new Error(`Failed to retry download: ${await res.text()}`);
+	return res.json();
+}
+
 export function formatFileSize(bytes: number): string {
 	if (bytes === 0) return '0 B';
 	const k = 1024;
@@ -83,7 +83,8 @@ export const POST: RequestHandler = async ({ params, url, request }) => {
 		}
 	}
 	const targetUrl = `${BACKEND_URL}/api/${params.path}${url.search}`;
-	const body = await request.text();
+	// Uploads are binary, so the body is passed on as bytes
+	const body = await request.arrayBuffer();
 	const res = await fetch(targetUrl, {
 		method: 'POST',
 		headers: {